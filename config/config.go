@@ -9,28 +9,129 @@ import (
 	"github.com/stregouet/nuntius/lib"
 )
 
+// either tls (implicit tls), starttls, or plain (no encryption, only for
+// local test servers)
+type ConnMode string
+
+const (
+	CONN_MODE_TLS      ConnMode = "tls"
+	CONN_MODE_STARTTLS ConnMode = "starttls"
+	CONN_MODE_PLAIN    ConnMode = "plain"
+)
+
+func (m ConnMode) Validate() error {
+	switch m {
+	case "", CONN_MODE_TLS, CONN_MODE_STARTTLS, CONN_MODE_PLAIN:
+		return nil
+	}
+	return fmt.Errorf("unknown connection mode `%s` (available modes: %s, %s, %s)", m, CONN_MODE_TLS, CONN_MODE_STARTTLS, CONN_MODE_PLAIN)
+}
+
+// where mails of an account are read from, either an imap server, a local
+// Maildir++ tree (e.g. synced by mbsync or offlineimap) or a single mbox file
+// opened read-only
+type BackendType string
+
+const (
+	BACKEND_IMAP    BackendType = "imap"
+	BACKEND_MAILDIR BackendType = "maildir"
+	BACKEND_MBOX    BackendType = "mbox"
+)
+
+func (b BackendType) Validate() error {
+	switch b {
+	case "", BACKEND_IMAP, BACKEND_MAILDIR, BACKEND_MBOX:
+		return nil
+	}
+	return fmt.Errorf("unknown backend `%s` (available backends: %s, %s, %s)", b, BACKEND_IMAP, BACKEND_MAILDIR, BACKEND_MBOX)
+}
+
 type ImapCfg struct {
-	Port    uint16
-	Host    string
-	User    string
-	Tls     bool
-	PassCmd string
+	Port uint16
+	Host string
+	User string
+	Tls  bool
+	Mode ConnMode
+	// pem file of certificate authorities used to verify server certificate
+	// instead of system ones
+	CaFile     string
+	SkipVerify bool
+	PassCmd    string
+}
+
+// ConnMode returns configured connection mode, falling back on `tls` field
+// when mode is not set
+func (c *ImapCfg) ConnMode() ConnMode {
+	if c.Mode != "" {
+		return c.Mode
+	}
+	if c.Tls {
+		return CONN_MODE_TLS
+	}
+	return CONN_MODE_STARTTLS
+}
+
+type MaildirCfg struct {
+	// root of Maildir++ tree, i.e. INBOX, other mailboxes being its
+	// `.name` subdirectories
+	Path string
+}
+
+type MboxCfg struct {
+	// mbox file, shown as a single mailbox named after it
+	Path string
 }
 
 type SmtpCfg struct {
-	Port    uint16
-	Host    string
-	User    string
-	Tls     bool
-	PassCmd string
+	Port       uint16
+	Host       string
+	User       string
+	Tls        bool
+	Mode       ConnMode
+	CaFile     string
+	SkipVerify bool
+	// name sent with EHLO, defaults to `localhost`
+	Hostname string
+	PassCmd  string
 	// either plain, login, none
 	Auth string
 }
 
+// ConnMode returns configured connection mode, falling back on `tls` field
+// when mode is not set
+func (c *SmtpCfg) ConnMode() ConnMode {
+	if c.Mode != "" {
+		return c.Mode
+	}
+	if c.Tls {
+		return CONN_MODE_TLS
+	}
+	return CONN_MODE_STARTTLS
+}
+
 type Account struct {
 	Name string
-	Imap *ImapCfg
-	Smtp *SmtpCfg
+	// address used in `From` header of replies and forwards, also excluded
+	// from recipients when replying to all
+	From string
+	// imap when not set
+	Backend BackendType
+	Imap    *ImapCfg
+	Maildir *MaildirCfg
+	Mbox    *MboxCfg
+	Smtp    *SmtpCfg
+	// mailbox where sent mails are saved, defaults to the one with \Sent
+	// special-use attribute
+	Sent string
+	// mailbox where postponed mails are saved, defaults to the one with
+	// \Drafts special-use attribute
+	Drafts string
+	// mailbox where archived mails are moved, defaults to the one with
+	// \Archive special-use attribute
+	Archive string
+	// mailbox where deleted mails are moved, defaults to the one with \Trash
+	// special-use attribute
+	Trash string
 }
 
 type Filters map[string]string
@@ -43,8 +144,18 @@ type Config struct {
 	Accounts    []*Account
 	Keybindings Keybindings
 	Filters     map[string]string
+	// commands opening mail parts, by mime type (same format as filters),
+	// path of the part file is appended to the command
+	Openers map[string]string
+	// directory where mail parts are saved
+	DownloadDir string
+	// group mails sharing a subject in a thread, even when none references
+	// the other, as long as one of them is a reply
+	ThreadBySubject bool
 }
 
+const DEFAULT_DOWNLOAD_DIR = "~/Downloads"
+
 func (c *Config) uniqueAccountName() error {
 	// hack: no set in golang, use a map instead
 	names := make(map[string]struct{})
@@ -57,8 +168,8 @@ func (c *Config) uniqueAccountName() error {
 	return nil
 }
 
-func (c *Config) valideFiltersMime() error {
-	for mime, _ := range c.Filters {
+func valideMimes(m map[string]string) error {
+	for mime, _ := range m {
 		parts := strings.Split(mime, "/")
 		if len(parts) != 2 {
 			return fmt.Errorf("malformed mime `%s`", mime)
@@ -70,6 +181,62 @@ func (c *Config) valideFiltersMime() error {
 	return nil
 }
 
+func (c *Config) validateConnModes() error {
+	for _, a := range c.Accounts {
+		if a.Imap != nil {
+			if err := a.Imap.Mode.Validate(); err != nil {
+				return errors.Wrapf(err, "in imap section of account `%s`", a.Name)
+			}
+		}
+		if a.Smtp != nil {
+			if err := a.Smtp.Mode.Validate(); err != nil {
+				return errors.Wrapf(err, "in smtp section of account `%s`", a.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// BackendType returns configured backend, defaulting to imap
+func (a *Account) BackendType() BackendType {
+	if a.Backend == "" {
+		return BACKEND_IMAP
+	}
+	return a.Backend
+}
+
+// CheckSend returns an error when mails cannot be sent with account: only
+// imap backend sends them through smtp and saves them once sent
+func (a *Account) CheckSend() error {
+	if a.BackendType() != BACKEND_IMAP {
+		return fmt.Errorf("account `%s` cannot send mails with %s backend", a.Name, a.BackendType())
+	}
+	return nil
+}
+
+func (c *Config) validateBackends() error {
+	for _, a := range c.Accounts {
+		if err := a.Backend.Validate(); err != nil {
+			return errors.Wrapf(err, "in account `%s`", a.Name)
+		}
+		switch a.BackendType() {
+		case BACKEND_IMAP:
+			if a.Imap == nil {
+				return fmt.Errorf("missing imap section in account `%s`", a.Name)
+			}
+		case BACKEND_MAILDIR:
+			if a.Maildir == nil || a.Maildir.Path == "" {
+				return fmt.Errorf("missing maildir path in account `%s`", a.Name)
+			}
+		case BACKEND_MBOX:
+			if a.Mbox == nil || a.Mbox.Path == "" {
+				return fmt.Errorf("missing mbox path in account `%s`", a.Name)
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Config) Validate() error {
 	_, err := lib.LogParseLevel(c.Log.Level)
 	if err != nil {
@@ -81,11 +248,27 @@ func (c *Config) Validate() error {
 	if err = c.uniqueAccountName(); err != nil {
 		return err
 	}
+	if err = c.validateBackends(); err != nil {
+		return err
+	}
+	if err = c.validateConnModes(); err != nil {
+		return err
+	}
 	if err = c.Keybindings.Validate(); err != nil {
 		return err
 	}
-	if err = c.valideFiltersMime(); err != nil {
+	if err = valideMimes(c.Filters); err != nil {
 		return errors.Wrap(err, "in filters section")
 	}
+	if err = valideMimes(c.Openers); err != nil {
+		return errors.Wrap(err, "in openers section")
+	}
 	return nil
 }
+
+func (c *Config) Defaults() {
+	c.Keybindings.Defaults()
+	if c.DownloadDir == "" {
+		c.DownloadDir = DEFAULT_DOWNLOAD_DIR
+	}
+}
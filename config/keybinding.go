@@ -23,9 +23,10 @@ const (
 	KEY_MODE_MAIL    KeyMode = "mail"
 	KEY_MODE_PARTS   KeyMode = "parts"
 	KEY_MODE_COMPOSE KeyMode = "compose"
+	KEY_MODE_OUTBOX  KeyMode = "outbox"
 )
 
-var KEYS_MODES = []KeyMode{KEY_MODE_SEARCH, KEY_MODE_THREAD, KEY_MODE_GLOBAL, KEY_MODE_MBOXES, KEY_MODE_MBOX, KEY_MODE_MAIL, KEY_MODE_PARTS, KEY_MODE_COMPOSE}
+var KEYS_MODES = []KeyMode{KEY_MODE_SEARCH, KEY_MODE_THREAD, KEY_MODE_GLOBAL, KEY_MODE_MBOXES, KEY_MODE_MBOX, KEY_MODE_MAIL, KEY_MODE_PARTS, KEY_MODE_COMPOSE, KEY_MODE_OUTBOX}
 
 func (m Mapping) FindCommand(ks []*lib.KeyStroke) string {
 	s := lib.KeyStrokesToString(ks)
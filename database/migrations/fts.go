@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// checkFts5 refuses to create search index when sqlite has no fts5 module,
+// which go-sqlite3 only embeds when built with `sqlite_fts5` tag, rather
+// than creating a database that cannot be searched
+func checkFts5(tx *sql.Tx) error {
+	if _, err := tx.Exec("CREATE VIRTUAL TABLE temp.fts5_check USING fts5(content)"); err != nil {
+		return errors.Wrap(err, "full-text search needs sqlite fts5 module, rebuild nuntius with `go build -tags sqlite_fts5`")
+	}
+	_, err := tx.Exec("DROP TABLE temp.fts5_check")
+	return err
+}
@@ -0,0 +1,21 @@
+package migrations
+
+import (
+	"github.com/stregouet/nuntius/database"
+)
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210601",
+		Description: "full-text search index",
+		Check:       checkFts5,
+		Statements: []string{
+			// rowid of mail_search is id of indexed mail
+			"CREATE VIRTUAL TABLE mail_search USING fts5(subject, sender, recipients, body)",
+			"INSERT INTO mail_search (rowid, subject, sender, recipients, body) SELECT id, subject, '', '', '' FROM mail",
+			`CREATE TRIGGER mail_search_delete AFTER DELETE ON mail BEGIN
+				DELETE FROM mail_search WHERE rowid = old.id;
+			END`,
+		},
+	})
+}
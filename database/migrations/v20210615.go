@@ -0,0 +1,22 @@
+package migrations
+
+import (
+	"github.com/stregouet/nuntius/database"
+)
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210615",
+		Description: "actions done while offline",
+		Statements: []string{
+			// payload is the json encoded message to replay
+			`CREATE TABLE pending_action (
+				id INTEGER PRIMARY KEY,
+				kind TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				created datetime,
+				account INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE
+			)`,
+		},
+	})
+}
@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/database"
+)
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210620",
+		Description: "outbox of mails waiting to be sent",
+		Statements: []string{
+			// body is the mail as edited in compose view, attachments a json
+			// list of files path
+			`CREATE TABLE outbox (
+				id INTEGER PRIMARY KEY,
+				body TEXT NOT NULL,
+				attachments TEXT,
+				subject TEXT,
+				recipients TEXT,
+				attempts INTEGER DEFAULT 0,
+				lasterror TEXT,
+				nextattempt datetime,
+				created datetime,
+				account INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE
+			)`,
+		},
+		Run: outboxPendingMails,
+	})
+}
+
+// outboxPendingMails moves to outbox mails which were queued as pending
+// actions, while offline, before outbox existed
+func outboxPendingMails(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, payload FROM pending_action WHERE kind = 'send' ORDER BY id")
+	if err != nil {
+		return err
+	}
+	payloads := make(map[int]string)
+	ids := make([]int, 0)
+	for rows.Next() {
+		var id int
+		var payload string
+		if err = rows.Scan(&id, &payload); err != nil {
+			rows.Close()
+			return err
+		}
+		payloads[id] = payload
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		// as recorded by pending action kind `send`
+		var queued struct {
+			Body        []byte
+			Attachments []string
+		}
+		if err = json.Unmarshal([]byte(payloads[id]), &queued); err != nil {
+			return errors.Wrapf(err, "while reading pending action %d", id)
+		}
+		attachments, err := json.Marshal(queued.Attachments)
+		if err != nil {
+			return err
+		}
+		// only kept to be displayed in outbox
+		var subject, recipients string
+		if msg, err := message.Read(bytes.NewReader(queued.Body)); err == nil {
+			subject = msg.Header.Get("Subject")
+			recipients = msg.Header.Get("To")
+		}
+		_, err = tx.Exec(`INSERT INTO outbox
+  (body, attachments, subject, recipients, attempts, lasterror, nextattempt, created, account)
+SELECT ?, ?, ?, ?, 0, '', ?, ifnull(created, datetime('now')), account FROM pending_action WHERE id = ?`,
+			string(queued.Body), string(attachments), subject, recipients, time.Now(), id)
+		if err != nil {
+			return errors.Wrapf(err, "while moving pending action %d to outbox", id)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM pending_action WHERE kind = 'send'")
+	return err
+}
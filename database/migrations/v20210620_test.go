@@ -0,0 +1,79 @@
+package migrations
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/stregouet/nuntius/database"
+	"github.com/stregouet/nuntius/models"
+)
+
+// migrated returns a database with every migration applied and account
+// `acc`, along with a transaction left open to add data
+func migrated(t *testing.T) (*sql.DB, *sql.Tx) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = database.Setup(tx); err != nil {
+		t.Fatal(err)
+	}
+	Rethread = func(tx *sql.Tx) error {
+		return models.ThreadUnthreaded(tx, false)
+	}
+	if err = database.Migrate(tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tx.Exec("INSERT INTO account (name) VALUES ('acc')"); err != nil {
+		t.Fatal(err)
+	}
+	return db, tx
+}
+
+func TestOutboxPendingMails(t *testing.T) {
+	db, tx := migrated(t)
+	// as recorded while offline before outbox existed, body is base64
+	payload := `{"Body":"U3ViamVjdDogaGVsbG8NClRvOiB5b3VAZXhhbXBsZS5vcmcNCg0KYm9keQ==","Attachments":["/tmp/a.pdf"]}`
+	_, err := tx.Exec(`INSERT INTO pending_action (kind, payload, created, account) VALUES
+  ('send', ?, datetime('now'), 1),
+  ('delete', '{}', datetime('now'), 1)`, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = outboxPendingMails(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	mails, err := models.FetchOutbox(db, "acc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 {
+		t.Fatalf("expected one mail in outbox, found %v", mails)
+	}
+	m := mails[0]
+	if m.Body != "Subject: hello\r\nTo: you@example.org\r\n\r\nbody" || m.Subject != "hello" || m.Recipients != "you@example.org" {
+		t.Errorf("unexpected outbox mail %+v", m)
+	}
+	if len(m.Attachments) != 1 || m.Attachments[0] != "/tmp/a.pdf" || m.NextAttempt.IsZero() {
+		t.Errorf("expected mail with its attachment, due to be sent, found %+v", m)
+	}
+	actions, err := models.FetchPendingActions(db, "acc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0].Kind != "delete" {
+		t.Errorf("expected only other pending actions kept, found %v", actions)
+	}
+}
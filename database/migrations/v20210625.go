@@ -0,0 +1,16 @@
+package migrations
+
+import (
+	"github.com/stregouet/nuntius/database"
+)
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210625",
+		Description: "uidvalidity of mailboxes",
+		Statements: []string{
+			// 0 until mailbox is selected once
+			"ALTER TABLE mailbox ADD COLUMN uidvalidity INTEGER DEFAULT 0",
+		},
+	})
+}
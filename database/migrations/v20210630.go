@@ -0,0 +1,16 @@
+package migrations
+
+import (
+	"github.com/stregouet/nuntius/database"
+)
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210630",
+		Description: "highest modseq of mailboxes",
+		Statements: []string{
+			// 0 until flags of mailbox are fetched from a CONDSTORE server
+			"ALTER TABLE mailbox ADD COLUMN highestmodseq INTEGER DEFAULT 0",
+		},
+	})
+}
@@ -0,0 +1,30 @@
+package migrations
+
+import (
+	"github.com/stregouet/nuntius/database"
+)
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210705",
+		Description: "references of mails and subjects for threading",
+		Statements: []string{
+			// message-ids of ancestors of mail, oldest at position 0
+			`CREATE TABLE mail_reference (
+				mail INTEGER NOT NULL REFERENCES mail(id) ON DELETE CASCADE,
+				position INTEGER NOT NULL,
+				messageid TEXT NOT NULL,
+				PRIMARY KEY (mail, position)
+			)`,
+			"CREATE INDEX mail_reference_messageid_idx ON mail_reference(messageid)",
+			// references header of mails already known was not kept,
+			// in-reply-to is the best we have
+			`INSERT INTO mail_reference (mail, position, messageid)
+			SELECT id, 0, inreplyto FROM mail WHERE inreplyto IS NOT NULL AND inreplyto != ''`,
+			// subject without reply and forward prefixes, unknown (null) for
+			// mails already known
+			"ALTER TABLE mail ADD COLUMN basesubject TEXT",
+			"CREATE INDEX basesubject_idx ON mail(basesubject)",
+		},
+	})
+}
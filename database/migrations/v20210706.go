@@ -0,0 +1,34 @@
+package migrations
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/database"
+)
+
+// Rethread threads again mails left without thread. Threading belongs to
+// models, which cannot be imported here, so it is set by database worker
+var Rethread func(tx *sql.Tx) error
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210706",
+		Description: "thread again mails known before references were kept",
+		Statements: []string{
+			// threads of mails already known were computed from in-reply-to
+			// only, they are computed again now that their references are
+			// known
+			"UPDATE mail SET threadid = NULL",
+		},
+		Run: rethread,
+	})
+}
+
+func rethread(tx *sql.Tx) error {
+	if Rethread == nil {
+		return errors.New("cannot thread mails again, Rethread is not set")
+	}
+	return Rethread(tx)
+}
@@ -0,0 +1,23 @@
+package migrations
+
+import (
+	"github.com/stregouet/nuntius/database"
+)
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210710",
+		Description: "sort of thread lists",
+		Statements: []string{
+			// name (or address when there is none) of first author of mail
+			"ALTER TABLE mail ADD COLUMN sender TEXT",
+			// header of mails already known was only kept in search index,
+			// whose text is turned into sender by 20210711
+			"UPDATE mail SET sender = (SELECT sender FROM mail_search WHERE rowid = mail.id)",
+			"ALTER TABLE mailbox ADD COLUMN sortkey TEXT DEFAULT 'recent'",
+			"ALTER TABLE mailbox ADD COLUMN sortasc INTEGER DEFAULT 0",
+			// list mails one by one instead of threads
+			"ALTER TABLE mailbox ADD COLUMN flat INTEGER DEFAULT 0",
+		},
+	})
+}
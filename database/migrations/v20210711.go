@@ -0,0 +1,66 @@
+package migrations
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/stregouet/nuntius/database"
+)
+
+func init() {
+	database.Register(&database.Migration{
+		Version:     "20210711",
+		Description: "sender of mails known before sort, as computed for new ones",
+		Run:         fixIndexedSenders,
+	})
+}
+
+// indexedSender returns, from indexed text of From field (names and
+// addresses), sender as computed for new mails: name of first author, or
+// its address when there is none
+func indexedSender(text string) string {
+	words := strings.Fields(text)
+	for i, w := range words {
+		if strings.Contains(w, "@") {
+			if i == 0 {
+				return w
+			}
+			return strings.Join(words[:i], " ")
+		}
+	}
+	// raw field which could not be parsed
+	return text
+}
+
+// fixIndexedSenders replaces sender of mails which was copied as is from
+// search index by 20210710
+func fixIndexedSenders(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT m.id, s.sender
+FROM
+  mail m
+  JOIN mail_search s ON s.rowid = m.id
+WHERE m.sender = s.sender`)
+	if err != nil {
+		return err
+	}
+	senders := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var text string
+		if err = rows.Scan(&id, &text); err != nil {
+			rows.Close()
+			return err
+		}
+		senders[id] = indexedSender(text)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for id, sender := range senders {
+		if _, err = tx.Exec("UPDATE mail SET sender = ? WHERE id = ?", sender, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
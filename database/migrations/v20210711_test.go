@@ -0,0 +1,60 @@
+package migrations
+
+import (
+	"testing"
+)
+
+func TestIndexedSender(t *testing.T) {
+	testCases := []struct {
+		text     string
+		expected string
+	}{
+		{"Alice Liddell alice@example.com", "Alice Liddell"},
+		{"alice@example.com", "alice@example.com"},
+		{"Alice alice@example.com bob@example.com", "Alice"},
+		{"undisclosed", "undisclosed"},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		if found := indexedSender(tc.text); found != tc.expected {
+			t.Errorf("%q: expected %q, found %q", tc.text, tc.expected, found)
+		}
+	}
+}
+
+func TestFixIndexedSenders(t *testing.T) {
+	db, tx := migrated(t)
+	_, err := tx.Exec(`INSERT INTO mailbox (name, account) VALUES ('INBOX', 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// first mail backfilled from search index, second one inserted since
+	_, err = tx.Exec(`INSERT INTO mail (id, messageid, uid, mailbox, account, sender) VALUES
+  (1, '<1>', 1, 1, 1, 'Alice alice@example.com'),
+  (2, '<2>', 2, 1, 1, 'Bob')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec(`INSERT INTO mail_search (rowid, subject, sender, recipients, body) VALUES
+  (1, '', 'Alice alice@example.com', '', ''),
+  (2, '', 'Bob bob@example.com', '', '')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fixIndexedSenders(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Alice", "Bob"}
+	for i, sender := range expected {
+		var found string
+		if err = db.QueryRow("SELECT sender FROM mail WHERE id = ?", i+1).Scan(&found); err != nil {
+			t.Fatal(err)
+		}
+		if found != sender {
+			t.Errorf("mail %d: expected sender %q, found %q", i+1, sender, found)
+		}
+	}
+}
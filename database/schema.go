@@ -17,7 +17,13 @@ type Migration struct {
 	Version     string
 	Description string
 	Statements  []string
-	checksum    string
+	// run before statements, to refuse migration when sqlite lacks what it
+	// needs. It is not part of checksum
+	Check func(tx *sql.Tx) error
+	// run after statements, for data which cannot be migrated with sql
+	// alone. It is not part of checksum
+	Run      func(tx *sql.Tx) error
+	checksum string
 }
 
 func (m *Migration) insertInto(tx *sql.Tx) error {
@@ -110,12 +116,22 @@ func Migrate(tx *sql.Tx) error {
 			continue
 		}
 		migration := migrations[version]
+		if migration.Check != nil {
+			if err = migration.Check(tx); err != nil {
+				return errors.Wrapf(err, "while checking migration %s", version)
+			}
+		}
 		for _, statement := range migration.Statements {
 			_, err = tx.Exec(statement)
 			if err != nil {
 				return errors.Wrapf(err, "while executing migration %s", version)
 			}
 		}
+		if migration.Run != nil {
+			if err = migration.Run(tx); err != nil {
+				return errors.Wrapf(err, "while executing migration %s", version)
+			}
+		}
 		if err = migration.insertInto(tx); err != nil {
 			return err
 		}
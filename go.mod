@@ -9,6 +9,7 @@ require (
 	github.com/emersion/go-message v0.14.1
 	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21
 	github.com/emersion/go-smtp v0.15.0
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gdamore/tcell/v2 v2.2.0
 	github.com/mattn/go-runewidth v0.0.13
 	github.com/mattn/go-sqlite3 v1.14.7
@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var (
+	fromLines        = regexp.MustCompile(`(?m)^(>*From )`)
+	escapedFromLines = regexp.MustCompile(`(?m)^>(>*From )`)
+)
+
+// MboxEscape quotes lines of message raw starting with `From `, quoted or
+// not, so that it can be written to an mboxrd file
+func MboxEscape(raw []byte) []byte {
+	return fromLines.ReplaceAll(raw, []byte(">$1"))
+}
+
+// MboxUnescape reverts quoting of `From ` lines in message raw read from an
+// mboxrd file (also fine for mboxo where quoted lines are ambiguous anyway)
+func MboxUnescape(raw []byte) []byte {
+	return escapedFromLines.ReplaceAll(raw, []byte("$1"))
+}
+
+// MboxFromLine returns `From ` line separating messages in an mbox file,
+// for a message sent by from at date
+func MboxFromLine(from string, date time.Time) string {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+	return fmt.Sprintf("From %s %s\n", from, date.UTC().Format(time.ANSIC))
+}
@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMboxEscape(t *testing.T) {
+	testCases := []struct {
+		raw     string
+		escaped string
+	}{
+		{"Subject: hello\n\nbody\n", "Subject: hello\n\nbody\n"},
+		{"Subject: hello\n\nFrom me\n", "Subject: hello\n\n>From me\n"},
+		{"Subject: hello\n\n>From me\n>>From you\n", "Subject: hello\n\n>>From me\n>>>From you\n"},
+		{"Subject: hello\n\nnot From me\n>From\n", "Subject: hello\n\nnot From me\n>From\n"},
+	}
+	for _, test := range testCases {
+		escaped := string(MboxEscape([]byte(test.raw)))
+		if escaped != test.escaped {
+			t.Errorf("escaping %q: got %q, expected %q", test.raw, escaped, test.escaped)
+		}
+		if raw := string(MboxUnescape([]byte(escaped))); raw != test.raw {
+			t.Errorf("unescaping %q: got %q, expected %q", escaped, raw, test.raw)
+		}
+	}
+}
+
+func TestMboxFromLine(t *testing.T) {
+	date := time.Date(2021, time.July, 4, 9, 5, 3, 0, time.FixedZone("CEST", 2*3600))
+	if l := MboxFromLine("jane@example.com", date); l != "From jane@example.com Sun Jul  4 07:05:03 2021\n" {
+		t.Errorf("unexpected from line %q", l)
+	}
+	if l := MboxFromLine("", date); l != "From MAILER-DAEMON Sun Jul  4 07:05:03 2021\n" {
+		t.Errorf("unexpected from line %q", l)
+	}
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ExpandHome replaces leading `~` of path with user home directory
+func ExpandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// CompletePath completes prefix with files of the filesystem, it returns the
+// longest unambiguous completion and the names of all candidates (directories
+// ending with `/`)
+func CompletePath(prefix string) (string, []string) {
+	dir, base := "", prefix
+	if idx := strings.LastIndex(prefix, "/"); idx >= 0 {
+		dir, base = prefix[:idx+1], prefix[idx+1:]
+	}
+	lookup := dir
+	if lookup == "" {
+		lookup = "."
+	}
+	lookup, err := ExpandHome(lookup)
+	if err != nil {
+		return prefix, nil
+	}
+	entries, err := ioutil.ReadDir(lookup)
+	if err != nil {
+		return prefix, nil
+	}
+	candidates := make([]string, 0)
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		if e.IsDir() {
+			name += "/"
+		}
+		candidates = append(candidates, name)
+	}
+	if len(candidates) == 0 {
+		return prefix, candidates
+	}
+	sort.Strings(candidates)
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	// do not cut a multibyte character
+	for !utf8.ValidString(common) {
+		common = common[:len(common)-1]
+	}
+	return dir + common, candidates
+}
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCompletePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nuntius-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	for _, f := range []string{"invoice-2021.pdf", "invoice-2020.pdf", "photo.jpg", ".hidden"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "pictures"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		input      string
+		completion string
+		candidates []string
+	}{
+		{
+			input:      dir + "/inv",
+			completion: dir + "/invoice-202",
+			candidates: []string{"invoice-2020.pdf", "invoice-2021.pdf"},
+		},
+		{
+			input:      dir + "/pi",
+			completion: dir + "/pictures/",
+			candidates: []string{"pictures/"},
+		},
+		{
+			input:      dir + "/p",
+			completion: dir + "/p",
+			candidates: []string{"photo.jpg", "pictures/"},
+		},
+		{
+			input:      dir + "/.h",
+			completion: dir + "/.hidden",
+			candidates: []string{".hidden"},
+		},
+		{
+			input:      dir + "/unknown",
+			completion: dir + "/unknown",
+			candidates: []string{},
+		},
+	}
+	for _, tc := range testCases {
+		completion, candidates := CompletePath(tc.input)
+		if completion != tc.completion {
+			t.Errorf("(input: %s) expected completion %s, found %s", tc.input, tc.completion, completion)
+		}
+		if !reflect.DeepEqual(candidates, tc.candidates) {
+			t.Errorf("(input: %s) expected candidates %v, found %v", tc.input, tc.candidates, candidates)
+		}
+	}
+}
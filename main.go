@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -26,6 +27,10 @@ func main() {
 		log.Fatal(err)
 	}
 	l.Debugf("config %#v", c.Keybindings)
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(l, c, os.Args[2:])
+		return
+	}
 	if err = ui.InitApp(l, c); err != nil {
 		l.Fatalf("cannot init app %v", err)
 	}
@@ -34,6 +39,31 @@ func main() {
 	ui.App.Run()
 }
 
+// runImport imports an mbox file or a maildir into an imap mailbox, without
+// starting the terminal interface
+func runImport(l *lib.Logger, c *config.Config, args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s import [-account <name>] -mailbox <name> <mbox file or maildir>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(c.Accounts) == 0 {
+		fmt.Fprintln(os.Stderr, "import failed: no account in config")
+		os.Exit(1)
+	}
+	account := flags.String("account", c.Accounts[0].Name, "account to import mails into")
+	mailbox := flags.String("mailbox", "", "mailbox to import mails into")
+	flags.Parse(args)
+	if *mailbox == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := ui.RunImport(l, c, *account, *mailbox, flags.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
 // recoverTerm prints the stacktrace upon panic and tries to recover the term
 // not doing that leaves the terminal in a broken state
 func recoverTerm(logger *lib.Logger) {
@@ -69,6 +99,6 @@ func initConfig(cfgFile string) (*config.Config, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "while validating config")
 	}
-	c.Keybindings.Defaults()
+	c.Defaults()
 	return &c, nil
 }
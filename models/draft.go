@@ -0,0 +1,144 @@
+package models
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/lib"
+)
+
+// headers regenerated upon sending, so there is no point letting user edit
+// them. Message-Id is kept so that a resumed draft remains the same mail
+var generatedHeaders = map[string]struct{}{
+	"date":                      {},
+	"mime-version":              {},
+	"content-type":              {},
+	"content-transfer-encoding": {},
+	"content-disposition":       {},
+}
+
+var errStopWalk = errors.New("stop walk")
+
+// PlaintextBody returns decoded body of the first text/plain part of e, or nil
+// if there is none
+func PlaintextBody(e *message.Entity) (io.Reader, error) {
+	var body io.Reader
+	err := e.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if isPlaintext(path, part) {
+			body = part.Body
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, err
+	}
+	return body, nil
+}
+
+func isPlaintext(path []int, part *message.Entity) bool {
+	t, _, _ := part.Header.ContentType()
+	return t == "text/plain" || (t == "" && len(path) == 0)
+}
+
+// draftPart is a part of a draft saved as attachment
+type draftPart struct {
+	path []int
+	dir  string
+	file string
+}
+
+// ComposeContent converts a mail, as stored on disk, back to the plain text
+// format edited in compose view (editable headers, blank line, then body).
+// Parts other than body are saved in dir, paths of these attachments are
+// returned along with content
+func ComposeContent(r io.Reader, dir string) (string, []string, error) {
+	msg, err := message.Read(r)
+	if err != nil {
+		return "", nil, err
+	}
+	buf := new(strings.Builder)
+	fields := msg.Header.Fields()
+	for fields.Next() {
+		if _, ok := generatedHeaders[strings.ToLower(fields.Key())]; ok {
+			continue
+		}
+		val, err := fields.Text()
+		if err != nil {
+			return "", nil, err
+		}
+		buf.WriteString(fields.Key() + ": " + val + "\n")
+	}
+	buf.WriteString("\n")
+	var bodyPath []int
+	alternatives := make([][]int, 0)
+	parts := make([]*draftPart, 0)
+	// mail is walked once, as its parts can only be read once
+	err = msg.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if part.MultipartReader() != nil {
+			if t, _, _ := part.Header.ContentType(); t == "multipart/alternative" {
+				alternatives = append(alternatives, append([]int{}, path...))
+			}
+			return nil
+		}
+		if bodyPath == nil && isPlaintext(path, part) {
+			bodyPath = append([]int{}, path...)
+			_, err = io.Copy(buf, part.Body)
+			return err
+		}
+		// one directory per part, as attachments may share a filename
+		bp := BodyPathFromMessagePath(path)
+		partDir := filepath.Join(dir, strconv.Itoa(len(parts)))
+		saved, err := SavePart(part, bp, partDir+"/")
+		if err != nil {
+			return errors.Wrapf(err, "while saving part %s", bp)
+		}
+		parts = append(parts, &draftPart{append([]int{}, path...), partDir, saved})
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	attachments := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if isAlternativeOf(p.path, bodyPath, alternatives) {
+			// other version of body (e.g. html), not an attachment
+			os.RemoveAll(p.dir)
+			continue
+		}
+		attachments = append(attachments, p.file)
+	}
+	// editors expect unix line endings
+	return strings.ReplaceAll(buf.String(), "\r\n", "\n"), attachments, nil
+}
+
+// isAlternativeOf tells whether part at path is in the same
+// multipart/alternative part as body
+func isAlternativeOf(path, body []int, alternatives [][]int) bool {
+	if body == nil {
+		return false
+	}
+	for _, alt := range alternatives {
+		if hasPrefix(path, alt) && hasPrefix(body, alt) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefix(path, prefix []int) bool {
+	return len(path) >= len(prefix) && lib.IsSliceIntEqual(path[:len(prefix)], prefix)
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComposeContent(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input: "From: me@example.org\r\n" +
+				"To: you@example.org\r\n" +
+				"Subject: hello\r\n" +
+				"Message-Id: <1@example.org>\r\n" +
+				"Date: Mon, 26 Apr 2021 10:00:00 +0200\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"body\r\n",
+			expected: "From: me@example.org\nTo: you@example.org\nSubject: hello\nMessage-Id: <1@example.org>\n\nbody\n",
+		},
+		{
+			input: "Subject: multi\r\n" +
+				"Content-Type: multipart/alternative; boundary=b\r\n" +
+				"\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/html\r\n" +
+				"\r\n" +
+				"<p>html</p>\r\n" +
+				"--b\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"\r\n" +
+				"plain\r\n" +
+				"--b--\r\n",
+			expected: "Subject: multi\n\nplain",
+		},
+	}
+	for _, tc := range testCases {
+		content, attachments, err := ComposeContent(strings.NewReader(tc.input), t.TempDir())
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if content != tc.expected {
+			t.Errorf("compose content not built correctly (expected: %q, got: %q)", tc.expected, content)
+		}
+		if len(attachments) != 0 {
+			t.Errorf("expected no attachment, got %v", attachments)
+		}
+	}
+}
+
+func TestComposeContentAttachments(t *testing.T) {
+	input := "Subject: with attachments\r\n" +
+		"Content-Type: multipart/mixed; boundary=m\r\n" +
+		"\r\n" +
+		"--m\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"body\r\n" +
+		"--m\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=notes.txt\r\n" +
+		"\r\n" +
+		"first\r\n" +
+		"--m\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Disposition: attachment; filename=notes.txt\r\n" +
+		"\r\n" +
+		"second\r\n" +
+		"--m--\r\n"
+	content, attachments, err := ComposeContent(strings.NewReader(input), t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if content != "Subject: with attachments\n\nbody" {
+		t.Errorf("unexpected content %q", content)
+	}
+	expected := []string{"first", "second"}
+	if len(attachments) != len(expected) {
+		t.Fatalf("expected %d attachments, got %v", len(expected), attachments)
+	}
+	for i, path := range attachments {
+		if filepath.Base(path) != "notes.txt" {
+			t.Errorf("expected attachment keeping its filename, got %s", path)
+		}
+		saved, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(saved) != expected[i] {
+			t.Errorf("expected attachment %q, got %q", expected[i], saved)
+		}
+	}
+}
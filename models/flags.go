@@ -0,0 +1,58 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// names usable in commands for imap system flags
+var systemFlags = map[string]string{
+	"seen":     imap.SeenFlag,
+	"read":     imap.SeenFlag,
+	"answered": imap.AnsweredFlag,
+	"flagged":  imap.FlaggedFlag,
+	"deleted":  imap.DeletedFlag,
+	"draft":    imap.DraftFlag,
+}
+
+// characters not allowed in a keyword (rfc3501 atom-specials and
+// resp-specials)
+const keywordSpecials = "(){ %*\"\\]"
+
+// ParseFlag returns imap flag named name, either a system flag given with or
+// without its leading backslash (e.g. `seen` or `\Seen`) or a keyword (e.g.
+// `$Label1`)
+func ParseFlag(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fmt.Errorf("missing flag name")
+	}
+	if f, ok := systemFlags[strings.ToLower(strings.TrimPrefix(name, "\\"))]; ok {
+		return f, nil
+	}
+	if strings.HasPrefix(name, "\\") {
+		return "", fmt.Errorf("unknown system flag `%s`", name)
+	}
+	if strings.ContainsAny(name, keywordSpecials) {
+		return "", fmt.Errorf("invalid flag `%s`", name)
+	}
+	for _, r := range name {
+		if r < 0x21 || r > 0x7e {
+			return "", fmt.Errorf("invalid flag `%s`", name)
+		}
+	}
+	return name, nil
+}
+
+// AllHaveFlag returns true if every mail has flag, i.e. toggling flag on
+// mails means removing it
+func AllHaveFlag(mails []*Mail, flag string) bool {
+	for _, m := range mails {
+		if !m.HasFlag(flag) {
+			return false
+		}
+	}
+	return true
+}
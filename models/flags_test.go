@@ -0,0 +1,53 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestParseFlag(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"seen", imap.SeenFlag},
+		{"Read", imap.SeenFlag},
+		{"\\Flagged", imap.FlaggedFlag},
+		{"answered", imap.AnsweredFlag},
+		{"$Label1", "$Label1"},
+		{" todo ", "todo"},
+	}
+	for _, tc := range testCases {
+		found, err := ParseFlag(tc.input)
+		if err != nil {
+			t.Errorf("(input: %s) unexpected error %v", tc.input, err)
+			continue
+		}
+		if found != tc.expected {
+			t.Errorf("(input: %s) expected %s, found %s", tc.input, tc.expected, found)
+		}
+	}
+	for _, input := range []string{"", "\\Unknown", "two words", "a(b", "café"} {
+		if _, err := ParseFlag(input); err == nil {
+			t.Errorf("(input: %s) expected error", input)
+		}
+	}
+}
+
+func TestToggleFlag(t *testing.T) {
+	m1 := &Mail{Flags: []string{imap.SeenFlag}}
+	m2 := &Mail{Flags: []string{}}
+	if AllHaveFlag([]*Mail{m1, m2}, imap.SeenFlag) {
+		t.Errorf("expected not all mails to be seen")
+	}
+	m2.AddFlag(imap.SeenFlag)
+	m2.AddFlag(imap.SeenFlag)
+	if len(m2.Flags) != 1 || !AllHaveFlag([]*Mail{m1, m2}, imap.SeenFlag) {
+		t.Errorf("expected all mails to be seen, found %v", m2.Flags)
+	}
+	m1.RemoveFlag(imap.SeenFlag)
+	if !m1.IsUnread() || len(m1.Flags) != 0 {
+		t.Errorf("expected flag to be removed, found %v", m1.Flags)
+	}
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// ParseReferences returns message-ids found in References header, enclosed
+// in angle brackets as message-ids are stored
+func ParseReferences(h *mail.Header) []string {
+	ids, err := h.MsgIDList("References")
+	if err != nil {
+		return nil
+	}
+	refs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		refs = append(refs, "<"+id+">")
+	}
+	return refs
+}
+
+// references returns ancestors of m, oldest first: References header
+// followed by In-Reply-To when it is not already its last element (JWZ step
+// 1.A). Duplicates and m itself are dropped so that no loop is created
+func (m *Mail) references() []string {
+	refs := make([]string, 0, len(m.References)+1)
+	seen := map[string]bool{m.MessageId: true}
+	add := func(ref string) {
+		ref = strings.TrimSpace(ref)
+		if ref == "" || seen[ref] {
+			return
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+	for _, ref := range m.References {
+		add(ref)
+	}
+	add(m.InReplyTo)
+	return refs
+}
+
+var subjectPrefix = regexp.MustCompile(`(?i)^\s*(re|fwd?|aw|sv)\s*(\[\d+\])?\s*:\s*`)
+
+// BaseSubject returns subject without reply and forward prefixes (e.g. `Re:`,
+// `Fwd:`, `Re[2]:`), and whether there were any
+func BaseSubject(subject string) (string, bool) {
+	base := strings.TrimSpace(subject)
+	prefixed := false
+	for {
+		loc := subjectPrefix.FindStringIndex(base)
+		if loc == nil {
+			return base, prefixed
+		}
+		base = base[loc[1]:]
+		prefixed = true
+	}
+}
+
+// container is a node of JWZ threading tree, holding the mail with
+// messageid or standing for it when it is missing
+type container struct {
+	messageid string
+	mail      *Mail
+	parent    *container
+	children  []*container
+}
+
+func (c *container) hasDescendant(other *container) bool {
+	for _, child := range c.children {
+		if child == other || child.hasDescendant(other) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *container) setParent(parent *container) {
+	if c.parent != nil {
+		siblings := c.parent.children
+		for i, child := range siblings {
+			if child == c {
+				c.parent.children = append(siblings[:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	c.parent = parent
+	if parent != nil {
+		parent.children = append(parent.children, c)
+	}
+}
+
+// date is date of mail, or of earliest mail below missing one
+func (c *container) date() time.Time {
+	if c.mail != nil {
+		return c.mail.Date
+	}
+	var d time.Time
+	for _, child := range c.children {
+		if cd := child.date(); d.IsZero() || cd.Before(d) {
+			d = cd
+		}
+	}
+	return d
+}
+
+// threadTree links mails of a thread following JWZ algorithm
+// (https://www.jwz.org/doc/threading.html) and returns roots of the tree.
+// Missing messages are kept as empty containers only when they gather
+// several roots
+func threadTree(mails []*Mail) []*container {
+	byId := make(map[string]*container)
+	all := make([]*container, 0, len(mails))
+	get := func(id string) *container {
+		c, ok := byId[id]
+		if !ok {
+			c = &container{messageid: id}
+			byId[id] = c
+			all = append(all, c)
+		}
+		return c
+	}
+	for _, m := range mails {
+		c := get(m.MessageId)
+		if c.mail != nil {
+			// same message-id twice, keep both
+			c = &container{messageid: m.MessageId}
+			all = append(all, c)
+		}
+		c.mail = m
+		refs := m.references()
+		// link references together, each one being parent of the next one,
+		// unless they are already linked or it would create a loop
+		var prev *container
+		for _, ref := range refs {
+			rc := get(ref)
+			if prev != nil && rc.parent == nil && !rc.hasDescendant(prev) {
+				rc.setParent(prev)
+			}
+			prev = rc
+		}
+		// last reference is parent of mail, whatever other mails told
+		if prev != nil && prev != c.parent && !c.hasDescendant(prev) {
+			c.setParent(prev)
+		}
+	}
+	roots := make([]*container, 0)
+	for _, c := range all {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	return prune(roots, true)
+}
+
+// prune removes containers of missing messages, their children taking their
+// place (JWZ step 4). At root level, a missing message with several
+// children is kept as it is the only link between them
+func prune(containers []*container, root bool) []*container {
+	result := make([]*container, 0, len(containers))
+	for _, c := range containers {
+		c.children = prune(c.children, false)
+		if c.mail == nil {
+			if len(c.children) == 0 {
+				continue
+			}
+			if !root || len(c.children) == 1 {
+				for _, child := range c.children {
+					child.parent = c.parent
+				}
+				result = append(result, c.children...)
+				continue
+			}
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// SortThread returns mails of a thread sorted in a tree (see threadTree), the
+// depth of each being set
+func SortThread(mails []*Mail) []*Mail {
+	return flattenThread(threadTree(mails), 0, make([]*Mail, 0, len(mails)))
+}
+
+// flattenThread appends mails of tree to result, depth first, siblings
+// sorted by date. Children of a missing message are shown at its depth
+func flattenThread(containers []*container, depth int, result []*Mail) []*Mail {
+	sort.SliceStable(containers, func(i, j int) bool {
+		return containers[i].date().Before(containers[j].date())
+	})
+	for _, c := range containers {
+		if c.mail == nil {
+			result = flattenThread(c.children, depth, result)
+			continue
+		}
+		c.mail.depth = depth
+		result = append(result, c.mail)
+		result = flattenThread(c.children, depth+1, result)
+	}
+	return result
+}
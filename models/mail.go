@@ -1,14 +1,18 @@
 package models
 
 import (
+	"database/sql"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
 	"github.com/emersion/go-message/mail"
 	"github.com/gdamore/tcell/v2"
+	"github.com/pkg/errors"
 
 	"github.com/stregouet/nuntius/config"
 	ndb "github.com/stregouet/nuntius/database"
@@ -100,6 +104,52 @@ func BodyPartsFromImap(bs *imap.BodyStructure) []*BodyPart {
 	return bodyPartsFromImapParts(bs, result, []int{})
 }
 
+// ParseMail reads header and structure of a raw mail, as found in local
+// mail stores (e.g. maildir, mbox) which do not provide them as imap
+// servers do
+func ParseMail(r io.Reader) (*Mail, error) {
+	e, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+	header := &mail.Header{Header: e.Header}
+	subject, err := header.Subject()
+	if err != nil {
+		subject = header.Get("Subject")
+	}
+	date, _ := header.Date()
+	result := &Mail{
+		Subject:    subject,
+		InReplyTo:  header.Get("In-Reply-To"),
+		MessageId:  header.Get("Message-Id"),
+		References: ParseReferences(header),
+		Date:       date,
+		Flags:      []string{},
+		Parts:      make([]*BodyPart, 0),
+		Header:     header,
+	}
+	err = e.Walk(func(path []int, part *message.Entity, err error) error {
+		if part == nil {
+			return err
+		}
+		t, _, _ := part.Header.ContentType()
+		if t == "" {
+			t = "text/plain"
+		}
+		types := strings.SplitN(t, "/", 2)
+		bp := &BodyPart{Path: BodyPathFromMessagePath(path), MIMEType: types[0]}
+		if len(types) > 1 {
+			bp.MIMESubType = types[1]
+		}
+		result.Parts = append(result.Parts, bp)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading parts")
+	}
+	return result, nil
+}
+
 type Mail struct {
 	Id        int
 	Uid       uint32
@@ -113,34 +163,138 @@ type Mail struct {
 	depth     int
 	Date      time.Time
 	Header    *mail.Header
+	// message-ids of ancestors, oldest first, as found in References header
+	References []string
+	// same mail stored in other mailboxes
+	Copies []MailCopy
+}
+
+// MailCopy locates a copy of a mail. As message-ids are unique in db, copies
+// are not stored as mails of their own but tracked in `identical_as` column
+type MailCopy struct {
+	Uid     uint32
+	Mailbox string
+}
+
+// Mailboxes returns names of mailboxes holding m
+func (m *Mail) Mailboxes() []string {
+	result := []string{m.Mailbox}
+	for _, c := range m.Copies {
+		result = append(result, c.Mailbox)
+	}
+	return result
+}
+
+// In returns m as stored in mailbox, i.e. with uid of its copy there, or nil
+// if mailbox holds no copy of m
+func (m *Mail) In(mailbox string) *Mail {
+	if m.Mailbox == mailbox {
+		return m
+	}
+	for _, c := range m.Copies {
+		if c.Mailbox == mailbox {
+			copy := *m
+			copy.Uid = c.Uid
+			copy.Mailbox = c.Mailbox
+			return &copy
+		}
+	}
+	return nil
+}
+
+// sender returns name, or address when there is none, of first author of m
+func (m *Mail) sender() string {
+	if m.Header == nil {
+		return ""
+	}
+	addrs, err := m.Header.AddressList("From")
+	if err != nil || len(addrs) == 0 {
+		return m.Header.Get("From")
+	}
+	if addrs[0].Name != "" {
+		return addrs[0].Name
+	}
+	return addrs[0].Address
+}
+
+// identicalCopy is a copy as stored in `identical_as` column, i.e.
+// `(uid, mailboxid)` separated by `|`
+type identicalCopy struct {
+	uid     uint32
+	mailbox int
+}
+
+func parseIdenticalAs(s string) []identicalCopy {
+	result := make([]identicalCopy, 0)
+	for _, part := range strings.Split(s, "|") {
+		var c identicalCopy
+		if _, err := fmt.Sscanf(part, "(%d, %d)", &c.uid, &c.mailbox); err == nil {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// formatIdenticalAs returns value of `identical_as` column for copies, null
+// when there are none
+func formatIdenticalAs(copies []identicalCopy) interface{} {
+	if len(copies) == 0 {
+		return nil
+	}
+	parts := make([]string, 0, len(copies))
+	for _, c := range copies {
+		parts = append(parts, fmt.Sprintf("(%d, %d)", c.uid, c.mailbox))
+	}
+	return strings.Join(parts, "|")
 }
 
 func (m *Mail) StyledContent() []*widgets.ContentWithStyle {
 	s := tcell.StyleDefault.Bold(m.IsUnread())
-	return []*widgets.ContentWithStyle{
+	result := []*widgets.ContentWithStyle{
 		widgets.NewContent(m.Date.Format("2006-01-02 15:04:05") + " "),
-		{m.Subject, s},
-		widgets.NewContent(" (" + strings.Join(m.Flags, "|") + ")"),
 	}
+	if m.Mailbox != "" {
+		result = append(result, widgets.NewContent("["+strings.Join(m.Mailboxes(), ", ")+"] "))
+	}
+	return append(result,
+		&widgets.ContentWithStyle{Content: m.Subject, Style: s},
+		widgets.NewContent(" ("+strings.Join(m.Flags, "|")+")"),
+	)
 }
 
 func (m *Mail) IsUnread() bool {
+	return !m.HasFlag(imap.SeenFlag)
+}
+
+func (m *Mail) MarkAsRead() {
+	m.AddFlag(imap.SeenFlag)
+}
+
+func (m *Mail) HasFlag(flag string) bool {
 	for _, f := range m.Flags {
-		if f == imap.SeenFlag {
-			return false
+		if f == flag {
+			return true
 		}
 	}
-	return true
+	return false
 }
 
-func (m *Mail) MarkAsRead() {
-	// check if Seen flag is already set
+func (m *Mail) AddFlag(flag string) {
+	// check if flag is already set
+	if m.HasFlag(flag) {
+		return
+	}
+	m.Flags = append(m.Flags, flag)
+}
+
+func (m *Mail) RemoveFlag(flag string) {
+	flags := make([]string, 0, len(m.Flags))
 	for _, f := range m.Flags {
-		if f == imap.SeenFlag {
-			return
+		if f != flag {
+			flags = append(flags, f)
 		}
 	}
-	m.Flags = append(m.Flags, imap.SeenFlag)
+	m.Flags = flags
 }
 
 func (m *Mail) Depth() int {
@@ -176,6 +330,225 @@ func (m *Mail) Delete(r ndb.Execer) error {
 	return err
 }
 
+// HasMessageId tells whether a mail with messageid is in mailbox of account
+// accname, be it the mail itself or one of its copies
+func HasMessageId(r ndb.Queryer, messageid, mailbox, accname string) (bool, error) {
+	var found bool
+	err := r.QueryRow(`SELECT EXISTS (SELECT 1
+FROM
+  mail m
+  JOIN mailbox mbox ON mbox.account = m.account
+  JOIN account a ON a.id = mbox.account
+WHERE
+  m.messageid = ? AND a.name = ? AND mbox.name = ?
+  AND (m.mailbox = mbox.id OR instr(m.identical_as, ', ' || mbox.id || ')') > 0))`,
+		messageid, accname, mailbox).Scan(&found)
+	return found, err
+}
+
+// DeleteMails deletes mails with uids of mailbox
+func DeleteMails(r ndb.BaseRunner, mailbox, accname string, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	if err := detachCopies(r, mailbox, accname, uids); err != nil {
+		return errors.Wrap(err, "while detaching copies")
+	}
+	args := []interface{}{accname, mailbox}
+	for _, uid := range uids {
+		args = append(args, uid)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(uids)), ",")
+	_, err := r.Exec(`DELETE FROM mail WHERE id IN (
+  SELECT m.id FROM
+    mail m
+    JOIN mailbox mbox ON mbox.id = m.mailbox
+    JOIN account a ON a.id = m.account AND a.id = mbox.account
+  WHERE
+    a.name = ? AND mbox.name = ? AND m.uid IN (`+placeholders+`))`, args...)
+	return err
+}
+
+// detachCopies forgets copies of mails with uids stored in mailbox (every
+// mail of mailbox when uids is nil). Mails of mailbox having copies elsewhere
+// are kept, one of their copies taking their place
+func detachCopies(r ndb.BaseRunner, mailbox, accname string, uids []uint32) error {
+	mboxid, err := mailboxId(r, mailbox, accname)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	removed := make(map[uint32]bool)
+	for _, uid := range uids {
+		removed[uid] = true
+	}
+	isRemoved := func(uid uint32, mbox int) bool {
+		return mbox == mboxid && (uids == nil || removed[uid])
+	}
+	rows, err := r.Query(`SELECT id, uid, mailbox, identical_as FROM mail
+WHERE identical_as IS NOT NULL AND (mailbox = ? OR instr(identical_as, ?) > 0)`,
+		mboxid, fmt.Sprintf(", %d)", mboxid))
+	if err != nil {
+		return err
+	}
+	type update struct {
+		id      int
+		primary identicalCopy
+		copies  []identicalCopy
+	}
+	updates := make([]*update, 0)
+	for rows.Next() {
+		var id int
+		var primary identicalCopy
+		var identicalAs string
+		if err = rows.Scan(&id, &primary.uid, &primary.mailbox, &identicalAs); err != nil {
+			rows.Close()
+			return err
+		}
+		copies := parseIdenticalAs(identicalAs)
+		kept := make([]identicalCopy, 0, len(copies))
+		for _, c := range copies {
+			if !isRemoved(c.uid, c.mailbox) {
+				kept = append(kept, c)
+			}
+		}
+		if isRemoved(primary.uid, primary.mailbox) {
+			if len(kept) == 0 {
+				// deleted with other mails of mailbox
+				continue
+			}
+			primary, kept = kept[0], kept[1:]
+		} else if len(kept) == len(copies) {
+			continue
+		}
+		updates = append(updates, &update{id, primary, kept})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, u := range updates {
+		_, err = r.Exec("UPDATE mail SET uid = ?, mailbox = ?, identical_as = ? WHERE id = ?",
+			u.primary.uid, u.primary.mailbox, formatIdenticalAs(u.copies), u.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CopyMails records that mails with uids of mailbox were copied to dest,
+// with destUids (in the same order) as uids there. Moved mails are no longer
+// in mailbox. A zero dest uid means it was not told by server: such mails
+// are found again once dest is synced, moved ones are removed meanwhile
+func CopyMails(r ndb.BaseRunner, mailbox, dest, accname string, uids, destUids []uint32, move bool) error {
+	copied := make(map[uint32]uint32)
+	unknown := make([]uint32, 0)
+	for i, uid := range uids {
+		if i < len(destUids) && destUids[i] != 0 {
+			copied[uid] = destUids[i]
+		} else {
+			unknown = append(unknown, uid)
+		}
+	}
+	if move {
+		if err := DeleteMails(r, mailbox, accname, unknown); err != nil {
+			return errors.Wrap(err, "while removing moved mails")
+		}
+	}
+	if len(copied) == 0 {
+		return nil
+	}
+	mboxid, err := mailboxId(r, mailbox, accname)
+	if err != nil {
+		return errors.Wrapf(err, "while looking for mailbox `%s`", mailbox)
+	}
+	destid, err := mailboxId(r, dest, accname)
+	if err == sql.ErrNoRows {
+		// dest is not synced yet, mails are found there once it is
+		if move {
+			return DeleteMails(r, mailbox, accname, uids)
+		}
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "while looking for mailbox `%s`", dest)
+	}
+	// only rows of copied mails, stored in mailbox or as one of their copies
+	args := []interface{}{mboxid}
+	copyConds := make([]string, 0, len(copied))
+	for uid := range copied {
+		args = append(args, uid)
+		copyConds = append(copyConds, "instr('|' || identical_as || '|', ?) > 0")
+	}
+	for uid := range copied {
+		args = append(args, fmt.Sprintf("|(%d, %d)|", uid, mboxid))
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(copied)), ",")
+	rows, err := r.Query(`SELECT id, uid, mailbox, identical_as FROM mail
+WHERE (mailbox = ? AND uid IN (`+placeholders+`))
+  OR (identical_as IS NOT NULL AND (`+strings.Join(copyConds, " OR ")+`))`, args...)
+	if err != nil {
+		return err
+	}
+	type update struct {
+		id     int
+		copies []identicalCopy
+	}
+	updates := make([]*update, 0)
+	for rows.Next() {
+		var id int
+		var primary identicalCopy
+		var identicalAs sql.NullString
+		if err = rows.Scan(&id, &primary.uid, &primary.mailbox, &identicalAs); err != nil {
+			rows.Close()
+			return err
+		}
+		copies := append([]identicalCopy{primary}, parseIdenticalAs(identicalAs.String)...)
+		result := make([]identicalCopy, 0, len(copies)+1)
+		changed := false
+		for _, c := range copies {
+			destUid, ok := copied[c.uid]
+			if c.mailbox != mboxid || !ok {
+				result = append(result, c)
+				continue
+			}
+			if !move {
+				result = append(result, c)
+			}
+			result = append(result, identicalCopy{uid: destUid, mailbox: destid})
+			changed = true
+		}
+		if changed {
+			updates = append(updates, &update{id, result})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, u := range updates {
+		_, err = r.Exec("UPDATE mail SET uid = ?, mailbox = ?, identical_as = ? WHERE id = ?",
+			u.copies[0].uid, u.copies[0].mailbox, formatIdenticalAs(u.copies[1:]), u.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mailboxId returns id of mailbox of account accname, sql.ErrNoRows when
+// it is unknown
+func mailboxId(r ndb.Queryer, mailbox, accname string) (int, error) {
+	var id int
+	err := r.QueryRow(`SELECT mbox.id
+FROM
+  mailbox mbox
+  JOIN account a ON a.id = mbox.account
+WHERE a.name = ? AND mbox.name = ?`, accname, mailbox).Scan(&id)
+	return id, err
+}
+
 func (m *Mail) SaveFlags(r ndb.Execer) error {
 	_, err := r.Exec("UPDATE mail SET flags = ? WHERE id = ?", strings.Join(m.Flags, ","), m.Id)
 	return err
@@ -196,7 +569,8 @@ func FetchMails(r ndb.Queryer, mailbox, accname string, lastseenuid uint32) ([]*
         JOIN mailbox mbox ON mbox.id = m.mailbox
         JOIN account a ON a.id = m.account AND a.id = mbox.account
       WHERE
-        a.name = ? AND mbox.name = ? AND m.uid <= ?`, accname, mailbox, lastseenuid)
+        a.name = ? AND mbox.name = ? AND m.uid <= ?
+      ORDER BY m.uid`, accname, mailbox, lastseenuid)
 	if err != nil {
 		return nil, err
 	}
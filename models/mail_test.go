@@ -1,7 +1,9 @@
 package models
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/emersion/go-imap"
@@ -162,3 +164,285 @@ func TestBodyStructure(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMail(t *testing.T) {
+	raw := strings.Join([]string{
+		"Subject: =?utf-8?q?caf=C3=A9?=",
+		"Message-Id: <a@b>",
+		"In-Reply-To: <parent@b>",
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000",
+		"Content-Type: multipart/mixed; boundary=XX",
+		"",
+		"--XX",
+		"Content-Type: text/plain",
+		"",
+		"hi",
+		"--XX",
+		"Content-Type: image/png",
+		"",
+		"xx",
+		"--XX--",
+		"",
+	}, "\r\n")
+	m, err := ParseMail(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Subject != "café" || m.MessageId != "<a@b>" || m.InReplyTo != "<parent@b>" {
+		t.Errorf("unexpected header fields %q, %q, %q", m.Subject, m.MessageId, m.InReplyTo)
+	}
+	if m.Date.Year() != 2006 {
+		t.Errorf("unexpected date %v", m.Date)
+	}
+	expected := []*BodyPart{
+		{Path: "/", MIMEType: "multipart", MIMESubType: "mixed"},
+		{Path: "/0", MIMEType: "text", MIMESubType: "plain"},
+		{Path: "/1", MIMEType: "image", MIMESubType: "png"},
+	}
+	if !reflect.DeepEqual(m.Parts, expected) {
+		t.Errorf("parts not correctly built (expected: %#v, got: %#v)", expected, m.Parts)
+	}
+}
+
+func TestDeleteMails(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	other := Mailbox{Name: "archive"}
+	if err = other.InsertInto(db, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(uid uint32, mailbox string) {
+		m := &Mail{Uid: uid, MessageId: fmt.Sprintf("id%d-%s", uid, mailbox)}
+		if err := m.InsertInto(db, mailbox, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert(1, FAKE_MBOX)
+	insert(2, FAKE_MBOX)
+	insert(3, FAKE_MBOX)
+	insert(2, "archive")
+
+	if err = DeleteMails(db, FAKE_MBOX, FAKE_ACC, []uint32{2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.Query("SELECT messageid FROM mail ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	found := make([]string, 0)
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		found = append(found, id)
+	}
+	expected := []string{"id1-inbox", "id2-archive"}
+	if !reflect.DeepEqual(expected, found) {
+		t.Errorf("expected remaining mails %v, found %v", expected, found)
+	}
+}
+
+func TestHasMessageId(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	for _, name := range []string{"archive", "sent"} {
+		mbox := Mailbox{Name: name}
+		if err = mbox.InsertInto(db, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &Mail{Uid: 1, MessageId: "<id1@example.com>"}
+	if err = m.InsertInto(db, FAKE_MBOX, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	// copy of the same mail
+	m = &Mail{Uid: 3, MessageId: "<id1@example.com>"}
+	if err = m.InsertInto(db, "archive", FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		messageid string
+		mailbox   string
+		accname   string
+		expected  bool
+	}{
+		{"<id1@example.com>", FAKE_MBOX, FAKE_ACC, true},
+		{"<id1@example.com>", "archive", FAKE_ACC, true},
+		{"<id1@example.com>", "sent", FAKE_ACC, false},
+		{"<id1@example.com>", FAKE_MBOX, "other", false},
+		{"<id2@example.com>", FAKE_MBOX, FAKE_ACC, false},
+		{"", FAKE_MBOX, FAKE_ACC, false},
+	}
+	for _, tc := range testCases {
+		found, err := HasMessageId(db, tc.messageid, tc.mailbox, tc.accname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != tc.expected {
+			t.Errorf("message-id %q in %s/%s: expected %v, found %v", tc.messageid, tc.accname, tc.mailbox, tc.expected, found)
+		}
+	}
+}
+
+func TestMailCopies(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	for _, name := range []string{"archive", "sent"} {
+		mbox := Mailbox{Name: name}
+		if err = mbox.InsertInto(db, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert := func(uid uint32, mailbox string) {
+		m := &Mail{Uid: uid, MessageId: "<id1>", Threadid: 1}
+		if err := m.InsertInto(db, mailbox, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert(1, FAKE_MBOX)
+	insert(5, "archive")
+	insert(7, "sent")
+	// copies are only tracked once
+	insert(5, "archive")
+	insert(1, FAKE_MBOX)
+	copiesOf := func() (*Mail, error) {
+		var id int
+		if err := db.QueryRow("SELECT id FROM mail").Scan(&id); err != nil {
+			return nil, err
+		}
+		mails, err := AllThreadMails(db, id)
+		if err != nil || len(mails) != 1 {
+			return nil, fmt.Errorf("expected one mail, found %v (%v)", mails, err)
+		}
+		return mails[0], nil
+	}
+	m, err := copiesOf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{FAKE_MBOX, "archive", "sent"}
+	if !reflect.DeepEqual(expected, m.Mailboxes()) {
+		t.Errorf("expected mailboxes %v, found %v", expected, m.Mailboxes())
+	}
+	if c := m.In("archive"); c == nil || c.Uid != 5 {
+		t.Errorf("expected copy with uid 5 in archive, found %v", c)
+	}
+	if c := m.In("trash"); c != nil {
+		t.Errorf("expected no copy in trash, found %v", c)
+	}
+	for _, name := range expected {
+		threads, err := AllThreads(db, name, FAKE_ACC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(threads) != 1 {
+			t.Errorf("expected thread listed in %s, found %v", name, threads)
+		}
+	}
+
+	// deleting a copy forgets it, deleting mail keeps one of its copies
+	if err = DeleteMails(db, "sent", FAKE_ACC, []uint32{7}); err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteMails(db, FAKE_MBOX, FAKE_ACC, []uint32{1}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = copiesOf(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Uid != 5 || !reflect.DeepEqual([]string{"archive"}, m.Mailboxes()) {
+		t.Errorf("expected mail only kept in archive with uid 5, found %d in %v", m.Uid, m.Mailboxes())
+	}
+	mbox := Mailbox{Name: "archive"}
+	if err = mbox.Reset(db, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	db.QueryRow("SELECT count(1) FROM mail").Scan(&count)
+	if count != 0 {
+		t.Errorf("expected no mail left, found %d", count)
+	}
+}
+
+func TestCopyMails(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	for _, name := range []string{"archive", "sent"} {
+		mbox := Mailbox{Name: name}
+		if err = mbox.InsertInto(db, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for uid := uint32(1); uid <= 3; uid++ {
+		m := &Mail{Uid: uid, MessageId: fmt.Sprintf("<id%d>", uid), Threadid: int(uid)}
+		if err = m.InsertInto(db, FAKE_MBOX, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	locations := func() map[string][]string {
+		rows, err := db.Query("SELECT id, messageid FROM mail ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make(map[int]string)
+		for rows.Next() {
+			var id int
+			var messageid string
+			if err = rows.Scan(&id, &messageid); err != nil {
+				t.Fatal(err)
+			}
+			ids[id] = messageid
+		}
+		rows.Close()
+		result := make(map[string][]string)
+		for id, messageid := range ids {
+			mails, err := AllThreadMails(db, id)
+			if err != nil || len(mails) != 1 {
+				t.Fatalf("expected one mail, found %v (%v)", mails, err)
+			}
+			m := mails[0]
+			for _, name := range m.Mailboxes() {
+				result[messageid] = append(result[messageid], fmt.Sprintf("%s:%d", name, m.In(name).Uid))
+			}
+		}
+		return result
+	}
+
+	// copy keeps mail in source, uid 0 is not known in dest
+	err = CopyMails(db, FAKE_MBOX, "archive", FAKE_ACC, []uint32{1, 2}, []uint32{10, 0}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// move of a copy leaves original in place
+	err = CopyMails(db, "archive", "sent", FAKE_ACC, []uint32{10}, []uint32{20}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// move without dest uid removes mail until dest is synced
+	err = CopyMails(db, FAKE_MBOX, "archive", FAKE_ACC, []uint32{2, 3}, []uint32{11}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"<id1>": {FAKE_MBOX + ":1", "sent:20"},
+		"<id2>": {"archive:11"},
+	}
+	if found := locations(); !reflect.DeepEqual(expected, found) {
+		t.Errorf("expected mails %v, found %v", expected, found)
+	}
+	threads, err := AllThreads(db, "archive", FAKE_ACC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 1 {
+		t.Errorf("expected one thread in archive, found %v", threads)
+	}
+}
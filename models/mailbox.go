@@ -16,6 +16,12 @@ type Mailbox struct {
 	Unseen      uint32
 	ReadOnly    bool
 	LastSeenUid uint32
+	// uids are only meaningful along with uidvalidity (rfc3501#section-2.3.1.1)
+	UidValidity uint32
+	// greatest modseq (rfc7162) of mails known in db, 0 if unknown
+	HighestModSeq uint64
+	// how threads of mailbox are listed
+	Sort ThreadSort
 
 	directoryDepth int
 }
@@ -40,6 +46,69 @@ func (m *Mailbox) UpdateLastUid(r ndb.Execer, accname string) error {
 	return err
 }
 
+// UpdateUidValidity records uidvalidity of m
+func (m *Mailbox) UpdateUidValidity(r ndb.Execer, accname string) error {
+	_, err := r.Exec(
+		"UPDATE mailbox SET uidvalidity = ? WHERE name = ? AND account = (SELECT id FROM account WHERE name = ?)",
+		m.UidValidity,
+		m.Name,
+		accname,
+	)
+	return err
+}
+
+// UpdateHighestModSeq records highest modseq of m
+func (m *Mailbox) UpdateHighestModSeq(r ndb.Execer, accname string) error {
+	_, err := r.Exec(
+		"UPDATE mailbox SET highestmodseq = ? WHERE name = ? AND account = (SELECT id FROM account WHERE name = ?)",
+		m.HighestModSeq,
+		m.Name,
+		accname,
+	)
+	return err
+}
+
+// UpdateSort records how threads of m are listed
+func (m *Mailbox) UpdateSort(r ndb.Execer, accname string) error {
+	key := m.Sort.Key
+	if key == "" {
+		key = SORT_RECENT
+	}
+	_, err := r.Exec(
+		"UPDATE mailbox SET sortkey = ?, sortasc = ?, flat = ? WHERE name = ? AND account = (SELECT id FROM account WHERE name = ?)",
+		key,
+		m.Sort.Asc,
+		m.Sort.Flat,
+		m.Name,
+		accname,
+	)
+	return err
+}
+
+// Reset removes every mail of m, so that it can be synced again from scratch
+// once its uids are no longer valid
+func (m *Mailbox) Reset(r ndb.BaseRunner, accname string) error {
+	if err := detachCopies(r, m.Name, accname, nil); err != nil {
+		return err
+	}
+	_, err := r.Exec(`DELETE FROM mail WHERE id IN (
+  SELECT m.id FROM
+    mail m
+    JOIN mailbox mbox ON mbox.id = m.mailbox
+    JOIN account a ON a.id = m.account AND a.id = mbox.account
+  WHERE
+    a.name = ? AND mbox.name = ?)`, accname, m.Name)
+	if err != nil {
+		return err
+	}
+	_, err = r.Exec(
+		"UPDATE mailbox SET lastseenuid = 0, highestmodseq = 0 WHERE name = ? AND account = (SELECT id FROM account WHERE name = ?)",
+		m.Name,
+		accname,
+	)
+	return err
+}
+
 func (m *Mailbox) InsertInto(r ndb.Execer, accname string) error {
 	columns := []string{"name", "shortname"}
 	values := []interface{}{m.Name, m.ShortName}
@@ -64,20 +133,31 @@ func GetMailbox(r ndb.Queryer, mboxname, accname string) (*Mailbox, error) {
 	var name string
 	var shortname string
 	var lastseenuid int
+	var uidvalidity int
+	var highestmodseq int64
+	var sort ThreadSort
 	err := r.QueryRow(`
 SELECT
-  m.name, m.shortname, m.lastseenuid
+  m.name, m.shortname, m.lastseenuid, m.uidvalidity, m.highestmodseq,
+  ifnull(m.sortkey, ''), ifnull(m.sortasc, 0), ifnull(m.flat, 0)
 FROM
   mailbox m
   JOIN account a ON m.account = a.id
 WHERE a.name = ? AND m.name = ?`,
 		accname,
 		mboxname,
-	).Scan(&name, &shortname, &lastseenuid)
+	).Scan(&name, &shortname, &lastseenuid, &uidvalidity, &highestmodseq, &sort.Key, &sort.Asc, &sort.Flat)
 	if err != nil {
 		return nil, err
 	}
-	m := &Mailbox{Name: name, ShortName: shortname, LastSeenUid: uint32(lastseenuid)}
+	m := &Mailbox{
+		Name:          name,
+		ShortName:     shortname,
+		LastSeenUid:   uint32(lastseenuid),
+		UidValidity:   uint32(uidvalidity),
+		HighestModSeq: uint64(highestmodseq),
+		Sort:          sort,
+	}
 	return m, nil
 }
 
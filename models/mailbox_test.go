@@ -0,0 +1,70 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMailboxReset(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	other := Mailbox{Name: "archive"}
+	if err = other.InsertInto(db, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	for i, mailbox := range []string{FAKE_MBOX, FAKE_MBOX, "archive"} {
+		m := &Mail{Uid: uint32(i + 1), MessageId: fmt.Sprintf("id%d", i)}
+		if err = m.InsertInto(db, mailbox, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mbox := &Mailbox{Name: FAKE_MBOX, LastSeenUid: 2, UidValidity: 42, HighestModSeq: 7}
+	if err = mbox.UpdateLastUid(db, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	if err = mbox.UpdateUidValidity(db, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	if err = mbox.UpdateHighestModSeq(db, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = mbox.Reset(db, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetMailbox(db, FAKE_MBOX, FAKE_ACC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LastSeenUid != 0 || got.UidValidity != 42 || got.HighestModSeq != 0 {
+		t.Errorf("expected lastseenuid 0, uidvalidity 42 and highestmodseq 0, got %d, %d and %d", got.LastSeenUid, got.UidValidity, got.HighestModSeq)
+	}
+	var count int
+	if err = db.QueryRow("SELECT count(*) FROM mail").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected only mail of other mailbox to remain, found %d mails", count)
+	}
+}
+
+func TestMailboxHighestModSeq(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	// greater than 32 bits, as found on some servers
+	mbox := &Mailbox{Name: FAKE_MBOX, HighestModSeq: 1 << 40}
+	if err = mbox.UpdateHighestModSeq(db, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	got, err := GetMailbox(db, FAKE_MBOX, FAKE_ACC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.HighestModSeq != 1<<40 {
+		t.Errorf("expected highestmodseq %d, got %d", uint64(1<<40), got.HighestModSeq)
+	}
+}
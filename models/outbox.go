@@ -0,0 +1,165 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/gdamore/tcell/v2"
+
+	ndb "github.com/stregouet/nuntius/database"
+	"github.com/stregouet/nuntius/widgets"
+)
+
+// OutboxMail is a mail waiting in outbox to be sent
+type OutboxMail struct {
+	Id int
+	// mail as edited in compose view
+	Body string
+	// path of files to attach
+	Attachments []string
+	Subject     string
+	Recipients  string
+	Attempts    int
+	LastError   string
+	// zero when mail is no longer retried automatically
+	NextAttempt time.Time
+	Created     time.Time
+}
+
+// NewOutboxMail builds outbox mail from compose view content, subject and
+// recipients are only kept to be displayed
+func NewOutboxMail(body string, attachments []string) *OutboxMail {
+	o := &OutboxMail{
+		Body:        body,
+		Attachments: attachments,
+		NextAttempt: time.Now(),
+		Created:     time.Now(),
+	}
+	if msg, err := message.Read(strings.NewReader(body)); err == nil {
+		o.Subject = msg.Header.Get("Subject")
+		o.Recipients = msg.Header.Get("To")
+	}
+	return o
+}
+
+func (o *OutboxMail) StyledContent() []*widgets.ContentWithStyle {
+	status := "sending"
+	style := tcell.StyleDefault
+	if o.LastError == "" && o.NextAttempt.IsZero() {
+		status = "on hold"
+	} else if o.LastError != "" {
+		style = style.Foreground(tcell.ColorRed)
+		if o.NextAttempt.IsZero() {
+			status = fmt.Sprintf("failed after %d attempt(s): %s", o.Attempts, o.LastError)
+		} else {
+			status = fmt.Sprintf("attempt %d failed, retry at %s: %s",
+				o.Attempts,
+				o.NextAttempt.Format("15:04:05"),
+				o.LastError)
+		}
+	}
+	return []*widgets.ContentWithStyle{
+		widgets.NewContent(fmt.Sprintf("%s %s %s ",
+			o.Created.Format("2006-01-02 15:04:05"),
+			o.Recipients,
+			o.Subject)),
+		{Content: status, Style: style},
+	}
+}
+
+func (o *OutboxMail) InsertInto(r ndb.Execer, accname string) error {
+	attachments, err := json.Marshal(o.Attachments)
+	if err != nil {
+		return err
+	}
+	res, err := r.Exec(`INSERT INTO outbox
+  (body, attachments, subject, recipients, attempts, lasterror, nextattempt, created, account)
+SELECT ?, ?, ?, ?, ?, ?, ?, ?, account.id FROM account WHERE account.name = ?`,
+		o.Body,
+		string(attachments),
+		o.Subject,
+		o.Recipients,
+		o.Attempts,
+		o.LastError,
+		o.NextAttempt,
+		o.Created,
+		accname,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	o.Id = int(id)
+	return nil
+}
+
+// Update saves content and sending status of o
+func (o *OutboxMail) Update(r ndb.Execer) error {
+	attachments, err := json.Marshal(o.Attachments)
+	if err != nil {
+		return err
+	}
+	_, err = r.Exec(`UPDATE outbox SET
+  body = ?, attachments = ?, subject = ?, recipients = ?, attempts = ?, lasterror = ?, nextattempt = ?
+WHERE id = ?`,
+		o.Body,
+		string(attachments),
+		o.Subject,
+		o.Recipients,
+		o.Attempts,
+		o.LastError,
+		o.NextAttempt,
+		o.Id,
+	)
+	return err
+}
+
+// FetchOutbox returns mails of account waiting to be sent, oldest first
+func FetchOutbox(r ndb.Queryer, accname string) ([]*OutboxMail, error) {
+	rows, err := r.Query(`SELECT
+  o.id, o.body, o.attachments, o.subject, o.recipients, o.attempts, o.lasterror, o.nextattempt, o.created
+FROM
+  outbox o
+  JOIN account a ON a.id = o.account
+WHERE a.name = ?
+ORDER BY o.id`, accname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*OutboxMail, 0)
+	for rows.Next() {
+		o := &OutboxMail{}
+		var attachments string
+		err = rows.Scan(
+			&o.Id,
+			&o.Body,
+			&attachments,
+			&o.Subject,
+			&o.Recipients,
+			&o.Attempts,
+			&o.LastError,
+			&o.NextAttempt,
+			&o.Created,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(attachments), &o.Attachments); err != nil {
+			return nil, err
+		}
+		result = append(result, o)
+	}
+	return result, rows.Err()
+}
+
+func DeleteOutboxMail(r ndb.Execer, id int) error {
+	_, err := r.Exec("DELETE FROM outbox WHERE id = ?", id)
+	return err
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewOutboxMail(t *testing.T) {
+	o := NewOutboxMail("To: bob@example.com\r\nSubject: hello\r\n\r\nbody\r\n", nil)
+	if o.Subject != "hello" || o.Recipients != "bob@example.com" {
+		t.Errorf("unexpected subject and recipients (got: %q, %q)", o.Subject, o.Recipients)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	first := NewOutboxMail("Subject: first\r\n\r\nbody\r\n", []string{"/tmp/a.txt"})
+	second := NewOutboxMail("Subject: second\r\n\r\nbody\r\n", nil)
+	for _, o := range []*OutboxMail{first, second} {
+		if err = o.InsertInto(db, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first.Attempts = 2
+	first.LastError = "connection refused"
+	first.NextAttempt = time.Time{}
+	if err = first.Update(db); err != nil {
+		t.Fatal(err)
+	}
+	if err = DeleteOutboxMail(db, second.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	mails, err := FetchOutbox(db, FAKE_ACC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mails) != 1 {
+		t.Fatalf("expected 1 mail in outbox, got %d", len(mails))
+	}
+	got := mails[0]
+	if got.Id != first.Id || got.Subject != "first" || got.Attempts != 2 || got.LastError != "connection refused" {
+		t.Errorf("unexpected outbox mail %#v", got)
+	}
+	if !got.NextAttempt.IsZero() {
+		t.Errorf("expected no next attempt, got %v", got.NextAttempt)
+	}
+	if !reflect.DeepEqual(got.Attachments, []string{"/tmp/a.txt"}) {
+		t.Errorf("unexpected attachments %v", got.Attachments)
+	}
+}
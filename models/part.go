@@ -0,0 +1,86 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-message"
+
+	"github.com/stregouet/nuntius/lib"
+)
+
+// FindPart returns part of msg located at path
+func FindPart(msg *message.Entity, path BodyPath) (*message.Entity, error) {
+	msgpath, err := path.ToMessagePath()
+	if err != nil {
+		return nil, err
+	}
+	var found *message.Entity
+	err = msg.Walk(func(p []int, e *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if lib.IsSliceIntEqual(p, msgpath) {
+			found = e
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil && err != errStopWalk {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no part at `%s`", path)
+	}
+	return found, nil
+}
+
+// PartFilename returns filename of part e, taken from Content-Disposition
+// or Content-Type `name` parameter, otherwise built from its path and mime
+// type
+func PartFilename(e *message.Entity, path BodyPath) string {
+	var name string
+	if _, params, err := e.Header.ContentDisposition(); err == nil {
+		name = params["filename"]
+	}
+	t, params, err := e.Header.ContentType()
+	if name == "" && err == nil {
+		name = params["name"]
+	}
+	// never trust a filename coming from a mail
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name != "/" && name != "." {
+		return name
+	}
+	name = "part" + strings.ReplaceAll(string(path), "/", "-")
+	if exts, err := mime.ExtensionsByType(t); err == nil && len(exts) > 0 {
+		name += exts[0]
+	}
+	return name
+}
+
+// SavePart writes decoded content of part e to dest, which may be either
+// a directory (part is saved with its filename) or a file path, existing
+// files are never overwritten. It returns path of written file
+func SavePart(e *message.Entity, path BodyPath, dest string) (string, error) {
+	if fi, err := os.Stat(dest); (err == nil && fi.IsDir()) || strings.HasSuffix(dest, "/") {
+		dest = filepath.Join(dest, PartFilename(e, path))
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(f, e.Body); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return "", err
+	}
+	return dest, f.Close()
+}
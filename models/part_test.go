@@ -0,0 +1,102 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+)
+
+const MULTIPART_MAIL = "Subject: report\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"see attached\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=\"../../report.txt\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aGVsbG8=\r\n" +
+	"--b\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"aGVsbG8=\r\n" +
+	"--b--\r\n"
+
+func TestSavePart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nuntius-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	testCases := []struct {
+		path     BodyPath
+		dest     string
+		expected string
+		err      bool
+	}{
+		{
+			path:     "/1",
+			dest:     dir,
+			expected: filepath.Join(dir, "report.txt"),
+		},
+		{
+			// never overwrite existing file
+			path: "/1",
+			dest: dir,
+			err:  true,
+		},
+		{
+			path:     "/2",
+			dest:     dir + "/sub/",
+			expected: filepath.Join(dir, "sub", "part-2.png"),
+		},
+		{
+			path:     "/1",
+			dest:     filepath.Join(dir, "renamed.txt"),
+			expected: filepath.Join(dir, "renamed.txt"),
+		},
+		{
+			path: "/5",
+			dest: dir,
+			err:  true,
+		},
+	}
+	for _, tc := range testCases {
+		msg, err := message.Read(strings.NewReader(MULTIPART_MAIL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var saved string
+		part, err := FindPart(msg, tc.path)
+		if err == nil {
+			saved, err = SavePart(part, tc.path, tc.dest)
+		}
+		if (err != nil) != tc.err {
+			t.Errorf("(path: %s) unexpected error value %v", tc.path, err)
+			continue
+		}
+		if tc.err {
+			continue
+		}
+		if saved != tc.expected {
+			t.Errorf("(path: %s) expected part saved at %s, found %s", tc.path, tc.expected, saved)
+		}
+		content, err := ioutil.ReadFile(saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "hello" {
+			t.Errorf("(path: %s) part not decoded, found %q", tc.path, content)
+		}
+	}
+}
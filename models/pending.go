@@ -0,0 +1,83 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	ndb "github.com/stregouet/nuntius/database"
+)
+
+// PendingAction is an action done while offline, waiting to be replayed on
+// imap server once connection is back
+type PendingAction struct {
+	Id      int
+	Kind    string
+	Payload string
+	Created time.Time
+}
+
+func (p *PendingAction) InsertInto(r ndb.Execer, accname string) error {
+	if p.Created.IsZero() {
+		p.Created = time.Now()
+	}
+	res, err := r.Exec(
+		"INSERT INTO pending_action (kind, payload, created, account) SELECT ?, ?, ?, account.id FROM account WHERE account.name = ?",
+		p.Kind,
+		p.Payload,
+		p.Created,
+		accname,
+	)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	p.Id = int(id)
+	return nil
+}
+
+// FetchPendingActions returns actions of account in the order they were done
+func FetchPendingActions(r ndb.Queryer, accname string) ([]*PendingAction, error) {
+	rows, err := r.Query(`SELECT p.id, p.kind, p.payload, p.created FROM
+        pending_action p
+        JOIN account a ON a.id = p.account
+      WHERE a.name = ?
+      ORDER BY p.id`, accname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]*PendingAction, 0)
+	for rows.Next() {
+		p := &PendingAction{}
+		if err = rows.Scan(&p.Id, &p.Kind, &p.Payload, &p.Created); err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+func DeletePendingActions(r ndb.Execer, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	_, err := r.Exec("DELETE FROM pending_action WHERE id IN ("+placeholders+")", args...)
+	return err
+}
+
+func CountPendingActions(r ndb.Queryer, accname string) (int, error) {
+	var count int
+	err := r.QueryRow(`SELECT count(*) FROM
+        pending_action p
+        JOIN account a ON a.id = p.account
+      WHERE a.name = ?`, accname).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPendingActions(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	for _, kind := range []string{"flags", "move", "send"} {
+		p := &PendingAction{Kind: kind, Payload: "{}"}
+		if err = p.InsertInto(db, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+		if p.Id == 0 {
+			t.Errorf("expected id to be set once inserted")
+		}
+	}
+	actions, err := FetchPendingActions(db, FAKE_ACC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make([]string, 0)
+	for _, p := range actions {
+		kinds = append(kinds, p.Kind)
+	}
+	if expected := []string{"flags", "move", "send"}; !reflect.DeepEqual(expected, kinds) {
+		t.Errorf("expected actions %v in order, got %v", expected, kinds)
+	}
+
+	if err = DeletePendingActions(db, []int{actions[0].Id, actions[2].Id}); err != nil {
+		t.Fatal(err)
+	}
+	count, err := CountPendingActions(db, FAKE_ACC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 remaining action, got %d", count)
+	}
+	if count, _ = CountPendingActions(db, "otheracc"); count != 0 {
+		t.Errorf("expected no action for another account, got %d", count)
+	}
+}
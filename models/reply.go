@@ -0,0 +1,228 @@
+package models
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+)
+
+type ForwardMode string
+
+const (
+	FORWARD_INLINE     ForwardMode = "inline"
+	FORWARD_ATTACHMENT ForwardMode = "attachment"
+)
+
+func formatAddress(a *mail.Address) string {
+	if a.Name == "" {
+		return a.Address
+	}
+	name := a.Name
+	if strings.ContainsAny(name, "\"(),.:;<>@[\\]") {
+		name = strconv.Quote(name)
+	}
+	return name + " <" + a.Address + ">"
+}
+
+func formatAddressList(addrs []*mail.Address) string {
+	formatted := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		formatted = append(formatted, formatAddress(a))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// withoutAddresses returns addrs without those in excluded nor duplicates
+func withoutAddresses(addrs []*mail.Address, excluded map[string]struct{}) []*mail.Address {
+	res := make([]*mail.Address, 0, len(addrs))
+	for _, a := range addrs {
+		key := strings.ToLower(a.Address)
+		if _, ok := excluded[key]; ok {
+			continue
+		}
+		excluded[key] = struct{}{}
+		res = append(res, a)
+	}
+	return res
+}
+
+// prefixSubject adds prefix (`Re`, `Fwd`) to subject unless it is already
+// there
+func prefixSubject(prefix, subject string) string {
+	if strings.HasPrefix(strings.ToLower(subject), strings.ToLower(prefix)+":") {
+		return subject
+	}
+	return prefix + ": " + subject
+}
+
+type composeHeader struct {
+	buf *strings.Builder
+}
+
+func (h composeHeader) set(key, value string) {
+	if value == "" {
+		return
+	}
+	h.buf.WriteString(key + ": " + value + "\n")
+}
+
+// readOriginal parses header and plain text body of the mail being answered
+func readOriginal(r io.Reader) (*mail.Header, string, error) {
+	msg, err := message.Read(r)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := PlaintextBody(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	content := new(strings.Builder)
+	if body != nil {
+		if _, err = io.Copy(content, body); err != nil {
+			return nil, "", err
+		}
+	}
+	return &mail.Header{Header: msg.Header}, strings.ReplaceAll(content.String(), "\r\n", "\n"), nil
+}
+
+func quote(body string) string {
+	buf := new(strings.Builder)
+	s := bufio.NewScanner(strings.NewReader(strings.TrimRight(body, "\n")))
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, ">") {
+			buf.WriteString(">" + line + "\n")
+		} else {
+			buf.WriteString("> " + line + "\n")
+		}
+	}
+	return buf.String()
+}
+
+// ReplyContent builds compose view content answering mail read from r, from
+// is the address used to answer (may be empty), when all is true every
+// recipient of original mail, except from, is kept
+func ReplyContent(r io.Reader, from string, all bool) (string, error) {
+	header, body, err := readOriginal(r)
+	if err != nil {
+		return "", err
+	}
+	excluded := make(map[string]struct{})
+	if from != "" {
+		addrs, err := mail.ParseAddressList(from)
+		if err != nil {
+			return "", err
+		}
+		for _, a := range addrs {
+			excluded[strings.ToLower(a.Address)] = struct{}{}
+		}
+	}
+	to, err := header.AddressList("Reply-To")
+	if err != nil {
+		return "", err
+	}
+	if len(to) == 0 {
+		if to, err = header.AddressList("From"); err != nil {
+			return "", err
+		}
+	}
+	var cc []*mail.Address
+	if all {
+		origTo, err := header.AddressList("To")
+		if err != nil {
+			return "", err
+		}
+		if cc, err = header.AddressList("Cc"); err != nil {
+			return "", err
+		}
+		to = withoutAddresses(append(to, origTo...), excluded)
+		cc = withoutAddresses(cc, excluded)
+	}
+
+	subject, err := header.Subject()
+	if err != nil {
+		return "", err
+	}
+	messageid, err := header.MessageID()
+	if err != nil {
+		return "", err
+	}
+	references, err := header.MsgIDList("References")
+	if err != nil {
+		return "", err
+	}
+	if len(references) == 0 {
+		// fallback on in-reply-to as advised by rfc5322
+		if references, err = header.MsgIDList("In-Reply-To"); err != nil {
+			return "", err
+		}
+	}
+	if messageid != "" {
+		references = append(references, messageid)
+	}
+	refs := make([]string, 0, len(references))
+	for _, ref := range references {
+		refs = append(refs, "<"+ref+">")
+	}
+
+	buf := new(strings.Builder)
+	h := composeHeader{buf}
+	h.set("From", from)
+	h.set("To", formatAddressList(to))
+	h.set("Cc", formatAddressList(cc))
+	h.set("Subject", prefixSubject("Re", subject))
+	if messageid != "" {
+		h.set("In-Reply-To", "<"+messageid+">")
+	}
+	h.set("References", strings.Join(refs, " "))
+	buf.WriteString("\n")
+
+	author, err := header.AddressList("From")
+	if err != nil {
+		return "", err
+	}
+	intro := "On " + header.Get("Date") + ", " + formatAddressList(author) + " wrote:\n"
+	if header.Get("Date") == "" {
+		intro = formatAddressList(author) + " wrote:\n"
+	}
+	buf.WriteString("\n" + intro + quote(body))
+	return buf.String(), nil
+}
+
+// ForwardContent builds compose view content forwarding mail read from r,
+// either inline (original header summary and body copied in new body) or as
+// attachment (in this case original mail must be attached by caller)
+func ForwardContent(r io.Reader, from string, mode ForwardMode) (string, error) {
+	header, body, err := readOriginal(r)
+	if err != nil {
+		return "", err
+	}
+	subject, err := header.Subject()
+	if err != nil {
+		return "", err
+	}
+	buf := new(strings.Builder)
+	h := composeHeader{buf}
+	h.set("From", from)
+	buf.WriteString("To: \n")
+	h.set("Subject", prefixSubject("Fwd", subject))
+	buf.WriteString("\n")
+	if mode == FORWARD_ATTACHMENT {
+		return buf.String(), nil
+	}
+
+	buf.WriteString("\n---------- Forwarded message ----------\n")
+	for _, key := range []string{"From", "Date", "Subject", "To", "Cc"} {
+		val, err := header.Text(key)
+		if err != nil {
+			return "", err
+		}
+		h.set(key, val)
+	}
+	buf.WriteString("\n" + body)
+	return buf.String(), nil
+}
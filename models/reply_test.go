@@ -0,0 +1,107 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+const ORIGINAL_MAIL = "From: Alice <alice@example.org>\r\n" +
+	"To: me@example.org, Bob <bob@example.org>\r\n" +
+	"Cc: carol@example.org\r\n" +
+	"Subject: lunch\r\n" +
+	"Date: Mon, 26 Apr 2021 10:00:00 +0200\r\n" +
+	"Message-Id: <2@example.org>\r\n" +
+	"References: <1@example.org>\r\n" +
+	"\r\n" +
+	"are you in?\r\n" +
+	"> previous\r\n"
+
+func TestReplyContent(t *testing.T) {
+	testCases := []struct {
+		all      bool
+		expected string
+	}{
+		{
+			all: false,
+			expected: "From: me@example.org\n" +
+				"To: Alice <alice@example.org>\n" +
+				"Subject: Re: lunch\n" +
+				"In-Reply-To: <2@example.org>\n" +
+				"References: <1@example.org> <2@example.org>\n" +
+				"\n\n" +
+				"On Mon, 26 Apr 2021 10:00:00 +0200, Alice <alice@example.org> wrote:\n" +
+				"> are you in?\n" +
+				">> previous\n",
+		},
+		{
+			all: true,
+			expected: "From: me@example.org\n" +
+				"To: Alice <alice@example.org>, Bob <bob@example.org>\n" +
+				"Cc: carol@example.org\n" +
+				"Subject: Re: lunch\n" +
+				"In-Reply-To: <2@example.org>\n" +
+				"References: <1@example.org> <2@example.org>\n" +
+				"\n\n" +
+				"On Mon, 26 Apr 2021 10:00:00 +0200, Alice <alice@example.org> wrote:\n" +
+				"> are you in?\n" +
+				">> previous\n",
+		},
+	}
+	for _, tc := range testCases {
+		content, err := ReplyContent(strings.NewReader(ORIGINAL_MAIL), "me@example.org", tc.all)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if content != tc.expected {
+			t.Errorf("reply content not built correctly (all: %v)\nexpected: %q\ngot:      %q", tc.all, tc.expected, content)
+		}
+	}
+}
+
+func TestForwardContent(t *testing.T) {
+	testCases := []struct {
+		mode     ForwardMode
+		expected string
+	}{
+		{
+			mode:     FORWARD_ATTACHMENT,
+			expected: "To: \nSubject: Fwd: lunch\n\n",
+		},
+		{
+			mode: FORWARD_INLINE,
+			expected: "To: \nSubject: Fwd: lunch\n\n" +
+				"\n---------- Forwarded message ----------\n" +
+				"From: Alice <alice@example.org>\n" +
+				"Date: Mon, 26 Apr 2021 10:00:00 +0200\n" +
+				"Subject: lunch\n" +
+				"To: me@example.org, Bob <bob@example.org>\n" +
+				"Cc: carol@example.org\n" +
+				"\nare you in?\n> previous\n",
+		},
+	}
+	for _, tc := range testCases {
+		content, err := ForwardContent(strings.NewReader(ORIGINAL_MAIL), "", tc.mode)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if content != tc.expected {
+			t.Errorf("forward content not built correctly (mode: %s)\nexpected: %q\ngot:      %q", tc.mode, tc.expected, content)
+		}
+	}
+}
+
+func TestPrefixSubject(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"hello", "Re: hello"},
+		{"Re: hello", "Re: hello"},
+		{"RE: hello", "RE: hello"},
+	}
+	for _, tc := range testCases {
+		if res := prefixSubject("Re", tc.input); res != tc.expected {
+			t.Errorf("subject not prefixed correctly (expected: %s, got: %s)", tc.expected, res)
+		}
+	}
+}
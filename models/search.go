@@ -0,0 +1,268 @@
+package models
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+
+	ndb "github.com/stregouet/nuntius/database"
+)
+
+const SEARCH_DATE_FORMAT = "2006-01-02"
+
+// columns of full-text index which can be targeted by query prefix
+var searchColumns = map[string]string{
+	"from":    "sender",
+	"to":      "recipients",
+	"subject": "subject",
+	"body":    "body",
+}
+
+// SearchTerm is a text searched in Field (one of `from`, `to`, `subject`,
+// `body`), or anywhere in mail when Field is empty
+type SearchTerm struct {
+	Field string
+	Value string
+}
+
+// SearchQuery is a parsed search, e.g.
+// `from:alice subject:"lunch plans" before:2021-05-01 is:unread "pizza party"`
+type SearchQuery struct {
+	Terms []SearchTerm
+	// full-text match expression of Terms, empty when only filtering
+	Match  string
+	Before time.Time
+	After  time.Time
+	// flags mails must have, or must not have
+	With    []string
+	Without []string
+	// uids by mailbox of mails found by imap server for this query, they
+	// match even if local index does not know their content
+	Hits map[string][]uint32
+}
+
+// splitQuery splits query on spaces, keeping quoted values together. Single
+// quotes are accepted as well since query is itself often given as a double
+// quoted command argument
+func splitQuery(query string) ([]string, error) {
+	tokens := make([]string, 0)
+	cur := new(strings.Builder)
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case r == quote:
+			quote = 0
+		case r == ' ' && quote == 0:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unfinished quoted value in `%s`", query)
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens, nil
+}
+
+// ftsPhrase quotes term so that it is matched as is by full-text engine
+func ftsPhrase(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
+
+// ftsColumnTerms restricts each word of value to column, so that words are
+// matched independently, in any order. Words are lowercased (index is case
+// insensitive anyway) to not be taken as fts5 operators such as AND or NOT
+func ftsColumnTerms(column, value string) []string {
+	words := strings.FieldsFunc(value, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		terms = append(terms, column+":"+strings.ToLower(w))
+	}
+	return terms
+}
+
+func ParseSearchQuery(query string) (*SearchQuery, error) {
+	tokens, err := splitQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	q := &SearchQuery{}
+	match := make([]string, 0)
+	for _, token := range tokens {
+		key, value := "", token
+		if idx := strings.Index(token, ":"); idx > 0 {
+			key, value = token[:idx], token[idx+1:]
+		}
+		if column, ok := searchColumns[key]; ok {
+			if value != "" {
+				q.Terms = append(q.Terms, SearchTerm{Field: key, Value: value})
+				match = append(match, ftsColumnTerms(column, value)...)
+			}
+			continue
+		}
+		switch key {
+		case "before", "after":
+			d, err := time.ParseInLocation(SEARCH_DATE_FORMAT, value, time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("malformed date `%s`, expected format is YYYY-MM-DD", value)
+			}
+			if key == "before" {
+				q.Before = d
+			} else {
+				q.After = d
+			}
+		case "is":
+			switch value {
+			case "unread":
+				q.Without = append(q.Without, imap.SeenFlag)
+			case "read":
+				q.With = append(q.With, imap.SeenFlag)
+			case "flagged":
+				q.With = append(q.With, imap.FlaggedFlag)
+			case "answered":
+				q.With = append(q.With, imap.AnsweredFlag)
+			default:
+				return nil, fmt.Errorf("unknown state `is:%s` (available: unread, read, flagged, answered)", value)
+			}
+		default:
+			// not a known prefix, search token as is
+			q.Terms = append(q.Terms, SearchTerm{Value: token})
+			match = append(match, ftsPhrase(token))
+		}
+	}
+	q.Match = strings.Join(match, " ")
+	return q, nil
+}
+
+// SearchThreads returns threads of account containing at least one mail
+// matching q, sorted by sort (only matching mails in flat mode)
+func SearchThreads(r ndb.Queryer, accname string, q *SearchQuery, sort ThreadSort) ([]*Thread, error) {
+	cond := []string{"1"}
+	args := []interface{}{}
+	if q.Match != "" {
+		cond = append(cond, "m.id IN (SELECT rowid FROM mail_search WHERE mail_search MATCH ?)")
+		args = append(args, q.Match)
+	}
+	if !q.Before.IsZero() {
+		cond = append(cond, "julianday(m.date) < julianday(?)")
+		args = append(args, q.Before.UTC().Format(DATE_SQLITE_FORMAT))
+	}
+	if !q.After.IsZero() {
+		cond = append(cond, "julianday(m.date) >= julianday(?)")
+		args = append(args, q.After.UTC().Format(DATE_SQLITE_FORMAT))
+	}
+	for _, f := range q.With {
+		cond = append(cond, "(',' || m.flags || ',') LIKE ?")
+		args = append(args, "%,"+f+",%")
+	}
+	for _, f := range q.Without {
+		cond = append(cond, "(',' || m.flags || ',') NOT LIKE ?")
+		args = append(args, "%,"+f+",%")
+	}
+	where := "(" + strings.Join(cond, " AND ") + ")"
+	for mailbox, uids := range q.Hits {
+		if len(uids) == 0 {
+			continue
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(uids)), ",")
+		where += " OR (mbox.name = ? AND m.uid IN (" + placeholders + "))"
+		args = append(args, mailbox)
+		for _, uid := range uids {
+			args = append(args, uid)
+		}
+	}
+	args = append(args, accname)
+	return fetchThreads(r, sort, `
+      SELECT
+        m.id
+      FROM
+        mail m
+        JOIN mailbox mbox ON mbox.id = m.mailbox
+        JOIN account a ON a.id = m.account
+      WHERE
+        (`+where+`) AND a.name = ?`, args...)
+}
+
+// addressesText returns names and addresses found in header fields keys, as
+// indexed text
+func addressesText(h *mail.Header, keys ...string) string {
+	words := make([]string, 0)
+	for _, key := range keys {
+		addrs, err := h.AddressList(key)
+		if err != nil {
+			// keep raw value rather than nothing
+			words = append(words, h.Get(key))
+			continue
+		}
+		for _, a := range addrs {
+			if a.Name != "" {
+				words = append(words, a.Name)
+			}
+			words = append(words, a.Address)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// Index adds mail to full-text index unless it is already there, only
+// header is indexed until full content of mail is known
+func (m *Mail) Index(r ndb.Execer) error {
+	var sender, recipients string
+	if m.Header != nil {
+		sender = addressesText(m.Header, "From")
+		recipients = addressesText(m.Header, "To", "Cc")
+	}
+	_, err := r.Exec(`INSERT INTO mail_search (rowid, subject, sender, recipients, body)
+SELECT id, ?, ?, ?, '' FROM mail
+WHERE messageid = ? AND NOT EXISTS (SELECT 1 FROM mail_search s WHERE s.rowid = mail.id)`,
+		m.Subject, sender, recipients, m.MessageId)
+	return err
+}
+
+// IndexContent (re)indexes mail with its full content read from raw
+func IndexContent(r ndb.Execer, mailid int, raw io.Reader) error {
+	msg, err := message.Read(raw)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return err
+	}
+	h := &mail.Header{Header: msg.Header}
+	subject, _ := h.Subject()
+	content := new(strings.Builder)
+	body, err := PlaintextBody(msg)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		if _, err = io.Copy(content, body); err != nil {
+			return err
+		}
+	}
+	if _, err = r.Exec("DELETE FROM mail_search WHERE rowid = ?", mailid); err != nil {
+		return err
+	}
+	_, err = r.Exec(
+		"INSERT INTO mail_search (rowid, subject, sender, recipients, body) VALUES (?, ?, ?, ?, ?)",
+		mailid,
+		subject,
+		addressesText(h, "From"),
+		addressesText(h, "To", "Cc"),
+		content.String(),
+	)
+	return err
+}
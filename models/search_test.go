@@ -0,0 +1,218 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected *SearchQuery
+	}{
+		{
+			"pizza",
+			&SearchQuery{
+				Terms: []SearchTerm{{Value: "pizza"}},
+				Match: `"pizza"`,
+			},
+		},
+		{
+			`from:alice subject:"lunch plans"`,
+			&SearchQuery{
+				Terms: []SearchTerm{{"from", "alice"}, {"subject", "lunch plans"}},
+				Match: `sender:alice subject:lunch subject:plans`,
+			},
+		},
+		{
+			"to:'bob smith' is:unread is:flagged",
+			&SearchQuery{
+				Terms:   []SearchTerm{{"to", "bob smith"}},
+				Match:   `recipients:bob recipients:smith`,
+				With:    []string{"\\Flagged"},
+				Without: []string{"\\Seen"},
+			},
+		},
+		{
+			"before:2021-05-01 after:2021-04-01",
+			&SearchQuery{
+				Before: time.Date(2021, 5, 1, 0, 0, 0, 0, time.Local),
+				After:  time.Date(2021, 4, 1, 0, 0, 0, 0, time.Local),
+			},
+		},
+		{
+			"from:Alice@Example.org",
+			&SearchQuery{
+				Terms: []SearchTerm{{"from", "Alice@Example.org"}},
+				Match: `sender:alice sender:example sender:org`,
+			},
+		},
+		{
+			`'say "hello"'`,
+			&SearchQuery{
+				Terms: []SearchTerm{{Value: `say "hello"`}},
+				Match: `"say ""hello"""`,
+			},
+		},
+		{
+			"http://example.org",
+			&SearchQuery{
+				Terms: []SearchTerm{{Value: "http://example.org"}},
+				Match: `"http://example.org"`,
+			},
+		},
+	}
+	for _, tc := range testCases {
+		q, err := ParseSearchQuery(tc.input)
+		if err != nil {
+			t.Errorf("(input: %s) unexpected error %v", tc.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.expected, q) {
+			t.Errorf("(input: %s) expected %#v, found %#v", tc.input, tc.expected, q)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"is:deleted", "unknown state"},
+		{"before:yesterday", "malformed date"},
+		{`subject:"lunch`, "unfinished quoted value"},
+	}
+	for _, tc := range testCases {
+		_, err := ParseSearchQuery(tc.input)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("(input: %s) expected error containing `%s`, found %v", tc.input, tc.expected, err)
+		}
+	}
+}
+
+func TestSearchThreads(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	insertMail := func(m *Mail, raw string) {
+		err := m.InsertInto(db, FAKE_MBOX, FAKE_ACC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.Index(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw != "" {
+			err = IndexContent(db, m.Id, strings.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	insertMail(&Mail{
+		Uid:       1,
+		Threadid:  1,
+		MessageId: "id1",
+		Subject:   "lunch plans",
+		Date:      time.Date(2021, 4, 15, 12, 0, 0, 0, time.UTC),
+		Flags:     []string{"\\Seen"},
+	}, "From: Alice <alice@example.org>\r\n"+
+		"To: bob@example.org\r\n"+
+		"Subject: lunch plans\r\n"+
+		"\r\n"+
+		"what about pizza?\r\n")
+	insertMail(&Mail{
+		Uid:       2,
+		Threadid:  1,
+		MessageId: "id2",
+		InReplyTo: "id1",
+		Subject:   "Re: lunch plans",
+		Date:      time.Date(2021, 4, 16, 12, 0, 0, 0, time.UTC),
+	}, "")
+	insertMail(&Mail{
+		Uid:       3,
+		Threadid:  2,
+		MessageId: "id3",
+		Subject:   "holidays",
+		Date:      time.Date(2021, 5, 20, 12, 0, 0, 0, time.UTC),
+		Flags:     []string{"\\Seen", "\\Flagged"},
+	}, "From: Carol <carol@example.org>\r\n"+
+		"To: alice@example.org\r\n"+
+		"Subject: holidays\r\n"+
+		"\r\n"+
+		"see you in august\r\n")
+
+	testCases := []struct {
+		input    string
+		expected []int
+	}{
+		{"pizza", []int{1}},
+		{"lunch", []int{1}},
+		{"from:alice", []int{1}},
+		{"to:alice", []int{2}},
+		{"alice", []int{2, 1}},
+		{"is:unread", []int{1}},
+		{"is:flagged", []int{2}},
+		{"is:read from:carol", []int{2}},
+		{"before:2021-05-01", []int{1}},
+		{"after:2021-05-01", []int{2}},
+		{"august from:alice", []int{}},
+		{"from:alice@example.org", []int{1}},
+		{"subject:'plans lunch'", []int{1}},
+	}
+	for _, tc := range testCases {
+		q, err := ParseSearchQuery(tc.input)
+		if err != nil {
+			t.Fatalf("(input: %s) cannot parse query %v", tc.input, err)
+		}
+		threads, err := SearchThreads(db, FAKE_ACC, q, ThreadSort{})
+		if err != nil {
+			t.Fatalf("(input: %s) cannot search %v", tc.input, err)
+		}
+		found := make([]int, 0, len(threads))
+		for _, th := range threads {
+			found = append(found, th.Id)
+		}
+		if !reflect.DeepEqual(tc.expected, found) {
+			t.Errorf("(input: %s) expected threads %v, found %v", tc.input, tc.expected, found)
+		}
+	}
+
+	// thread is listed as a whole even if only one mail matches
+	q, _ := ParseSearchQuery("pizza")
+	threads, err := SearchThreads(db, FAKE_ACC, q, ThreadSort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 1 || threads[0].Count != 2 || threads[0].Subject != "lunch plans" {
+		t.Errorf("expected whole thread, found %#v", threads[0])
+	}
+
+	// mails found by imap server match even if unknown to local index
+	q, _ = ParseSearchQuery("august")
+	q.Hits = map[string][]uint32{FAKE_MBOX: {2}}
+	threads, err = SearchThreads(db, FAKE_ACC, q, ThreadSort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 2 || threads[0].Id != 2 || threads[1].Id != 1 {
+		t.Errorf("expected local and imap matches, found %v", threads)
+	}
+
+	// deleted mails are removed from index
+	if _, err = db.Exec("DELETE FROM mail WHERE messageid = 'id3'"); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err = db.QueryRow("SELECT count(1) FROM mail_search").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 indexed mails after deletion, found %d", count)
+	}
+}
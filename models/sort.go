@@ -0,0 +1,128 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SortKey is what threads of a mailbox are sorted by
+type SortKey string
+
+const (
+	// date of most recent mail of thread
+	SORT_RECENT SortKey = "recent"
+	// date of root of thread
+	SORT_DATE    SortKey = "date"
+	SORT_SUBJECT SortKey = "subject"
+	// sender of root of thread
+	SORT_SENDER SortKey = "sender"
+	// threads with unread mails
+	SORT_UNREAD SortKey = "unread"
+	// count of mails in thread
+	SORT_COUNT SortKey = "count"
+)
+
+var sortKeys = []SortKey{SORT_RECENT, SORT_DATE, SORT_SUBJECT, SORT_SENDER, SORT_UNREAD, SORT_COUNT}
+
+// ParseSortKey returns sort key named name
+func ParseSortKey(name string) (SortKey, error) {
+	for _, k := range sortKeys {
+		if string(k) == strings.ToLower(name) {
+			return k, nil
+		}
+	}
+	names := make([]string, 0, len(sortKeys))
+	for _, k := range sortKeys {
+		names = append(names, string(k))
+	}
+	return "", fmt.Errorf("unknown sort key `%s` (available: %s)", name, strings.Join(names, ", "))
+}
+
+// defaultAsc tells whether k sorts in ascending order unless asked
+// otherwise: alphabetical order for texts, latest, biggest or unread first
+// for others
+func (k SortKey) defaultAsc() bool {
+	return k == SORT_SUBJECT || k == SORT_SENDER
+}
+
+// ThreadSort tells how threads of a mailbox are listed. Zero value lists
+// threads with most recent activity first
+type ThreadSort struct {
+	Key SortKey
+	Asc bool
+	// list mails one by one instead of threads
+	Flat bool
+}
+
+// With returns s changed as asked by sort command arguments, empty ones
+// being left unchanged
+func (s ThreadSort) With(by, order, flat string) (ThreadSort, error) {
+	if by != "" {
+		key, err := ParseSortKey(by)
+		if err != nil {
+			return s, err
+		}
+		s.Key = key
+		s.Asc = key.defaultAsc()
+	}
+	switch strings.ToLower(order) {
+	case "":
+	case "asc":
+		s.Asc = true
+	case "desc":
+		s.Asc = false
+	default:
+		return s, fmt.Errorf("unknown sort order `%s` (available: asc, desc)", order)
+	}
+	switch strings.ToLower(flat) {
+	case "":
+	case "yes", "on", "true":
+		s.Flat = true
+	case "no", "off", "false":
+		s.Flat = false
+	default:
+		return s, fmt.Errorf("invalid flat mode `%s` (expected yes or no)", flat)
+	}
+	return s, nil
+}
+
+func (s ThreadSort) String() string {
+	key := s.Key
+	if key == "" {
+		key = SORT_RECENT
+	}
+	order := "desc"
+	if s.Asc {
+		order = "asc"
+	}
+	result := fmt.Sprintf("%s %s", key, order)
+	if s.Flat {
+		result += ", flat"
+	}
+	return result
+}
+
+// orderBy returns ORDER BY clause sorting rows selected by fetchThreads
+func (s ThreadSort) orderBy() string {
+	var expr string
+	switch s.Key {
+	case SORT_DATE:
+		expr = "date"
+	case SORT_SUBJECT:
+		expr = "basesubject COLLATE NOCASE"
+	case SORT_SENDER:
+		expr = "sender COLLATE NOCASE"
+	case SORT_UNREAD:
+		expr = "seen < count"
+	case SORT_COUNT:
+		expr = "count"
+	default:
+		expr = "mostrecent"
+	}
+	if s.Asc {
+		expr += " ASC"
+	} else {
+		expr += " DESC"
+	}
+	return expr + ", mostrecent DESC"
+}
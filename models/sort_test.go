@@ -0,0 +1,118 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+)
+
+func TestThreadSortWith(t *testing.T) {
+	testCases := []struct {
+		by, order, flat string
+		expected        ThreadSort
+		err             bool
+	}{
+		{"", "", "", ThreadSort{}, false},
+		{"subject", "", "", ThreadSort{Key: SORT_SUBJECT, Asc: true}, false},
+		{"Count", "", "", ThreadSort{Key: SORT_COUNT}, false},
+		{"date", "asc", "", ThreadSort{Key: SORT_DATE, Asc: true}, false},
+		{"", "asc", "yes", ThreadSort{Asc: true, Flat: true}, false},
+		{"sender", "desc", "no", ThreadSort{Key: SORT_SENDER}, false},
+		{"size", "", "", ThreadSort{}, true},
+		{"", "up", "", ThreadSort{}, true},
+		{"", "", "maybe", ThreadSort{}, true},
+	}
+	for _, tc := range testCases {
+		s, err := ThreadSort{}.With(tc.by, tc.order, tc.flat)
+		if tc.err {
+			if err == nil {
+				t.Errorf("(input: %q %q %q) expected error", tc.by, tc.order, tc.flat)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("(input: %q %q %q) unexpected error %v", tc.by, tc.order, tc.flat, err)
+		} else if s != tc.expected {
+			t.Errorf("(input: %q %q %q) expected %#v, found %#v", tc.by, tc.order, tc.flat, tc.expected, s)
+		}
+	}
+}
+
+func TestAllThreadsSort(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	day := func(d int) time.Time {
+		return time.Date(2021, time.July, d, 10, 0, 0, 0, time.UTC)
+	}
+	insert := func(uid uint32, threadid int, subject, from string, date time.Time, seen bool) {
+		h := &mail.Header{}
+		h.SetAddressList("From", []*mail.Address{{Address: from}})
+		m := &Mail{Uid: uid, Threadid: threadid, Subject: subject, Date: date, Header: h, Flags: []string{}}
+		if seen {
+			m.Flags = []string{imap.SeenFlag}
+		}
+		if err := m.InsertInto(db, FAKE_MBOX, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// thread 1: started first by carol, two mails, last one on day 5
+	insert(1, 1, "Budget", "carol@example.com", day(1), true)
+	insert(2, 1, "Re: Budget", "alice@example.com", day(5), true)
+	// thread 2: three mails by bob, one unread, active until day 4
+	insert(3, 2, "agenda", "bob@example.com", day(2), true)
+	insert(4, 2, "Re: agenda", "alice@example.com", day(3), false)
+	insert(5, 2, "Re: agenda", "bob@example.com", day(4), true)
+	// thread 3: single mail by alice, on day 6
+	insert(6, 3, "Coffee", "alice@example.com", day(6), true)
+
+	testCases := []struct {
+		sort     ThreadSort
+		expected []int
+	}{
+		{ThreadSort{}, []int{6, 1, 3}},
+		{ThreadSort{Key: SORT_RECENT, Asc: true}, []int{3, 1, 6}},
+		{ThreadSort{Key: SORT_DATE}, []int{6, 3, 1}},
+		{ThreadSort{Key: SORT_DATE, Asc: true}, []int{1, 3, 6}},
+		{ThreadSort{Key: SORT_SUBJECT, Asc: true}, []int{3, 1, 6}},
+		{ThreadSort{Key: SORT_SENDER, Asc: true}, []int{6, 3, 1}},
+		{ThreadSort{Key: SORT_UNREAD}, []int{3, 6, 1}},
+		{ThreadSort{Key: SORT_COUNT}, []int{3, 1, 6}},
+		{ThreadSort{Key: SORT_DATE, Flat: true}, []int{6, 2, 5, 4, 3, 1}},
+	}
+	for _, tc := range testCases {
+		mbox := Mailbox{Name: FAKE_MBOX, Sort: tc.sort}
+		if err = mbox.UpdateSort(db, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+		saved, err := GetMailbox(db, FAKE_MBOX, FAKE_ACC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := tc.sort.Key
+		if key == "" {
+			key = SORT_RECENT
+		}
+		if saved.Sort.Key != key || saved.Sort.Asc != tc.sort.Asc || saved.Sort.Flat != tc.sort.Flat {
+			t.Errorf("(sort: %s) sort not saved, found %s", tc.sort, saved.Sort)
+		}
+		threads, err := AllThreads(db, FAKE_MBOX, FAKE_ACC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := make([]int, 0, len(threads))
+		for _, th := range threads {
+			found = append(found, th.RootId)
+			if th.Flat != tc.sort.Flat {
+				t.Errorf("(sort: %s) expected flat %v for thread %d", tc.sort, tc.sort.Flat, th.RootId)
+			}
+		}
+		if !reflect.DeepEqual(tc.expected, found) {
+			t.Errorf("(sort: %s) expected roots %v, found %v", tc.sort, tc.expected, found)
+		}
+	}
+}
@@ -22,15 +22,21 @@ type Thread struct {
 	Date      time.Time
 	Count     int
 	SeenCount int
+	// set in flat mode, when thread stands for its mail RootId alone
+	Flat bool
 }
 
 func (t *Thread) StyledContent() []*widgets.ContentWithStyle {
 	s := tcell.StyleDefault.Bold(t.HasUnread())
+	count := fmt.Sprintf(" (%d)", t.Count)
+	if t.Flat {
+		count = ""
+	}
 	return []*widgets.ContentWithStyle{
 		{
-			fmt.Sprintf("%s (%d) %s",
+			fmt.Sprintf("%s%s %s",
 				t.Date.Format("2006-01-02 15:04:05"),
-				t.Count,
+				count,
 				t.Subject),
 			s,
 		},
@@ -48,29 +54,22 @@ func (t *Thread) MarkOneAsRead() {
 	}
 }
 
-func (m *Mail) hasParent(tx *sql.Tx) (int, error) {
-	row := tx.QueryRow("SELECT threadid FROM mail WHERE messageid = ?", m.InReplyTo)
-	var id int
-	err := row.Scan(&id)
-	if err == sql.ErrNoRows {
-		return 0, nil
-	} else if err != nil {
-		return 0, err
-	} else {
-		return id, nil
+func (t *Thread) MarkOneAsUnread() {
+	t.SeenCount--
+	if t.SeenCount < 0 {
+		t.SeenCount = 0
 	}
 }
 
-func (m *Mail) hasChild(tx *sql.Tx) (int, error) {
-	row := tx.QueryRow("SELECT threadid FROM mail WHERE inreplyto = ?", m.MessageId)
-	var id int
-	err := row.Scan(&id)
-	if err == sql.ErrNoRows {
-		return 0, nil
-	} else if err != nil {
-		return 0, err
-	} else {
-		return id, nil
+// UpdateSeen adds to thread seen count the difference between count of seen
+// mails before and after a flags change
+func (t *Thread) UpdateSeen(before, after int) {
+	t.SeenCount += after - before
+	if t.SeenCount < 0 {
+		t.SeenCount = 0
+	}
+	if t.SeenCount > t.Count {
+		t.SeenCount = t.Count
 	}
 }
 
@@ -97,15 +96,19 @@ func (m *Mail) InsertInto(r ndb.Execer, mailbox, accname string) error {
 	if m.MessageId == "" {
 		m.MessageId = fmt.Sprintf("empty-%s-%s-%d", accname, mailbox, m.Uid)
 	}
-	res, err := r.Exec(`INSERT INTO mail (subject, messageid, inreplyto, date, threadid, uid, flags, parts, account, mailbox)
-SELECT ?, ?, ?, ?, ?, ?, ?, ?, account.id, mailbox.id
+	base, _ := BaseSubject(m.Subject)
+	res, err := r.Exec(`INSERT INTO mail (subject, basesubject, sender, messageid, inreplyto, date, threadid, uid, flags, parts, account, mailbox)
+SELECT ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, account.id, mailbox.id
 FROM
   mailbox
   JOIN account on account.id = mailbox.account
 WHERE mailbox.name = ? AND account.name = ?
 ON CONFLICT (uid, mailbox) DO UPDATE SET flags=excluded.flags
-ON CONFLICT (messageid) DO UPDATE SET identical_as=trim(printf('%s|(%s, %s)', mail.identical_as, excluded.uid, excluded.mailbox), '|')`,
+ON CONFLICT (messageid) DO UPDATE SET identical_as=trim(printf('%s|(%s, %s)', mail.identical_as, excluded.uid, excluded.mailbox), '|')
+  WHERE instr('|' || ifnull(mail.identical_as, '') || '|', printf('|(%s, %s)|', excluded.uid, excluded.mailbox)) = 0`,
 		m.Subject,
+		base,
+		m.sender(),
 		m.MessageId,
 		inreplyto,
 		m.Date,
@@ -124,154 +127,288 @@ ON CONFLICT (messageid) DO UPDATE SET identical_as=trim(printf('%s|(%s, %s)', ma
 		return err
 	}
 	m.Id = int(lastid)
-	return err
+	for i, ref := range m.references() {
+		// mail is searched by messageid as lastid is wrong when mail was
+		// already known
+		_, err = r.Exec(`INSERT OR IGNORE INTO mail_reference (mail, position, messageid)
+SELECT id, ?, ? FROM mail WHERE messageid = ?`, i, ref, m.MessageId)
+		if err != nil {
+			return errors.Wrap(err, "while inserting references")
+		}
+	}
+	return nil
 }
 
-func (m *Mail) applyThreadidOnChildren(tx *sql.Tx) error {
-	_, err := tx.Exec(`with recursive empdata(id, messageid) as (
-    select
-      mail.id,
-      messageid
-    from mail
-    where mail.inreplyto = ?
-  UNION ALL
-    select
-      this.id,
-      this.messageid
-    from
-      empdata prior
-      inner join mail this on this.inreplyto = prior.messageid
-	) update mail set threadid = ? from empdata where empdata.id = mail.id`, m.MessageId, m.Threadid)
-	return err
+// UpdateThreadid sets threadid of m following JWZ algorithm
+// (https://www.jwz.org/doc/threading.html): mails are in the same thread
+// when one references the other, or when both reference a same message,
+// even a missing one. Threads that m links together are merged, keeping
+// threadid of its ancestors. When bySubject is true, a mail linked to no
+// thread joins the latest one with the same subject, as long as one of them
+// is a reply. Only mails of account accname are considered
+func (m *Mail) UpdateThreadid(tx *sql.Tx, accname string, bySubject bool) error {
+	threadids, err := m.linkedThreads(tx, accname)
+	if err != nil {
+		return errors.Wrap(err, "while searching linked threads")
+	}
+	if len(threadids) == 0 && bySubject {
+		if threadids, err = m.subjectThread(tx, accname); err != nil {
+			return errors.Wrap(err, "while searching thread by subject")
+		}
+	}
+	if len(threadids) == 0 {
+		row := tx.QueryRow("UPDATE counter SET value = value + 1 WHERE name = 'threadid' RETURNING value")
+		var id int
+		err = row.Scan(&id)
+		if err != nil {
+			return errors.Wrap(err, "while updating `threadid` counter")
+		}
+		m.Threadid = id
+		return nil
+	}
+	m.Threadid = threadids[0]
+	if len(threadids) == 1 {
+		return nil
+	}
+	args := []interface{}{m.Threadid}
+	for _, id := range threadids[1:] {
+		args = append(args, id)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(threadids)-1), ",")
+	if _, err = tx.Exec("UPDATE mail SET threadid = ? WHERE threadid IN ("+placeholders+")", args...); err != nil {
+		return errors.Wrap(err, "while merging threads")
+	}
+	return nil
 }
 
-// suppose to be called on root of thread
-func (m *Mail) UpdateThreadidOnChild(tx *sql.Tx, threadid int) error {
-	_, err := tx.Exec(`with recursive empdata(id, messageid) as (
-    select
-      mail.id,
-      messageid
-    from mail
-    where mail.id = ?
+// linkedThreads returns threads of mails m references, then of mails
+// referencing m or one of its references, among mails of account accname
+func (m *Mail) linkedThreads(tx *sql.Tx, accname string) ([]int, error) {
+	ids := []interface{}{m.MessageId}
+	for _, ref := range m.references() {
+		ids = append(ids, ref)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	args := append([]interface{}{accname}, ids...)
+	args = append(args, accname)
+	args = append(args, ids...)
+	rows, err := tx.Query(`
+SELECT threadid FROM (
+    SELECT threadid, 0 AS rank FROM mail
+    WHERE account = (SELECT id FROM account WHERE name = ?) AND messageid IN (`+placeholders+`)
   UNION ALL
-    select
-      this.id,
-      this.messageid
-    from
-      empdata prior
-      inner join mail this on this.inreplyto = prior.messageid
-	) update mail set threadid = ? from empdata where empdata.id = mail.id`, m.Id, threadid)
-	return err
+    SELECT m.threadid, 1 AS rank
+    FROM
+      mail m
+      JOIN mail_reference r ON r.mail = m.id
+    WHERE m.account = (SELECT id FROM account WHERE name = ?) AND r.messageid IN (`+placeholders+`)
+)
+WHERE threadid IS NOT NULL
+GROUP BY threadid
+ORDER BY MIN(rank), threadid`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]int, 0)
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		result = append(result, id)
+	}
+	return result, rows.Err()
 }
 
-// fetch thread root
-func (m *Mail) FetchRoot(r ndb.Queryer) (*Mail, error) {
-	if strings.TrimSpace(m.MessageId) == "" {
-		// no need to search for hierarchy in case of empty messageid
-		return m, nil
+// subjectThread returns thread of latest mail of account accname with same
+// subject as m, if either of them is a reply
+func (m *Mail) subjectThread(tx *sql.Tx, accname string) ([]int, error) {
+	base, reply := BaseSubject(m.Subject)
+	if base == "" {
+		return nil, nil
 	}
 	var id int
-	// retrieve parents in thread hierarchy, then select oldest parent
-	err := r.QueryRow(`
-WITH RECURSIVE empdata(id, inreplyto, messageid, date) as (
-    SELECT
-      mail.id,
-      mail.inreplyto,
-      messageid,
-	  mail.date
-    FROM mail
-    WHERE mail.id = ?
-  UNION ALL
-    SELECT
-      this.id,
-      this.inreplyto,
-      this.messageid,
-	  this.date
-    FROM
-      empdata prior
-      INNER JOIN mail this ON this.messageid = prior.inreplyto
-)
-SELECT
-  e.id
-FROM
-  (SELECT MIN(date) AS d FROM empdata) r,
-  empdata e
-WHERE e.date = r.d
-	`, m.Id).Scan(&id)
-	return &Mail{Id: id}, err
+	err := tx.QueryRow(`
+SELECT threadid FROM mail
+WHERE account = (SELECT id FROM account WHERE name = ?)
+  AND basesubject = ? AND threadid IS NOT NULL AND (? OR subject != basesubject)
+ORDER BY date DESC
+LIMIT 1`, accname, base, reply).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []int{id}, nil
 }
 
-func (m *Mail) UpdateThreadid(tx *sql.Tx) error {
-	parentThread, err := m.hasParent(tx)
+// ThreadUnthreaded sets threadid of mails which have none, as left by
+// migrations clearing threads to compute them again. Mails are threaded
+// oldest first, as they would have been when received. It is run once by
+// such migrations, through migrations.Rethread
+func ThreadUnthreaded(tx *sql.Tx, bySubject bool) error {
+	if err := fillBaseSubjects(tx); err != nil {
+		return errors.Wrap(err, "while filling base subjects")
+	}
+	rows, err := tx.Query(`
+SELECT m.id, m.messageid, ifnull(m.inreplyto, ''), m.subject, a.name
+FROM
+  mail m
+  JOIN account a ON a.id = m.account
+WHERE m.threadid IS NULL
+ORDER BY m.date, m.id`)
 	if err != nil {
-		return errors.Wrap(err, "while checking parent")
+		return errors.Wrap(err, "while selecting mails without thread")
 	}
-	if parentThread != 0 {
-		// we find a parent with parentThread
-		m.Threadid = parentThread
-		err = m.applyThreadidOnChildren(tx)
-		if err != nil {
-			return errors.Wrap(err, "while updating children threadid")
+	mails := make([]*Mail, 0)
+	accnames := make([]string, 0)
+	for rows.Next() {
+		m := &Mail{}
+		var accname string
+		if err = rows.Scan(&m.Id, &m.MessageId, &m.InReplyTo, &m.Subject, &accname); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "while scanning mail without thread")
 		}
+		mails = append(mails, m)
+		accnames = append(accnames, accname)
 	}
-	childThreadid, err := m.hasChild(tx)
-	if err != nil {
-		return errors.Wrap(err, "while checking child")
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "while selecting mails without thread")
 	}
-	if childThreadid != 0 {
-		// we find child with childThreadid
-		m.Threadid = childThreadid
-		err = m.applyThreadidOnChildren(tx)
-		if err != nil {
-			return errors.Wrap(err, "while updating children threadid")
+	for i, m := range mails {
+		if m.References, err = mailReferences(tx, m.Id); err != nil {
+			return errors.Wrap(err, "while selecting references")
+		}
+		if err = m.UpdateThreadid(tx, accnames[i], bySubject); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("UPDATE mail SET threadid = ? WHERE id = ?", m.Threadid, m.Id); err != nil {
+			return errors.Wrap(err, "while updating threadid")
 		}
 	}
+	return nil
+}
 
-	if m.Threadid == 0 {
-		row := tx.QueryRow("UPDATE counter SET value = value + 1 WHERE name = 'threadid' RETURNING value")
+// fillBaseSubjects sets base subject of mails known before it was kept
+func fillBaseSubjects(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, subject FROM mail WHERE basesubject IS NULL")
+	if err != nil {
+		return err
+	}
+	bases := make(map[int]string)
+	for rows.Next() {
 		var id int
-		err = row.Scan(&id)
-		if err != nil {
-			return errors.Wrap(err, "while updating `threadid` counter")
+		var subject string
+		if err = rows.Scan(&id, &subject); err != nil {
+			rows.Close()
+			return err
+		}
+		bases[id], _ = BaseSubject(subject)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for id, base := range bases {
+		if _, err = tx.Exec("UPDATE mail SET basesubject = ? WHERE id = ?", base, id); err != nil {
+			return err
 		}
-		m.Threadid = id
 	}
-
 	return nil
 }
 
+// mailReferences returns message-ids referenced by mail id, oldest first
+func mailReferences(tx *sql.Tx, id int) ([]string, error) {
+	rows, err := tx.Query("SELECT messageid FROM mail_reference WHERE mail = ? ORDER BY position", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]string, 0)
+	for rows.Next() {
+		var ref string
+		if err = rows.Scan(&ref); err != nil {
+			return nil, err
+		}
+		result = append(result, ref)
+	}
+	return result, rows.Err()
+}
+
+// AllThreads returns threads with a mail in mailbox, or a copy of one,
+// sorted as chosen for mailbox
 func AllThreads(r ndb.Queryer, mailbox, accname string) ([]*Thread, error) {
-	// select all threads in specified account, mailbox with:
-	// - count of messages in this thread
-	// - date of the most recent messages in this thread
-	// - subject of root of this thread (i.e. the oldest message)
-	rows, err := r.Query(`
+	var sort ThreadSort
+	mbox, err := GetMailbox(r, mailbox, accname)
+	if err == nil {
+		sort = mbox.Sort
+	} else if err != sql.ErrNoRows {
+		return nil, errors.Wrap(err, "while fetching mailbox sort")
+	}
+	return fetchThreads(r, sort, `
+      SELECT
+        m.id
+      FROM
+        mail m
+        JOIN mailbox mbox ON mbox.account = m.account
+        JOIN account a ON a.id = m.account
+      WHERE
+        a.name = ? AND mbox.name = ?
+        AND (m.mailbox = mbox.id OR instr(m.identical_as, ', ' || mbox.id || ')') > 0)`, accname, mailbox)
+}
+
+// fetchThreads selects threads of mails whose id is returned by mailids
+// query with:
+// - count of messages in this thread
+// - date of the most recent messages in this thread
+// - subject of root of this thread (i.e. the oldest message)
+// In flat mode, each selected mail is returned as a thread of its own
+func fetchThreads(r ndb.Queryer, sort ThreadSort, mailids string, args ...interface{}) ([]*Thread, error) {
+	query := `
 SELECT id, threadid, subject, mostrecent, seen, count
 FROM (
     SELECT
 	  p.id,
       p.threadid,
       subject,
+      ifnull(basesubject, subject) AS basesubject,
+      ifnull(sender, '') AS sender,
+      p.date,
 	  SUM(flags like '%Seen%') OVER w AS seen,
       MAX(p.date) OVER w AS mostrecent,
       COUNT(1) OVER w as count,
       ROW_NUMBER() OVER (PARTITION BY threadid ORDER BY p.date ASC) AS rn
     FROM mail p
-    WHERE p.threadid in (
-      SELECT
-        m.threadid
-      FROM
-        mail m
-        JOIN mailbox mbox ON mbox.id = m.mailbox
-        JOIN account a ON a.id = m.account AND a.id = mbox.account
-      WHERE
-        a.name = ? AND mbox.name = ?
-    )
+    WHERE p.threadid in (SELECT threadid FROM mail WHERE id IN (` + mailids + `
+    ))
     WINDOW w AS (partition by threadid)
 )
 WHERE rn = 1
-ORDER BY mostrecent DESC
-`, accname, mailbox)
+ORDER BY ` + sort.orderBy()
+	if sort.Flat {
+		query = `
+SELECT id, threadid, subject, mostrecent, seen, count
+FROM (
+    SELECT
+      p.id,
+      p.threadid,
+      subject,
+      ifnull(basesubject, subject) AS basesubject,
+      ifnull(sender, '') AS sender,
+      p.date,
+      flags like '%Seen%' AS seen,
+      -- read as text, as MAX(p.date) is
+      CAST(p.date AS TEXT) AS mostrecent,
+      1 AS count
+    FROM mail p
+    WHERE p.id in (` + mailids + `
+    )
+)
+ORDER BY ` + sort.orderBy()
+	}
+	rows, err := r.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -287,7 +424,7 @@ ORDER BY mostrecent DESC
 		if err != nil {
 			return nil, err
 		}
-		t := &Thread{RootId: rootid, Subject: subject, Date: date.T, Count: count, SeenCount: seen}
+		t := &Thread{RootId: rootid, Subject: subject, Date: date.T, Count: count, SeenCount: seen, Flat: sort.Flat}
 		if threadid.Valid {
 			t.Id = int(threadid.Int32)
 		}
@@ -296,76 +433,37 @@ ORDER BY mostrecent DESC
 	return result, nil
 }
 
-func AllThreadsRoot(r ndb.Queryer, accname string) ([]*Mail, error) {
+// AllThreadMails returns mails in the thread of mail with rootMailId, whatever
+// mailbox of its account they are stored in, sorted in a tree (see
+// threadTree) with depth of each
+func AllThreadMails(r ndb.Queryer, rootMailId int) ([]*Mail, error) {
 	rows, err := r.Query(`
-SELECT m.id
+SELECT m.id, m.messageid, m.subject, m.date, m.uid, m.parts, m.flags, mbox.name, ifnull(m.identical_as, '')
 FROM
   mail m
-  JOIN account a on m.account = a.id
+  JOIN mailbox mbox ON mbox.id = m.mailbox
 WHERE
-  a.name = ? AND
-  NOT EXISTS (SELECT 1 FROM mail p WHERE m.inreplyto = p.messageid)`, accname)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	roots := make([]*Mail, 0)
-	for rows.Next() {
-		var id int
-		err = rows.Scan(&id)
-		if err != nil {
-			return nil, err
-		}
-		roots = append(roots, &Mail{Id: id})
-	}
-	return roots, nil
-}
-
-// given the id of a mail this function returns all of its children in its thread
-// with specific depth for each
-func AllThreadMails(r ndb.Queryer, rootMailId int) ([]*Mail, error) {
-	rows, err := r.Query(`
-WITH RECURSIVE tmp(id, messageid, subject, date, uid, parts, flags, depth) as (
-    SELECT
-      mail.id,
-      messageid,
-	  subject,
-	  date,
-	  uid,
-	  parts,
-	  flags,
-	  0 as depth
-    FROM mail
-    WHERE mail.id = ?
-  UNION ALL
-    SELECT
-      this.id,
-      this.messageid,
-	  this.subject,
-	  this.date,
-	  this.uid,
-	  this.parts,
-	  this.flags,
-	  prior.depth + 1 as depth
-    FROM
-      tmp prior
-      INNER JOIN mail this ON this.inreplyto = prior.messageid
-	ORDER BY this.date
-) select id, subject, date, uid, parts, flags, depth from tmp`, rootMailId)
+  m.id = ? OR (
+    m.threadid = (SELECT threadid FROM mail WHERE id = ?)
+    AND m.account = (SELECT account FROM mail WHERE id = ?))`, rootMailId, rootMailId, rootMailId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	roots := make([]*Mail, 0)
+	mails := make([]*Mail, 0)
+	byId := make(map[int]*Mail)
+	copies := make(map[*Mail][]identicalCopy)
 	for rows.Next() {
 		var id int
+		var messageid string
 		var subject string
 		var date time.Time
 		var uid uint32
-		var depth int
 		var rawparts []byte
 		var flags string
-		err = rows.Scan(&id, &subject, &date, &uid, &rawparts, &flags, &depth)
+		var mailbox string
+		var identicalAs string
+		err = rows.Scan(&id, &messageid, &subject, &date, &uid, &rawparts, &flags, &mailbox, &identicalAs)
 		if err != nil {
 			return nil, err
 		}
@@ -374,13 +472,79 @@ WITH RECURSIVE tmp(id, messageid, subject, date, uid, parts, flags, depth) as (
 		if err != nil {
 			return nil, err
 		}
-		m := &Mail{Id: id, Subject: subject, depth: depth, Date: date, Uid: uid, Parts: parts}
+		m := &Mail{Id: id, MessageId: messageid, Subject: subject, Date: date, Uid: uid, Parts: parts, Mailbox: mailbox}
 		if flags != "" {
 			// split only if flags is not empty
 			// if flags is empty we want an empty []string
 			m.Flags = strings.Split(flags, ",")
 		}
-		roots = append(roots, m)
+		if identicalAs != "" {
+			copies[m] = parseIdenticalAs(identicalAs)
+		}
+		mails = append(mails, m)
+		byId[id] = m
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(copies) > 0 {
+		if err = setCopies(r, copies); err != nil {
+			return nil, errors.Wrap(err, "while fetching copies")
+		}
+	}
+	refs, err := r.Query(`
+SELECT r.mail, r.messageid
+FROM
+  mail_reference r
+  JOIN mail m ON m.id = r.mail
+WHERE
+  m.id = ? OR m.threadid = (SELECT threadid FROM mail WHERE id = ?)
+ORDER BY r.mail, r.position`, rootMailId, rootMailId)
+	if err != nil {
+		return nil, err
+	}
+	defer refs.Close()
+	for refs.Next() {
+		var id int
+		var ref string
+		if err = refs.Scan(&id, &ref); err != nil {
+			return nil, err
+		}
+		if m, ok := byId[id]; ok {
+			m.References = append(m.References, ref)
+		}
 	}
-	return roots, nil
+	if err = refs.Err(); err != nil {
+		return nil, err
+	}
+	return SortThread(mails), nil
+}
+
+// setCopies fills Copies of mails, naming mailboxes they are stored in
+func setCopies(r ndb.Queryer, copies map[*Mail][]identicalCopy) error {
+	rows, err := r.Query("SELECT id, name FROM mailbox")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	names := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var name string
+		if err = rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		names[id] = name
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for m, cs := range copies {
+		for _, c := range cs {
+			if name, ok := names[c.mailbox]; ok {
+				m.Copies = append(m.Copies, MailCopy{Uid: c.uid, Mailbox: name})
+			}
+		}
+	}
+	return nil
 }
@@ -2,15 +2,17 @@ package models
 
 import (
 	"database/sql"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/stregouet/nuntius/database"
-	_ "github.com/stregouet/nuntius/database/migrations"
+	"github.com/stregouet/nuntius/database/migrations"
 )
 
 const (
@@ -41,6 +43,9 @@ func setupdb(t *testing.T) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	migrations.Rethread = func(tx *sql.Tx) error {
+		return ThreadUnthreaded(tx, false)
+	}
 	err = database.Migrate(tx)
 	if err != nil {
 		return nil, err
@@ -101,7 +106,7 @@ func TestThreadidAttribution(t *testing.T) {
 	}
 	insertMail := func(m *Mail) *Mail {
 		m.Uid = nextuid()
-		err = m.UpdateThreadid(tx)
+		err = m.UpdateThreadid(tx, FAKE_ACC, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -116,8 +121,9 @@ func TestThreadidAttribution(t *testing.T) {
 		t.Errorf("unexpected threadid for mail 5")
 	}
 
+	// id4 is missing but, as parent of both, links id5 and id6
 	m6 := insertMail(&Mail{MessageId: "id6", InReplyTo: "id4"})
-	if m6.Threadid != 2 {
+	if m6.Threadid != 1 {
 		t.Errorf("unexpected threadid for mail 6")
 	}
 
@@ -174,7 +180,7 @@ func TestThreadidAttributionOrder1(t *testing.T) {
 	}
 	insertMail := func(m *Mail) *Mail {
 		m.Uid = nextuid()
-		err = m.UpdateThreadid(tx)
+		err = m.UpdateThreadid(tx, FAKE_ACC, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -193,17 +199,18 @@ func TestThreadidAttributionOrder1(t *testing.T) {
 	if err != nil {
 		t.Fatalf("error fetching mails %v", err)
 	}
+	// id5 and id6 are siblings, id1 is not linked to them yet
 	expected := map[int]map[string]interface{}{
 		1: map[string]interface{}{
 			"threadid":  1,
 			"messageid": "id5",
 		},
 		2: map[string]interface{}{
-			"threadid":  2,
+			"threadid":  1,
 			"messageid": "id6",
 		},
 		3: map[string]interface{}{
-			"threadid":  3,
+			"threadid":  2,
 			"messageid": "id1",
 		},
 	}
@@ -219,19 +226,19 @@ func TestThreadidAttributionOrder1(t *testing.T) {
 	// we expect to choose threadid from parent of id4 (i.e. threadid of id1)
 	expected = map[int]map[string]interface{}{
 		1: map[string]interface{}{
-			"threadid":  3,
+			"threadid":  2,
 			"messageid": "id5",
 		},
 		2: map[string]interface{}{
-			"threadid":  3,
+			"threadid":  2,
 			"messageid": "id6",
 		},
 		3: map[string]interface{}{
-			"threadid":  3,
+			"threadid":  2,
 			"messageid": "id1",
 		},
 		4: map[string]interface{}{
-			"threadid":  3,
+			"threadid":  2,
 			"messageid": "id4",
 		},
 	}
@@ -256,7 +263,7 @@ func TestThreadidAttributionOrder2(t *testing.T) {
 	}
 	insertMail := func(m *Mail) *Mail {
 		m.Uid = nextuid()
-		err = m.UpdateThreadid(tx)
+		err = m.UpdateThreadid(tx, FAKE_ACC, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -337,3 +344,332 @@ func TestThreadidAttributionOrder2(t *testing.T) {
 		t.Errorf("unexpected database content %v", mails)
 	}
 }
+
+// insertThreaded threads then inserts mails, uids following their order
+func insertThreaded(t *testing.T, tx *sql.Tx, bySubject bool, mails ...*Mail) {
+	for _, m := range mails {
+		m.Uid = uint32(m.Date.Unix())
+		if err := m.UpdateThreadid(tx, FAKE_ACC, bySubject); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.InsertInto(tx, FAKE_MBOX, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func at(minute int) time.Time {
+	return time.Date(2021, time.July, 5, 10, minute, 0, 0, time.UTC)
+}
+
+func TestThreadidReferences(t *testing.T) {
+	testCases := []struct {
+		name  string
+		mails []*Mail
+		// expected thread of each mail, as index of first mail of thread
+		expected []int
+	}{
+		{
+			name: "missing intermediate message",
+			mails: []*Mail{
+				{MessageId: "<a>", Date: at(1)},
+				{MessageId: "<c>", References: []string{"<a>", "<b>"}, InReplyTo: "<b>", Date: at(3)},
+			},
+			expected: []int{0, 0},
+		},
+		{
+			name: "references without in-reply-to",
+			mails: []*Mail{
+				{MessageId: "<a>", Date: at(1)},
+				{MessageId: "<b>", References: []string{"<a>"}, Date: at(2)},
+				{MessageId: "<c>", References: []string{"<a>", "<b>"}, Date: at(3)},
+			},
+			expected: []int{0, 0, 0},
+		},
+		{
+			name: "siblings of a missing root",
+			mails: []*Mail{
+				{MessageId: "<b>", References: []string{"<a>"}, Date: at(2)},
+				{MessageId: "<c>", References: []string{"<a>"}, Date: at(3)},
+				{MessageId: "<d>", Date: at(4)},
+			},
+			expected: []int{0, 0, 2},
+		},
+		{
+			name: "reply received before its parent",
+			mails: []*Mail{
+				{MessageId: "<c>", References: []string{"<a>", "<b>"}, Date: at(3)},
+				{MessageId: "<x>", Date: at(4)},
+				{MessageId: "<a>", Date: at(1)},
+				{MessageId: "<b>", InReplyTo: "<a>", Date: at(2)},
+			},
+			expected: []int{0, 1, 0, 0},
+		},
+		{
+			name: "reference loop",
+			mails: []*Mail{
+				{MessageId: "<a>", References: []string{"<b>"}, Date: at(1)},
+				{MessageId: "<b>", References: []string{"<a>"}, Date: at(2)},
+				{MessageId: "<c>", References: []string{"<c>"}, Date: at(3)},
+			},
+			expected: []int{0, 0, 2},
+		},
+		{
+			name: "in-reply-to disagreeing with references",
+			mails: []*Mail{
+				{MessageId: "<a>", Date: at(1)},
+				{MessageId: "<x>", Date: at(2)},
+				{MessageId: "<b>", References: []string{"<a>"}, InReplyTo: "<x>", Date: at(3)},
+			},
+			expected: []int{0, 0, 0},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := setupdb(t)
+			if err != nil {
+				t.Fatalf("cannot setup database %v", err)
+			}
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatalf("cannot begin transaction %v", err)
+			}
+			defer tx.Rollback()
+			insertThreaded(t, tx, false, tc.mails...)
+			// threadids change when threads are merged, read them back
+			threads := make(map[string]int)
+			rows, err := tx.Query("SELECT messageid, threadid FROM mail")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id string
+				var threadid int
+				if err = rows.Scan(&id, &threadid); err != nil {
+					t.Fatal(err)
+				}
+				threads[id] = threadid
+			}
+			for i, m := range tc.mails {
+				same := threads[m.MessageId] == threads[tc.mails[tc.expected[i]].MessageId]
+				for j := range tc.mails {
+					if tc.expected[j] != tc.expected[i] && threads[tc.mails[j].MessageId] == threads[m.MessageId] {
+						same = false
+					}
+				}
+				if !same {
+					t.Errorf("unexpected threads %v", threads)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestThreadidBySubject(t *testing.T) {
+	testCases := []struct {
+		bySubject bool
+		subject   string
+		joins     bool
+	}{
+		{true, "Re: meeting", true},
+		{true, "RE[2]: Fwd: meeting", true},
+		{true, "meeting", false},
+		{true, "Re: lunch", false},
+		{false, "Re: meeting", false},
+	}
+	for _, tc := range testCases {
+		db, err := setupdb(t)
+		if err != nil {
+			t.Fatalf("cannot setup database %v", err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("cannot begin transaction %v", err)
+		}
+		first := &Mail{MessageId: "<a>", Subject: "meeting", Date: at(1)}
+		other := &Mail{MessageId: "<b>", Subject: tc.subject, Date: at(2)}
+		insertThreaded(t, tx, tc.bySubject, first, other)
+		if joins := first.Threadid == other.Threadid; joins != tc.joins {
+			t.Errorf("(subject: %q, by subject: %v) expected joining thread %v", tc.subject, tc.bySubject, tc.joins)
+		}
+		tx.Rollback()
+	}
+}
+
+func TestThreadidAccounts(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("cannot begin transaction %v", err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.Exec("INSERT INTO account (name) VALUES ('other')"); err != nil {
+		t.Fatal(err)
+	}
+	mbox := Mailbox{Name: FAKE_MBOX}
+	if err = mbox.InsertInto(tx, "other"); err != nil {
+		t.Fatal(err)
+	}
+	first := &Mail{Uid: 1, MessageId: "<a>", Subject: "meeting", Date: at(1)}
+	if err = first.UpdateThreadid(tx, FAKE_ACC, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = first.InsertInto(tx, FAKE_MBOX, FAKE_ACC); err != nil {
+		t.Fatal(err)
+	}
+	// neither reference nor subject links mails of different accounts
+	other := &Mail{Uid: 1, MessageId: "<b>", InReplyTo: "<a>", Subject: "Re: meeting", Date: at(2)}
+	if err = other.UpdateThreadid(tx, "other", true); err != nil {
+		t.Fatal(err)
+	}
+	if first.Threadid == other.Threadid {
+		t.Errorf("expected mails of other account in another thread")
+	}
+}
+
+func TestThreadUnthreaded(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("cannot begin transaction %v", err)
+	}
+	defer tx.Rollback()
+	mails := []*Mail{
+		{MessageId: "<c>", References: []string{"<a>", "<b>"}, Subject: "Re: hello", Date: at(3)},
+		{MessageId: "<a>", Subject: "hello", Date: at(1)},
+		{MessageId: "<l>", Subject: "lunch", Date: at(2)},
+		{MessageId: "<m>", Subject: "Re: lunch", Date: at(4)},
+		{MessageId: "<o>", Subject: "other", Date: at(5)},
+	}
+	for i, m := range mails {
+		m.Uid = uint32(i + 1)
+		if err = m.InsertInto(tx, FAKE_MBOX, FAKE_ACC); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// base subjects of mails known before they were kept
+	if _, err = tx.Exec("UPDATE mail SET basesubject = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ThreadUnthreaded(tx, true); err != nil {
+		t.Fatal(err)
+	}
+	threads := make(map[string]int)
+	rows, err := tx.Query("SELECT messageid, threadid FROM mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var threadid sql.NullInt32
+		if err = rows.Scan(&id, &threadid); err != nil {
+			t.Fatal(err)
+		}
+		if !threadid.Valid {
+			t.Fatalf("mail %s left without thread", id)
+		}
+		threads[id] = int(threadid.Int32)
+	}
+	if threads["<a>"] != threads["<c>"] || threads["<l>"] != threads["<m>"] ||
+		threads["<a>"] == threads["<l>"] || threads["<o>"] == threads["<a>"] || threads["<o>"] == threads["<l>"] {
+		t.Errorf("unexpected threads %v", threads)
+	}
+}
+
+func TestBaseSubject(t *testing.T) {
+	testCases := []struct {
+		subject string
+		base    string
+		prefix  bool
+	}{
+		{"hello", "hello", false},
+		{"Re: hello", "hello", true},
+		{"re:hello", "hello", true},
+		{"RE: Fwd: hello", "hello", true},
+		{"Re[3]: hello", "hello", true},
+		{"AW: hello", "hello", true},
+		{"Fw: Re: ", "", true},
+		{"Reply: hello", "Reply: hello", false},
+	}
+	for _, tc := range testCases {
+		base, prefix := BaseSubject(tc.subject)
+		if base != tc.base || prefix != tc.prefix {
+			t.Errorf("(input: %q) expected %q %v, found %q %v", tc.subject, tc.base, tc.prefix, base, prefix)
+		}
+	}
+}
+
+func TestAllThreadMails(t *testing.T) {
+	db, err := setupdb(t)
+	if err != nil {
+		t.Fatalf("cannot setup database %v", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("cannot begin transaction %v", err)
+	}
+	defer tx.Rollback()
+	// a
+	// ├─ c (b is missing)
+	// │  └─ e
+	// └─ d
+	// f, g (siblings under missing x)
+	mails := []*Mail{
+		{MessageId: "<e>", References: []string{"<a>", "<b>", "<c>"}, Date: at(5)},
+		{MessageId: "<d>", InReplyTo: "<a>", Date: at(4)},
+		{MessageId: "<a>", Date: at(1)},
+		{MessageId: "<c>", References: []string{"<a>", "<b>"}, Date: at(3)},
+		{MessageId: "<g>", References: []string{"<x>"}, Date: at(7)},
+		{MessageId: "<f>", References: []string{"<x>"}, Date: at(6)},
+	}
+	insertThreaded(t, tx, false, mails...)
+	testCases := []struct {
+		root     *Mail
+		expected []string
+	}{
+		{mails[2], []string{"<a>:0", "<c>:1", "<e>:2", "<d>:1"}},
+		{mails[4], []string{"<f>:0", "<g>:0"}},
+	}
+	for _, tc := range testCases {
+		found, err := AllThreadMails(tx, tc.root.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree := make([]string, 0, len(found))
+		for _, m := range found {
+			tree = append(tree, fmt.Sprintf("%s:%d", m.MessageId, m.Depth()))
+		}
+		if !reflect.DeepEqual(tc.expected, tree) {
+			t.Errorf("expected tree %v, found %v", tc.expected, tree)
+		}
+	}
+}
+
+func TestThreadUpdateSeen(t *testing.T) {
+	testCases := []struct {
+		seen, before, after int
+		expected            int
+	}{
+		{1, 1, 3, 3},
+		{3, 3, 0, 0},
+		{2, 0, 1, 3},
+		{4, 4, 6, 4},
+		{0, 1, 0, 0},
+	}
+	for _, tc := range testCases {
+		th := &Thread{Count: 4, SeenCount: tc.seen}
+		th.UpdateSeen(tc.before, tc.after)
+		if th.SeenCount != tc.expected {
+			t.Errorf("(input: %d %d->%d) expected %d, found %d", tc.seen, tc.before, tc.after, tc.expected, th.SeenCount)
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package statesmachines
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/stregouet/nuntius/lib"
 )
@@ -17,11 +21,62 @@ const (
 	TR_COMPOSE_WRITE   lib.TransitionType = "COMPOSE_WRITE"
 	TR_COMPOSE_SET_ERR lib.TransitionType = "COMPOSE_SET_ERR"
 	TR_COMPOSE_SEND    lib.TransitionType = "COMPOSE_SEND"
+	// save mail in drafts mailbox to finish it later
+	TR_COMPOSE_POSTPONE lib.TransitionType = "COMPOSE_POSTPONE"
+	// `attach path:<file>`
+	TR_ATTACH lib.TransitionType = "ATTACH"
+	// `detach index:<n>` (starting at 1), removes last attachment without
+	// index
+	TR_DETACH lib.TransitionType = "DETACH"
 )
 
 type ComposeMachineCtx struct {
 	MailFile *os.File
 	Body     string
+	// path of files to attach
+	Attachments []string
+	// why last attach or detach command failed
+	AttachErr error
+}
+
+// attachmentPath returns absolute path of file to attach, expanding `~`
+func attachmentPath(ev *lib.Event) (string, error) {
+	args, ok := ev.Payload.(lib.CmdArgs)
+	if !ok || args["path"] == "" {
+		return "", errors.New("missing file path (attach path:<file>)")
+	}
+	path, err := lib.ExpandHome(args["path"])
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("`%s` is not a regular file", path)
+	}
+	return path, nil
+}
+
+// detachIndex returns index in attachments list of attachment to remove
+func detachIndex(ev *lib.Event, count int) (int, error) {
+	if count == 0 {
+		return 0, errors.New("no attachment")
+	}
+	args, ok := ev.Payload.(lib.CmdArgs)
+	if !ok || args["index"] == "" {
+		return count - 1, nil
+	}
+	idx, err := strconv.Atoi(args["index"])
+	if err != nil || idx < 1 || idx > count {
+		return 0, fmt.Errorf("invalid attachment index `%s`", args["index"])
+	}
+	return idx - 1, nil
 }
 
 func NewComposeMachine(mailfile *os.File) *lib.Machine {
@@ -45,7 +100,7 @@ func NewComposeMachine(mailfile *os.File) *lib.Machine {
 	}
 
 	return lib.NewMachine(
-		&ComposeMachineCtx{mailfile, ""},
+		&ComposeMachineCtx{MailFile: mailfile},
 		STATE_COMPOSE_WRITE_MAIL,
 		lib.States{
 			STATE_COMPOSE_WRITE_MAIL: &lib.State{
@@ -90,6 +145,35 @@ func NewComposeMachine(mailfile *os.File) *lib.Machine {
 					TR_COMPOSE_SEND: &lib.Transition{
 						Target: STATE_COMPOSE_REVIEW_MAIL,
 					},
+					TR_COMPOSE_POSTPONE: &lib.Transition{
+						Target: STATE_COMPOSE_REVIEW_MAIL,
+					},
+					TR_ATTACH: &lib.Transition{
+						Target: STATE_COMPOSE_REVIEW_MAIL,
+						Action: func(c interface{}, ev *lib.Event) {
+							state := c.(*ComposeMachineCtx)
+							path, err := attachmentPath(ev)
+							state.AttachErr = err
+							if err == nil {
+								state.Attachments = append(state.Attachments, path)
+							}
+						},
+					},
+					TR_DETACH: &lib.Transition{
+						Target: STATE_COMPOSE_REVIEW_MAIL,
+						Action: func(c interface{}, ev *lib.Event) {
+							state := c.(*ComposeMachineCtx)
+							idx, err := detachIndex(ev, len(state.Attachments))
+							state.AttachErr = err
+							if err == nil {
+								// do not modify slice possibly shared with
+								// a previous send request
+								attachments := make([]string, 0, len(state.Attachments)-1)
+								attachments = append(attachments, state.Attachments[:idx]...)
+								state.Attachments = append(attachments, state.Attachments[idx+1:]...)
+							}
+						},
+					},
 				},
 			},
 		},
@@ -0,0 +1,87 @@
+package statesmachines
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stregouet/nuntius/lib"
+)
+
+func TestAttachDetach(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nuntius-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	first := filepath.Join(dir, "first.txt")
+	second := filepath.Join(dir, "second.txt")
+	for _, f := range []string{first, second} {
+		if err := ioutil.WriteFile(f, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewComposeMachine(nil)
+	m.Send(&lib.Event{Transition: TR_COMPOSE_REVIEW})
+	state := m.Context.(*ComposeMachineCtx)
+
+	testCases := []struct {
+		input    lib.Event
+		expected []string
+		err      bool
+	}{
+		{
+			input:    lib.Event{Transition: TR_ATTACH, Payload: lib.CmdArgs{"path": first}},
+			expected: []string{first},
+		},
+		{
+			input:    lib.Event{Transition: TR_ATTACH, Payload: lib.CmdArgs{"path": filepath.Join(dir, "unknown")}},
+			expected: []string{first},
+			err:      true,
+		},
+		{
+			input:    lib.Event{Transition: TR_ATTACH, Payload: lib.CmdArgs{"path": dir}},
+			expected: []string{first},
+			err:      true,
+		},
+		{
+			input:    lib.Event{Transition: TR_ATTACH, Payload: lib.CmdArgs{"path": second}},
+			expected: []string{first, second},
+		},
+		{
+			input:    lib.Event{Transition: TR_DETACH, Payload: lib.CmdArgs{"index": "3"}},
+			expected: []string{first, second},
+			err:      true,
+		},
+		{
+			input:    lib.Event{Transition: TR_DETACH, Payload: lib.CmdArgs{"index": "1"}},
+			expected: []string{second},
+		},
+		{
+			input:    lib.Event{Transition: TR_DETACH, Payload: lib.CmdArgs{}},
+			expected: []string{},
+		},
+		{
+			input:    lib.Event{Transition: TR_DETACH, Payload: lib.CmdArgs{}},
+			expected: []string{},
+			err:      true,
+		},
+	}
+	for _, tc := range testCases {
+		ev := tc.input
+		if !m.Send(&ev) {
+			t.Fatalf("transition %s not available", ev.Transition)
+		}
+		if (state.AttachErr != nil) != tc.err {
+			t.Errorf("(input: %#v) unexpected error value %v", tc.input, state.AttachErr)
+		}
+		if len(state.Attachments) != len(tc.expected) || (len(tc.expected) > 0 && !reflect.DeepEqual(state.Attachments, tc.expected)) {
+			t.Errorf("(input: %#v) expected %v, found %v", tc.input, tc.expected, state.Attachments)
+		}
+	}
+}
@@ -15,6 +15,12 @@ const (
 	TR_SHOW_MAIL_PARTS    lib.TransitionType = "SHOW_MAIL_PARTS"
 	TR_SHOW_MAIL_PART     lib.TransitionType = "SHOW_MAIL_PART"
 	TR_SET_MAIL           lib.TransitionType = "TR_SET_MAIL"
+	TR_RESUME_DRAFT       lib.TransitionType = "RESUME_DRAFT"
+	// also available from thread view
+	TR_REPLY     lib.TransitionType = "REPLY"
+	TR_REPLY_ALL lib.TransitionType = "REPLY_ALL"
+	// `forward as:attachment` forwards mail as attachment instead of inline
+	TR_FORWARD lib.TransitionType = "FORWARD"
 	// TR_DOWN_MAIL      lib.TransitionType = "DOWN_MAIL"
 	// TR_SET_MAILS      lib.TransitionType = "SET_MAILS"
 )
@@ -78,6 +84,45 @@ func NewMailMachine() *lib.Machine {
 					TR_SHOW_MAIL_PARTS: &lib.Transition{
 						Target: STATE_SHOW_MAIL_PARTS,
 					},
+					TR_RESUME_DRAFT: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_REPLY: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_REPLY_ALL: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_FORWARD: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_MOVE: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_COPY: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_DELETE: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_ARCHIVE: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_SET_FLAG: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_UNSET_FLAG: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_TOGGLE_READ: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_TOGGLE_FLAGGED: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
+					TR_EXPORT: &lib.Transition{
+						Target: STATE_SHOW_MAIL,
+					},
 				},
 			},
 		},
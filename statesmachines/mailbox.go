@@ -15,6 +15,32 @@ const (
 	TR_UP_THREAD     lib.TransitionType = "UP_THREAD"
 	TR_DOWN_THREAD   lib.TransitionType = "DOWN_THREAD"
 	TR_SELECT_THREAD lib.TransitionType = "SELECT_THREAD"
+	// also available from thread and mail views, `move mailbox:<name>` and
+	// `copy mailbox:<name>`
+	TR_MOVE lib.TransitionType = "MOVE"
+	TR_COPY lib.TransitionType = "COPY"
+	// also available from thread and mail views, moves mails to trash,
+	// `delete [permanently:yes]` expunges them when there is no trash
+	TR_DELETE  lib.TransitionType = "DELETE"
+	TR_ARCHIVE lib.TransitionType = "ARCHIVE"
+	// also available from thread and mail views, `set-flag flag:<name>` and
+	// `unset-flag flag:<name>`
+	TR_SET_FLAG       lib.TransitionType = "SET_FLAG"
+	TR_UNSET_FLAG     lib.TransitionType = "UNSET_FLAG"
+	TR_TOGGLE_READ    lib.TransitionType = "TOGGLE_READ"
+	TR_TOGGLE_FLAGGED lib.TransitionType = "TOGGLE_FLAGGED"
+	// also available from thread and mail views, `export path:<file or
+	// directory> [format:mbox|eml] [overwrite:yes]`
+	TR_EXPORT lib.TransitionType = "EXPORT"
+	// whole mailbox, `export-mailbox path:<file or directory>
+	// [format:mbox|eml] [overwrite:yes]`
+	TR_EXPORT_MAILBOX lib.TransitionType = "EXPORT_MAILBOX"
+	// appends mails of an mbox file or a maildir to this mailbox (or another
+	// one), `import path:<archive> [mailbox:<name>]`
+	TR_IMPORT lib.TransitionType = "IMPORT"
+	// changes how threads are listed, saved for this mailbox,
+	// `sort [by:<key>] [order:asc|desc] [flat:yes|no]`
+	TR_SORT lib.TransitionType = "SORT"
 )
 
 type MailboxMachineCtx struct {
@@ -42,7 +68,13 @@ func NewMailboxMachine() *lib.Machine {
 			state := c.(*MailboxMachineCtx)
 			threads := ev.Payload.([]*models.Thread)
 			state.Threads = threads
-			state.Selected = 1
+			// keep selection when threads are updated
+			if state.Selected > len(threads) {
+				state.Selected = len(threads)
+			}
+			if state.Selected < 1 {
+				state.Selected = 1
+			}
 		},
 	}
 
@@ -58,6 +90,42 @@ func NewMailboxMachine() *lib.Machine {
 					TR_SELECT_THREAD: &lib.Transition{
 						Target: STATE_SHOW_MBOX,
 					},
+					TR_MOVE: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_COPY: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_DELETE: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_ARCHIVE: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_SET_FLAG: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_UNSET_FLAG: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_TOGGLE_READ: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_TOGGLE_FLAGGED: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_EXPORT: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_EXPORT_MAILBOX: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_IMPORT: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
+					TR_SORT: &lib.Transition{
+						Target: STATE_SHOW_MBOX,
+					},
 					TR_UP_THREAD: &lib.Transition{
 						Target: STATE_SHOW_MBOX,
 						Action: func(c interface{}, ev *lib.Event) {
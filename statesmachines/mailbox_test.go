@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
 )
 
 func TestParseNbLine(t *testing.T) {
@@ -37,3 +38,34 @@ func TestParseNbLine(t *testing.T) {
 	}
 
 }
+
+func TestSetThreadsKeepsSelection(t *testing.T) {
+	threads := func(n int) []*models.Thread {
+		res := make([]*models.Thread, n)
+		for i := range res {
+			res[i] = &models.Thread{Id: i + 1}
+		}
+		return res
+	}
+	m := NewMailboxMachine()
+	state := m.Context.(*MailboxMachineCtx)
+	m.Send(&lib.Event{Transition: TR_SET_THREADS, Payload: threads(5)})
+	m.Send(&lib.Event{Transition: TR_DOWN_THREAD, Payload: lib.CmdArgs{"line": "3"}})
+	if state.Selected != 4 {
+		t.Fatalf("expected selected 4, found %d", state.Selected)
+	}
+	testCases := []struct {
+		count    int
+		expected int
+	}{
+		{5, 4},
+		{3, 3},
+		{0, 1},
+	}
+	for _, tc := range testCases {
+		m.Send(&lib.Event{Transition: TR_SET_THREADS, Payload: threads(tc.count)})
+		if state.Selected != tc.expected {
+			t.Errorf("(input: %d threads) expected selected %d, found %d", tc.count, tc.expected, state.Selected)
+		}
+	}
+}
@@ -11,6 +11,9 @@ const (
 	TR_MAIL_PARTS_DOWN   lib.TransitionType = "MAIL_PARTS_DOWN"
 	TR_SET_SELECTED_PART lib.TransitionType = "SET_SELECTED_PART"
 	TR_SELECT_PART       lib.TransitionType = "SELECT_PART"
+	// `save-part path:<file or directory>`, path defaults to download dir
+	TR_SAVE_PART lib.TransitionType = "SAVE_PART"
+	TR_OPEN_PART lib.TransitionType = "OPEN_PART"
 )
 
 type MailPartsMachineCtx struct {
@@ -38,6 +41,12 @@ func NewMailPartsMachine(parts []*models.BodyPart) *lib.Machine {
 					TR_SELECT_PART: &lib.Transition{
 						Target: STATE_MAIL_PARTS,
 					},
+					TR_SAVE_PART: &lib.Transition{
+						Target: STATE_MAIL_PARTS,
+					},
+					TR_OPEN_PART: &lib.Transition{
+						Target: STATE_MAIL_PARTS,
+					},
 					TR_MAIL_PARTS_DOWN: &lib.Transition{
 						Target: STATE_MAIL_PARTS,
 						Action: func(c interface{}, ev *lib.Event) {
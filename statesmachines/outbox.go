@@ -0,0 +1,93 @@
+package statesmachines
+
+import (
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+)
+
+const (
+	STATE_LOAD_OUTBOX lib.StateType      = "LOAD_OUTBOX"
+	STATE_SHOW_OUTBOX lib.StateType      = "SHOW_OUTBOX"
+	TR_SET_OUTBOX     lib.TransitionType = "SET_OUTBOX"
+	TR_UP_OUTBOX      lib.TransitionType = "UP_OUTBOX"
+	TR_DOWN_OUTBOX    lib.TransitionType = "DOWN_OUTBOX"
+	// open selected mail in compose view
+	TR_OUTBOX_EDIT lib.TransitionType = "OUTBOX_EDIT"
+	// send selected mail right away
+	TR_OUTBOX_RETRY lib.TransitionType = "OUTBOX_RETRY"
+	// remove selected mail from outbox without sending it
+	TR_OUTBOX_CANCEL lib.TransitionType = "OUTBOX_CANCEL"
+)
+
+type OutboxMachineCtx struct {
+	Mails    []*models.OutboxMail
+	Selected int
+}
+
+func NewOutboxMachine() *lib.Machine {
+	setmails := &lib.Transition{
+		Target: STATE_SHOW_OUTBOX,
+		Action: func(c interface{}, ev *lib.Event) {
+			state := c.(*OutboxMachineCtx)
+			mails := ev.Payload.([]*models.OutboxMail)
+			state.Mails = mails
+			// keep selection when outbox is reloaded
+			if state.Selected > len(mails) {
+				state.Selected = len(mails)
+			}
+			if state.Selected < 1 {
+				state.Selected = 1
+			}
+		},
+	}
+	return lib.NewMachine(
+		&OutboxMachineCtx{
+			Mails:    make([]*models.OutboxMail, 0),
+			Selected: 1,
+		},
+		STATE_LOAD_OUTBOX,
+		lib.States{
+			STATE_LOAD_OUTBOX: &lib.State{
+				Transitions: lib.Transitions{
+					TR_SET_OUTBOX: setmails,
+				},
+			},
+			STATE_SHOW_OUTBOX: &lib.State{
+				Transitions: lib.Transitions{
+					TR_SET_OUTBOX: setmails,
+					TR_OUTBOX_EDIT: &lib.Transition{
+						Target: STATE_SHOW_OUTBOX,
+					},
+					TR_OUTBOX_RETRY: &lib.Transition{
+						Target: STATE_SHOW_OUTBOX,
+					},
+					TR_OUTBOX_CANCEL: &lib.Transition{
+						Target: STATE_SHOW_OUTBOX,
+					},
+					TR_DOWN_OUTBOX: &lib.Transition{
+						Target: STATE_SHOW_OUTBOX,
+						Action: func(c interface{}, ev *lib.Event) {
+							state := c.(*OutboxMachineCtx)
+							next := state.Selected + getNblines(ev)
+							if next > len(state.Mails) {
+								next = len(state.Mails)
+							}
+							state.Selected = next
+						},
+					},
+					TR_UP_OUTBOX: &lib.Transition{
+						Target: STATE_SHOW_OUTBOX,
+						Action: func(c interface{}, ev *lib.Event) {
+							state := c.(*OutboxMachineCtx)
+							next := state.Selected - getNblines(ev)
+							if next < 1 {
+								next = 1
+							}
+							state.Selected = next
+						},
+					},
+				},
+			},
+		},
+	)
+}
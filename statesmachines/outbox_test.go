@@ -0,0 +1,34 @@
+package statesmachines
+
+import (
+	"testing"
+
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+)
+
+func TestSetOutboxKeepsSelection(t *testing.T) {
+	mails := func(n int) []*models.OutboxMail {
+		res := make([]*models.OutboxMail, n)
+		for i := range res {
+			res[i] = &models.OutboxMail{Id: i + 1}
+		}
+		return res
+	}
+	m := NewOutboxMachine()
+	state := m.Context.(*OutboxMachineCtx)
+	m.Send(&lib.Event{Transition: TR_SET_OUTBOX, Payload: mails(3)})
+	m.Send(&lib.Event{Transition: TR_DOWN_OUTBOX, Payload: lib.CmdArgs{"line": "2"}})
+	if state.Selected != 3 {
+		t.Fatalf("expected selected 3, found %d", state.Selected)
+	}
+	// mail sent meanwhile
+	m.Send(&lib.Event{Transition: TR_SET_OUTBOX, Payload: mails(2)})
+	if state.Selected != 2 {
+		t.Errorf("expected selected 2, found %d", state.Selected)
+	}
+	m.Send(&lib.Event{Transition: TR_SET_OUTBOX, Payload: mails(0)})
+	if state.Selected != 1 {
+		t.Errorf("expected selected 1 on empty outbox, found %d", state.Selected)
+	}
+}
@@ -1,6 +1,8 @@
 package statesmachines
 
 import (
+	"strings"
+
 	"github.com/stregouet/nuntius/lib"
 )
 
@@ -15,13 +17,40 @@ const (
 	TR_STATUS_RM_CHAR         lib.TransitionType = "REMOVE_CHAR"
 	TR_STATUS_RM_WORD         lib.TransitionType = "REMOVE_WORD"
 	TR_STATUS_BROWSE_HISTORY  lib.TransitionType = "TR_STATUS_BROWSE_HISTORY"
+	TR_STATUS_COMPLETE        lib.TransitionType = "TR_STATUS_COMPLETE"
 )
 
+// arguments whose value is completed with filesystem paths
+const PATH_ARG = "path:"
+
 type StatusMachineCtx struct {
 	CursorPos    int
 	WriteContent []rune
 	History      []string
 	HistoryIdx   int
+	// candidates found by last completion
+	Completions []string
+}
+
+// completeWord completes `path:` argument under cursor
+func completeWord(state *StatusMachineCtx) {
+	start := state.CursorPos
+	for start > 0 && state.WriteContent[start-1] != ' ' {
+		start--
+	}
+	word := string(state.WriteContent[start:state.CursorPos])
+	if !strings.HasPrefix(word, PATH_ARG) {
+		state.Completions = nil
+		return
+	}
+	completion, candidates := lib.CompletePath(strings.TrimPrefix(word, PATH_ARG))
+	state.Completions = candidates
+	completed := []rune(PATH_ARG + completion)
+	content := make([]rune, 0, len(state.WriteContent)+len(completed))
+	content = append(content, state.WriteContent[:start]...)
+	content = append(content, completed...)
+	state.WriteContent = append(content, state.WriteContent[state.CursorPos:]...)
+	state.CursorPos = start + len(completed)
 }
 
 func NewStatusMachine() *lib.Machine {
@@ -29,10 +58,11 @@ func NewStatusMachine() *lib.Machine {
 		state.CursorPos = 0
 		state.WriteContent = []rune{}
 		state.HistoryIdx = -1
+		state.Completions = nil
 	}
 
 	return lib.NewMachine(
-		&StatusMachineCtx{0, []rune{}, []string{}, -1},
+		&StatusMachineCtx{0, []rune{}, []string{}, -1, nil},
 		STATE_STATUS_SHOW_MESSAGE,
 		lib.States{
 			STATE_STATUS_SHOW_MESSAGE: &lib.State{
@@ -105,6 +135,12 @@ func NewStatusMachine() *lib.Machine {
 							}
 						},
 					},
+					TR_STATUS_COMPLETE: &lib.Transition{
+						Target: STATE_STATUS_WRITE_CMD,
+						Action: func(c interface{}, ev *lib.Event) {
+							completeWord(c.(*StatusMachineCtx))
+						},
+					},
 					TR_STATUS_BROWSE_HISTORY: &lib.Transition{
 						Target: STATE_STATUS_WRITE_CMD,
 						Action: func(c interface{}, ev *lib.Event) {
@@ -0,0 +1,52 @@
+package statesmachines
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stregouet/nuntius/lib"
+)
+
+func TestCompleteWord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nuntius-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, "report.pdf"), []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    "save-part path:" + dir + "/rep",
+			expected: "save-part path:" + dir + "/report.pdf",
+		},
+		{
+			input:    "save-part " + dir + "/rep",
+			expected: "save-part " + dir + "/rep",
+		},
+	}
+	for _, tc := range testCases {
+		m := NewStatusMachine()
+		m.Send(&lib.Event{Transition: TR_STATUS_START_WRITING})
+		for _, r := range tc.input {
+			m.Send(&lib.Event{Transition: TR_STATUS_WRITE_CHAR, Payload: r})
+		}
+		m.Send(&lib.Event{Transition: TR_STATUS_COMPLETE})
+		state := m.Context.(*StatusMachineCtx)
+		if string(state.WriteContent) != tc.expected {
+			t.Errorf("(input: %s) expected %s, found %s", tc.input, tc.expected, string(state.WriteContent))
+		}
+		if state.CursorPos != len(state.WriteContent) {
+			t.Errorf("(input: %s) cursor should be at end of completion, found %d", tc.input, state.CursorPos)
+		}
+	}
+}
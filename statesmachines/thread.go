@@ -11,18 +11,125 @@ const (
 	TR_DOWN_MAIL      lib.TransitionType = "DOWN_MAIL"
 	TR_SET_MAILS      lib.TransitionType = "SET_MAILS"
 	TR_SELECT_MAIL    lib.TransitionType = "SELECT_MAIL"
+	TR_FOLD           lib.TransitionType = "FOLD"
+	TR_UNFOLD         lib.TransitionType = "UNFOLD"
+	TR_FOLD_ALL       lib.TransitionType = "FOLD_ALL"
+	TR_UNFOLD_ALL     lib.TransitionType = "UNFOLD_ALL"
 )
 
 type ThreadMachineCtx struct {
-	Mails    []*models.Mail
+	Mails []*models.Mail
+	// mails not hidden in a folded subtree, Selected is an index of it
+	Shown    []*models.Mail
 	Selected int
+	// ids of mails whose subtree is folded, kept when mails are set again
+	Folded map[int]bool
+}
+
+// subtree returns mails below mail at idx of Mails
+func (c *ThreadMachineCtx) subtree(idx int) []*models.Mail {
+	end := idx + 1
+	for end < len(c.Mails) && c.Mails[end].Depth() > c.Mails[idx].Depth() {
+		end++
+	}
+	return c.Mails[idx+1 : end]
+}
+
+func (c *ThreadMachineCtx) indexOf(m *models.Mail) int {
+	for i, other := range c.Mails {
+		if other == m {
+			return i
+		}
+	}
+	return -1
+}
+
+// FoldedSummary returns count of mails hidden below m and whether one of
+// them is unread, when m is folded
+func (c *ThreadMachineCtx) FoldedSummary(m *models.Mail) (int, bool) {
+	idx := c.indexOf(m)
+	if idx < 0 || !c.Folded[m.Id] {
+		return 0, false
+	}
+	hidden := c.subtree(idx)
+	for _, h := range hidden {
+		if h.IsUnread() {
+			return len(hidden), true
+		}
+	}
+	return len(hidden), false
+}
+
+// SelectedMail returns mail shown under cursor
+func (c *ThreadMachineCtx) SelectedMail() *models.Mail {
+	if c.Selected < 1 || c.Selected > len(c.Shown) {
+		return nil
+	}
+	return c.Shown[c.Selected-1]
+}
+
+// updateShown computes shown mails from folded ones. Selection stays on the
+// same mail, or moves to the folded mail hiding it
+func (c *ThreadMachineCtx) updateShown() {
+	selected := c.SelectedMail()
+	c.Shown = make([]*models.Mail, 0, len(c.Mails))
+	newSelected := 0
+	for i := 0; i < len(c.Mails); i++ {
+		m := c.Mails[i]
+		c.Shown = append(c.Shown, m)
+		var hidden []*models.Mail
+		if c.Folded[m.Id] {
+			hidden = c.subtree(i)
+		}
+		// mails are compared by id as they are fetched again on reload
+		if selected != nil && m.Id == selected.Id {
+			newSelected = len(c.Shown)
+		}
+		for _, h := range hidden {
+			if selected != nil && h.Id == selected.Id {
+				newSelected = len(c.Shown)
+			}
+		}
+		i += len(hidden)
+	}
+	if newSelected != 0 {
+		c.Selected = newSelected
+	}
+	if c.Selected > len(c.Shown) {
+		c.Selected = len(c.Shown)
+	}
+	if c.Selected < 1 {
+		c.Selected = 1
+	}
+}
+
+// fold folds subtree of selected mail, or the one of its parent when it has
+// no reply
+func (c *ThreadMachineCtx) fold() {
+	selected := c.SelectedMail()
+	idx := c.indexOf(selected)
+	if idx < 0 {
+		return
+	}
+	if len(c.subtree(idx)) == 0 {
+		for idx >= 0 && c.Mails[idx].Depth() >= selected.Depth() {
+			idx--
+		}
+		if idx < 0 {
+			return
+		}
+	}
+	c.Folded[c.Mails[idx].Id] = true
+	c.updateShown()
 }
 
 func NewThreadMachine() *lib.Machine {
 	return lib.NewMachine(
 		&ThreadMachineCtx{
 			Mails:    make([]*models.Mail, 0),
+			Shown:    make([]*models.Mail, 0),
 			Selected: 1,
+			Folded:   make(map[int]bool),
 		},
 		STATE_SHOW_THREAD,
 		lib.States{
@@ -31,12 +138,85 @@ func NewThreadMachine() *lib.Machine {
 					TR_SELECT_MAIL: &lib.Transition{
 						Target: STATE_SHOW_THREAD,
 					},
+					TR_REPLY: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_REPLY_ALL: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_FORWARD: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_MOVE: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_COPY: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_DELETE: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_ARCHIVE: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_SET_FLAG: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_UNSET_FLAG: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_TOGGLE_READ: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_TOGGLE_FLAGGED: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
+					TR_EXPORT: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+					},
 					TR_SET_MAILS: &lib.Transition{
 						Target: STATE_SHOW_THREAD,
 						Action: func(c interface{}, ev *lib.Event) {
 							state := c.(*ThreadMachineCtx)
-							mails := ev.Payload.([]*models.Mail)
-							state.Mails = mails
+							state.Mails = ev.Payload.([]*models.Mail)
+							state.updateShown()
+						},
+					},
+					TR_FOLD: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+						Action: func(c interface{}, ev *lib.Event) {
+							state := c.(*ThreadMachineCtx)
+							state.fold()
+						},
+					},
+					TR_UNFOLD: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+						Action: func(c interface{}, ev *lib.Event) {
+							state := c.(*ThreadMachineCtx)
+							if m := state.SelectedMail(); m != nil {
+								delete(state.Folded, m.Id)
+								state.updateShown()
+							}
+						},
+					},
+					TR_FOLD_ALL: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+						Action: func(c interface{}, ev *lib.Event) {
+							state := c.(*ThreadMachineCtx)
+							for i, m := range state.Mails {
+								if len(state.subtree(i)) > 0 {
+									state.Folded[m.Id] = true
+								}
+							}
+							state.updateShown()
+						},
+					},
+					TR_UNFOLD_ALL: &lib.Transition{
+						Target: STATE_SHOW_THREAD,
+						Action: func(c interface{}, ev *lib.Event) {
+							state := c.(*ThreadMachineCtx)
+							state.Folded = make(map[int]bool)
+							state.updateShown()
 						},
 					},
 					TR_UP_MAIL: &lib.Transition{
@@ -55,8 +235,8 @@ func NewThreadMachine() *lib.Machine {
 						Action: func(c interface{}, ev *lib.Event) {
 							state := c.(*ThreadMachineCtx)
 							next := state.Selected + 1
-							if next > len(state.Mails) {
-								next = len(state.Mails)
+							if next > len(state.Shown) {
+								next = len(state.Shown)
 							}
 							state.Selected = next
 						},
@@ -0,0 +1,167 @@
+package statesmachines
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+)
+
+// threadMails builds a thread from depths of its mails, ids starting at 1:
+// each mail replies to the last one before it at the depth above
+func threadMails(depths ...int) []*models.Mail {
+	result := make([]*models.Mail, len(depths))
+	parents := make([]string, 0)
+	start := time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)
+	for i, d := range depths {
+		m := &models.Mail{
+			Id:        i + 1,
+			MessageId: fmt.Sprintf("<%d>", i+1),
+			Flags:     []string{imap.SeenFlag},
+			Date:      start.Add(time.Duration(i) * time.Minute),
+		}
+		parents = append(parents[:d], m.MessageId)
+		if d > 0 {
+			m.InReplyTo = parents[d-1]
+		}
+		result[i] = m
+	}
+	return models.SortThread(result)
+}
+
+func shownIds(state *ThreadMachineCtx) []int {
+	ids := make([]int, 0, len(state.Shown))
+	for _, m := range state.Shown {
+		ids = append(ids, m.Id)
+	}
+	return ids
+}
+
+func TestFoldThread(t *testing.T) {
+	// 1
+	// ├─ 2
+	// │  └─ 3
+	// │     └─ 4
+	// └─ 5
+	//    └─ 6
+	testCases := []struct {
+		name     string
+		events   []*lib.Event
+		shown    []int
+		selected int
+	}{
+		{
+			name: "fold selected subtree",
+			events: []*lib.Event{
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_FOLD},
+			},
+			shown:    []int{1, 2, 5, 6},
+			selected: 2,
+		},
+		{
+			name: "fold parent of a mail without reply",
+			events: []*lib.Event{
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_FOLD},
+			},
+			shown:    []int{1, 2, 3, 4, 5},
+			selected: 5,
+		},
+		{
+			name: "fold root",
+			events: []*lib.Event{
+				{Transition: TR_FOLD},
+				{Transition: TR_DOWN_MAIL},
+			},
+			shown:    []int{1},
+			selected: 1,
+		},
+		{
+			name: "unfold",
+			events: []*lib.Event{
+				{Transition: TR_FOLD_ALL},
+				{Transition: TR_UNFOLD},
+			},
+			shown:    []int{1, 2, 5},
+			selected: 1,
+		},
+		{
+			name: "fold all keeps selection on folded mail",
+			events: []*lib.Event{
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_FOLD_ALL},
+			},
+			shown:    []int{1},
+			selected: 1,
+		},
+		{
+			name: "unfold all",
+			events: []*lib.Event{
+				{Transition: TR_FOLD_ALL},
+				{Transition: TR_UNFOLD_ALL},
+			},
+			shown:    []int{1, 2, 3, 4, 5, 6},
+			selected: 1,
+		},
+		{
+			name: "folding is kept when mails are set again",
+			events: []*lib.Event{
+				{Transition: TR_DOWN_MAIL},
+				{Transition: TR_FOLD},
+				{Transition: TR_SET_MAILS, Payload: threadMails(0, 1, 2, 3, 1, 2)},
+			},
+			shown:    []int{1, 2, 5, 6},
+			selected: 2,
+		},
+	}
+	for _, tc := range testCases {
+		m := NewThreadMachine()
+		state := m.Context.(*ThreadMachineCtx)
+		m.Send(&lib.Event{Transition: TR_SET_MAILS, Payload: threadMails(0, 1, 2, 3, 1, 2)})
+		for _, ev := range tc.events {
+			m.Send(ev)
+		}
+		if !reflect.DeepEqual(tc.shown, shownIds(state)) {
+			t.Errorf("(%s) expected shown mails %v, found %v", tc.name, tc.shown, shownIds(state))
+		}
+		if state.Selected != tc.selected {
+			t.Errorf("(%s) expected selected %d, found %d", tc.name, tc.selected, state.Selected)
+		}
+	}
+}
+
+func TestFoldedSummary(t *testing.T) {
+	m := NewThreadMachine()
+	state := m.Context.(*ThreadMachineCtx)
+	mails := threadMails(0, 1, 2, 1)
+	mails[2].Flags = []string{}
+	m.Send(&lib.Event{Transition: TR_SET_MAILS, Payload: mails})
+	m.Send(&lib.Event{Transition: TR_FOLD_ALL})
+	testCases := []struct {
+		mail   *models.Mail
+		count  int
+		unread bool
+	}{
+		{mails[0], 3, true},
+		{mails[1], 1, true},
+		{mails[3], 0, false},
+	}
+	for _, tc := range testCases {
+		count, unread := state.FoldedSummary(tc.mail)
+		if count != tc.count || unread != tc.unread {
+			t.Errorf("(mail %d) expected %d hidden (unread: %v), found %d (unread: %v)",
+				tc.mail.Id, tc.count, tc.unread, count, unread)
+		}
+	}
+}
@@ -13,6 +13,12 @@ const (
 	TR_PREV_TAB     lib.TransitionType = "PREV_TAB"
 	TR_CLOSE_APP    lib.TransitionType = "CLOSE_APP"
 	TR_COMPOSE_MAIL lib.TransitionType = "COMPOSE_MAIL"
+	// search query:"..." [account:name]
+	TR_SEARCH lib.TransitionType = "SEARCH"
+	// search-imap query:"..." [account:name] [mailbox:name]
+	TR_SEARCH_IMAP lib.TransitionType = "SEARCH_IMAP"
+	// outbox [account:name]
+	TR_OUTBOX lib.TransitionType = "OUTBOX"
 
 	STATE_WRITE_CMD  lib.StateType      = "WRITE_CMD"
 	TR_START_WRITING lib.TransitionType = "START_WRITING"
@@ -45,6 +51,15 @@ func NewWindowMachine() *lib.Machine {
 					TR_COMPOSE_MAIL: &lib.Transition{
 						Target: STATE_SHOW_TAB,
 					},
+					TR_SEARCH: &lib.Transition{
+						Target: STATE_SHOW_TAB,
+					},
+					TR_SEARCH_IMAP: &lib.Transition{
+						Target: STATE_SHOW_TAB,
+					},
+					TR_OUTBOX: &lib.Transition{
+						Target: STATE_SHOW_TAB,
+					},
 					TR_OPEN_TAB: &lib.Transition{
 						Target: STATE_SHOW_TAB,
 						Action: func(c interface{}, ev *lib.Event) {
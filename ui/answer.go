@@ -0,0 +1,90 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/stregouet/nuntius/config"
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+	sm "github.com/stregouet/nuntius/statesmachines"
+)
+
+// answerFunc is called by views showing mails on reply or forward transitions,
+// filepath being where raw content of mail is cached
+type answerFunc func(ev *lib.Event, acc, mailbox string, m *models.Mail, filepath string)
+
+func forwardMode(ev *lib.Event) (models.ForwardMode, error) {
+	args, ok := ev.Payload.(lib.CmdArgs)
+	if !ok || args["as"] == "" {
+		return models.FORWARD_INLINE, nil
+	}
+	switch mode := models.ForwardMode(args["as"]); mode {
+	case models.FORWARD_INLINE, models.FORWARD_ATTACHMENT:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown forward mode `%s` (available modes: %s, %s)", args["as"], models.FORWARD_INLINE, models.FORWARD_ATTACHMENT)
+}
+
+// answer opens a compose tab replying to, or forwarding, m
+func (w *Window) answer(ev *lib.Event, acc, mailbox string, m *models.Mail, filepath string) {
+	cfg := w.account(acc)
+	if cfg == nil {
+		w.Errorf("unknown account `%s`", acc)
+		return
+	}
+	if err := cfg.CheckSend(); err != nil {
+		w.Errorf("%v", err)
+		return
+	}
+	f, err := os.Open(filepath)
+	if err != nil {
+		App.logger.Errorf("cannot open filepath %v (filepath: %s)", err, filepath)
+		w.Errorf("cannot read mail to answer")
+		return
+	}
+	defer f.Close()
+	var content string
+	var attachment string
+	switch ev.Transition {
+	case sm.TR_REPLY, sm.TR_REPLY_ALL:
+		content, err = models.ReplyContent(f, cfg.From, ev.Transition == sm.TR_REPLY_ALL)
+	case sm.TR_FORWARD:
+		var mode models.ForwardMode
+		if mode, err = forwardMode(ev); err != nil {
+			break
+		}
+		content, err = models.ForwardContent(f, cfg.From, mode)
+		if mode == models.FORWARD_ATTACHMENT {
+			attachment = filepath
+		}
+	}
+	if err != nil {
+		App.logger.Errorf("cannot build answer %v", err)
+		w.Errorf("cannot answer mail: %v", err)
+		return
+	}
+	c := NewComposeView(cfg, w.bindings[config.KEY_MODE_COMPOSE], content)
+	if attachment != "" {
+		c.Attach(attachment)
+	}
+	if ev.Transition != sm.TR_FORWARD {
+		c.OnSent(func() {
+			w.markAnswered(acc, mailbox, m)
+		})
+	}
+	w.addTab(c)
+}
+
+// markAnswered sets \Answered flag on m, both on imap server and in db
+func (w *Window) markAnswered(acc, mailbox string, m *models.Mail) {
+	m.Mailbox = mailbox
+	messagef := func(msg string, args ...interface{}) {
+		w.Errorf("cannot mark mail as answered: "+msg, args...)
+	}
+	storeFlags(acc, []*models.Mail{m}, []string{imap.AnsweredFlag}, false, messagef, func() {
+		w.ReloadMailboxes(acc)
+	})
+}
@@ -11,6 +11,8 @@ import (
 	"github.com/stregouet/nuntius/lib"
 	"github.com/stregouet/nuntius/workers"
 	"github.com/stregouet/nuntius/workers/imap"
+	"github.com/stregouet/nuntius/workers/maildir"
+	"github.com/stregouet/nuntius/workers/mbox"
 )
 
 var App *Application
@@ -30,9 +32,29 @@ type Application struct {
 
 	dbcallbacks   map[int]PostCallback
 	imapcallbacks map[int]PostCallback
+	// accounts whose pending actions are being replayed
+	replaying map[string]bool
+	// called once outbox mail with this id is sent
+	outboxSent map[int]func()
 
-	db   *workers.Database
-	imap *imap.ImapWorker
+	db *workers.Database
+	// imap server, or whatever backend accounts are configured with
+	backends *workers.BackendWorker
+}
+
+func newBackends(l *lib.Logger, accounts []*config.Account) *workers.BackendWorker {
+	backends := make(map[string]workers.Backend)
+	for _, c := range accounts {
+		switch c.BackendType() {
+		case config.BACKEND_MAILDIR:
+			backends[c.Name] = maildir.NewAccount(l, c)
+		case config.BACKEND_MBOX:
+			backends[c.Name] = mbox.NewAccount(l, c)
+		default:
+			backends[c.Name] = imap.NewAccount(l, c)
+		}
+	}
+	return workers.NewBackendWorker(l, backends)
 }
 
 func InitApp(l *lib.Logger, cfg *config.Config) error {
@@ -51,8 +73,10 @@ func InitApp(l *lib.Logger, cfg *config.Config) error {
 			tcEvents:      make(chan tcell.Event, 10),
 			dbcallbacks:   make(map[int]PostCallback),
 			imapcallbacks: make(map[int]PostCallback),
-			db:            workers.NewDatabase(l),
-			imap:          imap.NewImapWorker(l, cfg.Accounts),
+			replaying:     make(map[string]bool),
+			outboxSent:    make(map[int]func()),
+			db:            workers.NewDatabase(l, cfg.ThreadBySubject),
+			backends:      newBackends(l, cfg.Accounts),
 			done:          make(chan struct{}),
 			screen:        screen,
 		}
@@ -65,6 +89,26 @@ func InitApp(l *lib.Logger, cfg *config.Config) error {
 	return errors.New("InitApp should be called only once")
 }
 
+// InitHeadlessApp initializes app without any screen, to run a command
+// from shell (e.g. import) with RunHeadless
+func InitHeadlessApp(l *lib.Logger, cfg *config.Config) error {
+	if App != nil {
+		return errors.New("InitHeadlessApp should be called only once")
+	}
+	App = &Application{
+		logger:        l,
+		dbcallbacks:   make(map[int]PostCallback),
+		imapcallbacks: make(map[int]PostCallback),
+		replaying:     make(map[string]bool),
+		outboxSent:    make(map[int]func()),
+		db:            workers.NewDatabase(l, cfg.ThreadBySubject),
+		backends:      newBackends(l, cfg.Accounts),
+		done:          make(chan struct{}),
+	}
+	App.exit.Store(false)
+	return nil
+}
+
 // func (app *Application) SetStyle(style tcell.Style) {
 // 	app.style = style
 // 	if app.screen != nil {
@@ -141,7 +185,7 @@ func (app *Application) PostImapMessage(msg workers.Message, accountname string,
 	if f != nil {
 		app.imapcallbacks[app.cbId] = f
 	}
-	app.imap.PostMessage(msg)
+	app.backends.PostMessage(msg)
 }
 
 func (app *Application) PostMessage(m workers.ClonableMessage, accountname string, f PostCallback) {
@@ -155,12 +199,107 @@ func (app *Application) PostMessage(m workers.ClonableMessage, accountname strin
 	})
 }
 
+// onImapNotification handles messages pushed by imap worker without any
+// prior request (e.g. while idling)
+func (app *Application) onImapNotification(res workers.Message) {
+	if app.window == nil {
+		// headless, nothing to show
+		return
+	}
+	accname := res.GetAccName()
+	var msg workers.Message
+	var mailbox string
+	switch r := res.(type) {
+	case *workers.NewMessagesNotif:
+		mailbox = r.Mailbox
+		msg = &workers.InsertNewMessages{Mailbox: r.Mailbox, Mails: r.Mails}
+	case *workers.MessageUpdatesNotif:
+		mailbox = r.Mailbox
+		msg = &workers.UpdateMessages{Mailbox: r.Mailbox, LastSeenUid: r.LastSeenUid, MailsChanges: r.MailsChanges}
+	case *workers.MailboxResetNotif:
+		app.window.SyncMailbox(accname, r.Mailbox)
+		return
+	case *workers.OutboxNotif:
+		app.onOutboxNotif(accname, r)
+		return
+	case *workers.ConnectionStateNotif:
+		app.window.SetConnectionState(accname, r)
+		if r.State != workers.CONN_CONNECTING {
+			app.syncPendingActions(accname, r.State == workers.CONN_CONNECTED)
+		}
+		return
+	default:
+		app.logger.Warnf("unexpected imap notification %#v", res)
+		return
+	}
+	app.PostDbMessage(msg, accname, func(response workers.Message) error {
+		switch r := response.(type) {
+		case *workers.Error:
+			app.logger.Errorf("error saving imap notification %v", r.Error)
+			app.window.Errorf("cannot save mailbox update: %v", r.Error)
+		case *workers.InsertNewMessagesRes:
+			app.window.SetMailboxThreads(accname, mailbox, r.Threads)
+		case *workers.UpdateMessagesRes:
+			app.window.SetMailboxThreads(accname, mailbox, r.Threads)
+		}
+		return nil
+	})
+}
+
+func (app *Application) onImapResponse(res workers.Message) {
+	id := res.GetId()
+	if id == 0 {
+		app.onImapNotification(res)
+		return
+	}
+	cb, ok := app.imapcallbacks[id]
+	if !ok {
+		app.logger.Warnf("cannot found imap callbacks with id %d", id)
+	} else {
+		if q, ok := res.(*workers.Queued); ok {
+			res = app.onQueued(q)
+		}
+		cb(res)
+		delete(app.imapcallbacks, id)
+	}
+}
+
+func (app *Application) onDbResponse(res workers.Message) {
+	id := res.GetId()
+	cb, ok := app.dbcallbacks[id]
+	if !ok {
+		app.logger.Warnf("cannot found db callbacks with id %d", id)
+	} else {
+		cb(res)
+		delete(app.dbcallbacks, id)
+	}
+}
+
+// RunHeadless calls start once workers run, then handles their responses
+// until Stop is called
+func (app *Application) RunHeadless(start func()) {
+	go app.db.Run()
+	go app.backends.Run()
+	defer app.backends.Close()
+	start()
+	for {
+		select {
+		case <-app.done:
+			return
+		case res := <-app.backends.Responses():
+			app.onImapResponse(res)
+		case res := <-app.db.Responses():
+			app.onDbResponse(res)
+		}
+	}
+}
+
 func (app *Application) Run() {
 	if err := app.initialize(); err != nil {
 		panic(err)
 	}
 	go app.db.Run()
-	go app.imap.Run()
+	go app.backends.Run()
 
 	app.screen.Init()
 	app.screen.Clear()
@@ -178,24 +317,10 @@ func (app *Application) Run() {
 		select {
 		case <-app.done:
 			return
-		case res := <-app.imap.Responses():
-			id := res.GetId()
-			cb, ok := app.imapcallbacks[id]
-			if !ok {
-				app.logger.Warnf("cannot found imap callbacks with id %d", id)
-			} else {
-				cb(res)
-				delete(app.imapcallbacks, id)
-			}
+		case res := <-app.backends.Responses():
+			app.onImapResponse(res)
 		case res := <-app.db.Responses():
-			id := res.GetId()
-			cb, ok := app.dbcallbacks[id]
-			if !ok {
-				app.logger.Warnf("cannot found db callbacks with id %d", id)
-			} else {
-				cb(res)
-				delete(app.dbcallbacks, id)
-			}
+			app.onDbResponse(res)
 		default:
 			for app.tick() {
 
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"bufio"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -14,6 +15,7 @@ import (
 
 	"github.com/stregouet/nuntius/config"
 	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
 	sm "github.com/stregouet/nuntius/statesmachines"
 	"github.com/stregouet/nuntius/widgets"
 	"github.com/stregouet/nuntius/workers"
@@ -24,11 +26,21 @@ type ComposeView struct {
 	bindings config.Mapping
 	term     *widgets.Terminal
 	screen   tcell.Screen
+	onSentCb func()
+	// outbox mail being edited, if any
+	replaced *models.OutboxMail
+	// draft this mail was resumed from, or last postponed to, if any
+	draft *models.MailCopy
 	*widgets.BaseWidget
 }
 
-func NewComposeView(acc *config.Account, bindings config.Mapping) *ComposeView {
+// NewComposeView opens editor on a new mail, prefilled with content (headers,
+// blank line, then body) if not empty
+func NewComposeView(acc *config.Account, bindings config.Mapping, content string) *ComposeView {
 	email, err := ioutil.TempFile("", "nuntius-*.eml")
+	if err == nil && content != "" {
+		_, err = email.WriteString(content)
+	}
 	machine := sm.NewComposeMachine(email)
 	if err != nil {
 		App.logger.Errorf("cannot create tmp file %v", err)
@@ -44,21 +56,68 @@ func NewComposeView(acc *config.Account, bindings config.Mapping) *ComposeView {
 	machine.OnTransition(func(s lib.StateType, ctx interface{}, ev *lib.Event) {
 		switch ev.Transition {
 		case sm.TR_COMPOSE_SEND:
+			state := ctx.(*sm.ComposeMachineCtx)
+			mail := models.NewOutboxMail(state.Body, state.Attachments)
+			if c.replaced != nil {
+				mail.Id = c.replaced.Id
+				mail.Created = c.replaced.Created
+			}
+			App.PostDbMessage(
+				&workers.QueueMail{Mail: mail},
+				acc.Name,
+				func(response workers.Message) error {
+					switch r := response.(type) {
+					case *workers.Error:
+						App.logger.Errorf("cannot queue mail %v", r.Error)
+						c.Messagef("%v", r.Error)
+					case *workers.QueueMailRes:
+						c.Messagef("mail queued in outbox")
+						App.sendOutbox(acc.Name, r.Mail, c.onSentCb)
+						// mail is kept in outbox until sent
+						c.deleteDraft(acc.Name)
+					}
+					return nil
+				},
+			)
+			c.AskRedraw()
+		case sm.TR_COMPOSE_POSTPONE:
 			state := ctx.(*sm.ComposeMachineCtx)
 			App.PostImapMessage(
-				&workers.SendMail{
-					Body: strings.NewReader(state.Body),
+				&workers.PostponeMail{
+					Body:        strings.NewReader(state.Body),
+					Attachments: state.Attachments,
 				},
 				acc.Name,
 				func(response workers.Message) error {
-					if r, ok := response.(*workers.Error); ok {
-						App.logger.Errorf("cannot send mail %v", r.Error)
-						c.Messagef("error sending mail (%v)", r.Error)
+					switch r := response.(type) {
+					case *workers.Error:
+						App.logger.Errorf("cannot postpone mail %v", r.Error)
+						c.Messagef("%v", r.Error)
+					case *workers.MsgToDb:
+						c.Messagef("mail postponed to drafts")
+						postponed := c.postponedDraft(r.Wrapped)
+						App.PostDbMessage(r.Wrapped, acc.Name, func(response workers.Message) error {
+							if r, ok := response.(*workers.Error); ok {
+								c.Messagef("error saving draft in db: %v", r.Error)
+								return nil
+							}
+							App.window.ReloadMailboxes(acc.Name)
+							// previous draft is replaced by this one
+							c.deleteDraft(acc.Name)
+							c.draft = postponed
+							return nil
+						})
 					}
 					return nil
 				},
 			)
 			c.AskRedraw()
+		case sm.TR_ATTACH, sm.TR_DETACH:
+			state := ctx.(*sm.ComposeMachineCtx)
+			if state.AttachErr != nil {
+				c.Messagef("%v", state.AttachErr)
+			}
+			c.AskRedraw()
 		case sm.TR_COMPOSE_SET_ERR:
 			c.AskRedraw()
 		case sm.TR_COMPOSE_REVIEW:
@@ -85,6 +144,77 @@ func (c *ComposeView) TabTitle() string {
 	return "compose"
 }
 
+// Attach adds file at path to attachments of the mail
+func (c *ComposeView) Attach(path string) {
+	state := c.state()
+	state.Attachments = append(state.Attachments, path)
+}
+
+// ReplaceOutboxMail makes sending this mail replace m in outbox, instead of
+// adding a new mail
+func (c *ComposeView) ReplaceOutboxMail(m *models.OutboxMail) {
+	c.replaced = m
+}
+
+// ReplaceDraft makes postponing or sending this mail delete draft, which it
+// was resumed from
+func (c *ComposeView) ReplaceDraft(draft models.MailCopy) {
+	c.draft = &draft
+}
+
+// postponedDraft returns where mail was postponed, as told by msg sent to db
+// once appended in drafts mailbox
+func (c *ComposeView) postponedDraft(msg workers.Message) *models.MailCopy {
+	inserted, ok := msg.(*workers.InsertNewMessages)
+	if !ok {
+		return nil
+	}
+	var found *models.MailCopy
+	for _, m := range inserted.Mails {
+		// previous draft is found as well when it has the same message-id
+		if c.draft != nil && c.draft.Mailbox == inserted.Mailbox && c.draft.Uid == m.Uid {
+			continue
+		}
+		if found == nil || m.Uid > found.Uid {
+			found = &models.MailCopy{Uid: m.Uid, Mailbox: inserted.Mailbox}
+		}
+	}
+	return found
+}
+
+// deleteDraft deletes draft mail was resumed from, if any
+func (c *ComposeView) deleteDraft(acc string) {
+	if c.draft == nil {
+		return
+	}
+	draft := c.draft
+	c.draft = nil
+	// a replaced draft is expunged even when there is no trash to move it to
+	msg := &workers.DeleteMails{Mailbox: draft.Mailbox, Uids: []uint32{draft.Uid}, Permanently: true}
+	App.PostImapMessage(msg, acc, func(response workers.Message) error {
+		switch r := response.(type) {
+		case *workers.Error:
+			c.Messagef("cannot delete previous draft: %v", r.Error)
+		case *workers.MsgToDb:
+			App.PostDbMessage(r.Wrapped, acc, func(response workers.Message) error {
+				switch r := response.(type) {
+				case *workers.Error:
+					c.Messagef("error updating db: %v", r.Error)
+				case *workers.RemoveMailsRes:
+					App.window.RemoveThreads(acc, r.Mailbox, r.Threads)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+// OnSent registers f to be called once mail is successfully sent
+func (c *ComposeView) OnSent(f func()) {
+	c.onSentCb = f
+}
+
 func (c *ComposeView) setTermView(view *views.ViewPort, screen tcell.Screen) {
 	if c.term != nil {
 		c.term.SetViewPort(view, screen)
@@ -115,7 +245,7 @@ func (c *ComposeView) err(msg string, format ...interface{}) {
 	c.machine.Send(&lib.Event{sm.TR_COMPOSE_SET_ERR, nil})
 }
 
-func (c *ComposeView) drawMail(content string) {
+func (c *ComposeView) drawMail(content string, attachments []string) {
 	style := tcell.StyleDefault
 	bold := style.Bold(true)
 	r := strings.NewReader(content)
@@ -137,6 +267,11 @@ func (c *ComposeView) drawMail(content string) {
 		c.Print(offset, line, style, val)
 		line++
 	}
+	for i, a := range attachments {
+		offset := c.Print(0, line, bold, fmt.Sprintf("Attachment %d: ", i+1))
+		c.Print(offset, line, style, a)
+		line++
+	}
 
 	s := bufio.NewScanner(msg.Body)
 	line++
@@ -156,7 +291,7 @@ func (c *ComposeView) Draw() {
 	} else {
 		c.Clear()
 		state := c.state()
-		c.drawMail(state.Body)
+		c.drawMail(state.Body, state.Attachments)
 	}
 }
 
@@ -0,0 +1,160 @@
+package ui
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// exporter writes mails to an mboxrd file or to a directory of eml files,
+// one mail after the other, fetching their content when not cached yet
+type exporter struct {
+	acc      string
+	mails    []*models.Mail
+	dest     string
+	eml      bool
+	done     int
+	messagef func(string, ...interface{})
+}
+
+// exportMails exports mails of account acc as asked by export command args
+func exportMails(acc string, mails []*models.Mail, args lib.CmdArgs, messagef func(string, ...interface{})) {
+	e, err := newExporter(acc, mails, args)
+	if err != nil {
+		messagef("%v", err)
+		return
+	}
+	e.messagef = messagef
+	e.next()
+}
+
+func newExporter(acc string, mails []*models.Mail, args lib.CmdArgs) (*exporter, error) {
+	if args["path"] == "" {
+		return nil, errors.New("missing destination (e.g. `export path:~/mails.mbox`)")
+	}
+	if len(mails) == 0 {
+		return nil, errors.New("no mail to export")
+	}
+	dest, err := lib.ExpandHome(args["path"])
+	if err != nil {
+		return nil, err
+	}
+	e := &exporter{acc: acc, mails: mails, dest: dest}
+	switch args["format"] {
+	case "eml":
+		e.eml = true
+	case "mbox":
+	case "":
+		// a directory can only hold eml files
+		info, err := os.Stat(dest)
+		e.eml = strings.HasSuffix(args["path"], "/") || (err == nil && info.IsDir())
+	default:
+		return nil, fmt.Errorf("unknown export format `%s` (expected mbox or eml)", args["format"])
+	}
+	if e.eml {
+		return e, os.MkdirAll(dest, 0755)
+	}
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return nil, err
+	}
+	// mails are appended one after the other to a file emptied first, an
+	// existing one is only replaced when asked
+	flags := os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	if args["overwrite"] == "yes" {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	f, err := os.OpenFile(dest, flags, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("`%s` already exists, use `overwrite:yes` to replace it", args["path"])
+	} else if err != nil {
+		return nil, err
+	}
+	return e, f.Close()
+}
+
+func (e *exporter) next() {
+	m := e.mails[e.done]
+	App.PostImapMessage(
+		&workers.FetchFullMail{Uid: m.Uid, Mailbox: m.Mailbox, Peek: true},
+		e.acc,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				e.messagef("export stopped after %d mail(s), cannot fetch mail: %v", e.done, r.Error)
+			case *workers.FetchFullMailRes:
+				err := e.write(m, r.Filepath)
+				if r.Temporary {
+					os.Remove(r.Filepath)
+				}
+				if err != nil {
+					e.messagef("export stopped after %d mail(s): %v", e.done, err)
+					return nil
+				}
+				e.done++
+				if e.done == len(e.mails) {
+					e.messagef("%d mail(s) exported to %s", e.done, e.dest)
+					return nil
+				}
+				e.messagef("exporting to %s: %d/%d", e.dest, e.done, len(e.mails))
+				e.next()
+			}
+			return nil
+		})
+}
+
+// write adds mail m, whose full content is at path, to export destination
+func (e *exporter) write(m *models.Mail, path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if e.eml {
+		name := strings.ReplaceAll(m.Mailbox, "/", "_")
+		return ioutil.WriteFile(filepath.Join(e.dest, fmt.Sprintf("%s-%d.eml", name, m.Uid)), raw, 0644)
+	}
+	f, err := os.OpenFile(e.dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	if !bytes.HasSuffix(raw, []byte("\n")) {
+		raw = append(raw, '\n')
+	}
+	from, date := mboxSender(raw)
+	if _, err = f.WriteString(lib.MboxFromLine(from, date)); err != nil {
+		return err
+	}
+	if _, err = f.Write(lib.MboxEscape(raw)); err != nil {
+		return err
+	}
+	// messages are separated by a blank line
+	if _, err = f.WriteString("\n"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// mboxSender returns sender address and date of mail raw, as found in its
+// header, to build its mbox `From ` line
+func mboxSender(raw []byte) (from string, date time.Time) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", time.Time{}
+	}
+	if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		from = addr.Address
+	}
+	date, _ = msg.Header.Date()
+	return from, date
+}
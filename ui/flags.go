@@ -0,0 +1,108 @@
+package ui
+
+import (
+	"fmt"
+
+	"github.com/emersion/go-imap"
+
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+	sm "github.com/stregouet/nuntius/statesmachines"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// flagsChange returns flag to add to mails (or to remove from them when
+// remove is true) for set-flag, unset-flag, toggle-read or toggle-flagged
+// command ev
+func flagsChange(ev *lib.Event, mails []*models.Mail) (flag string, remove bool, err error) {
+	switch ev.Transition {
+	case sm.TR_SET_FLAG, sm.TR_UNSET_FLAG:
+		args, _ := ev.Payload.(lib.CmdArgs)
+		flag, err = models.ParseFlag(args["flag"])
+		return flag, ev.Transition == sm.TR_UNSET_FLAG, err
+	case sm.TR_TOGGLE_READ:
+		return imap.SeenFlag, models.AllHaveFlag(mails, imap.SeenFlag), nil
+	case sm.TR_TOGGLE_FLAGGED:
+		return imap.FlaggedFlag, models.AllHaveFlag(mails, imap.FlaggedFlag), nil
+	}
+	return "", false, fmt.Errorf("unexpected transition %s", ev.Transition)
+}
+
+// applyFlagsAction applies set-flag, unset-flag, toggle-read or
+// toggle-flagged command ev on mails
+func applyFlagsAction(ev *lib.Event, acc string, mails []*models.Mail, messagef func(string, ...interface{}), done func()) {
+	flag, remove, err := flagsChange(ev, mails)
+	if err != nil {
+		messagef("%v", err)
+		return
+	}
+	storeFlags(acc, mails, []string{flag}, remove, messagef, done)
+}
+
+// storeFlags adds flags to mails (or removes them), on imap server then in
+// mails themselves and in db. done is called for each mailbox once its mails
+// are updated, so that views showing them can be refreshed
+func storeFlags(acc string, mails []*models.Mail, flags []string, remove bool, messagef func(string, ...interface{}), done func()) {
+	byMailbox := make(map[string][]*models.Mail)
+	for _, m := range mails {
+		byMailbox[m.Mailbox] = append(byMailbox[m.Mailbox], m)
+	}
+	for mailbox, mboxMails := range byMailbox {
+		mboxMails := mboxMails
+		uids := make([]uint32, 0, len(mboxMails))
+		for _, m := range mboxMails {
+			uids = append(uids, m.Uid)
+		}
+		App.PostImapMessage(
+			&workers.StoreFlags{Mailbox: mailbox, Uids: uids, Flags: flags, Remove: remove},
+			acc,
+			func(response workers.Message) error {
+				switch r := response.(type) {
+				case *workers.Error:
+					messagef("%v", r.Error)
+				case *workers.Done:
+					for _, m := range mboxMails {
+						for _, f := range flags {
+							if remove {
+								m.RemoveFlag(f)
+							} else {
+								m.AddFlag(f)
+							}
+						}
+						saveFlags(acc, m, messagef)
+					}
+					if done != nil {
+						done()
+					}
+				}
+				return nil
+			})
+	}
+}
+
+// saveFlags writes flags of m in db
+func saveFlags(acc string, m *models.Mail, messagef func(string, ...interface{})) {
+	// copy flags before sending them to another goroutine
+	flags := make([]string, len(m.Flags))
+	copy(flags, m.Flags)
+	App.PostDbMessage(
+		&workers.SaveMailFlags{MailId: m.Id, Flags: flags},
+		acc,
+		func(response workers.Message) error {
+			if r, ok := response.(*workers.Error); ok {
+				messagef("error saving flags to db: %v", r.Error)
+			}
+			return nil
+		})
+}
+
+// countSeen returns number of mails with \Seen flag
+func countSeen(mails []*models.Mail) int {
+	seen := 0
+	for _, m := range mails {
+		if !m.IsUnread() {
+			seen++
+		}
+	}
+	return seen
+}
@@ -0,0 +1,245 @@
+package ui
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+
+	"github.com/stregouet/nuntius/config"
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/workers"
+	"github.com/stregouet/nuntius/workers/maildir"
+	"github.com/stregouet/nuntius/workers/mbox"
+)
+
+// openArchive opens maildir or mbox file found at path
+func openArchive(path string) (workers.Archive, error) {
+	path, err := lib.ExpandHome(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return mbox.OpenArchive(path)
+	}
+	if _, err = os.Stat(filepath.Join(path, "cur")); err != nil {
+		return nil, fmt.Errorf("`%s` is neither an mbox file nor a maildir", path)
+	}
+	return maildir.OpenArchive(path)
+}
+
+// importer appends mails of an archive to a mailbox, one after the other.
+// Mails whose message-id is already in mailbox are skipped
+type importer struct {
+	acc      string
+	mailbox  string
+	archive  workers.Archive
+	current  int
+	imported int
+	skipped  int
+	failed   int
+	// message-ids met while importing, not yet in db
+	seen map[string]bool
+	// reports progress
+	messagef func(string, ...interface{})
+	// reports mails that cannot be imported
+	failf func(string, ...interface{})
+	done  func()
+}
+
+func newImporter(acc, mailbox string, archive workers.Archive) *importer {
+	return &importer{
+		acc:     acc,
+		mailbox: mailbox,
+		archive: archive,
+		seen:    make(map[string]bool),
+	}
+}
+
+// messageId returns message-id found in header of raw mail
+func messageId(raw []byte) string {
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(header.Get("Message-Id"))
+}
+
+// next imports next mail of archive that is not known yet
+func (im *importer) next() {
+	for im.current < im.archive.Len() {
+		idx := im.current
+		im.current++
+		m, err := im.archive.Read(idx)
+		if err != nil {
+			im.fail(idx, "", err)
+			continue
+		}
+		messageid := messageId(m.Raw)
+		if messageid == "" {
+			// cannot tell whether it is known
+			im.append(idx, messageid, m)
+			return
+		}
+		if im.seen[messageid] {
+			im.skipped++
+			continue
+		}
+		im.seen[messageid] = true
+		App.PostDbMessage(&workers.HasMessageId{Mailbox: im.mailbox, MessageId: messageid}, im.acc, func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				im.fail(idx, messageid, r.Error)
+				im.next()
+			case *workers.HasMessageIdRes:
+				if r.Found {
+					im.skipped++
+					im.next()
+				} else {
+					im.append(idx, messageid, m)
+				}
+			}
+			return nil
+		})
+		return
+	}
+	im.messagef("%d mail(s) imported into %s, %d skipped (already there), %d failed",
+		im.imported, im.mailbox, im.skipped, im.failed)
+	if err := im.archive.Close(); err != nil {
+		App.logger.Warnf("cannot close archive %v", err)
+	}
+	if im.done != nil {
+		im.done()
+	}
+}
+
+func (im *importer) append(idx int, messageid string, m *workers.ArchivedMail) {
+	// mails marked for expunge in archive are imported as regular ones
+	flags := make([]string, 0, len(m.Flags))
+	for _, f := range m.Flags {
+		if f != imap.DeletedFlag {
+			flags = append(flags, f)
+		}
+	}
+	m.Flags = flags
+	App.PostImapMessage(
+		&workers.ImportMail{Mailbox: im.mailbox, Mail: m},
+		im.acc,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				im.fail(idx, messageid, r.Error)
+			case *workers.Done:
+				im.imported++
+				im.messagef("importing into %s: %d/%d", im.mailbox, im.current, im.archive.Len())
+			}
+			im.next()
+			return nil
+		})
+}
+
+func (im *importer) fail(idx int, messageid string, err error) {
+	im.failed++
+	App.logger.Errorf("cannot import mail %d %v (message-id: %s)", idx+1, err, messageid)
+	if im.failf != nil {
+		im.failf("mail %d %s: %v", idx+1, messageid, err)
+	}
+}
+
+// importArchive applies import command ev, importing archive into mailbox
+// shown by mv unless another one is given
+func (mv *MailboxView) importArchive(ev *lib.Event) {
+	args, _ := ev.Payload.(lib.CmdArgs)
+	if args["path"] == "" {
+		mv.Messagef("missing archive (e.g. `import path:~/old.mbox`)")
+		return
+	}
+	mailbox := mv.mbox.Name
+	if args["mailbox"] != "" {
+		mailbox = args["mailbox"]
+	}
+	if mailbox == "" {
+		mv.Messagef("missing destination (e.g. `import path:~/old.mbox mailbox:INBOX`)")
+		return
+	}
+	if acc := App.window.account(mv.accountName); acc == nil || acc.BackendType() != config.BACKEND_IMAP {
+		mv.Messagef("mails can only be imported into an imap account")
+		return
+	}
+	archive, err := openArchive(args["path"])
+	if err != nil {
+		mv.Messagef("cannot open archive: %v", err)
+		return
+	}
+	im := newImporter(mv.accountName, mailbox, archive)
+	im.messagef = mv.Messagef
+	im.done = func() {
+		App.window.SyncMailbox(mv.accountName, mailbox)
+	}
+	im.next()
+}
+
+// RunImport imports mails of archive found at path (mbox file or maildir)
+// into mailbox of account accname, without any screen. Progress is printed
+// on stdout and failures on stderr
+func RunImport(l *lib.Logger, cfg *config.Config, accname, mailbox, path string) error {
+	var acc *config.Account
+	for _, c := range cfg.Accounts {
+		if c.Name == accname {
+			acc = c
+		}
+	}
+	if acc == nil {
+		return fmt.Errorf("unknown account `%s`", accname)
+	}
+	if acc.BackendType() != config.BACKEND_IMAP {
+		return fmt.Errorf("mails can only be imported into an imap account")
+	}
+	archive, err := openArchive(path)
+	if err != nil {
+		return err
+	}
+	if err = InitHeadlessApp(l, cfg); err != nil {
+		return err
+	}
+	im := newImporter(accname, mailbox, archive)
+	im.messagef = func(format string, args ...interface{}) {
+		fmt.Printf("\r"+format, args...)
+	}
+	im.failf = func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "\rcannot import "+format+"\n", args...)
+	}
+	im.done = func() {
+		fmt.Println()
+		App.Stop()
+	}
+	App.RunHeadless(func() {
+		App.PostImapMessage(&workers.ConnectImap{}, accname, func(response workers.Message) error {
+			if r, ok := response.(*workers.Error); ok {
+				err = r.Error
+				App.Stop()
+				return nil
+			}
+			fmt.Printf("importing %d mail(s) into %s\n", archive.Len(), mailbox)
+			im.next()
+			return nil
+		})
+	})
+	if err != nil {
+		archive.Close()
+		return fmt.Errorf("cannot connect: %v", err)
+	}
+	if im.failed > 0 {
+		return fmt.Errorf("%d mail(s) cannot be imported", im.failed)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 
@@ -27,18 +28,30 @@ type MailView struct {
 	bindings  config.Mapping
 	partsView *MailPartsView
 	filters   config.Filters
-	onReadCb  func()
+	openers   config.Filters
+	// where parts are saved when no destination is given
+	downloadDir string
+	onReadCb    func()
+	onUnreadCb  func()
+	// called with account name, location, content and attachments of a
+	// draft to resume
+	onResumeDraftCb func(acc string, draft models.MailCopy, content string, attachments []string)
+	onAnswerCb      answerFunc
+	accName         string
+	mailbox         string
 	*widgets.BaseWidget
 }
 
-func NewMailView(bindings config.Mapping, partsBindings config.Mapping, filters config.Filters) *MailView {
+func NewMailView(bindings config.Mapping, partsBindings config.Mapping, filters, openers config.Filters, downloadDir string) *MailView {
 	b := widgets.BaseWidget{}
 	machine := sm.NewMailMachine()
 	mv := &MailView{
-		machine:    machine,
-		bindings:   bindings,
-		BaseWidget: &b,
-		filters:    filters,
+		machine:     machine,
+		bindings:    bindings,
+		BaseWidget:  &b,
+		filters:     filters,
+		openers:     openers,
+		downloadDir: downloadDir,
 	}
 	machine.OnTransition(func(s lib.StateType, ctx interface{}, ev *lib.Event) {
 		switch ev.Transition {
@@ -56,6 +69,28 @@ func NewMailView(bindings config.Mapping, partsBindings config.Mapping, filters
 			mv.partsView.AskingRedraw(func() {
 				mv.AskRedraw()
 			})
+			mv.partsView.OnSave(mv.savePart)
+			mv.partsView.OnOpen(mv.openPart)
+		case sm.TR_RESUME_DRAFT:
+			mv.resumeDraft(ctx.(*sm.MailMachineCtx))
+		case sm.TR_MOVE, sm.TR_COPY, sm.TR_DELETE, sm.TR_ARCHIVE:
+			state := ctx.(*sm.MailMachineCtx)
+			m := *state.Mail
+			m.Mailbox = mv.mailbox
+			applyMailsAction(ev, mv.accName, []*models.Mail{&m}, mv.Messagef, nil)
+		case sm.TR_SET_FLAG, sm.TR_UNSET_FLAG, sm.TR_TOGGLE_READ, sm.TR_TOGGLE_FLAGGED:
+			mv.applyFlags(ev, ctx.(*sm.MailMachineCtx).Mail)
+		case sm.TR_REPLY, sm.TR_REPLY_ALL, sm.TR_FORWARD:
+			state := ctx.(*sm.MailMachineCtx)
+			if mv.onAnswerCb != nil {
+				mv.onAnswerCb(ev, mv.accName, mv.mailbox, state.Mail, state.Filepath)
+			}
+		case sm.TR_EXPORT:
+			state := ctx.(*sm.MailMachineCtx)
+			m := *state.Mail
+			m.Mailbox = mv.mailbox
+			args, _ := ev.Payload.(lib.CmdArgs)
+			exportMails(mv.accName, []*models.Mail{&m}, args, mv.Messagef)
 		}
 	})
 	return mv
@@ -74,6 +109,8 @@ func (mv *MailView) TabTitle() string {
 }
 
 func (mv *MailView) SetMail(m *models.Mail, mailbox, acc string) {
+	mv.accName = acc
+	mv.mailbox = mailbox
 	ev := &lib.Event{sm.TR_SET_MAIL, m}
 	mv.machine.Send(ev)
 	App.PostImapMessage(
@@ -88,6 +125,7 @@ func (mv *MailView) SetMail(m *models.Mail, mailbox, acc string) {
 				if r.FromImap {
 					mv.MarkAsRead()
 					mv.SaveIndDb(mailbox, acc)
+					mv.index(acc, r.Filepath)
 				}
 				App.logger.Debugf("full mail received, `%v`", r.Filepath)
 			default:
@@ -113,6 +151,19 @@ func (mv *MailView) SaveIndDb(mailbox, acc string) {
 		})
 }
 
+// index adds full content of mail, now that it is fetched, to search index
+func (mv *MailView) index(acc, filepath string) {
+	App.PostDbMessage(
+		&workers.IndexMail{MailId: mv.state().Mail.Id, Filepath: filepath},
+		acc,
+		func(response workers.Message) error {
+			if r, ok := response.(*workers.Error); ok {
+				App.logger.Errorf("cannot index mail %v", r.Error)
+			}
+			return nil
+		})
+}
+
 func (mv *MailView) MarkAsRead() {
 	state := mv.state()
 	state.Mail.MarkAsRead()
@@ -125,6 +176,64 @@ func (mv *MailView) OnRead(f func()) {
 	mv.onReadCb = f
 }
 
+func (mv *MailView) OnUnread(f func()) {
+	mv.onUnreadCb = f
+}
+
+// applyFlags applies set-flag, unset-flag, toggle-read or toggle-flagged
+// command ev on displayed mail m
+func (mv *MailView) applyFlags(ev *lib.Event, m *models.Mail) {
+	m.Mailbox = mv.mailbox
+	wasUnread := m.IsUnread()
+	applyFlagsAction(ev, mv.accName, []*models.Mail{m}, mv.Messagef, func() {
+		if wasUnread && !m.IsUnread() && mv.onReadCb != nil {
+			mv.onReadCb()
+		} else if !wasUnread && m.IsUnread() && mv.onUnreadCb != nil {
+			mv.onUnreadCb()
+		}
+		wasUnread = m.IsUnread()
+		mv.AskRedraw()
+	})
+}
+
+func (mv *MailView) OnResumeDraft(f func(acc string, draft models.MailCopy, content string, attachments []string)) {
+	mv.onResumeDraftCb = f
+}
+
+func (mv *MailView) OnAnswer(f answerFunc) {
+	mv.onAnswerCb = f
+}
+
+// resumeDraft opens a compose tab prefilled with displayed mail, which is
+// replaced once mail is postponed again or sent
+func (mv *MailView) resumeDraft(state *sm.MailMachineCtx) {
+	if mv.onResumeDraftCb == nil {
+		return
+	}
+	f, err := os.Open(state.Filepath)
+	if err != nil {
+		App.logger.Errorf("cannot open filepath %v (filepath: %s)", err, state.Filepath)
+		mv.Messagef("cannot open draft")
+		return
+	}
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "nuntius-draft-*")
+	if err != nil {
+		App.logger.Errorf("cannot create tmp dir %v", err)
+		mv.Messagef("cannot read draft attachments")
+		return
+	}
+	content, attachments, err := models.ComposeContent(f, dir)
+	if err != nil {
+		App.logger.Errorf("cannot read draft %v", err)
+		mv.Messagef("cannot read draft: %v", err)
+		return
+	}
+	m := preferCopy(state.Mail, mv.mailbox)
+	draft := models.MailCopy{Uid: m.Uid, Mailbox: m.Mailbox}
+	mv.onResumeDraftCb(mv.accName, draft, content, attachments)
+}
+
 func (mv *MailView) onSelectPart(part *models.BodyPart) {
 	ev := &lib.Event{sm.TR_SHOW_MAIL_PART, part}
 	mv.machine.Send(ev)
@@ -257,3 +366,10 @@ func (mv *MailView) HandleEvent(ks []*lib.KeyStroke) bool {
 	}
 	return false
 }
+
+func (mv *MailView) HandleTransitions(ev *lib.Event) bool {
+	if mv.machine.Current == sm.STATE_SHOW_MAIL_PARTS {
+		return mv.partsView.HandleTransitions(ev)
+	}
+	return mv.machine.Send(ev)
+}
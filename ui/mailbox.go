@@ -19,32 +19,67 @@ type MailboxView struct {
 	errorListener     func(e error)
 	accountName       string
 	mbox              *models.Mailbox
+	// not empty when view lists result of this search instead of a mailbox
+	query string
+	// uids by mailbox of mails found by imap server for query
+	hits map[string][]uint32
 	*widgets.ListWidget
 }
 
 func NewMailboxView(accountName string, mbox *models.Mailbox, bindings config.Mapping, onSelect func(accname, mailbox string, t *models.Thread)) *MailboxView {
 	machine := sm.NewMailboxMachine()
 	l := widgets.NewList()
+	mv := &MailboxView{
+		machine:     machine,
+		accountName: accountName,
+		bindings:    bindings,
+		mbox:        mbox,
+		ListWidget:  l,
+	}
 	machine.OnTransition(func(s lib.StateType, ctx interface{}, ev *lib.Event) {
 		state := ctx.(*sm.MailboxMachineCtx)
 		switch ev.Transition {
 		case sm.TR_SELECT_THREAD:
-			onSelect(accountName, mbox.Name, state.Threads[state.Selected-1])
+			if len(state.Threads) > 0 {
+				onSelect(accountName, mbox.Name, state.Threads[state.Selected-1])
+			}
 		case sm.TR_UP_THREAD, sm.TR_DOWN_THREAD:
 			l.SetSelected(state.Selected)
+		case sm.TR_MOVE, sm.TR_COPY, sm.TR_DELETE, sm.TR_ARCHIVE:
+			if len(state.Threads) > 0 {
+				mv.applyOnThread(ev, state.Threads[state.Selected-1])
+			}
+		case sm.TR_SET_FLAG, sm.TR_UNSET_FLAG, sm.TR_TOGGLE_READ, sm.TR_TOGGLE_FLAGGED:
+			if len(state.Threads) > 0 {
+				mv.flagThread(ev, state.Threads[state.Selected-1])
+			}
+		case sm.TR_EXPORT:
+			if len(state.Threads) > 0 {
+				mv.applyOnThread(ev, state.Threads[state.Selected-1])
+			}
+		case sm.TR_EXPORT_MAILBOX:
+			mv.exportMailbox(ev)
+		case sm.TR_IMPORT:
+			mv.importArchive(ev)
+		case sm.TR_SORT:
+			mv.sort(ev)
 		}
 	})
-	return &MailboxView{
-		machine:     machine,
-		accountName: accountName,
-		bindings:    bindings,
-		mbox:        mbox,
-		ListWidget:  l,
-	}
+	return mv
+}
+
+// NewSearchView builds a view listing threads of account matching query
+func NewSearchView(accountName, query string, bindings config.Mapping, onSelect func(accname, mailbox string, t *models.Thread)) *MailboxView {
+	mv := NewMailboxView(accountName, &models.Mailbox{}, bindings, onSelect)
+	mv.query = query
+	return mv
 }
 
 // Tab interface
 func (mv *MailboxView) TabTitle() string {
+	if mv.query != "" {
+		return "\uf002 " + mv.query
+	}
 	name := mv.mbox.Name
 	if mv.mbox.ShortName != "" {
 		name = mv.mbox.ShortName
@@ -52,24 +87,263 @@ func (mv *MailboxView) TabTitle() string {
 	return "\uf674 " + name
 }
 
+func (mv *MailboxView) IsShowing(acc, mailbox string) bool {
+	return mv.query == "" && mv.accountName == acc && mv.mbox.Name == mailbox
+}
+
 func (mv *MailboxView) SetThreads(threads []*models.Thread) {
-	if len(threads) == 0 {
+	if len(threads) == 0 && mv.query == "" {
+		// mailbox is probably not yet synced, keep on loading
 		return
 	}
+	mv.showThreads(threads)
+}
+
+func (mv *MailboxView) showThreads(threads []*models.Thread) {
 	mv.machine.Send(&lib.Event{sm.TR_SET_THREADS, threads})
 	mv.ClearLines()
 	for _, t := range threads {
 		mv.AddLine(t)
 	}
+	if mv.GetViewPort() != nil {
+		mv.SetSelected(mv.machine.Context.(*sm.MailboxMachineCtx).Selected)
+	}
 	mv.AskRedraw()
 }
 
+// applyOnThread applies move, copy, delete, archive or export command ev on
+// mails of thread. Only mails of this mailbox (or their copies stored in it)
+// are concerned, unless view lists search results
+func (mv *MailboxView) applyOnThread(ev *lib.Event, thread *models.Thread) {
+	App.PostDbMessage(
+		&workers.FetchThread{RootId: thread.RootId},
+		mv.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				mv.Messagef("%v", r.Error)
+			case *workers.FetchThreadRes:
+				mails := make([]*models.Mail, 0, len(r.Mails))
+				for _, m := range threadMails(thread, r.Mails) {
+					if mv.query != "" {
+						mails = append(mails, m)
+					} else if c := m.In(mv.mbox.Name); c != nil {
+						mails = append(mails, c)
+					}
+				}
+				if ev.Transition == sm.TR_EXPORT {
+					args, _ := ev.Payload.(lib.CmdArgs)
+					exportMails(mv.accountName, mails, args, mv.Messagef)
+				} else {
+					applyMailsAction(ev, mv.accountName, mails, mv.Messagef, nil)
+				}
+			}
+			return nil
+		})
+}
+
+// threadMails returns mails of thread concerned by commands, i.e. only its
+// root in flat mode
+func threadMails(thread *models.Thread, mails []*models.Mail) []*models.Mail {
+	if !thread.Flat {
+		return mails
+	}
+	for _, m := range mails {
+		if m.Id == thread.RootId {
+			return []*models.Mail{m}
+		}
+	}
+	return []*models.Mail{}
+}
+
+// sort applies sort command ev. Without arguments, current sort is shown
+func (mv *MailboxView) sort(ev *lib.Event) {
+	args, _ := ev.Payload.(lib.CmdArgs)
+	if len(args) == 0 {
+		mv.Messagef("threads sorted by %s", mv.mbox.Sort)
+		return
+	}
+	sort, err := mv.mbox.Sort.With(args["by"], args["order"], args["flat"])
+	if err != nil {
+		mv.Messagef("%v", err)
+		return
+	}
+	mv.mbox.Sort = sort
+	if mv.query != "" {
+		// search results have no mailbox to save sort in
+		mv.Search()
+		return
+	}
+	App.PostDbMessage(
+		&workers.SortMailbox{Mailbox: mv.mbox.Name, Sort: sort},
+		mv.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				mv.Messagef("%v", r.Error)
+			case *workers.SortMailboxRes:
+				mv.SetThreads(r.List)
+			}
+			return nil
+		})
+}
+
+// exportMailbox applies export-mailbox command ev on all mails of mailbox
+func (mv *MailboxView) exportMailbox(ev *lib.Event) {
+	if mv.query != "" {
+		mv.Messagef("search results are not a mailbox, export threads one by one")
+		return
+	}
+	args, _ := ev.Payload.(lib.CmdArgs)
+	App.PostDbMessage(
+		&workers.FetchMailboxMails{Mailbox: mv.mbox.Name},
+		mv.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				mv.Messagef("%v", r.Error)
+			case *workers.FetchMailboxMailsRes:
+				exportMails(mv.accountName, r.Mails, args, mv.Messagef)
+			}
+			return nil
+		})
+}
+
 func (mv *MailboxView) Error(err error) {
 	if mv.errorListener != nil {
 		mv.errorListener(err)
 	}
 }
 
+// Reload fetches again threads of this mailbox from db
+func (mv *MailboxView) Reload() {
+	if mv.query != "" {
+		mv.Search()
+		return
+	}
+	App.PostDbMessage(
+		&workers.FetchMailbox{Mailbox: mv.mbox.Name},
+		mv.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				App.logger.Errorf("reload mailbox %v", response)
+				mv.Error(r.Error)
+			case *workers.FetchMailboxRes:
+				mv.SetThreads(r.List)
+			}
+			return nil
+		})
+}
+
+// Search fetches threads matching query of this view from db
+func (mv *MailboxView) Search() {
+	App.PostDbMessage(
+		&workers.FetchSearch{Query: mv.query, Hits: mv.hits, Sort: mv.mbox.Sort},
+		mv.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				App.logger.Errorf("search %v", response)
+				mv.Messagef("search failed: %v", r.Error)
+			case *workers.FetchSearchRes:
+				if len(r.List) == 0 {
+					mv.Messagef("no mail matching `%s`", mv.query)
+				}
+				mv.SetThreads(r.List)
+			}
+			return nil
+		})
+}
+
+// SearchImap runs query of this view on imap server, found mails are saved
+// in db then listed along local results
+func (mv *MailboxView) SearchImap(mailboxes []string) {
+	mv.Messagef("searching on imap server…")
+	App.PostImapMessage(
+		&workers.SearchImap{Query: mv.query, Mailboxes: mailboxes},
+		mv.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				App.logger.Errorf("search imap %v", response)
+				mv.Messagef("%v", r.Error)
+			case *workers.SearchImapRes:
+				hits := make(map[string][]uint32)
+				for mailbox, mails := range r.Mails {
+					for _, m := range mails {
+						hits[mailbox] = append(hits[mailbox], m.Uid)
+					}
+					mv.saveHits(mailbox, mails)
+				}
+				mv.hits = hits
+				// db worker handles messages in order, so found mails are
+				// saved before searching again
+				mv.Search()
+			}
+			return nil
+		})
+}
+
+func (mv *MailboxView) saveHits(mailbox string, mails []*models.Mail) {
+	App.PostDbMessage(
+		&workers.InsertNewMessages{Mailbox: mailbox, Mails: mails, Partial: true},
+		mv.accountName,
+		func(response workers.Message) error {
+			if r, ok := response.(*workers.Error); ok {
+				App.logger.Errorf("cannot save mails found on imap server %v", r.Error)
+				mv.Messagef("cannot save mails found in `%s`: %v", mailbox, r.Error)
+			}
+			return nil
+		})
+}
+
+// flagThread applies set-flag, unset-flag, toggle-read or toggle-flagged
+// command ev on every mail of thread
+func (mv *MailboxView) flagThread(ev *lib.Event, thread *models.Thread) {
+	App.PostDbMessage(
+		&workers.FetchThread{RootId: thread.RootId},
+		mv.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				mv.Messagef("%v", r.Error)
+			case *workers.FetchThreadRes:
+				mails := threadMails(thread, r.Mails)
+				seen := countSeen(mails)
+				applyFlagsAction(ev, mv.accountName, mails, mv.Messagef, func() {
+					now := countSeen(mails)
+					thread.UpdateSeen(seen, now)
+					seen = now
+					mv.AskRedraw()
+				})
+			}
+			return nil
+		})
+}
+
+// Sync shows threads of this mailbox known in db, then asks imap server what
+// changed since
+func (mv *MailboxView) Sync() {
+	App.PostDbMessage(
+		&workers.FetchMailbox{Mailbox: mv.mbox.Name},
+		mv.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				App.logger.Errorf("fetchmailbox res %v", response)
+				mv.Messagef("%v", r.Error)
+			case *workers.FetchMailboxRes:
+				mv.mbox.UidValidity = r.UidValidity
+				mv.mbox.HighestModSeq = r.HighestModSeq
+				mv.mbox.Sort = r.Sort
+				mv.SetThreads(r.List)
+				mv.Refresh(r.LastSeenUid)
+			}
+			return nil
+		})
+}
+
 func (mv *MailboxView) Refresh(lastuid uint32) {
 	mv.FetchNewMessages(lastuid)
 	mv.FetchUpdateMessages(lastuid)
@@ -77,7 +351,12 @@ func (mv *MailboxView) Refresh(lastuid uint32) {
 
 func (mv *MailboxView) FetchUpdateMessages(lastuid uint32) {
 	App.PostImapMessage(
-		&workers.FetchMessageUpdates{Mailbox: mv.mbox.Name, LastSeenUid: lastuid},
+		&workers.FetchMessageUpdates{
+			Mailbox:       mv.mbox.Name,
+			LastSeenUid:   lastuid,
+			UidValidity:   mv.mbox.UidValidity,
+			HighestModSeq: mv.mbox.HighestModSeq,
+		},
 		mv.accountName,
 		func(response workers.Message) error {
 			switch r := response.(type) {
@@ -85,7 +364,7 @@ func (mv *MailboxView) FetchUpdateMessages(lastuid uint32) {
 				App.logger.Errorf("fetch update messages %v", response)
 				mv.Error(r.Error)
 			case *workers.FetchMessageUpdatesRes:
-				mv.updateDb(r.Mails, lastuid)
+				mv.updateDb(r.MailsChanges, lastuid)
 			}
 			return nil
 		})
@@ -93,7 +372,11 @@ func (mv *MailboxView) FetchUpdateMessages(lastuid uint32) {
 
 func (mv *MailboxView) FetchNewMessages(lastuid uint32) {
 	App.PostImapMessage(
-		&workers.FetchNewMessages{Mailbox: mv.mbox.Name, LastSeenUid: lastuid},
+		&workers.FetchNewMessages{
+			Mailbox:     mv.mbox.Name,
+			LastSeenUid: lastuid,
+			UidValidity: mv.mbox.UidValidity,
+		},
 		mv.accountName,
 		func(response workers.Message) error {
 			switch r := response.(type) {
@@ -101,18 +384,27 @@ func (mv *MailboxView) FetchNewMessages(lastuid uint32) {
 				App.logger.Errorf("fetch new message res %v", response)
 				mv.Error(r.Error)
 			case *workers.FetchNewMessagesRes:
-				mv.insertDb(r.Mails)
+				if r.Reset {
+					mv.mbox.HighestModSeq = 0
+					mv.Messagef("`%s` was renumbered by imap server, its mails are fetched again", mv.mbox.Name)
+				}
+				if len(r.Mails) > 0 || r.Reset || r.UidValidity != mv.mbox.UidValidity {
+					mv.mbox.UidValidity = r.UidValidity
+					mv.insertDb(r.Mails, r.UidValidity, r.Reset)
+				}
 			}
 			return nil
 		})
 }
 
-func (mv *MailboxView) updateDb(mails []*models.Mail, lastuid uint32) {
-	if len(mails) == 0 {
+func (mv *MailboxView) updateDb(changes workers.MailsChanges, lastuid uint32) {
+	if len(changes.Mails) == 0 && len(changes.Vanished) == 0 && changes.Uids == nil &&
+		changes.HighestModSeq == mv.mbox.HighestModSeq {
 		return
 	}
+	mv.mbox.HighestModSeq = changes.HighestModSeq
 	App.PostDbMessage(
-		&workers.UpdateMessages{Mailbox: mv.mbox.Name, Mails: mails, LastSeenUid: lastuid},
+		&workers.UpdateMessages{Mailbox: mv.mbox.Name, LastSeenUid: lastuid, MailsChanges: changes},
 		mv.accountName,
 		func(response workers.Message) error {
 			switch r := response.(type) {
@@ -126,12 +418,16 @@ func (mv *MailboxView) updateDb(mails []*models.Mail, lastuid uint32) {
 		})
 }
 
-func (mv *MailboxView) insertDb(mails []*models.Mail) {
-	if len(mails) == 0 {
-		return
-	}
+// insertDb saves new mails of this mailbox, dropping the ones already known
+// when reset is true
+func (mv *MailboxView) insertDb(mails []*models.Mail, uidvalidity uint32, reset bool) {
 	App.PostDbMessage(
-		&workers.InsertNewMessages{Mailbox: mv.mbox.Name, Mails: mails},
+		&workers.InsertNewMessages{
+			Mailbox:     mv.mbox.Name,
+			Mails:       mails,
+			UidValidity: uidvalidity,
+			Reset:       reset,
+		},
 		mv.accountName,
 		func(response workers.Message) error {
 			switch r := response.(type) {
@@ -0,0 +1,105 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+	sm "github.com/stregouet/nuntius/statesmachines"
+	"github.com/stregouet/nuntius/workers"
+	"github.com/stregouet/nuntius/workers/imap"
+)
+
+// mailsActionMsg builds message asking imap worker to apply move, copy,
+// delete or archive command ev on mails with uids of mailbox
+func mailsActionMsg(ev *lib.Event, mailbox string, uids []uint32) (workers.Message, error) {
+	args, _ := ev.Payload.(lib.CmdArgs)
+	switch ev.Transition {
+	case sm.TR_MOVE, sm.TR_COPY:
+		dest := args["mailbox"]
+		if dest == "" {
+			return nil, errors.New("missing destination (e.g. `move mailbox:INBOX`)")
+		}
+		if dest == mailbox {
+			return nil, fmt.Errorf("mails are already in `%s`", dest)
+		}
+		return &workers.MoveMails{
+			Mailbox: mailbox,
+			Uids:    uids,
+			Dest:    dest,
+			Copy:    ev.Transition == sm.TR_COPY,
+		}, nil
+	case sm.TR_ARCHIVE:
+		return &workers.ArchiveMails{Mailbox: mailbox, Uids: uids}, nil
+	case sm.TR_DELETE:
+		return &workers.DeleteMails{
+			Mailbox:     mailbox,
+			Uids:        uids,
+			Permanently: args["permanently"] == "yes",
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected transition %s", ev.Transition)
+}
+
+// applyMailsAction applies move, copy, delete or archive command ev on
+// mails, possibly stored in several mailboxes, on imap server then in db.
+// done is called for each mailbox once it is updated
+func applyMailsAction(ev *lib.Event, acc string, mails []*models.Mail, messagef func(string, ...interface{}), done func()) {
+	uids := make(map[string][]uint32)
+	for _, m := range mails {
+		uids[m.Mailbox] = append(uids[m.Mailbox], m.Uid)
+	}
+	for mailbox, mboxUids := range uids {
+		msg, err := mailsActionMsg(ev, mailbox, mboxUids)
+		if err != nil {
+			messagef("%v", err)
+			return
+		}
+		count := len(mboxUids)
+		App.PostImapMessage(msg, acc, func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				if errors.Is(r.Error, imap.ErrNoTrash) {
+					messagef("%v, or use `delete permanently:yes`", r.Error)
+				} else {
+					messagef("%v", r.Error)
+				}
+			case *workers.Done:
+				messagef("%d mail(s) copied", count)
+				if done != nil {
+					done()
+				}
+			case *workers.MsgToDb:
+				App.PostDbMessage(r.Wrapped, acc, func(response workers.Message) error {
+					switch r := response.(type) {
+					case *workers.Error:
+						messagef("error updating db: %v", r.Error)
+					case *workers.RemoveMailsRes:
+						messagef("%d mail(s) %s", count, mailsActionDone(ev))
+						App.window.RemoveThreads(acc, r.Mailbox, r.Threads)
+						if done != nil {
+							done()
+						}
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+}
+
+func mailsActionDone(ev *lib.Event) string {
+	switch ev.Transition {
+	case sm.TR_MOVE:
+		args, _ := ev.Payload.(lib.CmdArgs)
+		return "moved to " + args["mailbox"]
+	case sm.TR_COPY:
+		args, _ := ev.Payload.(lib.CmdArgs)
+		return "copied to " + args["mailbox"]
+	case sm.TR_ARCHIVE:
+		return "archived"
+	}
+	return "deleted"
+}
@@ -0,0 +1,221 @@
+package ui
+
+import (
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+
+	"github.com/stregouet/nuntius/config"
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+	sm "github.com/stregouet/nuntius/statesmachines"
+	"github.com/stregouet/nuntius/widgets"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// OutboxView lists mails of account waiting to be sent
+type OutboxView struct {
+	machine     *lib.Machine
+	accountName string
+	bindings    config.Mapping
+	*widgets.ListWidget
+}
+
+func NewOutboxView(accountName string, bindings config.Mapping, onEdit func(acc string, m *models.OutboxMail)) *OutboxView {
+	machine := sm.NewOutboxMachine()
+	l := widgets.NewList()
+	ov := &OutboxView{
+		machine:     machine,
+		accountName: accountName,
+		bindings:    bindings,
+		ListWidget:  l,
+	}
+	machine.OnTransition(func(s lib.StateType, ctx interface{}, ev *lib.Event) {
+		state := ctx.(*sm.OutboxMachineCtx)
+		if len(state.Mails) == 0 {
+			return
+		}
+		selected := state.Mails[state.Selected-1]
+		switch ev.Transition {
+		case sm.TR_UP_OUTBOX, sm.TR_DOWN_OUTBOX:
+			l.SetSelected(state.Selected)
+		case sm.TR_OUTBOX_EDIT:
+			onEdit(accountName, selected)
+		case sm.TR_OUTBOX_RETRY:
+			ov.retry(selected)
+		case sm.TR_OUTBOX_CANCEL:
+			ov.cancel(selected)
+		}
+	})
+	return ov
+}
+
+// Tab interface
+func (ov *OutboxView) TabTitle() string {
+	return " outbox " + ov.accountName
+}
+
+// Reload fetches again outbox from db
+func (ov *OutboxView) Reload() {
+	App.PostDbMessage(
+		&workers.FetchOutbox{},
+		ov.accountName,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				ov.Messagef("%v", r.Error)
+			case *workers.FetchOutboxRes:
+				ov.setMails(r.Mails)
+			}
+			return nil
+		})
+}
+
+func (ov *OutboxView) setMails(mails []*models.OutboxMail) {
+	ov.machine.Send(&lib.Event{Transition: sm.TR_SET_OUTBOX, Payload: mails})
+	ov.ClearLines()
+	for _, m := range mails {
+		ov.AddLine(m)
+	}
+	if ov.GetViewPort() != nil {
+		ov.SetSelected(ov.machine.Context.(*sm.OutboxMachineCtx).Selected)
+	}
+	ov.AskRedraw()
+}
+
+// retry sends m right away, whatever its previous attempts
+func (ov *OutboxView) retry(m *models.OutboxMail) {
+	m.NextAttempt = time.Now()
+	App.PostDbMessage(&workers.QueueMail{Mail: m}, ov.accountName, func(response workers.Message) error {
+		switch r := response.(type) {
+		case *workers.Error:
+			ov.Messagef("%v", r.Error)
+		case *workers.QueueMailRes:
+			App.sendOutbox(ov.accountName, r.Mail, nil)
+		}
+		return nil
+	})
+}
+
+// cancel removes m from outbox, once imap worker is sure not to send it
+func (ov *OutboxView) cancel(m *models.OutboxMail) {
+	acc := ov.accountName
+	App.PostImapMessage(&workers.CancelOutboxMail{Id: m.Id}, acc, func(response workers.Message) error {
+		if r, ok := response.(*workers.Error); ok {
+			ov.Messagef("%v", r.Error)
+			return nil
+		}
+		App.PostDbMessage(&workers.DeleteOutboxMail{Id: m.Id}, acc, App.onOutboxSaved(acc))
+		return nil
+	})
+}
+
+func (ov *OutboxView) Draw() {
+	ov.Clear()
+	if ov.machine.Current == sm.STATE_LOAD_OUTBOX {
+		style := tcell.StyleDefault
+		ov.Print(0, 0, style, "loading...")
+	} else {
+		ov.ListWidget.Draw()
+	}
+}
+
+func (ov *OutboxView) HandleEvent(ks []*lib.KeyStroke) bool {
+	if cmd := ov.bindings.FindCommand(ks); cmd != "" {
+		mev, err := ov.machine.BuildEvent(cmd)
+		if err != nil {
+			App.logger.Errorf("error building machine event from `%s` (%v)", cmd, err)
+			return false
+		}
+		if ov.machine.Send(mev) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ov *OutboxView) HandleTransitions(ev *lib.Event) bool {
+	return ov.machine.Send(ev)
+}
+
+// sendOutbox asks imap worker to send m in background, onSent (if not nil)
+// is called once it is sent
+func (app *Application) sendOutbox(acc string, m *models.OutboxMail, onSent func()) {
+	if onSent != nil {
+		app.outboxSent[m.Id] = onSent
+	}
+	app.PostImapMessage(&workers.SendOutbox{Mails: []*models.OutboxMail{m}}, acc, app.onSendOutbox(acc))
+	app.window.ReloadOutbox(acc)
+}
+
+// onSendOutbox reports worker refusing to send outbox mails, outcome of
+// sending each mail is told later by OutboxNotif
+func (app *Application) onSendOutbox(acc string) func(workers.Message) error {
+	return func(response workers.Message) error {
+		if r, ok := response.(*workers.Error); ok {
+			app.window.Errorf("%s: cannot send outbox mails: %v", acc, r.Error)
+		}
+		return nil
+	}
+}
+
+// resumeOutbox asks imap worker to send mails left in outbox of account by a
+// previous run
+func (app *Application) resumeOutbox(acc string) {
+	app.PostDbMessage(&workers.FetchOutbox{}, acc, func(response workers.Message) error {
+		switch r := response.(type) {
+		case *workers.Error:
+			app.window.Errorf("%s: %v", acc, r.Error)
+		case *workers.FetchOutboxRes:
+			if len(r.Mails) > 0 {
+				app.PostImapMessage(&workers.SendOutbox{Mails: r.Mails}, acc, app.onSendOutbox(acc))
+			}
+		}
+		return nil
+	})
+}
+
+// onOutboxNotif saves outcome of an attempt to send an outbox mail
+func (app *Application) onOutboxNotif(acc string, r *workers.OutboxNotif) {
+	m := r.Mail
+	if !r.Sent {
+		app.window.Errorf("%s: cannot send mail `%s` (attempt %d): %v", acc, m.Subject, m.Attempts, r.Error)
+		app.PostDbMessage(&workers.QueueMail{Mail: m}, acc, app.onOutboxSaved(acc))
+		return
+	}
+	if r.Error != nil {
+		app.window.Errorf("%s: %v", acc, r.Error)
+	} else if r.Pending != nil {
+		app.window.ShowMessagef("%s: mail `%s` sent, saved in sent mailbox once connected", acc, m.Subject)
+		app.PostDbMessage(&workers.QueueAction{Action: r.Pending}, acc, app.onPendingCount(acc))
+	} else {
+		app.window.ShowMessagef("%s: mail `%s` sent", acc, m.Subject)
+	}
+	if onSent, ok := app.outboxSent[m.Id]; ok {
+		delete(app.outboxSent, m.Id)
+		onSent()
+	}
+	app.PostDbMessage(&workers.DeleteOutboxMail{Id: m.Id}, acc, app.onOutboxSaved(acc))
+	if r.ToDb == nil {
+		return
+	}
+	app.PostDbMessage(r.ToDb, acc, func(response workers.Message) error {
+		if r, ok := response.(*workers.Error); ok {
+			app.window.Errorf("%s: error saving sent mail in db: %v", acc, r.Error)
+			return nil
+		}
+		app.window.ReloadMailboxes(acc)
+		return nil
+	})
+}
+
+func (app *Application) onOutboxSaved(acc string) PostCallback {
+	return func(response workers.Message) error {
+		if r, ok := response.(*workers.Error); ok {
+			app.window.Errorf("%s: %v", acc, r.Error)
+			return nil
+		}
+		app.window.ReloadOutbox(acc)
+		return nil
+	}
+}
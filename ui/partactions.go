@@ -0,0 +1,100 @@
+package ui
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/emersion/go-message"
+
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+)
+
+// readPart parses cached mail file and returns part located at bp
+func (mv *MailView) readPart(bp *models.BodyPart) (*message.Entity, *os.File, error) {
+	f, err := os.Open(mv.state().Filepath)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := message.Read(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	part, err := models.FindPart(msg, bp.Path)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return part, f, nil
+}
+
+func (mv *MailView) savePart(bp *models.BodyPart, dest string) {
+	if dest == "" {
+		dest = mv.downloadDir + "/"
+	}
+	dest, err := lib.ExpandHome(dest)
+	if err != nil {
+		mv.Messagef("cannot save part: %v", err)
+		return
+	}
+	part, f, err := mv.readPart(bp)
+	if err != nil {
+		App.logger.Errorf("cannot read part %v (filepath: %s)", err, mv.state().Filepath)
+		mv.Messagef("cannot read part: %v", err)
+		return
+	}
+	defer f.Close()
+	saved, err := models.SavePart(part, bp.Path, dest)
+	if err != nil {
+		mv.Messagef("cannot save part: %v", err)
+		return
+	}
+	mv.Messagef("part saved to %s", saved)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// openPart writes part in a temporary directory and hands it to the opener
+// configured for its mime type
+func (mv *MailView) openPart(bp *models.BodyPart) {
+	opener := bp.FindMatch(mv.openers)
+	if opener == "" {
+		mv.Messagef("no opener configured for %s/%s", bp.MIMEType, bp.MIMESubType)
+		return
+	}
+	part, f, err := mv.readPart(bp)
+	if err != nil {
+		App.logger.Errorf("cannot read part %v (filepath: %s)", err, mv.state().Filepath)
+		mv.Messagef("cannot read part: %v", err)
+		return
+	}
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "nuntius-part-*")
+	if err != nil {
+		mv.Messagef("cannot create tmp dir: %v", err)
+		return
+	}
+	saved, err := models.SavePart(part, bp.Path, dir)
+	if err != nil {
+		mv.Messagef("cannot write part: %v", err)
+		return
+	}
+	cmd := exec.Command("sh", "-c", opener+" "+shellQuote(saved))
+	if err := cmd.Start(); err != nil {
+		App.logger.Errorf("error running opener %v", err)
+		mv.Messagef("cannot run opener `%s`", opener)
+		return
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			App.logger.Errorf("opener `%s` failed %v", opener, err)
+		}
+		os.RemoveAll(filepath.Dir(saved))
+	}()
+}
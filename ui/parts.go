@@ -11,18 +11,32 @@ import (
 type MailPartsView struct {
 	machine  *lib.Machine
 	bindings config.Mapping
+	onSaveCb func(part *models.BodyPart, dest string)
+	onOpenCb func(part *models.BodyPart)
 	*widgets.TreeWidget
 }
 
 func NewMailPartsView(bindings config.Mapping, parts []*models.BodyPart, onSelect func(part *models.BodyPart)) *MailPartsView {
 	machine := sm.NewMailPartsMachine(parts)
-	mp := &MailPartsView{machine, bindings, nil}
+	mp := &MailPartsView{machine: machine, bindings: bindings}
 	t := widgets.NewTreeWithInitSelected(mp.state().Selected)
 	machine.OnTransition(func(s lib.StateType, ctx interface{}, ev *lib.Event) {
 		state := ctx.(*sm.MailPartsMachineCtx)
 		switch ev.Transition {
 		case sm.TR_SELECT_PART:
 			onSelect(state.Parts[state.Selected-1])
+		case sm.TR_SAVE_PART:
+			if mp.onSaveCb != nil {
+				var dest string
+				if args, ok := ev.Payload.(lib.CmdArgs); ok {
+					dest = args["path"]
+				}
+				mp.onSaveCb(state.Parts[state.Selected-1], dest)
+			}
+		case sm.TR_OPEN_PART:
+			if mp.onOpenCb != nil {
+				mp.onOpenCb(state.Parts[state.Selected-1])
+			}
 		case sm.TR_MAIL_PARTS_UP, sm.TR_MAIL_PARTS_DOWN, sm.TR_SET_SELECTED_PART:
 			t.SetSelected(state.Selected)
 			t.AskRedraw()
@@ -35,6 +49,20 @@ func NewMailPartsView(bindings config.Mapping, parts []*models.BodyPart, onSelec
 	return mp
 }
 
+// OnSave registers f to be called with selected part and destination given
+// by user (possibly empty) upon save-part command
+func (mp *MailPartsView) OnSave(f func(part *models.BodyPart, dest string)) {
+	mp.onSaveCb = f
+}
+
+func (mp *MailPartsView) OnOpen(f func(part *models.BodyPart)) {
+	mp.onOpenCb = f
+}
+
+func (mp *MailPartsView) HandleTransitions(ev *lib.Event) bool {
+	return mp.machine.Send(ev)
+}
+
 func (mp *MailPartsView) state() *sm.MailPartsMachineCtx {
 	return mp.machine.Context.(*sm.MailPartsMachineCtx)
 }
@@ -0,0 +1,82 @@
+package ui
+
+import (
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// onQueued records action which could not reach imap server, and returns
+// the response callback should get meanwhile
+func (app *Application) onQueued(q *workers.Queued) workers.Message {
+	acc := q.GetAccName()
+	app.PostDbMessage(&workers.QueueAction{Action: q.Action}, acc, app.onPendingCount(acc))
+	if q.Result == nil {
+		return q
+	}
+	return q.Result
+}
+
+func (app *Application) onPendingCount(acc string) PostCallback {
+	return func(response workers.Message) error {
+		switch r := response.(type) {
+		case *workers.Error:
+			app.window.Errorf("%s: %v", acc, r.Error)
+		case *workers.PendingCountRes:
+			app.window.SetPendingCount(acc, r.Count)
+		}
+		return nil
+	}
+}
+
+// syncPendingActions shows how many actions of account are pending and, when
+// replay is true, asks imap worker to replay them
+func (app *Application) syncPendingActions(acc string, replay bool) {
+	app.PostDbMessage(&workers.FetchPendingActions{}, acc, func(response workers.Message) error {
+		switch r := response.(type) {
+		case *workers.Error:
+			app.window.Errorf("%s: %v", acc, r.Error)
+		case *workers.FetchPendingActionsRes:
+			app.window.SetPendingCount(acc, len(r.Actions))
+			if replay && len(r.Actions) > 0 && !app.replaying[acc] {
+				app.replayPendingActions(acc, r.Actions)
+			}
+		}
+		return nil
+	})
+}
+
+func (app *Application) replayPendingActions(acc string, actions []*models.PendingAction) {
+	app.replaying[acc] = true
+	app.PostImapMessage(&workers.ReplayPendingActions{Actions: actions}, acc, func(response workers.Message) error {
+		switch r := response.(type) {
+		case *workers.Error:
+			app.replaying[acc] = false
+			app.window.Errorf("%s: cannot replay pending actions (%v)", acc, r.Error)
+		case *workers.ReplayPendingActionsRes:
+			for _, msg := range r.ToDb {
+				app.PostDbMessage(msg, acc, func(response workers.Message) error {
+					switch r := response.(type) {
+					case *workers.Error:
+						app.window.Errorf("%s: error updating db: %v", acc, r.Error)
+					case *workers.RemoveMailsRes:
+						app.window.RemoveThreads(acc, r.Mailbox, r.Threads)
+					case *workers.InsertNewMessagesRes:
+						app.window.ReloadMailboxes(acc)
+					}
+					return nil
+				})
+			}
+			onCount := app.onPendingCount(acc)
+			app.PostDbMessage(&workers.RemovePendingActions{Ids: r.Done}, acc, func(response workers.Message) error {
+				app.replaying[acc] = false
+				return onCount(response)
+			})
+			if r.Dropped > 0 {
+				app.window.Errorf("%s: %d pending action(s) dropped, they conflict with imap server", acc, r.Dropped)
+			} else if len(r.Done) > 0 {
+				app.window.ShowMessagef("%s: %d pending action(s) replayed", acc, len(r.Done))
+			}
+		}
+		return nil
+	})
+}
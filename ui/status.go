@@ -1,6 +1,7 @@
 package ui
 
 import (
+	"strings"
 	"time"
 
 	"github.com/gdamore/tcell/v2"
@@ -27,7 +28,7 @@ func NewStatus(msg string, onEndCmd func(string)) *Status {
 	}
 	s.machine.OnTransition(func(state lib.StateType, ctx interface{}, ev *lib.Event) {
 		switch ev.Transition {
-		case sm.TR_STATUS_START_WRITING, sm.TR_STATUS_WRITE_CHAR, sm.TR_STATUS_MOVE_CURSOR, sm.TR_STATUS_RM_CHAR, sm.TR_STATUS_RM_WORD, sm.TR_STATUS_BROWSE_HISTORY:
+		case sm.TR_STATUS_START_WRITING, sm.TR_STATUS_WRITE_CHAR, sm.TR_STATUS_MOVE_CURSOR, sm.TR_STATUS_RM_CHAR, sm.TR_STATUS_RM_WORD, sm.TR_STATUS_BROWSE_HISTORY, sm.TR_STATUS_COMPLETE:
 			s.AskRedraw()
 		case sm.TR_STATUS_VALIDATE:
 			c := ctx.(*sm.StatusMachineCtx)
@@ -75,7 +76,11 @@ func (s *Status) Draw() {
 	if s.machine.Current == sm.STATE_STATUS_WRITE_CMD {
 		state := s.state()
 		s.ShowCursor(state.CursorPos+1, 0)
-		s.Print(0, 0, style, ":"+string(state.WriteContent))
+		offset := s.Print(0, 0, style, ":"+string(state.WriteContent))
+		if len(state.Completions) > 1 {
+			dim := style.Dim(true)
+			s.Print(offset+2, 0, dim, strings.Join(state.Completions, " "))
+		}
 	} else {
 		content := s.GetContent()
 		if s.tmpContent.Length() > 0 {
@@ -108,6 +113,9 @@ func (s *Status) HandleEvent(ks []*lib.KeyStroke) bool {
 	case tcell.KeyDown:
 		s.machine.Send(&lib.Event{sm.TR_STATUS_BROWSE_HISTORY, 1})
 		return true
+	case tcell.KeyTab:
+		s.machine.Send(&lib.Event{sm.TR_STATUS_COMPLETE, nil})
+		return true
 	case tcell.KeyEnter:
 		s.machine.Send(&lib.Event{sm.TR_STATUS_VALIDATE, nil})
 		return true
@@ -1,38 +1,138 @@
 package ui
 
 import (
+	"fmt"
+
+	"github.com/gdamore/tcell/v2"
+
 	"github.com/stregouet/nuntius/config"
 	"github.com/stregouet/nuntius/lib"
 	"github.com/stregouet/nuntius/models"
 	sm "github.com/stregouet/nuntius/statesmachines"
 	"github.com/stregouet/nuntius/widgets"
+	"github.com/stregouet/nuntius/workers"
 )
 
 type ThreadView struct {
-	machine  *lib.Machine
-	bindings config.Mapping
-	thread   *models.Thread
+	machine    *lib.Machine
+	bindings   config.Mapping
+	thread     *models.Thread
+	onAnswerCb answerFunc
 	*widgets.TreeWidget
 }
 
 func NewThreadView(accname, mailbox string, thread *models.Thread, bindings config.Mapping, onSelect func(accname, mailbox string, m *models.Mail, t *models.Thread)) *ThreadView {
 	t := widgets.NewTree()
 	machine := sm.NewThreadMachine()
+	tv := &ThreadView{
+		machine:    machine,
+		bindings:   bindings,
+		thread:     thread,
+		TreeWidget: t,
+	}
 	machine.OnTransition(func(s lib.StateType, ctx interface{}, ev *lib.Event) {
 		state := ctx.(*sm.ThreadMachineCtx)
 		switch ev.Transition {
 		case sm.TR_SELECT_MAIL:
-			onSelect(accname, mailbox, state.Mails[state.Selected-1], thread)
+			m := state.SelectedMail()
+			onSelect(accname, mailOrigin(m, mailbox), m, thread)
 		case sm.TR_UP_MAIL, sm.TR_DOWN_MAIL:
 			t.SetSelected(state.Selected)
+		case sm.TR_SET_MAILS, sm.TR_FOLD, sm.TR_UNFOLD, sm.TR_FOLD_ALL, sm.TR_UNFOLD_ALL:
+			tv.showMails(state)
+		case sm.TR_MOVE, sm.TR_COPY, sm.TR_DELETE, sm.TR_ARCHIVE:
+			if len(state.Mails) > 0 {
+				m := preferCopy(state.SelectedMail(), mailbox)
+				applyMailsAction(ev, accname, []*models.Mail{m}, tv.Messagef, func() {
+					tv.reload(accname)
+				})
+			}
+		case sm.TR_SET_FLAG, sm.TR_UNSET_FLAG, sm.TR_TOGGLE_READ, sm.TR_TOGGLE_FLAGGED:
+			if len(state.Mails) > 0 {
+				m := state.SelectedMail()
+				m.Mailbox = mailOrigin(m, mailbox)
+				seen := countSeen(state.Mails)
+				applyFlagsAction(ev, accname, []*models.Mail{m}, tv.Messagef, func() {
+					now := countSeen(state.Mails)
+					thread.UpdateSeen(seen, now)
+					seen = now
+					tv.AskRedraw()
+				})
+			}
+		case sm.TR_REPLY, sm.TR_REPLY_ALL, sm.TR_FORWARD:
+			if len(state.Mails) > 0 {
+				m := state.SelectedMail()
+				tv.answer(ev, accname, mailOrigin(m, mailbox), m)
+			}
+		case sm.TR_EXPORT:
+			if len(state.Mails) > 0 {
+				m := preferCopy(state.SelectedMail(), mailbox)
+				args, _ := ev.Payload.(lib.CmdArgs)
+				exportMails(accname, []*models.Mail{m}, args, tv.Messagef)
+			}
 		}
 	})
-	return &ThreadView{
-		machine:    machine,
-		bindings:   bindings,
-		thread:     thread,
-		TreeWidget: t,
+	return tv
+}
+
+// reload fetches again mails of thread from db
+func (tv *ThreadView) reload(accname string) {
+	App.PostDbMessage(
+		&workers.FetchThread{RootId: tv.thread.RootId},
+		accname,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				tv.Messagef("%v", r.Error)
+			case *workers.FetchThreadRes:
+				tv.SetMails(r.Mails)
+			}
+			return nil
+		})
+}
+
+func (tv *ThreadView) OnAnswer(f answerFunc) {
+	tv.onAnswerCb = f
+}
+
+// answer fetches content of selected mail, needed to quote it, before
+// answering it
+func (tv *ThreadView) answer(ev *lib.Event, accname, mailbox string, m *models.Mail) {
+	if tv.onAnswerCb == nil {
+		return
 	}
+	App.PostImapMessage(
+		&workers.FetchFullMail{Uid: m.Uid, Mailbox: mailbox},
+		accname,
+		func(response workers.Message) error {
+			switch r := response.(type) {
+			case *workers.Error:
+				tv.Messagef("error fetching mail content %v", r.Error)
+			case *workers.FetchFullMailRes:
+				tv.onAnswerCb(ev, accname, mailbox, m, r.Filepath)
+			}
+			return nil
+		})
+}
+
+// mailOrigin returns mailbox mail is stored in. A thread may gather mails
+// from several mailboxes (e.g. replies in sent mailbox, or search results)
+func mailOrigin(m *models.Mail, mailbox string) string {
+	if m.Mailbox != "" {
+		return m.Mailbox
+	}
+	return mailbox
+}
+
+// preferCopy returns a copy of m whose mailbox is set, preferably the one
+// stored in mailbox the thread was opened from, so that commands act there
+func preferCopy(m *models.Mail, mailbox string) *models.Mail {
+	if c := m.In(mailbox); c != nil && c != m {
+		return c
+	}
+	c := *m
+	c.Mailbox = mailOrigin(m, mailbox)
+	return &c
 }
 
 // Tab interface
@@ -42,11 +142,41 @@ func (tv *ThreadView) TabTitle() string {
 
 func (tv *ThreadView) SetMails(mails []*models.Mail) {
 	tv.machine.Send(&lib.Event{sm.TR_SET_MAILS, mails})
+}
+
+// showMails draws mails not hidden by a folded subtree
+func (tv *ThreadView) showMails(state *sm.ThreadMachineCtx) {
 	tv.ClearLines()
-	for _, mail := range mails {
-		tv.AddLine(mail)
+	for _, m := range state.Shown {
+		if state.Folded[m.Id] {
+			tv.AddLine(&foldedMail{m, state})
+		} else {
+			tv.AddLine(m)
+		}
 	}
-	tv.AskRedraw()
+	tv.SetSelected(state.Selected)
+}
+
+// foldedMail is a mail whose replies are hidden, shown with their count and
+// whether one of them is unread
+type foldedMail struct {
+	*models.Mail
+	state *sm.ThreadMachineCtx
+}
+
+func (f *foldedMail) StyledContent() []*widgets.ContentWithStyle {
+	count, unread := f.state.FoldedSummary(f.Mail)
+	if count == 0 {
+		return f.Mail.StyledContent()
+	}
+	summary := fmt.Sprintf(" [+%d]", count)
+	if unread {
+		summary += " *"
+	}
+	return append(f.Mail.StyledContent(), &widgets.ContentWithStyle{
+		Content: summary,
+		Style:   tcell.StyleDefault.Bold(unread),
+	})
 }
 
 func (tv *ThreadView) HandleEvent(ks []*lib.KeyStroke) bool {
@@ -62,3 +192,7 @@ func (tv *ThreadView) HandleEvent(ks []*lib.KeyStroke) bool {
 	}
 	return false
 }
+
+func (tv *ThreadView) HandleTransitions(ev *lib.Event) bool {
+	return tv.machine.Send(ev)
+}
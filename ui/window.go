@@ -3,7 +3,9 @@ package ui
 import (
 	"fmt"
 	// "os/exec"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/gdamore/tcell/v2/views"
@@ -23,16 +25,29 @@ type Window struct {
 	ex       *Status
 	bindings config.Keybindings
 	filters  config.Filters
+	openers  config.Filters
+	// where mail parts are saved by default
+	downloadDir string
+	accounts    []*config.Account
+	// connection state of each account, shown in status line
+	connStates map[string]string
+	// number of actions waiting for connection by account
+	pending map[string]int
 
 	triggerRedraw atomic.Value // bool
 }
 
 func NewWindow(cfg *config.Config) *Window {
 	w := &Window{
-		machine:  sm.NewWindowMachine(),
-		bindings: cfg.Keybindings,
-		filters:  cfg.Filters,
+		machine:     sm.NewWindowMachine(),
+		bindings:    cfg.Keybindings,
+		filters:     cfg.Filters,
+		openers:     cfg.Openers,
+		downloadDir: cfg.DownloadDir,
+		connStates:  make(map[string]string),
+		pending:     make(map[string]int),
 	}
+	w.accounts = cfg.Accounts
 	w.ex = NewStatus("ici c'est pour les commandes", w.OnExCmd)
 	w.machine.OnTransition(func(s lib.StateType, ctx interface{}, ev *lib.Event) {
 		if ev.Transition == sm.TR_CLOSE_APP {
@@ -44,8 +59,11 @@ func NewWindow(cfg *config.Config) *Window {
 			w.ex.machine.Send(&lib.Event{sm.TR_STATUS_START_WRITING, nil})
 		case sm.TR_COMPOSE_MAIL:
 			// XXX it should be possible to choose account user want to send mail with
-			c := NewComposeView(cfg.Accounts[0], w.bindings[config.KEY_MODE_COMPOSE])
-			w.addTab(c)
+			w.openCompose(cfg.Accounts[0].Name, "")
+		case sm.TR_SEARCH, sm.TR_SEARCH_IMAP:
+			w.openSearch(ev)
+		case sm.TR_OUTBOX:
+			w.openOutbox(ev)
 		case sm.TR_OPEN_TAB:
 			w.onOpenTab(ev)
 			w.AskRedraw()
@@ -86,6 +104,9 @@ func NewWindow(cfg *config.Config) *Window {
 				return nil
 			})
 		w.addTab(accwidget)
+		if c.CheckSend() == nil {
+			App.resumeOutbox(c.Name)
+		}
 	}
 
 	return w
@@ -117,32 +138,178 @@ func (w *Window) state() *sm.WindowMachineCtx {
 
 func (w *Window) onSelectMailbox(acc string, mailbox *models.Mailbox) {
 	mv := NewMailboxView(acc, mailbox, w.bindings[config.KEY_MODE_MBOX], w.onSelectThread)
-	App.PostDbMessage(
-		&workers.FetchMailbox{Mailbox: mailbox.Name},
-		acc,
-		func(response workers.Message) error {
-			switch r := response.(type) {
-			case *workers.Error:
-				App.logger.Errorf("fetchmailbox res %v", response)
-				w.ShowMessage(r.Error.Error())
-			case *workers.FetchMailboxRes:
-				mv.SetThreads(r.List)
-				mv.FetchNewMessages(r.LastSeenUid)
-				mv.FetchUpdateMessages(r.LastSeenUid)
-			default:
-				App.logger.Error("unknown response type")
-			}
-			return nil
-		})
+	mv.Sync()
 	w.addTab(mv)
 }
 
+// SyncMailbox syncs again every opened tab showing this mailbox
+func (w *Window) SyncMailbox(acc, mailbox string) {
+	for _, t := range w.state().Tabs {
+		if mv, ok := t.(*MailboxView); ok && mv.IsShowing(acc, mailbox) {
+			mv.Sync()
+		}
+	}
+}
+
+// openSearch opens a tab listing threads matching query given in ev, by
+// default in first account. With search-imap, mails found by imap server
+// (in given mailbox or in all of them) are listed as well
+func (w *Window) openSearch(ev *lib.Event) {
+	args, _ := ev.Payload.(lib.CmdArgs)
+	query := strings.TrimSpace(args["query"])
+	if query == "" {
+		w.Errorf("missing search query (e.g. `search query:\"from:alice is:unread\"`)")
+		return
+	}
+	acc := w.accounts[0].Name
+	if name, ok := args["account"]; ok {
+		if w.account(name) == nil {
+			w.Errorf("unknown account `%s`", name)
+			return
+		}
+		acc = name
+	}
+	sv := NewSearchView(acc, query, w.bindings[config.KEY_MODE_SEARCH], w.onSelectThread)
+	w.addTab(sv)
+	sv.Search()
+	if ev.Transition == sm.TR_SEARCH_IMAP {
+		mailboxes := []string{}
+		if mailbox := args["mailbox"]; mailbox != "" {
+			mailboxes = append(mailboxes, mailbox)
+		}
+		sv.SearchImap(mailboxes)
+	}
+}
+
+// openOutbox opens a tab listing outbox of account given as argument, or of
+// first account
+func (w *Window) openOutbox(ev *lib.Event) {
+	args, _ := ev.Payload.(lib.CmdArgs)
+	acc := w.accounts[0].Name
+	if name, ok := args["account"]; ok {
+		if w.account(name) == nil {
+			w.Errorf("unknown account `%s`", name)
+			return
+		}
+		acc = name
+	}
+	ov := NewOutboxView(acc, w.bindings[config.KEY_MODE_OUTBOX], w.editOutboxMail)
+	w.addTab(ov)
+	ov.Reload()
+}
+
+// ReloadOutbox refreshes every opened outbox tab of account
+func (w *Window) ReloadOutbox(acc string) {
+	for _, t := range w.state().Tabs {
+		if ov, ok := t.(*OutboxView); ok && ov.accountName == acc {
+			ov.Reload()
+		}
+	}
+}
+
+// editOutboxMail puts m on hold and opens it in a compose tab, sending it
+// from there replaces m in outbox
+func (w *Window) editOutboxMail(acc string, m *models.OutboxMail) {
+	cfg := w.account(acc)
+	if cfg == nil {
+		w.Errorf("unknown account `%s`", acc)
+		return
+	}
+	App.PostImapMessage(&workers.CancelOutboxMail{Id: m.Id}, acc, func(response workers.Message) error {
+		if r, ok := response.(*workers.Error); ok {
+			w.Errorf("%v", r.Error)
+			return nil
+		}
+		m.NextAttempt = time.Time{}
+		App.PostDbMessage(&workers.QueueMail{Mail: m}, acc, App.onOutboxSaved(acc))
+		c := NewComposeView(cfg, w.bindings[config.KEY_MODE_COMPOSE], m.Body)
+		for _, path := range m.Attachments {
+			c.Attach(path)
+		}
+		c.ReplaceOutboxMail(m)
+		w.addTab(c)
+		return nil
+	})
+}
+
+func (w *Window) SetConnectionState(acc string, notif *workers.ConnectionStateNotif) {
+	state := string(notif.State)
+	if notif.Attempt > 0 {
+		state = fmt.Sprintf("%s (attempt %d)", state, notif.Attempt)
+	}
+	w.connStates[acc] = state
+	if notif.State == workers.CONN_DISCONNECTED && notif.Error != nil {
+		w.Errorf("%s: connection to imap server lost (%v)", acc, notif.Error)
+	}
+	w.showConnectionStates()
+}
+
+// SetPendingCount updates number of actions of account waiting to be
+// replayed on imap server
+func (w *Window) SetPendingCount(acc string, count int) {
+	w.pending[acc] = count
+	w.showConnectionStates()
+}
+
+func (w *Window) showConnectionStates() {
+	parts := make([]string, 0, len(w.accounts))
+	for _, a := range w.accounts {
+		s, ok := w.connStates[a.Name]
+		if !ok {
+			continue
+		}
+		if count := w.pending[a.Name]; count > 0 {
+			s = fmt.Sprintf("%s (%d pending)", s, count)
+		}
+		parts = append(parts, a.Name+": "+s)
+	}
+	w.ex.SetContent(strings.Join(parts, " | "))
+	w.AskRedraw()
+}
+
+// SetMailboxThreads refreshes every opened tab showing this mailbox
+func (w *Window) SetMailboxThreads(acc, mailbox string, threads []*models.Thread) {
+	for _, t := range w.state().Tabs {
+		if mv, ok := t.(*MailboxView); ok && mv.IsShowing(acc, mailbox) {
+			mv.SetThreads(threads)
+		}
+	}
+}
+
+// RemoveThreads updates opened tabs once mails have been removed from
+// mailbox, threads are the ones remaining in this mailbox
+func (w *Window) RemoveThreads(acc, mailbox string, threads []*models.Thread) {
+	for _, t := range w.state().Tabs {
+		mv, ok := t.(*MailboxView)
+		if !ok || mv.accountName != acc {
+			continue
+		}
+		if mv.IsShowing(acc, mailbox) {
+			mv.showThreads(threads)
+		} else if mv.query != "" {
+			mv.Reload()
+		}
+	}
+	w.AskRedraw()
+}
+
+// ReloadMailboxes reloads from db every opened mailbox of this account
+func (w *Window) ReloadMailboxes(acc string) {
+	for _, t := range w.state().Tabs {
+		if mv, ok := t.(*MailboxView); ok && mv.accountName == acc {
+			mv.Reload()
+		}
+	}
+}
+
 func (w *Window) onSelectThread(acc, mailbox string, thread *models.Thread) {
 	var tab sm.Tab
 	if thread.Count == 1 {
 		tab = w.buildMailView(thread)
 	} else {
-		tab = NewThreadView(acc, mailbox, thread, w.bindings[config.KEY_MODE_THREAD], w.onSelectMail)
+		tv := NewThreadView(acc, mailbox, thread, w.bindings[config.KEY_MODE_THREAD], w.onSelectMail)
+		tv.OnAnswer(w.answer)
+		tab = tv
 	}
 	App.PostDbMessage(
 		&workers.FetchThread{RootId: thread.RootId},
@@ -154,7 +321,15 @@ func (w *Window) onSelectThread(acc, mailbox string, thread *models.Thread) {
 			case *workers.FetchThreadRes:
 				switch t := tab.(type) {
 				case *MailView:
-					t.SetMail(r.Mails[0], mailbox, acc)
+					// thread of a single mail, or mail listed alone in flat
+					// mode
+					m := preferCopy(r.Mails[0], mailbox)
+					for _, other := range r.Mails {
+						if other.Id == thread.RootId {
+							m = preferCopy(other, mailbox)
+						}
+					}
+					t.SetMail(m, m.Mailbox, acc)
 				case *ThreadView:
 					t.SetMails(r.Mails)
 				}
@@ -167,17 +342,63 @@ func (w *Window) onSelectThread(acc, mailbox string, thread *models.Thread) {
 }
 
 func (w *Window) buildMailView(thread *models.Thread) *MailView {
-	mv := NewMailView(w.bindings[config.KEY_MODE_MAIL], w.bindings[config.KEY_MODE_PARTS], w.filters)
+	mv := NewMailView(w.bindings[config.KEY_MODE_MAIL], w.bindings[config.KEY_MODE_PARTS], w.filters, w.openers, w.downloadDir)
 	mv.OnRead(func() {
 		App.logger.Debugf("one mail marked as read %d", thread.SeenCount)
 		thread.MarkOneAsRead()
 	})
+	mv.OnUnread(thread.MarkOneAsUnread)
+	mv.OnResumeDraft(w.resumeDraft)
+	mv.OnAnswer(w.answer)
 	return mv
 }
 
+func (w *Window) account(name string) *config.Account {
+	for _, a := range w.accounts {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// openCompose opens a compose tab for account acc, prefilled with content
+func (w *Window) openCompose(acc, content string) {
+	cfg := w.account(acc)
+	if cfg == nil {
+		w.Errorf("unknown account `%s`", acc)
+		return
+	}
+	if err := cfg.CheckSend(); err != nil {
+		w.Errorf("%v", err)
+		return
+	}
+	w.addTab(NewComposeView(cfg, w.bindings[config.KEY_MODE_COMPOSE], content))
+}
+
+// resumeDraft opens a compose tab for account acc on draft, with content
+// and attachments read from it
+func (w *Window) resumeDraft(acc string, draft models.MailCopy, content string, attachments []string) {
+	cfg := w.account(acc)
+	if cfg == nil {
+		w.Errorf("unknown account `%s`", acc)
+		return
+	}
+	if err := cfg.CheckSend(); err != nil {
+		w.Errorf("%v", err)
+		return
+	}
+	c := NewComposeView(cfg, w.bindings[config.KEY_MODE_COMPOSE], content)
+	for _, path := range attachments {
+		c.Attach(path)
+	}
+	c.ReplaceDraft(draft)
+	w.addTab(c)
+}
+
 func (w *Window) onSelectMail(acc, mailbox string, mail *models.Mail, thread *models.Thread) {
 	mv := w.buildMailView(thread)
-	mv.SetMail(mail, mailbox, acc)
+	mv.SetMail(mail, mailOrigin(mail, mailbox), acc)
 	w.addTab(mv)
 }
 
@@ -302,10 +523,19 @@ func (w *Window) HandleTransitions(ev *lib.Event) bool {
 	if w.ex.HandleTransitions(ev) {
 		return true
 	}
-	for _, t := range s.Tabs {
-		if t.HandleTransitions(ev) {
+	// current tab has precedence over other tabs
+	if s.Tabs[s.SelectedTab].HandleTransitions(ev) {
+		return true
+	}
+	for i, t := range s.Tabs {
+		if i != s.SelectedTab && t.HandleTransitions(ev) {
 			return true
 		}
 	}
-	return false
+	// finally command may target window itself, except opening a tab which
+	// cannot be done from a command
+	if ev.Transition == sm.TR_OPEN_TAB {
+		return false
+	}
+	return w.machine.Send(ev)
 }
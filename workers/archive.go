@@ -0,0 +1,20 @@
+package workers
+
+import "time"
+
+// Archive is a set of mails stored locally (e.g. an mbox file or a
+// maildir), read one after the other to be imported into an account
+type Archive interface {
+	Len() int
+	// Read returns i-th mail of archive, i starting at 0
+	Read(i int) (*ArchivedMail, error)
+	Close() error
+}
+
+// ArchivedMail is raw content of a mail found in an archive, along with its
+// flags and the date it was received at (zero when unknown)
+type ArchivedMail struct {
+	Raw   []byte
+	Flags []string
+	Date  time.Time
+}
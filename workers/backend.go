@@ -0,0 +1,67 @@
+package workers
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/lib"
+)
+
+// Backend serves requests about mailboxes and mails of one account (e.g.
+// FetchMailboxes, FetchNewMessages, FetchMessageUpdates, FetchFullMail),
+// whether they are stored on an imap server or in a local maildir
+type Backend interface {
+	// Run handles posted requests until Close is called, sending responses
+	// and notifications (messages with a zero id) to responses
+	Run(responses chan<- Message)
+	PostMessage(m Message)
+	Close()
+}
+
+// BackendWorker dispatches requests to the backend of their account
+type BackendWorker struct {
+	*BaseWorker
+	backends map[string]Backend
+
+	logger *lib.Logger
+}
+
+func NewBackendWorker(l *lib.Logger, backends map[string]Backend) *BackendWorker {
+	bw := &BaseWorker{
+		requests:  make(chan Message, 10),
+		responses: make(chan Message, 10),
+	}
+	return &BackendWorker{
+		BaseWorker: bw,
+		backends:   backends,
+		logger:     l,
+	}
+}
+
+func (w *BackendWorker) terminate() {
+	for _, b := range w.backends {
+		b.Close()
+	}
+}
+
+func (w *BackendWorker) postResponse(msg Message, id int) {
+	msg.SetId(id)
+	w.responses <- msg
+}
+
+func (w *BackendWorker) Run() {
+	defer lib.Recover(w.logger, nil)
+	for _, b := range w.backends {
+		go b.Run(w.responses)
+	}
+	defer w.terminate()
+	for msg := range w.requests {
+		if b, ok := w.backends[msg.GetAccName()]; ok {
+			b.PostMessage(msg)
+		} else {
+			r := &Error{
+				Error: errors.Errorf("no worker found for account `%s`", msg.GetAccName()),
+			}
+			w.postResponse(r, msg.GetId())
+		}
+	}
+}
@@ -3,10 +3,12 @@ package workers
 import (
 	"database/sql"
 	"fmt"
+	"os"
 
 	"github.com/pkg/errors"
 
 	ndb "github.com/stregouet/nuntius/database"
+	"github.com/stregouet/nuntius/database/migrations"
 	"github.com/stregouet/nuntius/lib"
 	"github.com/stregouet/nuntius/models"
 )
@@ -15,14 +17,16 @@ type Database struct {
 	*BaseWorker
 
 	logger *lib.Logger
+	// group mails in threads by subject as well as by references
+	threadBySubject bool
 }
 
-func NewDatabase(l *lib.Logger) *Database {
+func NewDatabase(l *lib.Logger, threadBySubject bool) *Database {
 	bw := &BaseWorker{
 		requests:  make(chan Message, 10),
 		responses: make(chan Message, 10),
 	}
-	return &Database{bw, l}
+	return &Database{BaseWorker: bw, logger: l, threadBySubject: threadBySubject}
 }
 
 func (d *Database) setup(db *sql.DB) error {
@@ -44,6 +48,9 @@ func (d *Database) setup(db *sql.DB) error {
 		}
 		return errors.Wrap(err, "while creating _migrations table")
 	}
+	migrations.Rethread = func(tx *sql.Tx) error {
+		return models.ThreadUnthreaded(tx, d.threadBySubject)
+	}
 	err = ndb.Migrate(tx)
 	if err != nil {
 		if rollerr := tx.Rollback(); rollerr != nil {
@@ -145,6 +152,88 @@ func (d *Database) handleMessage(db *sql.DB, msg Message) {
 			m = &FetchThreadRes{Mails: result}
 		}
 		d.postResponse(m, msg.GetId())
+	case *FetchSearch:
+		m, err := d.handleFetchSearch(db, msg)
+		if err != nil {
+			m = &Error{Error: err}
+			d.logger.Errorf("error while searching %v (query: %s)", err, msg.Query)
+		}
+		d.postResponse(m, msg.GetId())
+	case *IndexMail:
+		r, err := d.handleIndexMail(db, msg)
+		if err != nil {
+			r = &Error{Error: errors.New("cannot index mail")}
+			d.logger.Errorf("error while indexing mail %v (mailid: %d)", err, msg.MailId)
+		}
+		d.postResponse(r, msg.GetId())
+	case *RemoveMails:
+		result, err := d.handleRemoveMails(db, msg)
+		var m Message
+		if err != nil {
+			m = &Error{Error: errors.New("cannot remove mails")}
+			d.logger.Errorf("error while removing mails %v", err)
+		} else {
+			m = &RemoveMailsRes{Mailbox: msg.Mailbox, Threads: result}
+		}
+		d.postResponse(m, msg.GetId())
+	case *CopyMails:
+		result, err := d.handleCopyMails(db, msg)
+		var m Message
+		if err != nil {
+			m = &Error{Error: errors.New("cannot record copied mails")}
+			d.logger.Errorf("error while recording copied mails %v", err)
+		} else {
+			m = &RemoveMailsRes{Mailbox: msg.Mailbox, Threads: result}
+		}
+		d.postResponse(m, msg.GetId())
+	case *QueueAction:
+		m, err := d.handleQueueAction(db, msg)
+		if err != nil {
+			m = &Error{Error: errors.New("cannot record action to replay")}
+			d.logger.Errorf("error while queueing action %v (kind: %s)", err, msg.Action.Kind)
+		}
+		d.postResponse(m, msg.GetId())
+	case *FetchPendingActions:
+		result, err := models.FetchPendingActions(db, msg.GetAccName())
+		var m Message
+		if err != nil {
+			m = &Error{Error: errors.New("cannot fetch pending actions")}
+			d.logger.Errorf("error while fetching pending actions %v", err)
+		} else {
+			m = &FetchPendingActionsRes{Actions: result}
+		}
+		d.postResponse(m, msg.GetId())
+	case *RemovePendingActions:
+		m, err := d.handleRemovePendingActions(db, msg)
+		if err != nil {
+			m = &Error{Error: errors.New("cannot remove pending actions")}
+			d.logger.Errorf("error while removing pending actions %v", err)
+		}
+		d.postResponse(m, msg.GetId())
+	case *QueueMail:
+		m, err := d.handleQueueMail(db, msg)
+		if err != nil {
+			m = &Error{Error: errors.New("cannot save mail in outbox")}
+			d.logger.Errorf("error while saving outbox mail %v", err)
+		}
+		d.postResponse(m, msg.GetId())
+	case *FetchOutbox:
+		result, err := models.FetchOutbox(db, msg.GetAccName())
+		var m Message
+		if err != nil {
+			m = &Error{Error: errors.New("cannot fetch outbox")}
+			d.logger.Errorf("error while fetching outbox %v", err)
+		} else {
+			m = &FetchOutboxRes{Mails: result}
+		}
+		d.postResponse(m, msg.GetId())
+	case *DeleteOutboxMail:
+		var m Message = &Done{}
+		if err := models.DeleteOutboxMail(db, msg.Id); err != nil {
+			m = &Error{Error: errors.New("cannot remove mail from outbox")}
+			d.logger.Errorf("error while deleting outbox mail %v (id: %d)", err, msg.Id)
+		}
+		d.postResponse(m, msg.GetId())
 	case *FetchMailbox:
 		m, err := d.handleFetchMailbox(db, msg)
 		if err != nil {
@@ -152,6 +241,33 @@ func (d *Database) handleMessage(db *sql.DB, msg Message) {
 			d.logger.Errorf("error while fetchingmailbox %v", err)
 		}
 		d.postResponse(m, msg.GetId())
+	case *SortMailbox:
+		m, err := d.handleSortMailbox(db, msg)
+		if err != nil {
+			m = &Error{Error: errors.New("cannot sort mailbox")}
+			d.logger.Errorf("error while sorting mailbox %v", err)
+		}
+		d.postResponse(m, msg.GetId())
+	case *FetchMailboxMails:
+		result, err := d.handleFetchMailboxMails(db, msg)
+		var m Message
+		if err != nil {
+			m = &Error{Error: errors.New("cannot fetch mailbox mails")}
+			d.logger.Errorf("error while fetching mailbox mails %v", err)
+		} else {
+			m = &FetchMailboxMailsRes{Mails: result}
+		}
+		d.postResponse(m, msg.GetId())
+	case *HasMessageId:
+		found, err := models.HasMessageId(db, msg.MessageId, msg.Mailbox, msg.GetAccName())
+		var m Message
+		if err != nil {
+			m = &Error{Error: errors.New("cannot search message-id")}
+			d.logger.Errorf("error while searching message-id %v", err)
+		} else {
+			m = &HasMessageIdRes{Found: found}
+		}
+		d.postResponse(m, msg.GetId())
 
 	}
 }
@@ -168,53 +284,49 @@ func (d *Database) handleInsertNewMessages(db *sql.DB, msg *InsertNewMessages) (
 		}
 		return errors.Wrap(err, msg)
 	}
-	// first insert mails on db
-	lastuid := uint32(0)
-	for _, m := range msg.Mails {
-		err = m.InsertInto(tx, msg.Mailbox, msg.GetAccName())
-		if err != nil {
-			return nil, rollback(err, fmt.Sprintf("while inserting mail (m: %#v)", m))
+	mbox := models.Mailbox{Name: msg.Mailbox, UidValidity: msg.UidValidity}
+	if msg.Reset {
+		if err = mbox.Reset(tx, msg.GetAccName()); err != nil {
+			return nil, rollback(err, "while removing mails no longer valid")
 		}
-		if m.Uid > lastuid {
-			lastuid = m.Uid
-		}
-	}
-	// update lastseenuid for this mailbox
-	m := models.Mailbox{Name: msg.Mailbox, LastSeenUid: lastuid}
-	err = m.UpdateLastUid(tx, msg.GetAccName())
-	if err != nil {
-		return nil, rollback(
-			err,
-			fmt.Sprintf("while updating lastseenuid (mbox: %#v)", msg.Mailbox))
 	}
-	// then fetch last thread id
-	threadid, err := models.FetchThreadCounter(tx)
-	if err != nil {
-		return nil, rollback(err, "while fetching thread counter")
+	if msg.UidValidity != 0 {
+		if err = mbox.UpdateUidValidity(tx, msg.GetAccName()); err != nil {
+			return nil, rollback(err, "while updating uidvalidity")
+		}
 	}
-	// then insert new threadid
-	alreadydone := make(map[int]struct{})
+	lastuid := uint32(0)
 	for idx, m := range msg.Mails {
-		root, err := m.FetchRoot(tx)
+		// thread mails one after the other, so that each one is linked to
+		// those already inserted
+		err = m.UpdateThreadid(tx, msg.GetAccName(), d.threadBySubject)
 		if err != nil {
-			return nil, rollback(err, fmt.Sprintf("while fetching root %d", m.Uid))
+			return nil, rollback(err, fmt.Sprintf("while updating threadid (m: %#v)", m))
 		}
-		if _, ok := alreadydone[root.Id]; ok {
-			continue
+		err = m.InsertInto(tx, msg.Mailbox, msg.GetAccName())
+		if err != nil {
+			return nil, rollback(err, fmt.Sprintf("while inserting mail (m: %#v)", m))
 		}
-		err = root.UpdateThreadidOnChild(tx, threadid.Next())
+		err = m.Index(tx)
 		if err != nil {
-			return nil, rollback(err, "while updating threadid")
+			return nil, rollback(err, fmt.Sprintf("while indexing mail (m: %#v)", m))
+		}
+		if m.Uid > lastuid {
+			lastuid = m.Uid
 		}
-		alreadydone[root.Id] = struct{}{}
 		if idx > 0 && idx%100 == 0 {
-			d.logger.Debugf("update root (%d/%d)", idx, len(msg.Mails))
+			d.logger.Debugf("insert mails (%d/%d)", idx, len(msg.Mails))
 		}
 	}
-	// finally update last threadid
-	err = threadid.UpdateThreadCounter(tx)
-	if err != nil {
-		return nil, rollback(err, "while updating thread counter")
+	// update lastseenuid for this mailbox
+	if !msg.Partial && lastuid > 0 {
+		m := models.Mailbox{Name: msg.Mailbox, LastSeenUid: lastuid}
+		err = m.UpdateLastUid(tx, msg.GetAccName())
+		if err != nil {
+			return nil, rollback(
+				err,
+				fmt.Sprintf("while updating lastseenuid (mbox: %#v)", msg.Mailbox))
+		}
 	}
 	if err = tx.Commit(); err != nil {
 		return nil, errors.Wrap(err, "while commiting tx")
@@ -247,7 +359,65 @@ func (d *Database) handleFetchMailbox(db *sql.DB, msg *FetchMailbox) (Message, e
 	if err != nil {
 		return nil, err
 	}
-	return &FetchMailboxRes{List: t, LastSeenUid: m.LastSeenUid}, nil
+	return &FetchMailboxRes{
+		List:          t,
+		LastSeenUid:   m.LastSeenUid,
+		UidValidity:   m.UidValidity,
+		HighestModSeq: m.HighestModSeq,
+		Sort:          m.Sort,
+	}, nil
+}
+
+func (d *Database) handleSortMailbox(db *sql.DB, msg *SortMailbox) (Message, error) {
+	m := models.Mailbox{Name: msg.Mailbox, Sort: msg.Sort}
+	if err := m.UpdateSort(db, msg.GetAccName()); err != nil {
+		return nil, errors.Wrap(err, "while saving sort")
+	}
+	t, err := models.AllThreads(db, msg.Mailbox, msg.GetAccName())
+	if err != nil {
+		return nil, err
+	}
+	return &SortMailboxRes{List: t}, nil
+}
+
+func (d *Database) handleFetchMailboxMails(db *sql.DB, msg *FetchMailboxMails) ([]*models.Mail, error) {
+	mbox, err := models.GetMailbox(db, msg.Mailbox, msg.GetAccName())
+	if err != nil {
+		return nil, err
+	}
+	mails, err := models.FetchMails(db, msg.Mailbox, msg.GetAccName(), mbox.LastSeenUid)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range mails {
+		m.Mailbox = msg.Mailbox
+	}
+	return mails, nil
+}
+
+func (d *Database) handleFetchSearch(db *sql.DB, msg *FetchSearch) (Message, error) {
+	q, err := models.ParseSearchQuery(msg.Query)
+	if err != nil {
+		return nil, err
+	}
+	q.Hits = msg.Hits
+	t, err := models.SearchThreads(db, msg.GetAccName(), q, msg.Sort)
+	if err != nil {
+		return nil, errors.Wrap(err, "while searching threads")
+	}
+	return &FetchSearchRes{List: t}, nil
+}
+
+func (d *Database) handleIndexMail(db *sql.DB, msg *IndexMail) (Message, error) {
+	f, err := os.Open(msg.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = models.IndexContent(db, msg.MailId, f); err != nil {
+		return nil, err
+	}
+	return &Done{}, nil
 }
 
 func (d *Database) handleFetchMailboxesImap(db *sql.DB, msg *FetchMailboxesImapRes) ([]*models.Mailbox, error) {
@@ -282,7 +452,18 @@ func (d *Database) handleUpdateMessages(db *sql.DB, msg *UpdateMessages) ([]*mod
 	for _, m := range msg.Mails {
 		imapMails[m.Uid] = m
 	}
-	d.logger.Debugf("will update mails flags  (imap: %d, db: %d)", len(imapMails), len(dbMails))
+	vanished := make(map[uint32]bool)
+	for _, uid := range msg.Vanished {
+		vanished[uid] = true
+	}
+	var remaining map[uint32]bool
+	if msg.Uids != nil {
+		remaining = make(map[uint32]bool)
+		for _, uid := range msg.Uids {
+			remaining[uid] = true
+		}
+	}
+	d.logger.Debugf("will update mails flags  (imap: %d, db: %d, incremental: %v)", len(imapMails), len(dbMails), msg.Incremental)
 
 	tx, err := db.Begin()
 	if err != nil {
@@ -295,20 +476,57 @@ func (d *Database) handleUpdateMessages(db *sql.DB, msg *UpdateMessages) ([]*mod
 		return errors.Wrap(err, msg)
 	}
 	for _, mail := range dbMails {
-		if m, ok := imapMails[mail.Uid]; ok {
-			err = mail.UpdateFlags(tx, m.Flags)
-			if err != nil {
-				return nil, rollback(err, "while updating flags")
-			}
-		} else {
+		m, ok := imapMails[mail.Uid]
+		gone := vanished[mail.Uid] || (remaining != nil && !remaining[mail.Uid])
+		if !msg.Incremental && !ok {
+			gone = true
+		}
+		if gone {
 			d.logger.Debugf("will delete mail %d", mail.Uid)
 			err = mail.Delete(tx)
 			if err != nil {
 				return nil, rollback(err, "while deleting mail")
 			}
+		} else if ok {
+			err = mail.UpdateFlags(tx, m.Flags)
+			if err != nil {
+				return nil, rollback(err, "while updating flags")
+			}
 		}
 	}
+	if msg.HighestModSeq != 0 {
+		mbox := models.Mailbox{Name: msg.Mailbox, HighestModSeq: msg.HighestModSeq}
+		if err = mbox.UpdateHighestModSeq(tx, msg.GetAccName()); err != nil {
+			return nil, rollback(err, "while updating highest modseq")
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "while commiting tx")
+	}
+	return models.AllThreads(db, msg.Mailbox, msg.GetAccName())
+}
+
+func (d *Database) handleRemoveMails(db *sql.DB, msg *RemoveMails) ([]*models.Thread, error) {
+	err := models.DeleteMails(db, msg.Mailbox, msg.GetAccName(), msg.Uids)
+	if err != nil {
+		return nil, errors.Wrap(err, "while deleting mails")
+	}
+	return models.AllThreads(db, msg.Mailbox, msg.GetAccName())
+}
 
+func (d *Database) handleCopyMails(db *sql.DB, msg *CopyMails) ([]*models.Thread, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, errors.Wrap(err, "while beginning tx")
+	}
+	err = models.CopyMails(tx, msg.Mailbox, msg.Dest, msg.GetAccName(), msg.Uids, msg.DestUids, msg.Move)
+	if err != nil {
+		if rollerr := tx.Rollback(); rollerr != nil {
+			return nil, errors.Wrap(rollerr, "while trying to rollback")
+		}
+		return nil, errors.Wrap(err, "while copying mails")
+	}
 	if err = tx.Commit(); err != nil {
 		return nil, errors.Wrap(err, "while commiting tx")
 	}
@@ -323,3 +541,53 @@ func (d *Database) handleSaveMailFlags(db *sql.DB, msg *SaveMailFlags) (Message,
 	}
 	return &Done{}, nil
 }
+
+func (d *Database) pendingCount(db *sql.DB, accname string) (Message, error) {
+	count, err := models.CountPendingActions(db, accname)
+	if err != nil {
+		return nil, errors.Wrap(err, "while counting pending actions")
+	}
+	return &PendingCountRes{Count: count}, nil
+}
+
+func (d *Database) handleQueueAction(db *sql.DB, msg *QueueAction) (Message, error) {
+	queued, err := ReplayMessage(msg.Action)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading pending action")
+	}
+	mbox, err := models.GetMailbox(db, PendingMailbox(queued), msg.GetAccName())
+	switch {
+	case err == sql.ErrNoRows:
+		// mailbox not synced yet, its uidvalidity is unknown
+	case err != nil:
+		return nil, errors.Wrap(err, "while fetching mailbox")
+	default:
+		if err = SetPendingUidValidity(msg.Action, mbox.UidValidity); err != nil {
+			return nil, errors.Wrap(err, "while recording uidvalidity")
+		}
+	}
+	if err = msg.Action.InsertInto(db, msg.GetAccName()); err != nil {
+		return nil, errors.Wrap(err, "while inserting pending action")
+	}
+	return d.pendingCount(db, msg.GetAccName())
+}
+
+func (d *Database) handleRemovePendingActions(db *sql.DB, msg *RemovePendingActions) (Message, error) {
+	if err := models.DeletePendingActions(db, msg.Ids); err != nil {
+		return nil, errors.Wrap(err, "while deleting pending actions")
+	}
+	return d.pendingCount(db, msg.GetAccName())
+}
+
+func (d *Database) handleQueueMail(db *sql.DB, msg *QueueMail) (Message, error) {
+	var err error
+	if msg.Mail.Id == 0 {
+		err = msg.Mail.InsertInto(db, msg.GetAccName())
+	} else {
+		err = msg.Mail.Update(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &QueueMailRes{Mail: msg.Mail}, nil
+}
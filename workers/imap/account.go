@@ -2,8 +2,10 @@ package imap
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -24,22 +26,64 @@ import (
 
 var PARSE_IMAP_ERR = errors.New("error parsing mail from imap server")
 
+// ErrNoSender tells that a mail cannot be sent as it has no `From` address
+var ErrNoSender = errors.New("mail has no `From` address")
+
 type Account struct {
 	cfg          *config.Account
 	requests     chan workers.Message
 	c            *client.Client
 	selectedMbox *models.Mailbox
-	logger       *lib.Logger
+	// true once new messages of selectedMbox have been fetched at least once,
+	// i.e. selectedMbox.LastSeenUid can be trusted
+	mboxSynced bool
+	// true once connecting failed, until connection is back
+	offline bool
+	// fires when a new connection attempt should be made while offline, set
+	// once going offline and reset after each failed retry
+	retry  *time.Timer
+	logger *lib.Logger
+	// post a message to app without prior request
+	notify func(workers.Message)
+
+	// mailboxes name by special-use attribute, filled upon listing mailboxes
+	specialMboxes map[string]string
+
+	canIdle  bool
+	updates  chan client.Update
+	idleStop chan struct{}
+	idleDone chan error
+	changes  chan struct{}
+	pending  pendingChanges
+
+	// whether mailboxes changes can be fetched incrementally (rfc7162)
+	condstore bool
+	qresync   bool
+
+	// outbox mails to send by id
+	outbox map[int]*models.OutboxMail
+	// fires when next outbox mail is due, nil when outbox is empty
+	outboxTimer *time.Timer
 }
 
 func NewAccount(l *lib.Logger, c *config.Account) *Account {
 	return &Account{
 		cfg:      c,
 		requests: make(chan workers.Message, 10),
+		changes:  make(chan struct{}, 1),
+		outbox:   make(map[int]*models.OutboxMail),
 		logger:   l,
 	}
 }
 
+func (a *Account) PostMessage(msg workers.Message) {
+	a.requests <- msg
+}
+
+func (a *Account) Close() {
+	close(a.requests)
+}
+
 func (a *Account) getImapPass() (string, error) {
 	return getPass(a.cfg.Imap.PassCmd)
 }
@@ -48,20 +92,70 @@ func (a *Account) getSmtpPass() (string, error) {
 	return getPass(a.cfg.Smtp.PassCmd)
 }
 
+func (a *Account) dial() (*client.Client, error) {
+	cfg := a.cfg.Imap
+	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	mode := cfg.ConnMode()
+	if mode == config.CONN_MODE_PLAIN {
+		a.logger.Warnf("connecting to imap server `%s` without encryption", addr)
+		return client.Dial(addr)
+	}
+	tlsConfig, err := newTlsConfig(cfg.Host, cfg.CaFile, cfg.SkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	if mode == config.CONN_MODE_TLS {
+		return client.DialTLS(addr, tlsConfig)
+	}
+	c, err := client.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := c.SupportStartTLS()
+	if err != nil {
+		c.Logout()
+		return nil, err
+	}
+	if !ok {
+		c.Logout()
+		return nil, fmt.Errorf("imap server `%s` does not support STARTTLS", addr)
+	}
+	if err = c.StartTLS(tlsConfig); err != nil {
+		c.Logout()
+		return nil, errors.Wrap(err, "while issuing starttls")
+	}
+	return c, nil
+}
+
 func (a *Account) connect() error {
 	var err error
-	if a.cfg.Imap.Tls {
-		a.c, err = client.DialTLS(fmt.Sprintf("%s:%d", a.cfg.Imap.Host, a.cfg.Imap.Port), nil)
+	a.c, err = a.dial()
+	if err != nil {
+		return err
 	}
 	p, err := a.getImapPass()
 	if err != nil {
 		return err
 	}
 	err = a.c.Login(a.cfg.Imap.User, p)
-	return err
+	if err != nil {
+		return err
+	}
+	a.canIdle, err = a.c.Support("IDLE")
+	if err != nil {
+		return err
+	}
+	if err = a.enableModSeq(); err != nil {
+		return err
+	}
+	a.updates = make(chan client.Update, 50)
+	a.c.Updates = a.updates
+	go a.watchUpdates(a.updates)
+	return nil
 }
 
 func (a *Account) terminate() error {
+	a.stopIdle()
 	if a.c != nil {
 		return a.c.Logout()
 	}
@@ -76,11 +170,13 @@ func (a *Account) selectMbox(mailbox string) error {
 		return err
 	}
 	a.selectedMbox = &models.Mailbox{
-		Name:     mailbox,
-		ReadOnly: res.ReadOnly,
-		Count:    res.Messages,
-		Unseen:   res.Unseen,
+		Name:        mailbox,
+		ReadOnly:    res.ReadOnly,
+		Count:       res.Messages,
+		Unseen:      res.Unseen,
+		UidValidity: res.UidValidity,
 	}
+	a.mboxSynced = false
 	return nil
 }
 
@@ -91,61 +187,183 @@ func (a *Account) Run(responses chan<- workers.Message) {
 		msg.SetId(id)
 		responses <- msg
 	}
-	for msg := range a.requests {
-		switch msg := msg.(type) {
-		case *workers.FetchMailboxes:
-			result, err := a.handleFetchMailboxes(msg)
-			var r workers.Message
-			if err != nil {
-				a.logger.Warnf("error fetching mailboxes %v", err)
-				r = &workers.Error{Error: errors.New("error requesting imap server")}
-			} else {
-				r = &workers.MsgToDb{Wrapped: &workers.FetchMailboxesImapRes{
-					Mailboxes: result,
-				}}
-			}
-			postResponse(r, msg.GetId())
-		case *workers.SendMail:
-			var r workers.Message
-			if err := a.handleSendMail(msg); err != nil {
-				a.logger.Warnf("error sending mail %v", err)
-				r = &workers.Error{Error: errors.New("error sending mail")}
-			} else {
-				r = &workers.Done{}
-			}
-			postResponse(r, msg.GetId())
-		case *workers.ConnectImap:
-			var r workers.Message
-			if err := a.connect(); err != nil {
-				a.logger.Warnf("error connecting to imap server %v", err)
-				r = &workers.Error{Error: err}
-			} else {
-				r = &workers.Done{}
+	a.notify = func(msg workers.Message) {
+		// notifications are not answers to a request, so they keep a zero id
+		msg.SetAccName(a.cfg.Name)
+		responses <- msg
+	}
+	for {
+		a.startIdle()
+		select {
+		case msg, ok := <-a.requests:
+			a.stopIdle()
+			if !ok {
+				return
 			}
-			postResponse(r, msg.GetId())
-		case *workers.FetchNewMessages:
-			r, err := a.handleFetchNewMessages(msg)
-			if err != nil {
-				a.logger.Warnf("error fetching new messages %v", err)
-				r = &workers.Error{Error: errors.New("error requesting imap server")}
+			postResponse(a.handleRequest(msg), msg.GetId())
+		case <-a.changes:
+			a.stopIdle()
+			a.handleChanges()
+		case <-a.nextOutboxAttempt():
+			a.stopIdle()
+			a.sendOutbox()
+		case <-a.retryLater():
+			a.retryConnection()
+		case <-a.loggedOut():
+			a.logger.Warnf("connection to imap server lost")
+			a.setConnState(workers.CONN_DISCONNECTED, 0, nil)
+			if err := a.reconnect(); err != nil {
+				a.logger.Warnf("cannot reconnect to imap server %v", err)
 			}
-			postResponse(r, msg.GetId())
-		case *workers.FetchMessageUpdates:
-			r, err := a.handleFetchMessageUpdates(msg)
-			if err != nil {
-				a.logger.Warnf("error fetching messages update %v", err)
-				r = &workers.Error{Error: errors.New("error requesting imap server")}
+		}
+	}
+}
+
+// handleRequest processes msg and, if it failed because connection to server
+// was lost, reconnects and replays it. While offline, requests which can be
+// replayed later are queued instead
+func (a *Account) handleRequest(msg workers.Message) workers.Message {
+	if !needsConnection(msg) {
+		return a.processRequest(msg)
+	}
+	if !a.connected() {
+		if a.offline && workers.IsQueueable(msg) {
+			return a.queue(msg)
+		}
+		if err := a.reconnect(); err != nil {
+			a.logger.Warnf("cannot reconnect to imap server %v", err)
+			if workers.IsQueueable(msg) {
+				return a.queue(msg)
 			}
-			postResponse(r, msg.GetId())
-		case *workers.FetchFullMail:
-			r, err := a.handleFetchFullMail(msg)
-			if err != nil {
-				a.logger.Warnf("error fetching full message %v", err)
-				r = &workers.Error{Error: errors.New("error requesting imap server")}
+			return &workers.Error{Error: ErrNotConnected}
+		}
+	}
+	r := a.processRequest(msg)
+	if _, ok := r.(*workers.Error); ok && !a.connected() {
+		a.logger.Warnf("connection lost while processing request, will replay it")
+		if err := a.reconnect(); err != nil {
+			a.logger.Warnf("cannot reconnect to imap server %v", err)
+			if workers.IsQueueable(msg) {
+				return a.queue(msg)
 			}
-			postResponse(r, msg.GetId())
+			return r
+		}
+		r = a.processRequest(msg)
+	}
+	return r
+}
+
+func (a *Account) processRequest(msg workers.Message) workers.Message {
+	var r workers.Message
+	switch msg := msg.(type) {
+	case *workers.FetchMailboxes:
+		result, err := a.handleFetchMailboxes(msg)
+		if err != nil {
+			a.logger.Warnf("error fetching mailboxes %v", err)
+			r = &workers.Error{Error: errors.New("error requesting imap server")}
+		} else {
+			r = &workers.MsgToDb{Wrapped: &workers.FetchMailboxesImapRes{
+				Mailboxes: result,
+			}}
+		}
+	case *workers.SendOutbox:
+		r = a.handleSendOutbox(msg)
+	case *workers.CancelOutboxMail:
+		delete(a.outbox, msg.Id)
+		a.scheduleOutbox()
+		r = &workers.Done{}
+	case *workers.AppendSentMail:
+		r = a.saveSentMail(msg.Body)
+	case *workers.ReplayPendingActions:
+		r = a.handleReplayPendingActions(msg)
+	case *workers.ConnectImap:
+		a.setConnState(workers.CONN_CONNECTING, 0, nil)
+		if err := a.connect(); err != nil {
+			a.logger.Warnf("error connecting to imap server %v", err)
+			a.dropClient()
+			a.setConnState(workers.CONN_DISCONNECTED, 0, err)
+			r = &workers.Error{Error: err}
+		} else {
+			a.setConnState(workers.CONN_CONNECTED, 0, nil)
+			r = &workers.Done{}
+		}
+	case *workers.FetchNewMessages:
+		var err error
+		r, err = a.handleFetchNewMessages(msg)
+		if err != nil {
+			a.logger.Warnf("error fetching new messages %v", err)
+			r = &workers.Error{Error: errors.New("error requesting imap server")}
+		}
+	case *workers.FetchMessageUpdates:
+		var err error
+		r, err = a.handleFetchMessageUpdates(msg)
+		if err != nil {
+			a.logger.Warnf("error fetching messages update %v", err)
+			r = &workers.Error{Error: errors.New("error requesting imap server")}
+		}
+	case *workers.FetchFullMail:
+		var err error
+		r, err = a.handleFetchFullMail(msg)
+		if err != nil {
+			a.logger.Warnf("error fetching full message %v", err)
+			r = &workers.Error{Error: errors.New("error requesting imap server")}
+		}
+	case *workers.PostponeMail:
+		var err error
+		r, err = a.handlePostponeMail(msg)
+		if err != nil {
+			a.logger.Warnf("error postponing mail %v", err)
+			r = &workers.Error{Error: errors.Wrap(err, "cannot save draft")}
+		}
+	case *workers.SearchImap:
+		var err error
+		r, err = a.handleSearchImap(msg)
+		if err != nil {
+			a.logger.Warnf("error searching on imap server %v", err)
+			r = &workers.Error{Error: errors.Wrap(err, "cannot search on imap server")}
+		}
+	case *workers.MoveMails:
+		var err error
+		r, err = a.handleMoveMails(msg)
+		if err != nil {
+			a.logger.Warnf("error moving mails %v", err)
+			r = &workers.Error{Error: errors.Wrapf(err, "cannot move mails to `%s`", msg.Dest)}
+		}
+	case *workers.ArchiveMails:
+		var err error
+		r, err = a.handleArchiveMails(msg)
+		if err != nil {
+			a.logger.Warnf("error archiving mails %v", err)
+			r = &workers.Error{Error: errors.Wrap(err, "cannot archive mails")}
+		}
+	case *workers.DeleteMails:
+		var err error
+		r, err = a.handleDeleteMails(msg)
+		if err != nil {
+			a.logger.Warnf("error deleting mails %v", err)
+			r = &workers.Error{Error: errors.Wrap(err, "cannot delete mails")}
+		}
+	case *workers.ImportMail:
+		if err := a.handleImportMail(msg); err != nil {
+			a.logger.Warnf("error importing mail %v", err)
+			r = &workers.Error{Error: errors.Wrapf(err, "cannot import mail into `%s`", msg.Mailbox)}
+		} else {
+			r = &workers.Done{}
+		}
+	case *workers.StoreFlags:
+		if err := a.handleStoreFlags(msg); err != nil {
+			a.logger.Warnf("error storing flags %v", err)
+			r = &workers.Error{Error: errors.New("cannot update flags on imap server")}
+		} else {
+			r = &workers.Done{}
 		}
 	}
+	return r
+}
+
+// cacheDir is where full mails of mailbox are stored once fetched
+func cacheDir(mailbox string) string {
+	return path.Join("/tmp/nuntius", mailbox)
 }
 
 func (a *Account) handleFetchFullMail(msg *workers.FetchFullMail) (workers.Message, error) {
@@ -153,7 +371,7 @@ func (a *Account) handleFetchFullMail(msg *workers.FetchFullMail) (workers.Messa
 	if err != nil {
 		return nil, err
 	}
-	section := &imap.BodySectionName{}
+	section := &imap.BodySectionName{Peek: msg.Peek}
 	items := []imap.FetchItem{
 		imap.FetchEnvelope,
 		imap.FetchFlags,
@@ -161,7 +379,7 @@ func (a *Account) handleFetchFullMail(msg *workers.FetchFullMail) (workers.Messa
 		section.FetchItem(),
 	}
 	r := &workers.FetchFullMailRes{
-		Filepath: fmt.Sprintf("/tmp/nuntius/%s/%d.mail", msg.Mailbox, msg.Uid),
+		Filepath: path.Join(cacheDir(msg.Mailbox), fmt.Sprintf("%d.mail", msg.Uid)),
 		FromImap: false,
 	}
 	if _, err := os.Stat(r.Filepath); os.IsNotExist(err) {
@@ -178,11 +396,21 @@ func (a *Account) handleFetchFullMail(msg *workers.FetchFullMail) (workers.Messa
 		if body == nil {
 			return fmt.Errorf("could not get section %#v", section)
 		}
-		f, err := os.OpenFile(r.Filepath, os.O_CREATE|os.O_WRONLY, 0644)
+		var f *os.File
+		var err error
+		if msg.Peek {
+			f, err = ioutil.TempFile("", "nuntius-*.mail")
+		} else {
+			f, err = os.OpenFile(r.Filepath, os.O_CREATE|os.O_WRONLY, 0644)
+		}
 		if err != nil {
 			return err
 		}
 		defer f.Close()
+		if msg.Peek {
+			r.Filepath = f.Name()
+			r.Temporary = true
+		}
 		_, err = io.Copy(f, body)
 		if err != nil {
 			return err
@@ -192,7 +420,7 @@ func (a *Account) handleFetchFullMail(msg *workers.FetchFullMail) (workers.Messa
 	if err != nil {
 		return nil, err
 	}
-	r.FromImap = true
+	r.FromImap = !msg.Peek
 	return r, nil
 }
 
@@ -202,38 +430,137 @@ func (a *Account) handleFetchMessageUpdates(msg *workers.FetchMessageUpdates) (w
 	if err != nil {
 		return nil, err
 	}
+	r := &workers.FetchMessageUpdatesRes{Mailbox: msg.Mailbox}
+	if msg.UidValidity != 0 && msg.UidValidity != a.selectedMbox.UidValidity {
+		// known uids are meaningless, mailbox is synced from scratch by
+		// FetchNewMessages instead
+		r.Incremental = true
+		return r, nil
+	}
+	r.MailsChanges, err = a.fetchMessageUpdates(msg.Mailbox, msg.LastSeenUid, msg.HighestModSeq)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fetch flags of already known messages (i.e. uid in range 1:lastseenuid) in
+// currently selected mailbox, only those changed since modseq when server
+// supports CONDSTORE and modseq is known
+func (a *Account) fetchMessageUpdates(mailbox string, lastseenuid uint32, modseq uint64) (workers.MailsChanges, error) {
+	r := workers.MailsChanges{Mails: []*models.Mail{}, HighestModSeq: modseq}
+	if lastseenuid == 0 {
+		return r, nil
+	}
+	var err error
+	if a.condstore && modseq > 0 {
+		err = a.fetchChanges(&r, lastseenuid, modseq)
+	} else {
+		err = a.fetchAllFlags(&r, lastseenuid)
+	}
+	if err != nil {
+		return r, err
+	}
+	if a.selectedMbox != nil && a.selectedMbox.Name == mailbox {
+		a.selectedMbox.HighestModSeq = r.HighestModSeq
+	}
+	return r, nil
+}
+
+// fetchAllFlags fills r with flags of every message with uid in range
+// 1:lastseenuid, along with their greatest modseq when server supports
+// CONDSTORE
+func (a *Account) fetchAllFlags(r *workers.MailsChanges, lastseenuid uint32) error {
 	items := []imap.FetchItem{
 		imap.FetchFlags,
 		imap.FetchUid,
 	}
-	result := make([]*models.Mail, 0)
+	if a.condstore {
+		items = append(items, FETCH_MODSEQ)
+	}
 	var set imap.SeqSet
 	// range 1:lastseenuid
-	set.AddRange(1, msg.LastSeenUid)
-	err = fetch(a.c, &set, items, func(m *imap.Message) error {
+	set.AddRange(1, lastseenuid)
+	return fetch(a.c, &set, items, func(m *imap.Message) error {
+		if v, ok := m.Items[FETCH_MODSEQ]; ok {
+			modseq, err := parseModSeq(v)
+			if err != nil {
+				return errors.Wrap(err, "while parsing modseq")
+			}
+			if modseq > r.HighestModSeq {
+				r.HighestModSeq = modseq
+			}
+		}
 		mail := &models.Mail{
 			Flags: m.Flags,
 			Uid:   m.Uid,
 		}
-		result = append(result, mail)
+		r.Mails = append(r.Mails, mail)
 		return nil
 	})
+}
+
+// fetch new messages following strategy described in rfc4549#section-4.3.1
+func (a *Account) handleFetchNewMessages(msg *workers.FetchNewMessages) (workers.Message, error) {
+	err := a.selectMbox(msg.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	lastseenuid := msg.LastSeenUid
+	uidvalidity := a.selectedMbox.UidValidity
+	reset := msg.UidValidity != 0 && msg.UidValidity != uidvalidity
+	if reset {
+		// server renumbered mailbox (rfc3501#section-2.3.1.1), whatever we
+		// know about it must be dropped
+		a.logger.Warnf("uidvalidity of `%s` changed (%d, was %d)", msg.Mailbox, uidvalidity, msg.UidValidity)
+		if err = os.RemoveAll(cacheDir(msg.Mailbox)); err != nil {
+			return nil, errors.Wrap(err, "while removing cached mails")
+		}
+		lastseenuid = 0
+	}
+	result, err := a.fetchNewMessages(msg.Mailbox, lastseenuid)
 	if err != nil {
 		return nil, err
 	}
-	r := &workers.FetchMessageUpdatesRes{
-		Mailbox: msg.Mailbox,
-		Mails:   result,
+	r := &workers.FetchNewMessagesRes{
+		Mailbox:     msg.Mailbox,
+		Mails:       result,
+		UidValidity: uidvalidity,
+		Reset:       reset,
 	}
 	return r, nil
 }
 
-// fetch new messages following strategy described in rfc4549#section-4.3.1
-func (a *Account) handleFetchNewMessages(msg *workers.FetchNewMessages) (workers.Message, error) {
-	err := a.selectMbox(msg.Mailbox)
+// fetch messages with uid greater than lastseenuid in currently selected
+// mailbox, and remember the greatest known uid
+func (a *Account) fetchNewMessages(mailbox string, lastseenuid uint32) ([]*models.Mail, error) {
+	var set imap.SeqSet
+	// range lastseenuid+1:*
+	set.AddRange(lastseenuid+1, 0)
+	result, err := a.fetchMails(&set, func(m *imap.Message) bool {
+		// already known messages, and here we are only interested in new
+		// messages
+		return m.Uid > lastseenuid
+	})
 	if err != nil {
 		return nil, err
 	}
+	maxuid := lastseenuid
+	for _, m := range result {
+		if m.Uid > maxuid {
+			maxuid = m.Uid
+		}
+	}
+	if a.selectedMbox != nil && a.selectedMbox.Name == mailbox {
+		a.selectedMbox.LastSeenUid = maxuid
+		a.mboxSynced = true
+	}
+	return result, nil
+}
+
+// fetchMails fetches everything but body of messages in set (uids), and
+// keeps only those for which keep returns true
+func (a *Account) fetchMails(set *imap.SeqSet, keep func(*imap.Message) bool) ([]*models.Mail, error) {
 	section := &imap.BodySectionName{
 		BodyPartName: imap.BodyPartName{
 			Specifier: imap.HeaderSpecifier,
@@ -250,13 +577,8 @@ func (a *Account) handleFetchNewMessages(msg *workers.FetchNewMessages) (workers
 		section.FetchItem(),
 	}
 	result := make([]*models.Mail, 0)
-	var set imap.SeqSet
-	// range lastseenuid+1:*
-	set.AddRange(msg.LastSeenUid+1, 0)
-	err = fetch(a.c, &set, items, func(m *imap.Message) error {
-		if m.Uid <= msg.LastSeenUid {
-			// already known messages, and here we are only interested in new
-			// messages
+	err := fetch(a.c, set, items, func(m *imap.Message) error {
+		if !keep(m) {
 			return nil
 		}
 		reader := m.GetBody(section)
@@ -267,14 +589,15 @@ func (a *Account) handleFetchNewMessages(msg *workers.FetchNewMessages) (workers
 		header := &mail.Header{message.Header{textprotoHeader}}
 
 		mail := &models.Mail{
-			Subject:   m.Envelope.Subject,
-			InReplyTo: m.Envelope.InReplyTo,
-			MessageId: m.Envelope.MessageId,
-			Date:      m.Envelope.Date,
-			Flags:     m.Flags,
-			Parts:     models.BodyPartsFromImap(m.BodyStructure),
-			Uid:       m.Uid,
-			Header:    header,
+			Subject:    m.Envelope.Subject,
+			InReplyTo:  m.Envelope.InReplyTo,
+			MessageId:  m.Envelope.MessageId,
+			References: models.ParseReferences(header),
+			Date:       m.Envelope.Date,
+			Flags:      m.Flags,
+			Parts:      models.BodyPartsFromImap(m.BodyStructure),
+			Uid:        m.Uid,
+			Header:     header,
 		}
 		result = append(result, mail)
 		return nil
@@ -282,11 +605,7 @@ func (a *Account) handleFetchNewMessages(msg *workers.FetchNewMessages) (workers
 	if err != nil {
 		return nil, err
 	}
-	r := &workers.FetchNewMessagesRes{
-		Mailbox: msg.Mailbox,
-		Mails:   result,
-	}
-	return r, nil
+	return result, nil
 }
 
 func canOpen(mbox *imap.MailboxInfo) bool {
@@ -298,15 +617,31 @@ func canOpen(mbox *imap.MailboxInfo) bool {
 	return true
 }
 
-func (a *Account) handleFetchMailboxes(msg *workers.FetchMailboxes) ([]*models.Mailbox, error) {
-	result := make([]*models.Mailbox, 0)
+func (a *Account) listMailboxes() ([]*imap.MailboxInfo, error) {
+	result := make([]*imap.MailboxInfo, 0)
 	mailboxes := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
 	go func() {
 		done <- a.c.List("", "*", mailboxes)
 	}()
-
 	for m := range mailboxes {
+		result = append(result, m)
+		a.rememberSpecialUse(m)
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (a *Account) handleFetchMailboxes(msg *workers.FetchMailboxes) ([]*models.Mailbox, error) {
+	result := make([]*models.Mailbox, 0)
+	mailboxes, err := a.listMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range mailboxes {
 		parent := ""
 		if !canOpen(m) {
 			continue
@@ -319,90 +654,164 @@ func (a *Account) handleFetchMailboxes(msg *workers.FetchMailboxes) ([]*models.M
 		mbox := models.Mailbox{Name: m.Name, ShortName: shortName, Parent: parent}
 		result = append(result, &mbox)
 	}
-
-	if err := <-done; err != nil {
-		return nil, err
-	}
 	return result, nil
 }
 
-func (a *Account) handleSendMail(msg *workers.SendMail) error {
-	cfg := a.cfg.Smtp
-	conn, err := connectSmtps(cfg.Host, cfg.Port)
+// prepareMail parses mail written by user and completes its header so that
+// it can be sent or saved
+func prepareMail(body io.Reader) (*mail.Header, io.Reader, error) {
+	m, err := message.Read(body)
 	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	password, err := a.getSmtpPass()
-	if err != nil {
-		return err
-	}
-	saslclient, err := newSaslClient(cfg.Auth, cfg.User, password)
-	if err != nil {
-		return err
-	}
-	if saslclient != nil {
-		if err := conn.Auth(saslclient); err != nil {
-			return errors.Wrap(err, "while issuing auth cmd")
-		}
-	}
-
-	m, err := message.Read(msg.Body)
-	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	header := &mail.Header{message.Header{m.Header.Header}}
 	err = encodeHeaderFields(header)
 	if err != nil {
-		return errors.Wrap(err, "while encoding header fields")
+		return nil, nil, errors.Wrap(err, "while encoding header fields")
 	}
 	if !header.Has("Message-Id") {
 		err := header.GenerateMessageID()
 		if err != nil {
-			return errors.Wrap(err, "generate message-id")
+			return nil, nil, errors.Wrap(err, "generate message-id")
 		}
 	}
 	if !header.Has("Date") {
 		header.SetDate(time.Now())
 	}
+	return header, m.Body, nil
+}
+
+// writeMail writes a single text/plain part mail, or a multipart/mixed one
+// when there are attachments (list of files path)
+func writeMail(w io.Writer, header *mail.Header, body io.Reader, attachments []string) error {
+	if len(attachments) == 0 {
+		header.SetContentType("text/plain", map[string]string{"charset": "UTF-8"})
+		mw, err := mail.CreateSingleInlineWriter(w, *header)
+		if err != nil {
+			return errors.Wrap(err, "CreateSingleInlineWriter")
+		}
+		if _, err := io.Copy(mw, body); err != nil {
+			return errors.Wrap(err, "io.Copy")
+		}
+		err = mw.Close()
+		if err != nil {
+			return errors.Wrap(err, "will closing data writer")
+		}
+		return nil
+	}
+	mw, err := mail.CreateWriter(w, *header)
+	if err != nil {
+		return errors.Wrap(err, "CreateWriter")
+	}
+	var th mail.InlineHeader
+	th.SetContentType("text/plain", map[string]string{"charset": "UTF-8"})
+	tw, err := mw.CreateSingleInline(th)
+	if err != nil {
+		return errors.Wrap(err, "CreateSingleInline")
+	}
+	if _, err := io.Copy(tw, body); err != nil {
+		return errors.Wrap(err, "io.Copy")
+	}
+	if err = tw.Close(); err != nil {
+		return errors.Wrap(err, "while closing text part")
+	}
+	for _, filepath := range attachments {
+		if err = writeAttachment(mw, filepath); err != nil {
+			return errors.Wrapf(err, "while attaching `%s`", filepath)
+		}
+	}
+	if err = mw.Close(); err != nil {
+		return errors.Wrap(err, "will closing data writer")
+	}
+	return nil
+}
 
+// sendMail sends mail (body with attachments) through smtp and returns the
+// exact bytes written to server
+func (a *Account) sendMail(body io.Reader, attachments []string) ([]byte, error) {
+	header, body, err := prepareMail(body)
+	if err != nil {
+		return nil, err
+	}
 	from, err := header.AddressList("from")
 	if err != nil {
-		return errors.Wrapf(err, "addresslist `from` (%v)", header.Get("from"))
+		return nil, errors.Wrapf(err, "addresslist `from` (%v)", header.Get("from"))
+	}
+	if len(from) == 0 {
+		return nil, ErrNoSender
+	}
+
+	cfg := a.cfg.Smtp
+	conn, err := connectSmtp(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	password, err := a.getSmtpPass()
+	if err != nil {
+		return nil, err
+	}
+	saslclient, err := newSaslClient(cfg.Auth, cfg.User, password)
+	if err != nil {
+		return nil, err
+	}
+	if saslclient != nil {
+		if err := conn.Auth(saslclient); err != nil {
+			return nil, errors.Wrap(err, "while issuing auth cmd")
+		}
 	}
 
 	if err := conn.Mail(from[0].Address, nil); err != nil {
-		return errors.Wrap(err, "while issuing mail cmd")
+		return nil, errors.Wrap(err, "while issuing mail cmd")
 	}
 	rcpts, err := listRecipients(header)
 	if err != nil {
-		return errors.Wrap(err, "addresslist rcpts")
+		return nil, errors.Wrap(err, "addresslist rcpts")
 	}
 	for _, rcpt := range rcpts {
 		if err := conn.Rcpt(rcpt.Address); err != nil {
-			return errors.Wrap(err, "while issuing rcpt cmd")
+			return nil, errors.Wrap(err, "while issuing rcpt cmd")
 		}
 	}
 	writer, err := conn.Data()
 	if err != nil {
-		return errors.Wrap(err, "while issuing data cmd")
+		return nil, errors.Wrap(err, "while issuing data cmd")
 	}
-	defer writer.Close()
 
-	header.SetContentType("text/plain", map[string]string{"charset": "UTF-8"})
-	w, err := mail.CreateSingleInlineWriter(writer, *header)
-	if err != nil {
-		return errors.Wrap(err, "CreateSingleInlineWriter")
+	var sent bytes.Buffer
+	if err = writeMail(io.MultiWriter(writer, &sent), header, body, attachments); err != nil {
+		return nil, err
 	}
-	if _, err := io.Copy(w, m.Body); err != nil {
-		return errors.Wrap(err, "io.Copy")
+	// server reports whether it accepted the message upon closing data
+	if err = writer.Close(); err != nil {
+		return nil, errors.Wrap(err, "while ending data cmd")
 	}
 
-	err = w.Close()
+	conn.Quit()
+	return sent.Bytes(), nil
+}
+
+// handlePostponeMail saves mail being composed in drafts mailbox
+func (a *Account) handlePostponeMail(msg *workers.PostponeMail) (workers.Message, error) {
+	header, body, err := prepareMail(msg.Body)
 	if err != nil {
-		return errors.Wrap(err, "will closing data writer")
+		return nil, err
 	}
-
-	conn.Quit()
-	return nil
+	var raw bytes.Buffer
+	if err = writeMail(&raw, header, body, msg.Attachments); err != nil {
+		return nil, err
+	}
+	mailbox, err := a.specialMailbox(a.cfg.Drafts, imap.DraftsAttr)
+	if err != nil {
+		return nil, err
+	}
+	mails, err := a.appendMessage(mailbox, []string{imap.DraftFlag, imap.SeenFlag}, time.Now(), raw.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &workers.MsgToDb{Wrapped: &workers.InsertNewMessages{
+		Mailbox: mailbox,
+		Mails:   mails,
+		Partial: true,
+	}}, nil
 }
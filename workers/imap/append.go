@@ -0,0 +1,133 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// special-use attributes (rfc6154) we are interested in
+var specialUses = []string{imap.SentAttr, imap.DraftsAttr, imap.TrashAttr, imap.ArchiveAttr}
+
+// errNoSpecialMailbox tells that no mailbox has a special-use attribute
+var errNoSpecialMailbox = errors.New("please set it in config")
+
+func (a *Account) rememberSpecialUse(m *imap.MailboxInfo) {
+	for _, attr := range m.Attributes {
+		for _, use := range specialUses {
+			if attr == use {
+				if a.specialMboxes == nil {
+					a.specialMboxes = make(map[string]string)
+				}
+				a.specialMboxes[use] = m.Name
+			}
+		}
+	}
+}
+
+// specialMailbox returns configured mailbox if any, otherwise the mailbox
+// flagged with special-use attribute attr
+func (a *Account) specialMailbox(configured, attr string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	if name, ok := a.specialMboxes[attr]; ok {
+		return name, nil
+	}
+	if _, err := a.listMailboxes(); err != nil {
+		return "", err
+	}
+	if name, ok := a.specialMboxes[attr]; ok {
+		return name, nil
+	}
+	return "", errors.Wrapf(errNoSpecialMailbox, "no mailbox with `%s` attribute found", attr)
+}
+
+// inMailbox runs f with mailbox selected, then selects back previously
+// selected mailbox so that idle keeps watching it
+func (a *Account) inMailbox(mailbox string, f func() error) error {
+	previous, synced := a.selectedMbox, a.mboxSynced
+	if err := a.selectMbox(mailbox); err != nil {
+		return err
+	}
+	err := f()
+	if previous != nil && previous.Name != mailbox {
+		if rerr := a.restoreMailbox(previous, synced); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// appendMessage appends raw message in mailbox with flags, and fetches it back
+// (searching its message-id) so that it can be inserted in db
+func (a *Account) appendMessage(mailbox string, flags []string, date time.Time, raw []byte) ([]*models.Mail, error) {
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading header")
+	}
+	if err = a.c.Append(mailbox, flags, date, bytes.NewBuffer(raw)); err != nil {
+		return nil, errors.Wrap(err, "while appending message")
+	}
+	messageid := header.Get("Message-Id")
+	if messageid == "" {
+		return []*models.Mail{}, nil
+	}
+	var mails []*models.Mail
+	err = a.inMailbox(mailbox, func() error {
+		criteria := imap.NewSearchCriteria()
+		criteria.Header.Set("Message-Id", messageid)
+		uids, err := a.c.UidSearch(criteria)
+		if err != nil {
+			return errors.Wrap(err, "while searching appended message")
+		}
+		if len(uids) == 0 {
+			mails = []*models.Mail{}
+			return nil
+		}
+		mails, err = a.fetchMails(toSeqSet(uids), func(*imap.Message) bool { return true })
+		return err
+	})
+	return mails, err
+}
+
+// handleImportMail appends an archived mail as is. It is not fetched back,
+// next sync of mailbox will find it
+func (a *Account) handleImportMail(msg *workers.ImportMail) error {
+	raw := toCRLF(msg.Mail.Raw)
+	return a.c.Append(msg.Mailbox, msg.Mail.Flags, msg.Mail.Date, bytes.NewBuffer(raw))
+}
+
+// toCRLF ends lines of raw with CRLF as required by imap, archives usually
+// have bare LF line endings
+func toCRLF(raw []byte) []byte {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
+
+// saveSentMail appends a copy of sent mail in sent mailbox, failing to do so
+// is reported to user but does not mean mail was not sent
+func (a *Account) saveSentMail(raw []byte) workers.Message {
+	mailbox, err := a.specialMailbox(a.cfg.Sent, imap.SentAttr)
+	if err != nil {
+		a.logger.Warnf("cannot find sent mailbox %v", err)
+		return &workers.Error{Error: errors.Wrap(err, "mail sent, but cannot be saved")}
+	}
+	mails, err := a.appendMessage(mailbox, []string{imap.SeenFlag}, time.Now(), raw)
+	if err != nil {
+		a.logger.Warnf("cannot save sent mail %v", err)
+		return &workers.Error{Error: errors.New("mail sent, but cannot be saved in sent mailbox")}
+	}
+	return &workers.MsgToDb{Wrapped: &workers.InsertNewMessages{
+		Mailbox: mailbox,
+		Mails:   mails,
+		Partial: true,
+	}}
+}
@@ -0,0 +1,232 @@
+package imap
+
+import (
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// MODSEQ fetch item (rfc7162#section-3.1.4)
+const FETCH_MODSEQ imap.FetchItem = "MODSEQ"
+
+// enableCmd is an ENABLE command (rfc5161), go-imap client does not provide
+// it
+type enableCmd struct {
+	capability string
+}
+
+func (cmd *enableCmd) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "ENABLE",
+		Arguments: []interface{}{imap.RawString(cmd.capability)},
+	}
+}
+
+// fetchChangedCmd fetches flags of messages with a modseq greater than
+// modseq (rfc7162#section-3.1.4.1), once wrapped in UID command. When
+// vanished is true, uids expunged since then are sent as well
+// (rfc7162#section-3.2.6)
+type fetchChangedCmd struct {
+	seqset   *imap.SeqSet
+	modseq   uint64
+	vanished bool
+}
+
+func (cmd *fetchChangedCmd) Command() *imap.Command {
+	items := []interface{}{
+		imap.RawString(imap.FetchUid),
+		imap.RawString(imap.FetchFlags),
+		imap.RawString(FETCH_MODSEQ),
+	}
+	modifiers := []interface{}{
+		imap.RawString("CHANGEDSINCE"),
+		imap.RawString(strconv.FormatUint(cmd.modseq, 10)),
+	}
+	if cmd.vanished {
+		modifiers = append(modifiers, imap.RawString("VANISHED"))
+	}
+	return &imap.Command{
+		Name:      "FETCH",
+		Arguments: []interface{}{cmd.seqset, items, modifiers},
+	}
+}
+
+// parseModSeq parses value of MODSEQ fetch item, i.e. a list holding a
+// single 63-bit number
+func parseModSeq(f interface{}) (uint64, error) {
+	if l, ok := f.([]interface{}); ok && len(l) == 1 {
+		f = l[0]
+	}
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// parseVanished parses fields of a VANISHED response, i.e. an optional
+// (EARLIER) tag followed by uids, keeping uids not greater than maxuid
+func parseVanished(fields []interface{}, maxuid uint32) ([]uint32, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("empty VANISHED response")
+	}
+	s, err := imap.ParseString(fields[len(fields)-1])
+	if err != nil {
+		return nil, err
+	}
+	set, err := imap.ParseSeqSet(s)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint32, 0)
+	for _, seq := range set.Set {
+		stop := seq.Stop
+		if stop == 0 || stop > maxuid {
+			stop = maxuid
+		}
+		for uid := seq.Start; uid <= stop && uid != 0; uid++ {
+			result = append(result, uid)
+		}
+	}
+	return result, nil
+}
+
+// enableModSeq detects whether mailboxes changes can be fetched
+// incrementally, enabling QRESYNC when advertised (CONDSTORE is enabled by
+// its first use)
+func (a *Account) enableModSeq() error {
+	var err error
+	a.qresync = false
+	a.condstore, err = a.c.Support("CONDSTORE")
+	if err != nil {
+		return err
+	}
+	qresync, err := a.c.Support("QRESYNC")
+	if err != nil {
+		return err
+	}
+	enable, err := a.c.Support("ENABLE")
+	if err != nil {
+		return err
+	}
+	if !qresync || !enable {
+		return nil
+	}
+	status, err := a.c.Execute(&enableCmd{"QRESYNC"}, responses.HandlerFunc(func(resp imap.Resp) error {
+		if name, _, ok := imap.ParseNamedResp(resp); ok && name == "ENABLED" {
+			return nil
+		}
+		return responses.ErrUnhandled
+	}))
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		a.logger.Warnf("cannot enable QRESYNC, expunged mails will be found by scanning uids %v", err)
+		return nil
+	}
+	// QRESYNC implies CONDSTORE (rfc7162#section-3.2.3)
+	a.condstore = true
+	a.qresync = true
+	return nil
+}
+
+// handleVanished catches unilateral VANISHED responses, sent instead of
+// EXPUNGE once QRESYNC is enabled and ignored by go-imap client
+func (a *Account) handleVanished(resp imap.Resp) error {
+	if name, _, ok := imap.ParseNamedResp(resp); ok && name == "VANISHED" {
+		a.pending.mu.Lock()
+		a.pending.updates = true
+		a.pending.mu.Unlock()
+		a.signalChanges()
+		return nil
+	}
+	return responses.ErrUnhandled
+}
+
+// noop issues a NOOP command, catching VANISHED responses
+func (a *Account) noop() error {
+	status, err := a.c.Execute(&commands.Noop{}, responses.HandlerFunc(a.handleVanished))
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// fetchChanges fills r with flags of known messages (i.e. uid in range
+// 1:lastseenuid) of selected mailbox changed since modseq, and with
+// messages expunged since then
+func (a *Account) fetchChanges(r *workers.MailsChanges, lastseenuid uint32, modseq uint64) error {
+	var set imap.SeqSet
+	set.AddRange(1, lastseenuid)
+	r.Incremental = true
+	cmd := &fetchChangedCmd{seqset: &set, modseq: modseq, vanished: a.qresync}
+	status, err := a.c.Execute(&commands.Uid{Cmd: cmd}, responses.HandlerFunc(func(resp imap.Resp) error {
+		name, fields, ok := imap.ParseNamedResp(resp)
+		if !ok {
+			return responses.ErrUnhandled
+		}
+		switch name {
+		case "FETCH":
+			if len(fields) < 2 {
+				return responses.ErrUnhandled
+			}
+			items, ok := fields[1].([]interface{})
+			if !ok {
+				return responses.ErrUnhandled
+			}
+			m := &imap.Message{}
+			if err := m.Parse(items); err != nil {
+				return err
+			}
+			if m.Uid == 0 || m.Uid > lastseenuid {
+				return nil
+			}
+			if v, ok := m.Items[FETCH_MODSEQ]; ok {
+				mseq, err := parseModSeq(v)
+				if err != nil {
+					return errors.Wrap(err, "while parsing modseq")
+				}
+				if mseq > r.HighestModSeq {
+					r.HighestModSeq = mseq
+				}
+			}
+			r.Mails = append(r.Mails, &models.Mail{Flags: m.Flags, Uid: m.Uid})
+			return nil
+		case "VANISHED":
+			uids, err := parseVanished(fields, lastseenuid)
+			if err != nil {
+				return errors.Wrap(err, "while parsing vanished uids")
+			}
+			r.Vanished = append(r.Vanished, uids...)
+			return nil
+		}
+		return responses.ErrUnhandled
+	}))
+	if err != nil {
+		return err
+	}
+	if err = status.Err(); err != nil {
+		return err
+	}
+	if a.qresync {
+		return nil
+	}
+	// without QRESYNC expunged mails are only found by listing uids still
+	// on server, which remains much lighter than fetching their flags
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = &set
+	uids, err := a.c.UidSearch(criteria)
+	if err != nil {
+		return errors.Wrap(err, "while searching remaining uids")
+	}
+	r.Uids = make([]uint32, 0, len(uids))
+	r.Uids = append(r.Uids, uids...)
+	return nil
+}
@@ -0,0 +1,190 @@
+package imap
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+const (
+	RECONNECT_MIN_DELAY    = 1 * time.Second
+	RECONNECT_MAX_DELAY    = 1 * time.Minute
+	RECONNECT_MAX_ATTEMPTS = 6
+)
+
+var ErrNotConnected = errors.New("not connected to imap server")
+
+// connected returns true if client exists and its connection is still alive
+func (a *Account) connected() bool {
+	if a.c == nil {
+		return false
+	}
+	select {
+	case <-a.c.LoggedOut():
+		return false
+	default:
+		return true
+	}
+}
+
+// loggedOut returns a channel closed when current connection is closed, or a
+// nil channel (blocking forever) when there is no client
+func (a *Account) loggedOut() <-chan struct{} {
+	if a.c == nil {
+		return nil
+	}
+	return a.c.LoggedOut()
+}
+
+// dropClient closes current connection, if any, and releases the goroutine
+// watching its updates
+func (a *Account) dropClient() {
+	if a.c == nil {
+		return
+	}
+	if a.connected() {
+		a.c.Terminate()
+	}
+	<-a.c.LoggedOut()
+	if a.updates != nil {
+		close(a.updates)
+		a.updates = nil
+	}
+	a.c = nil
+}
+
+func (a *Account) setConnState(state workers.ConnState, attempt int, err error) {
+	a.offline = state == workers.CONN_DISCONNECTED
+	switch state {
+	case workers.CONN_DISCONNECTED:
+		if a.retry == nil {
+			a.retry = time.NewTimer(RECONNECT_MAX_DELAY)
+		}
+	case workers.CONN_CONNECTED:
+		if a.retry != nil {
+			a.retry.Stop()
+			a.retry = nil
+		}
+	}
+	a.notify(&workers.ConnectionStateNotif{State: state, Attempt: attempt, Error: err})
+}
+
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	delay := min << uint(attempt-1)
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	return delay
+}
+
+// reconnect drops current client and tries to log in again with exponential
+// backoff, then restores previously selected mailbox
+func (a *Account) reconnect() error {
+	a.stopIdle()
+	a.dropClient()
+	var err error
+	for attempt := 1; attempt <= RECONNECT_MAX_ATTEMPTS; attempt++ {
+		a.setConnState(workers.CONN_CONNECTING, attempt, err)
+		if err = a.connect(); err == nil {
+			break
+		}
+		a.logger.Warnf("reconnection attempt %d failed %v", attempt, err)
+		a.dropClient()
+		if attempt < RECONNECT_MAX_ATTEMPTS {
+			time.Sleep(backoff(attempt, RECONNECT_MIN_DELAY, RECONNECT_MAX_DELAY))
+		}
+	}
+	if err != nil {
+		a.setConnState(workers.CONN_DISCONNECTED, 0, err)
+		return errors.Wrap(err, "while reconnecting")
+	}
+	if err = a.restoreSession(); err != nil {
+		a.setConnState(workers.CONN_DISCONNECTED, 0, err)
+		return errors.Wrap(err, "while restoring session")
+	}
+	a.setConnState(workers.CONN_CONNECTED, 0, nil)
+	return nil
+}
+
+// retryLater returns a channel firing when a new connection attempt should
+// be made while offline, or a nil channel (blocking forever) otherwise
+func (a *Account) retryLater() <-chan time.Time {
+	if !a.offline || a.retry == nil {
+		return nil
+	}
+	return a.retry.C
+}
+
+// retryConnection makes a single connection attempt while offline, so that
+// pending actions get replayed as soon as server is back
+func (a *Account) retryConnection() {
+	if err := a.connect(); err != nil {
+		a.logger.Debugf("still offline %v", err)
+		a.dropClient()
+		a.retry.Reset(RECONNECT_MAX_DELAY)
+		return
+	}
+	if err := a.restoreSession(); err != nil {
+		a.logger.Warnf("cannot restore session %v", err)
+		a.dropClient()
+		a.retry.Reset(RECONNECT_MAX_DELAY)
+		return
+	}
+	a.setConnState(workers.CONN_CONNECTED, 0, nil)
+}
+
+// restoreSession selects again the mailbox selected before connection was
+// lost, and schedules a check of what happened meanwhile
+func (a *Account) restoreSession() error {
+	previous := a.selectedMbox
+	synced := a.mboxSynced
+	if previous == nil {
+		return nil
+	}
+	if err := a.restoreMailbox(previous, synced); err != nil {
+		return err
+	}
+	if synced {
+		a.pending.mu.Lock()
+		a.pending.exists = true
+		a.pending.updates = true
+		a.pending.mu.Unlock()
+		select {
+		case a.changes <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// restoreMailbox selects previous mailbox again, keeping what was already
+// known about it
+func (a *Account) restoreMailbox(previous *models.Mailbox, synced bool) error {
+	a.selectedMbox = nil
+	if err := a.selectMbox(previous.Name); err != nil {
+		return err
+	}
+	if previous.UidValidity != a.selectedMbox.UidValidity {
+		// what was known is no longer valid, app has to sync mailbox again
+		a.notify(&workers.MailboxResetNotif{Mailbox: previous.Name})
+		return nil
+	}
+	if synced {
+		a.selectedMbox.LastSeenUid = previous.LastSeenUid
+		a.mboxSynced = true
+	}
+	return nil
+}
+
+// needsConnection returns false for requests that do not talk to imap server
+// through the account client
+func needsConnection(msg workers.Message) bool {
+	switch msg.(type) {
+	case *workers.ConnectImap, *workers.SendOutbox, *workers.CancelOutboxMail:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,26 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/workers"
+)
+
+func (a *Account) handleStoreFlags(msg *workers.StoreFlags) error {
+	var op imap.FlagsOp = imap.AddFlags
+	if msg.Remove {
+		op = imap.RemoveFlags
+	}
+	flags := make([]interface{}, 0, len(msg.Flags))
+	for _, f := range msg.Flags {
+		flags = append(flags, f)
+	}
+	return a.inMailbox(msg.Mailbox, func() error {
+		item := imap.FormatFlagsOp(op, true)
+		if err := a.c.UidStore(toSeqSet(msg.Uids), item, flags, nil); err != nil {
+			return errors.Wrap(err, "while storing flags")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,210 @@
+package imap
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/responses"
+
+	"github.com/stregouet/nuntius/workers"
+)
+
+// rfc2177 advises clients to re-issue IDLE at least every 29 minutes to avoid
+// being logged off
+const IDLE_TIMEOUT = 29 * time.Minute
+
+// used when server does not advertise IDLE capability
+const POLL_INTERVAL = 1 * time.Minute
+
+type idleCmd struct{}
+
+func (cmd *idleCmd) Command() *imap.Command {
+	return &imap.Command{Name: "IDLE"}
+}
+
+// idleHandler waits for the continuation request sent by server and then
+// sends DONE once stop is closed, other responses are passed to unilateral
+type idleHandler struct {
+	stop            <-chan struct{}
+	replies         chan []byte
+	gotContinuation bool
+	unilateral      responses.HandlerFunc
+}
+
+func (h *idleHandler) Replies() <-chan []byte {
+	return h.replies
+}
+
+func (h *idleHandler) Handle(resp imap.Resp) error {
+	if _, ok := resp.(*imap.ContinuationReq); ok && !h.gotContinuation {
+		h.gotContinuation = true
+		go func() {
+			<-h.stop
+			h.replies <- []byte("DONE\r\n")
+		}()
+		return nil
+	}
+	if h.unilateral != nil {
+		return h.unilateral(resp)
+	}
+	return responses.ErrUnhandled
+}
+
+// pendingChanges accumulates unilateral updates received from server until
+// account handles them
+type pendingChanges struct {
+	mu      sync.Mutex
+	exists  bool
+	updates bool
+}
+
+func (p *pendingChanges) take() (exists bool, updates bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	exists, updates = p.exists, p.updates
+	p.exists, p.updates = false, false
+	return
+}
+
+// watchUpdates drains unilateral updates sent by go-imap client, this must
+// never block otherwise client reader goroutine would be stuck
+func (a *Account) watchUpdates(updates <-chan client.Update) {
+	for u := range updates {
+		a.pending.mu.Lock()
+		switch u.(type) {
+		case *client.MailboxUpdate:
+			a.pending.exists = true
+		case *client.ExpungeUpdate, *client.MessageUpdate:
+			a.pending.updates = true
+		default:
+			a.pending.mu.Unlock()
+			continue
+		}
+		a.pending.mu.Unlock()
+		a.signalChanges()
+	}
+}
+
+// signalChanges wakes account up so that it handles pending changes
+func (a *Account) signalChanges() {
+	select {
+	case a.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Account) idleOnce(stop <-chan struct{}) error {
+	h := &idleHandler{stop: stop, replies: make(chan []byte, 1), unilateral: a.handleVanished}
+	status, err := a.c.Execute(&idleCmd{}, h)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+// idle keeps selected mailbox in IDLE until stop is closed, re-issuing the
+// command every IDLE_TIMEOUT
+func (a *Account) idle(stop <-chan struct{}) error {
+	if !a.canIdle {
+		return a.poll(stop)
+	}
+	for {
+		stopOnce := make(chan struct{})
+		done := make(chan error, 1)
+		go func() {
+			done <- a.idleOnce(stopOnce)
+		}()
+		timer := time.NewTimer(IDLE_TIMEOUT)
+		select {
+		case <-stop:
+			timer.Stop()
+			close(stopOnce)
+			return <-done
+		case <-timer.C:
+			close(stopOnce)
+			if err := <-done; err != nil {
+				return err
+			}
+		case err := <-done:
+			// server terminated idle on its own
+			timer.Stop()
+			close(stopOnce)
+			return err
+		}
+	}
+}
+
+func (a *Account) poll(stop <-chan struct{}) error {
+	ticker := time.NewTicker(POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := a.noop(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (a *Account) startIdle() {
+	if a.c == nil || a.selectedMbox == nil || a.idleStop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- a.idle(stop)
+	}()
+	a.idleStop = stop
+	a.idleDone = done
+}
+
+func (a *Account) stopIdle() {
+	if a.idleStop == nil {
+		return
+	}
+	close(a.idleStop)
+	if err := <-a.idleDone; err != nil {
+		a.logger.Warnf("error while idling %v", err)
+	}
+	a.idleStop = nil
+	a.idleDone = nil
+}
+
+// handleChanges translates pending unilateral updates into notifications
+// for the app
+func (a *Account) handleChanges() {
+	exists, updates := a.pending.take()
+	if a.selectedMbox == nil || !a.mboxSynced {
+		// we do not know yet what is already known from selected mailbox, so
+		// wait for an explicit fetch
+		return
+	}
+	mailbox := a.selectedMbox.Name
+	if exists {
+		mails, err := a.fetchNewMessages(mailbox, a.selectedMbox.LastSeenUid)
+		if err != nil {
+			a.logger.Warnf("error fetching new messages after idle %v", err)
+		} else if len(mails) > 0 {
+			a.notify(&workers.NewMessagesNotif{Mailbox: mailbox, Mails: mails})
+		}
+	}
+	if updates {
+		lastuid := a.selectedMbox.LastSeenUid
+		changes, err := a.fetchMessageUpdates(mailbox, lastuid, a.selectedMbox.HighestModSeq)
+		if err != nil {
+			a.logger.Warnf("error fetching messages update after idle %v", err)
+		} else {
+			a.notify(&workers.MessageUpdatesNotif{
+				Mailbox:      mailbox,
+				LastSeenUid:  lastuid,
+				MailsChanges: changes,
+			})
+		}
+	}
+}
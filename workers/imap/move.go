@@ -0,0 +1,240 @@
+package imap
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/workers"
+)
+
+// moveCmd is a MOVE command (rfc6851), go-imap client does not provide it
+type moveCmd struct {
+	seqset  *imap.SeqSet
+	mailbox string
+}
+
+func (cmd *moveCmd) Command() *imap.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.mailbox)
+	return &imap.Command{
+		Name:      "MOVE",
+		Arguments: []interface{}{cmd.seqset, imap.FormatMailboxName(mailbox)},
+	}
+}
+
+// expungeCmd is an EXPUNGE command restricted to a set of uids once wrapped
+// in UID command (rfc4315), go-imap client does not provide it
+type expungeCmd struct {
+	seqset *imap.SeqSet
+}
+
+func (cmd *expungeCmd) Command() *imap.Command {
+	return &imap.Command{
+		Name:      "EXPUNGE",
+		Arguments: []interface{}{cmd.seqset},
+	}
+}
+
+// ErrNoUidplus tells that mails cannot be expunged without expunging
+// every other mail flagged as \Deleted of their mailbox
+var ErrNoUidplus = errors.New("server does not support UIDPLUS, cannot expunge only these mails")
+
+// ErrNoTrash tells that deleted mails cannot be moved to trash, and are only
+// expunged when user confirms it
+var ErrNoTrash = errors.New("no trash mailbox found, please set it in config")
+
+func (a *Account) execute(cmd imap.Commander, h responses.Handler) (*imap.StatusResp, error) {
+	status, err := a.c.Execute(cmd, h)
+	if err != nil {
+		return nil, err
+	}
+	return status, status.Err()
+}
+
+// copyUid collects uids of copied mails as told by COPYUID response code
+// (rfc4315), which comes with tagged response of COPY and untagged one of
+// MOVE
+type copyUid struct {
+	dest map[uint32]uint32
+}
+
+func (h *copyUid) Handle(resp imap.Resp) error {
+	s, ok := resp.(*imap.StatusResp)
+	if !ok || s.Code != "COPYUID" {
+		return responses.ErrUnhandled
+	}
+	if len(s.Arguments) < 3 {
+		return nil
+	}
+	src, err := parseUidSet(s.Arguments[1])
+	if err != nil {
+		return nil
+	}
+	dest, err := parseUidSet(s.Arguments[2])
+	if err != nil || len(src) != len(dest) {
+		return nil
+	}
+	for i, uid := range src {
+		h.dest[uid] = dest[i]
+	}
+	return nil
+}
+
+// destUids returns uids in destination of mails with uids, 0 for those
+// server did not tell
+func (h *copyUid) destUids(uids []uint32) []uint32 {
+	result := make([]uint32, len(uids))
+	for i, uid := range uids {
+		result[i] = h.dest[uid]
+	}
+	return result
+}
+
+// parseUidSet reads uids of a COPYUID set, keeping their order as it maps
+// source uids to destination ones
+func parseUidSet(f interface{}) ([]uint32, error) {
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint32, 0)
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(r, ":", 2)
+		start, err := strconv.ParseUint(bounds[0], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		stop := start
+		if len(bounds) == 2 {
+			if stop, err = strconv.ParseUint(bounds[1], 10, 32); err != nil {
+				return nil, err
+			}
+		}
+		if start <= stop {
+			for uid := start; uid <= stop; uid++ {
+				result = append(result, uint32(uid))
+			}
+		} else {
+			for uid := start; uid >= stop; uid-- {
+				result = append(result, uint32(uid))
+			}
+		}
+	}
+	return result, nil
+}
+
+// requireUidplus refuses to go on when mails of selected mailbox cannot be
+// expunged one by one
+func (a *Account) requireUidplus() error {
+	uidplus, err := a.c.Support("UIDPLUS")
+	if err != nil {
+		return err
+	}
+	if !uidplus {
+		return ErrNoUidplus
+	}
+	return nil
+}
+
+func (a *Account) deleteMails(uids []uint32) error {
+	// without UIDPLUS, other mails flagged as \Deleted (e.g. by another
+	// client) would be expunged as well
+	if err := a.requireUidplus(); err != nil {
+		return err
+	}
+	item := imap.FormatFlagsOp(imap.AddFlags, true)
+	flags := []interface{}{imap.DeletedFlag}
+	if err := a.c.UidStore(toSeqSet(uids), item, flags, nil); err != nil {
+		return errors.Wrap(err, "while flagging as deleted")
+	}
+	if _, err := a.execute(&commands.Uid{Cmd: &expungeCmd{toSeqSet(uids)}}, nil); err != nil {
+		return errors.Wrap(err, "while expunging")
+	}
+	return nil
+}
+
+// copyMails copies mails with uids of mailbox to dest, removing them from
+// mailbox when move is true. It returns message recording this in db
+func (a *Account) copyMails(mailbox string, uids []uint32, dest string, move bool) (workers.Message, error) {
+	h := &copyUid{dest: make(map[uint32]uint32)}
+	err := a.inMailbox(mailbox, func() error {
+		if move {
+			supported, err := a.c.Support("MOVE")
+			if err != nil {
+				return err
+			}
+			if supported {
+				_, err = a.execute(&commands.Uid{Cmd: &moveCmd{toSeqSet(uids), dest}}, h)
+				return err
+			}
+			// checked before copying so that mails are not left in both
+			// mailboxes
+			if err = a.requireUidplus(); err != nil {
+				return err
+			}
+		}
+		status, err := a.execute(&commands.Uid{Cmd: &commands.Copy{SeqSet: toSeqSet(uids), Mailbox: dest}}, h)
+		if err != nil {
+			return errors.Wrap(err, "while copying")
+		}
+		h.Handle(status)
+		if move {
+			return a.deleteMails(uids)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &workers.MsgToDb{Wrapped: &workers.CopyMails{
+		Mailbox:  mailbox,
+		Uids:     uids,
+		Dest:     dest,
+		DestUids: h.destUids(uids),
+		Move:     move,
+	}}, nil
+}
+
+// handleMoveMails moves or copies mails, db must then be updated as
+// returned message tells
+func (a *Account) handleMoveMails(msg *workers.MoveMails) (workers.Message, error) {
+	return a.copyMails(msg.Mailbox, msg.Uids, msg.Dest, !msg.Copy)
+}
+
+func (a *Account) handleArchiveMails(msg *workers.ArchiveMails) (workers.Message, error) {
+	dest, err := a.specialMailbox(a.cfg.Archive, imap.ArchiveAttr)
+	if err != nil {
+		return nil, err
+	}
+	if dest == msg.Mailbox {
+		return nil, errors.New("mails are already archived")
+	}
+	return a.copyMails(msg.Mailbox, msg.Uids, dest, true)
+}
+
+// handleDeleteMails moves mails to trash. They are expunged only when they
+// are already there, or when there is no trash and user confirmed it
+func (a *Account) handleDeleteMails(msg *workers.DeleteMails) (workers.Message, error) {
+	trash, err := a.specialMailbox(a.cfg.Trash, imap.TrashAttr)
+	if errors.Cause(err) == errNoSpecialMailbox {
+		if !msg.Permanently {
+			return nil, ErrNoTrash
+		}
+	} else if err != nil {
+		return nil, err
+	} else if trash != msg.Mailbox {
+		return a.copyMails(msg.Mailbox, msg.Uids, trash, true)
+	}
+	err = a.inMailbox(msg.Mailbox, func() error {
+		return a.deleteMails(msg.Uids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &workers.MsgToDb{Wrapped: &workers.RemoveMails{Mailbox: msg.Mailbox, Uids: msg.Uids}}, nil
+}
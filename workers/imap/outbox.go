@@ -0,0 +1,140 @@
+package imap
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+const (
+	OUTBOX_MIN_DELAY    = 30 * time.Second
+	OUTBOX_MAX_DELAY    = 1 * time.Hour
+	OUTBOX_MAX_ATTEMPTS = 10
+)
+
+// temporary returns true when sending may succeed later, i.e. smtp server
+// could not be reached or answered with a transient (4xx) error
+func temporary(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case net.Error:
+		return true
+	case *smtp.SMTPError:
+		return err.Code >= 400 && err.Code < 500
+	}
+	return false
+}
+
+// handleSendOutbox schedules mails, and sends right away those which are due
+func (a *Account) handleSendOutbox(msg *workers.SendOutbox) workers.Message {
+	for _, m := range msg.Mails {
+		if m.NextAttempt.IsZero() {
+			// no longer retried automatically
+			continue
+		}
+		// keep a copy as app goes on using m
+		mail := *m
+		a.outbox[m.Id] = &mail
+	}
+	a.sendOutbox()
+	return &workers.Done{}
+}
+
+// nextOutboxAttempt returns a channel firing when the next outbox mail is
+// due, or a nil channel (blocking forever) when outbox is empty
+func (a *Account) nextOutboxAttempt() <-chan time.Time {
+	if a.outboxTimer == nil {
+		return nil
+	}
+	return a.outboxTimer.C
+}
+
+// scheduleOutbox sets outbox timer to fire when the next outbox mail is due,
+// it must be called whenever outbox changes
+func (a *Account) scheduleOutbox() {
+	var next time.Time
+	for _, m := range a.outbox {
+		if next.IsZero() || m.NextAttempt.Before(next) {
+			next = m.NextAttempt
+		}
+	}
+	if next.IsZero() {
+		if a.outboxTimer != nil {
+			a.outboxTimer.Stop()
+			a.outboxTimer = nil
+		}
+		return
+	}
+	if a.outboxTimer == nil {
+		a.outboxTimer = time.NewTimer(time.Until(next))
+		return
+	}
+	if !a.outboxTimer.Stop() {
+		// drain channel in case timer fired without being received
+		select {
+		case <-a.outboxTimer.C:
+		default:
+		}
+	}
+	a.outboxTimer.Reset(time.Until(next))
+}
+
+// sendOutbox sends outbox mails which are due
+func (a *Account) sendOutbox() {
+	now := time.Now()
+	for _, m := range a.outbox {
+		if !m.NextAttempt.After(now) {
+			a.sendOutboxMail(m)
+		}
+	}
+	a.scheduleOutbox()
+}
+
+// sendOutboxMail tries to send m, then tells app whether it was sent and,
+// if not, when it will be retried
+func (a *Account) sendOutboxMail(m *models.OutboxMail) {
+	raw, err := a.sendMail(strings.NewReader(m.Body), m.Attachments)
+	notif := &workers.OutboxNotif{}
+	if err != nil {
+		a.logger.Warnf("error sending mail %v (outbox id: %d)", err, m.Id)
+		m.Attempts++
+		m.LastError = err.Error()
+		if _, ok := errors.Cause(err).(*smtp.SMTPError); ok {
+			m.LastError = smtpStatusError(err).Error()
+		}
+		if temporary(err) && m.Attempts < OUTBOX_MAX_ATTEMPTS {
+			m.NextAttempt = time.Now().Add(backoff(m.Attempts, OUTBOX_MIN_DELAY, OUTBOX_MAX_DELAY))
+		} else {
+			m.NextAttempt = time.Time{}
+			delete(a.outbox, m.Id)
+		}
+		notif.Error = errors.New(m.LastError)
+	} else {
+		delete(a.outbox, m.Id)
+		notif.Sent = true
+		if a.connected() {
+			switch r := a.saveSentMail(raw).(type) {
+			case *workers.MsgToDb:
+				notif.ToDb = r.Wrapped
+			case *workers.Error:
+				notif.Error = r.Error
+			}
+		} else if action, err := workers.NewPendingAction(&workers.AppendSentMail{Body: raw}); err != nil {
+			a.logger.Warnf("cannot record sent mail to save it later %v", err)
+			notif.Error = errors.New("mail sent, but cannot be saved in sent mailbox")
+		} else {
+			// saved once connection is back, reconnecting here would
+			// hold up every other request
+			notif.Pending = action
+		}
+	}
+	// app gets its own copy, m may be sent again
+	mail := *m
+	notif.Mail = &mail
+	a.notify(notif)
+}
@@ -0,0 +1,139 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/workers"
+)
+
+// queue records msg, which cannot reach server, so that it is replayed once
+// connection is back
+func (a *Account) queue(msg workers.Message) workers.Message {
+	action, err := workers.NewPendingAction(msg)
+	if err != nil {
+		a.logger.Warnf("cannot record request to replay it %v", err)
+		return &workers.Error{Error: ErrNotConnected}
+	}
+	q := &workers.Queued{Action: action, Result: queuedResult(msg)}
+	q.SetAccName(a.cfg.Name)
+	return q
+}
+
+// queuedResult returns response to msg as if it had succeeded, so that local
+// state reflects the action until it is replayed
+func queuedResult(msg workers.Message) workers.Message {
+	switch msg := msg.(type) {
+	case *workers.StoreFlags:
+		return &workers.Done{}
+	case *workers.MoveMails:
+		if msg.Copy {
+			return &workers.Done{}
+		}
+		return &workers.MsgToDb{Wrapped: &workers.RemoveMails{Mailbox: msg.Mailbox, Uids: msg.Uids}}
+	case *workers.ArchiveMails:
+		return &workers.MsgToDb{Wrapped: &workers.RemoveMails{Mailbox: msg.Mailbox, Uids: msg.Uids}}
+	case *workers.DeleteMails:
+		return &workers.MsgToDb{Wrapped: &workers.RemoveMails{Mailbox: msg.Mailbox, Uids: msg.Uids}}
+	}
+	return nil
+}
+
+// errUidValidityChanged tells that uids of a pending action designate other
+// mails than when it was recorded
+var errUidValidityChanged = errors.New("uidvalidity of mailbox changed")
+
+// keepExistingUids removes from msg uids of mails which are no longer in its
+// mailbox, and returns false when there is no mail left to act on. It fails
+// when mailbox no longer has uidvalidity (unless it is unknown, i.e. 0)
+func (a *Account) keepExistingUids(msg workers.Message, uidvalidity uint32) (bool, error) {
+	var mailbox string
+	var uids *[]uint32
+	switch msg := msg.(type) {
+	case *workers.StoreFlags:
+		mailbox, uids = msg.Mailbox, &msg.Uids
+	case *workers.MoveMails:
+		mailbox, uids = msg.Mailbox, &msg.Uids
+	case *workers.ArchiveMails:
+		mailbox, uids = msg.Mailbox, &msg.Uids
+	case *workers.DeleteMails:
+		mailbox, uids = msg.Mailbox, &msg.Uids
+	default:
+		return true, nil
+	}
+	if len(*uids) == 0 {
+		return false, nil
+	}
+	err := a.inMailbox(mailbox, func() error {
+		if uidvalidity != 0 && uidvalidity != a.selectedMbox.UidValidity {
+			return errUidValidityChanged
+		}
+		criteria := imap.NewSearchCriteria()
+		criteria.Uid = toSeqSet(*uids)
+		found, err := a.c.UidSearch(criteria)
+		if err != nil {
+			return err
+		}
+		*uids = found
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "while searching mails in `%s`", mailbox)
+	}
+	return len(*uids) > 0, nil
+}
+
+// handleReplayPendingActions replays actions in the order they were done,
+// until connection is lost. Actions conflicting with server state (e.g. on
+// mails which no longer exist, or in a renumbered mailbox) are dropped
+func (a *Account) handleReplayPendingActions(msg *workers.ReplayPendingActions) workers.Message {
+	res := &workers.ReplayPendingActionsRes{}
+	for _, action := range msg.Actions {
+		if !a.connected() {
+			break
+		}
+		replayed, err := workers.ReplayMessage(action)
+		if err != nil {
+			a.logger.Warnf("dropping unreadable pending action %d %v", action.Id, err)
+			res.Done = append(res.Done, action.Id)
+			res.Dropped++
+			continue
+		}
+		uidvalidity, err := workers.PendingUidValidity(action)
+		if err != nil {
+			a.logger.Warnf("dropping unreadable pending action %d %v", action.Id, err)
+			res.Done = append(res.Done, action.Id)
+			res.Dropped++
+			continue
+		}
+		ok, err := a.keepExistingUids(replayed, uidvalidity)
+		if err != nil && !a.connected() {
+			break
+		}
+		if errors.Cause(err) == errUidValidityChanged {
+			a.logger.Warnf("dropping pending action %d, its mailbox was renumbered", action.Id)
+			res.Done = append(res.Done, action.Id)
+			res.Dropped++
+			continue
+		}
+		if !ok {
+			a.logger.Warnf("dropping pending action %d, its mails are gone %v", action.Id, err)
+			res.Done = append(res.Done, action.Id)
+			res.Dropped++
+			continue
+		}
+		r := a.processRequest(replayed)
+		if _, ok := r.(*workers.Error); ok && !a.connected() {
+			break
+		}
+		switch r := r.(type) {
+		case *workers.Error:
+			a.logger.Warnf("dropping pending action %d refused by server %v", action.Id, r.Error)
+			res.Dropped++
+		case *workers.MsgToDb:
+			res.ToDb = append(res.ToDb, r.Wrapped)
+		}
+		res.Done = append(res.Done, action.Id)
+	}
+	return res
+}
@@ -0,0 +1,82 @@
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// header field searched for each term field, `body` is handled apart
+var searchHeaders = map[string]string{
+	"from":    "From",
+	"to":      "To",
+	"subject": "Subject",
+}
+
+// searchCriteria translates q into imap search criteria, all criteria must
+// be satisfied as is the case in local search
+func searchCriteria(q *models.SearchQuery) *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	for _, t := range q.Terms {
+		if key, ok := searchHeaders[t.Field]; ok {
+			c.Header.Add(key, t.Value)
+		} else if t.Field == "body" {
+			c.Body = append(c.Body, t.Value)
+		} else {
+			c.Text = append(c.Text, t.Value)
+		}
+	}
+	if !q.Before.IsZero() {
+		c.Before = q.Before
+	}
+	if !q.After.IsZero() {
+		c.Since = q.After
+	}
+	c.WithFlags = q.With
+	c.WithoutFlags = q.Without
+	return c
+}
+
+func (a *Account) handleSearchImap(msg *workers.SearchImap) (workers.Message, error) {
+	q, err := models.ParseSearchQuery(msg.Query)
+	if err != nil {
+		return nil, err
+	}
+	criteria := searchCriteria(q)
+	mailboxes := msg.Mailboxes
+	if len(mailboxes) == 0 {
+		infos, err := a.listMailboxes()
+		if err != nil {
+			return nil, errors.Wrap(err, "while listing mailboxes")
+		}
+		for _, m := range infos {
+			if canOpen(m) {
+				mailboxes = append(mailboxes, m.Name)
+			}
+		}
+	}
+	r := &workers.SearchImapRes{Mails: make(map[string][]*models.Mail)}
+	for _, mailbox := range mailboxes {
+		err = a.inMailbox(mailbox, func() error {
+			uids, err := a.c.UidSearch(criteria)
+			if err != nil {
+				return errors.Wrap(err, "while searching")
+			}
+			if len(uids) == 0 {
+				return nil
+			}
+			mails, err := a.fetchMails(toSeqSet(uids), func(*imap.Message) bool { return true })
+			if err != nil {
+				return errors.Wrap(err, "while fetching found mails")
+			}
+			r.Mails[mailbox] = mails
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "in mailbox `%s`", mailbox)
+		}
+	}
+	return r, nil
+}
@@ -1,9 +1,17 @@
 package imap
 
 import (
+	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/emersion/go-imap"
@@ -12,6 +20,8 @@ import (
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/config"
 )
 
 func toSeqSet(uids []uint32) *imap.SeqSet {
@@ -56,17 +66,83 @@ func getPass(cmd string) (string, error) {
 	return strings.TrimRight(string(out), "\n"), nil
 }
 
-func connectSmtps(serverName string, port uint16) (*smtp.Client, error) {
-	host := fmt.Sprintf("%s:%d", serverName, port)
-	conn, err := smtp.DialTLS(host, &tls.Config{
-		ServerName: serverName,
-	})
-	if err != nil {
-		return nil, errors.Wrap(err, "while dialing tls for smtp")
+func newTlsConfig(serverName, cafile string, skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+	if cafile != "" {
+		pem, err := ioutil.ReadFile(cafile)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading ca file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ca file `%s`", cafile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func connectSmtp(cfg *config.SmtpCfg) (*smtp.Client, error) {
+	host := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	mode := cfg.ConnMode()
+	var tlsConfig *tls.Config
+	var err error
+	if mode != config.CONN_MODE_PLAIN {
+		tlsConfig, err = newTlsConfig(cfg.Host, cfg.CaFile, cfg.SkipVerify)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var conn *smtp.Client
+	if mode == config.CONN_MODE_TLS {
+		conn, err = smtp.DialTLS(host, tlsConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "while dialing tls for smtp")
+		}
+	} else {
+		conn, err = smtp.Dial(host)
+		if err != nil {
+			return nil, errors.Wrap(err, "while dialing smtp")
+		}
+	}
+	if cfg.Hostname != "" {
+		// Hello must be called before any other command
+		if err = conn.Hello(cfg.Hostname); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "while issuing ehlo cmd")
+		}
+	}
+	if mode == config.CONN_MODE_STARTTLS {
+		if ok, _ := conn.Extension("STARTTLS"); !ok {
+			conn.Close()
+			return nil, fmt.Errorf("smtp server `%s` does not support STARTTLS", host)
+		}
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "while issuing starttls cmd")
+		}
 	}
 	return conn, nil
 }
 
+// smtpStatusError builds the error reported to user, with status codes
+// returned by smtp server if any
+func smtpStatusError(err error) error {
+	smtpErr, ok := errors.Cause(err).(*smtp.SMTPError)
+	if !ok {
+		return errors.New("error sending mail")
+	}
+	code := fmt.Sprintf("%d", smtpErr.Code)
+	if smtpErr.EnhancedCode != smtp.NoEnhancedCode && smtpErr.EnhancedCode != smtp.EnhancedCodeNotSet {
+		ec := smtpErr.EnhancedCode
+		code = fmt.Sprintf("%s %d.%d.%d", code, ec[0], ec[1], ec[2])
+	}
+	return fmt.Errorf("error sending mail (%s: %s)", code, smtpErr.Message)
+}
+
 func newSaslClient(auth, user, password string) (sasl.Client, error) {
 	var saslClient sasl.Client
 	switch auth {
@@ -125,3 +201,55 @@ func encodeHeaderFields(h *mail.Header) error {
 	}
 	return nil
 }
+
+// attachmentType sniffs content-type of attached file from its first bytes,
+// relying on its extension when sniffing is inconclusive
+func attachmentType(path string, head []byte) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".mail", ".eml":
+		return "message/rfc822"
+	}
+	sniffed := http.DetectContentType(head)
+	if strings.HasPrefix(sniffed, "application/octet-stream") || strings.HasPrefix(sniffed, "text/plain") {
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t
+		}
+	}
+	return sniffed
+}
+
+func writeAttachment(mw *mail.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	// http.DetectContentType considers at most 512 bytes
+	head, err := r.Peek(512)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var h mail.AttachmentHeader
+	t, params, err := mime.ParseMediaType(attachmentType(path, head))
+	if err != nil {
+		return err
+	}
+	h.SetContentType(t, params)
+	if t == "message/rfc822" {
+		// rfc2046 forbids encoding message/rfc822 parts
+		h.Set("Content-Transfer-Encoding", "8bit")
+	} else {
+		h.Set("Content-Transfer-Encoding", "base64")
+	}
+	h.SetFilename(filepath.Base(path))
+	w, err := mw.CreateAttachment(h)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,426 @@
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/config"
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// name of mailbox stored at root of maildir tree
+const INBOX = "INBOX"
+
+// Maildir++ subfolders are named after their mailbox, prefixed and
+// delimited by a dot
+const DELIMITER = "."
+
+// delay without any change in watched mailbox before handling changes, as
+// syncing tools rename many files at once
+const CHANGES_DELAY = 500 * time.Millisecond
+
+// msgFile is a message file of a mailbox
+type msgFile struct {
+	uid uint32
+	// either new or cur
+	subdir string
+	name   string
+	flags  []string
+}
+
+// Account serves requests of an account whose mails are stored in a local
+// Maildir++ tree, e.g. synced by mbsync or offlineimap
+type Account struct {
+	cfg      *config.Account
+	requests chan workers.Message
+	root     string
+	logger   *lib.Logger
+	// post a message to app without prior request
+	notify func(workers.Message)
+
+	watcher *fsnotify.Watcher
+	// mailbox whose changes are notified, along with its greatest uid and
+	// flags of its messages known by app
+	watched     string
+	lastSeenUid uint32
+	known       map[uint32]string
+	changes     <-chan time.Time
+}
+
+func NewAccount(l *lib.Logger, c *config.Account) *Account {
+	return &Account{
+		cfg:      c,
+		requests: make(chan workers.Message, 10),
+		logger:   l,
+	}
+}
+
+func (a *Account) PostMessage(msg workers.Message) {
+	a.requests <- msg
+}
+
+func (a *Account) Close() {
+	close(a.requests)
+}
+
+func (a *Account) Run(responses chan<- workers.Message) {
+	defer lib.Recover(a.logger, nil)
+	defer a.terminate()
+	postResponse := func(msg workers.Message, id int) {
+		msg.SetId(id)
+		responses <- msg
+	}
+	a.notify = func(msg workers.Message) {
+		// notifications are not answers to a request, so they keep a zero id
+		msg.SetAccName(a.cfg.Name)
+		responses <- msg
+	}
+	for {
+		select {
+		case msg, ok := <-a.requests:
+			if !ok {
+				return
+			}
+			postResponse(a.processRequest(msg), msg.GetId())
+		case ev := <-a.events():
+			a.logger.Debugf("maildir event %v", ev)
+			a.changes = time.After(CHANGES_DELAY)
+		case err := <-a.watchErrors():
+			a.logger.Warnf("error watching maildir %v", err)
+		case <-a.changes:
+			a.changes = nil
+			a.handleChanges()
+		}
+	}
+}
+
+func (a *Account) terminate() {
+	if a.watcher != nil {
+		a.watcher.Close()
+	}
+}
+
+func (a *Account) processRequest(msg workers.Message) workers.Message {
+	var r workers.Message
+	switch msg := msg.(type) {
+	case *workers.ConnectImap:
+		var err error
+		a.root, err = lib.ExpandHome(a.cfg.Maildir.Path)
+		if err == nil {
+			_, err = os.Stat(filepath.Join(a.root, "cur"))
+		}
+		if err != nil {
+			a.logger.Warnf("cannot open maildir %v", err)
+			r = &workers.Error{Error: errors.Wrapf(err, "cannot open maildir `%s`", a.cfg.Maildir.Path)}
+		} else {
+			r = &workers.Done{}
+		}
+	case *workers.FetchMailboxes:
+		result, err := a.handleFetchMailboxes()
+		if err != nil {
+			a.logger.Warnf("error listing maildir folders %v", err)
+			r = &workers.Error{Error: errors.New("error reading maildir")}
+		} else {
+			r = &workers.MsgToDb{Wrapped: &workers.FetchMailboxesImapRes{
+				Mailboxes: result,
+			}}
+		}
+	case *workers.FetchNewMessages:
+		var err error
+		r, err = a.handleFetchNewMessages(msg)
+		if err != nil {
+			a.logger.Warnf("error reading new messages %v", err)
+			r = &workers.Error{Error: errors.New("error reading maildir")}
+		}
+	case *workers.FetchMessageUpdates:
+		var err error
+		r, err = a.handleFetchMessageUpdates(msg)
+		if err != nil {
+			a.logger.Warnf("error reading messages flags %v", err)
+			r = &workers.Error{Error: errors.New("error reading maildir")}
+		}
+	case *workers.FetchFullMail:
+		var err error
+		r, err = a.handleFetchFullMail(msg)
+		if err != nil {
+			a.logger.Warnf("error reading full message %v", err)
+			r = &workers.Error{Error: errors.New("error reading maildir")}
+		}
+	case *workers.StoreFlags:
+		if err := checkFlags(msg.Flags); err != nil {
+			r = &workers.Error{Error: err}
+		} else if err := a.handleStoreFlags(msg); err != nil {
+			a.logger.Warnf("error storing flags %v", err)
+			r = &workers.Error{Error: errors.New("cannot update flags in maildir")}
+		} else {
+			r = &workers.Done{}
+		}
+	default:
+		r = &workers.Error{Error: fmt.Errorf("%T is not supported by maildir backend", msg)}
+	}
+	return r
+}
+
+// dir returns directory of mailbox
+func (a *Account) dir(mailbox string) string {
+	if mailbox == INBOX {
+		return a.root
+	}
+	return filepath.Join(a.root, DELIMITER+mailbox)
+}
+
+// uidListPath is where uids of mailbox messages are kept
+func (a *Account) uidListPath(mailbox string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cache, "nuntius", "maildir", a.cfg.Name, mailbox+".json"), nil
+}
+
+func (a *Account) handleFetchMailboxes() ([]*models.Mailbox, error) {
+	entries, err := ioutil.ReadDir(a.root)
+	if err != nil {
+		return nil, err
+	}
+	result := []*models.Mailbox{{Name: INBOX, ShortName: INBOX}}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), DELIMITER) || e.Name() == ".." {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(a.root, e.Name(), "cur")); err != nil {
+			// not a maildir folder
+			continue
+		}
+		name := strings.TrimPrefix(e.Name(), DELIMITER)
+		parent := ""
+		parts := strings.Split(name, DELIMITER)
+		shortName := parts[len(parts)-1]
+		if len(parts) > 1 {
+			parent = parts[len(parts)-2]
+		}
+		result = append(result, &models.Mailbox{Name: name, ShortName: shortName, Parent: parent})
+	}
+	return result, nil
+}
+
+// scan lists messages of mailbox by uid, uids being given to messages not
+// seen so far
+func (a *Account) scan(mailbox string) (map[uint32]*msgFile, uint32, error) {
+	path, err := a.uidListPath(mailbox)
+	if err != nil {
+		return nil, 0, err
+	}
+	uids, err := loadUidList(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	byKey, keys, err := listMessages(a.dir(mailbox))
+	if err != nil {
+		return nil, 0, err
+	}
+	if uids.update(keys) {
+		if err = uids.save(path); err != nil {
+			return nil, 0, errors.Wrap(err, "while saving uids")
+		}
+	}
+	result := make(map[uint32]*msgFile, len(byKey))
+	for key, m := range byKey {
+		m.uid = uids.Uids[key]
+		result[m.uid] = m
+	}
+	return result, uids.UidValidity, nil
+}
+
+// listMessages returns message files found in new and cur subdirectories
+// of maildir dir by unique name, along with these names
+func listMessages(dir string) (map[string]*msgFile, []string, error) {
+	byKey := make(map[string]*msgFile)
+	keys := make([]string, 0)
+	for _, subdir := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir, subdir))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			key, flags := splitName(e.Name())
+			byKey[key] = &msgFile{subdir: subdir, name: e.Name(), flags: flags}
+			keys = append(keys, key)
+		}
+	}
+	return byKey, keys, nil
+}
+
+// sortedUids returns uids of messages in ascending order, i.e. in order
+// they were found
+func sortedUids(messages map[uint32]*msgFile) []uint32 {
+	uids := make([]uint32, 0, len(messages))
+	for uid := range messages {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+func (a *Account) path(mailbox string, m *msgFile) string {
+	return filepath.Join(a.dir(mailbox), m.subdir, m.name)
+}
+
+// readMail parses header and structure of message file
+func (a *Account) readMail(mailbox string, m *msgFile) (*models.Mail, error) {
+	f, err := os.Open(a.path(mailbox, m))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result, err := models.ParseMail(f)
+	if err != nil {
+		return nil, err
+	}
+	result.Flags = m.flags
+	result.Uid = m.uid
+	return result, nil
+}
+
+func (a *Account) handleFetchNewMessages(msg *workers.FetchNewMessages) (workers.Message, error) {
+	messages, uidvalidity, err := a.scan(msg.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	lastseenuid := msg.LastSeenUid
+	reset := msg.UidValidity != 0 && msg.UidValidity != uidvalidity
+	if reset {
+		a.logger.Warnf("uids of `%s` were lost (uidvalidity %d, was %d)", msg.Mailbox, uidvalidity, msg.UidValidity)
+		lastseenuid = 0
+	}
+	result := make([]*models.Mail, 0)
+	maxuid := lastseenuid
+	for _, uid := range sortedUids(messages) {
+		if uid <= lastseenuid {
+			continue
+		}
+		m := messages[uid]
+		mail, err := a.readMail(msg.Mailbox, m)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading `%s`", m.name)
+		}
+		result = append(result, mail)
+		if uid > maxuid {
+			maxuid = uid
+		}
+	}
+	a.watch(msg.Mailbox, maxuid, messages)
+	return &workers.FetchNewMessagesRes{
+		Mailbox:     msg.Mailbox,
+		Mails:       result,
+		UidValidity: uidvalidity,
+		Reset:       reset,
+	}, nil
+}
+
+// knownFlags returns flags of messages with uid up to lastseenuid
+func knownFlags(messages map[uint32]*msgFile, lastseenuid uint32) []*models.Mail {
+	result := make([]*models.Mail, 0)
+	for uid, m := range messages {
+		if uid <= lastseenuid {
+			result = append(result, &models.Mail{Uid: uid, Flags: m.flags})
+		}
+	}
+	return result
+}
+
+func (a *Account) handleFetchMessageUpdates(msg *workers.FetchMessageUpdates) (workers.Message, error) {
+	messages, uidvalidity, err := a.scan(msg.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	r := &workers.FetchMessageUpdatesRes{Mailbox: msg.Mailbox}
+	if msg.UidValidity != 0 && msg.UidValidity != uidvalidity {
+		// mailbox is synced from scratch by FetchNewMessages instead
+		r.Incremental = true
+		return r, nil
+	}
+	r.Mails = knownFlags(messages, msg.LastSeenUid)
+	return r, nil
+}
+
+// setFlags renames message file of m so that it holds flags, moving it to
+// cur subdirectory as it is no longer new
+func (a *Account) setFlags(mailbox string, m *msgFile, flags []string) error {
+	name, err := withFlags(m.name, flags)
+	if err != nil {
+		return err
+	}
+	renamed := &msgFile{uid: m.uid, subdir: "cur", name: name, flags: flags}
+	if err := os.Rename(a.path(mailbox, m), a.path(mailbox, renamed)); err != nil {
+		return err
+	}
+	*m = *renamed
+	if mailbox == a.watched && a.known != nil {
+		a.known[m.uid] = strings.Join(m.flags, " ")
+	}
+	return nil
+}
+
+func (a *Account) handleFetchFullMail(msg *workers.FetchFullMail) (workers.Message, error) {
+	messages, _, err := a.scan(msg.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := messages[msg.Uid]
+	if !ok {
+		return nil, fmt.Errorf("no message with uid %d in `%s`", msg.Uid, msg.Mailbox)
+	}
+	r := &workers.FetchFullMailRes{}
+	mail := &models.Mail{Flags: append([]string{}, m.flags...)}
+	if !mail.HasFlag(imap.SeenFlag) && !msg.Peek {
+		// first time message is read, as when it is fetched from imap
+		// server
+		mail.MarkAsRead()
+		if err = a.setFlags(msg.Mailbox, m, mail.Flags); err != nil {
+			return nil, errors.Wrap(err, "while marking as read")
+		}
+		r.FromImap = true
+	}
+	r.Filepath = a.path(msg.Mailbox, m)
+	return r, nil
+}
+
+func (a *Account) handleStoreFlags(msg *workers.StoreFlags) error {
+	messages, _, err := a.scan(msg.Mailbox)
+	if err != nil {
+		return err
+	}
+	for _, uid := range msg.Uids {
+		m, ok := messages[uid]
+		if !ok {
+			return fmt.Errorf("no message with uid %d in `%s`", uid, msg.Mailbox)
+		}
+		mail := &models.Mail{Flags: append([]string{}, m.flags...)}
+		for _, f := range msg.Flags {
+			if msg.Remove {
+				mail.RemoveFlag(f)
+			} else {
+				mail.AddFlag(f)
+			}
+		}
+		if err = a.setFlags(msg.Mailbox, m, mail.Flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/stregouet/nuntius/workers"
+)
+
+// archive is a maildir whose messages are imported into an account. Only
+// messages of dir itself are read, not those of its subfolders
+type archive struct {
+	dir      string
+	messages []*msgFile
+}
+
+// OpenArchive lists messages of maildir dir, in delivery order, so that
+// they can be read one after the other
+func OpenArchive(dir string) (workers.Archive, error) {
+	byKey, keys, err := listMessages(dir)
+	if err != nil {
+		return nil, err
+	}
+	// unique names start with delivery time
+	sort.Strings(keys)
+	messages := make([]*msgFile, 0, len(keys))
+	for _, k := range keys {
+		messages = append(messages, byKey[k])
+	}
+	return &archive{dir: dir, messages: messages}, nil
+}
+
+func (a *archive) Len() int {
+	return len(a.messages)
+}
+
+func (a *archive) Read(i int) (*workers.ArchivedMail, error) {
+	m := a.messages[i]
+	path := filepath.Join(a.dir, m.subdir, m.name)
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// like dovecot does, modification time of message file is taken as the
+	// date it was received at
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &workers.ArchivedMail{Raw: raw, Flags: m.flags, Date: info.ModTime()}, nil
+}
+
+func (a *archive) Close() error {
+	return nil
+}
@@ -0,0 +1,69 @@
+package maildir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct {
+		path    string
+		content string
+		date    time.Time
+	}{
+		{"cur/1625479200.M2P1.host:2,S", "Subject: two\n\nsecond\n", time.Date(2021, time.July, 5, 10, 0, 0, 0, time.UTC)},
+		{"new/1625392800.M1P1.host", "Subject: one\n\nfirst\n", time.Date(2021, time.July, 4, 10, 0, 0, 0, time.UTC)},
+		// messages of subfolders are not part of archive
+		{".sub/cur/1625500000.M3P1.host:2,", "Subject: three\n\nthird\n", time.Time{}},
+		{".sub/new/.hidden", "", time.Time{}},
+	}
+	for _, sub := range []string{"cur", "new", "tmp", ".sub/cur", ".sub/new"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.path)
+		if err := ioutil.WriteFile(path, []byte(f.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if !f.date.IsZero() {
+			if err := os.Chtimes(path, f.date, f.date); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a, err := OpenArchive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	// in delivery order
+	expected := []struct {
+		raw   string
+		flags []string
+		date  time.Time
+	}{
+		{files[1].content, []string{}, files[1].date},
+		{files[0].content, []string{imap.SeenFlag}, files[0].date},
+	}
+	if a.Len() != len(expected) {
+		t.Fatalf("expected %d mails, found %d", len(expected), a.Len())
+	}
+	for i, e := range expected {
+		m, err := a.Read(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Raw) != e.raw || !reflect.DeepEqual(e.flags, m.Flags) || !m.Date.Equal(e.date) {
+			t.Errorf("(mail %d) expected %q %v %v, found %q %v %v", i+1, e.raw, e.flags, e.date, m.Raw, m.Flags, m.Date)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package maildir
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// separates unique name of a message file from its info (rfc-less
+// convention described at https://cr.yp.to/proto/maildir.html)
+const INFO_SEP = ":2,"
+
+// maildir info flags and their imap counterpart
+var maildirFlags = map[byte]string{
+	'D': imap.DraftFlag,
+	'F': imap.FlaggedFlag,
+	'P': "$Forwarded",
+	'R': imap.AnsweredFlag,
+	'S': imap.SeenFlag,
+	'T': imap.DeletedFlag,
+}
+
+// splitName returns unique name of message file name, along with imap flags
+// found in its info
+func splitName(name string) (key string, flags []string) {
+	flags = make([]string, 0)
+	idx := strings.Index(name, INFO_SEP)
+	if idx < 0 {
+		return name, flags
+	}
+	for _, c := range []byte(name[idx+len(INFO_SEP):]) {
+		if f, ok := maildirFlags[c]; ok {
+			flags = append(flags, f)
+		}
+	}
+	return name[:idx], flags
+}
+
+// withFlags returns message file name with imap flags in its info instead of
+// the ones it had. Other info letters (e.g. keywords set by other clients)
+// are kept. Flags without maildir counterpart cannot be kept in file name, an
+// error is returned rather than dropping them
+func withFlags(name string, flags []string) (string, error) {
+	if err := checkFlags(flags); err != nil {
+		return "", err
+	}
+	key, info := name, ""
+	if idx := strings.Index(name, INFO_SEP); idx >= 0 {
+		key, info = name[:idx], name[idx+len(INFO_SEP):]
+	}
+	chars := make([]byte, 0, len(info)+len(flags))
+	for _, c := range []byte(info) {
+		if _, ok := maildirFlags[c]; !ok {
+			chars = append(chars, c)
+		}
+	}
+	for c, f := range maildirFlags {
+		for _, flag := range flags {
+			if flag == f {
+				chars = append(chars, c)
+				break
+			}
+		}
+	}
+	// flags must be in ascii order
+	sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+	return key + INFO_SEP + string(chars), nil
+}
+
+// checkFlags returns an error if one of flags has no maildir counterpart
+func checkFlags(flags []string) error {
+	for _, flag := range flags {
+		found := false
+		for _, f := range maildirFlags {
+			if f == flag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("flag `%s` cannot be stored in maildir", flag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package maildir
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestSplitName(t *testing.T) {
+	testCases := []struct {
+		name  string
+		key   string
+		flags []string
+	}{
+		{"1622.M1P2.host", "1622.M1P2.host", []string{}},
+		{"1622.M1P2.host:2,", "1622.M1P2.host", []string{}},
+		{"1622.M1P2.host:2,FS", "1622.M1P2.host", []string{imap.FlaggedFlag, imap.SeenFlag}},
+		// unknown letters are ignored
+		{"1622.M1P2.host:2,aRx", "1622.M1P2.host", []string{imap.AnsweredFlag}},
+	}
+	for _, tc := range testCases {
+		key, flags := splitName(tc.name)
+		if key != tc.key || !reflect.DeepEqual(flags, tc.flags) {
+			t.Errorf("%s: expected %s %v, got %s %v", tc.name, tc.key, tc.flags, key, flags)
+		}
+	}
+}
+
+func TestWithFlags(t *testing.T) {
+	name, err := withFlags("key", []string{imap.SeenFlag, imap.DraftFlag, "$Forwarded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "key:2,DPS" {
+		t.Errorf("expected flags in ascii order, got %s", name)
+	}
+	key, flags := splitName(name)
+	sort.Strings(flags)
+	expected := []string{"$Forwarded", imap.DraftFlag, imap.SeenFlag}
+	if key != "key" || !reflect.DeepEqual(flags, expected) {
+		t.Errorf("expected key with flags %v, got %s %v", expected, key, flags)
+	}
+	// keyword letters of other clients are kept
+	name, err = withFlags("key:2,FSab", []string{imap.AnsweredFlag, imap.SeenFlag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "key:2,RSab" {
+		t.Errorf("expected managed letters replaced and others kept, got %s", name)
+	}
+	if _, err = withFlags("key", []string{imap.SeenFlag, "$Label"}); err == nil {
+		t.Error("expected error for keyword without maildir counterpart")
+	}
+}
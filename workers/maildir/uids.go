@@ -0,0 +1,85 @@
+package maildir
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// uidList assigns uids to messages of a mailbox, which maildir has no notion
+// of, so that they are handled as imap ones. Uids are kept by unique name of
+// message files, a new uidvalidity is chosen once the list is lost
+type uidList struct {
+	UidValidity uint32
+	NextUid     uint32
+	Uids        map[string]uint32
+}
+
+func newUidList() *uidList {
+	return &uidList{
+		UidValidity: uint32(time.Now().Unix()),
+		NextUid:     1,
+		Uids:        make(map[string]uint32),
+	}
+}
+
+func loadUidList(path string) (*uidList, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return newUidList(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	l := &uidList{}
+	if err = json.Unmarshal(content, l); err != nil {
+		return nil, errors.Wrapf(err, "while parsing `%s`", path)
+	}
+	if l.Uids == nil {
+		l.Uids = make(map[string]uint32)
+	}
+	return l, nil
+}
+
+func (l *uidList) save(path string) error {
+	content, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// update gives uids to keys not known yet, in keys order (unique names start
+// with delivery time), and forgets keys no longer found. It returns true if
+// list changed
+func (l *uidList) update(keys []string) bool {
+	changed := false
+	found := make(map[string]bool, len(keys))
+	sort.Strings(keys)
+	for _, k := range keys {
+		found[k] = true
+		if _, ok := l.Uids[k]; !ok {
+			l.Uids[k] = l.NextUid
+			l.NextUid++
+			changed = true
+		}
+	}
+	for k := range l.Uids {
+		if !found[k] {
+			delete(l.Uids, k)
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,48 @@
+package maildir
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUidListUpdate(t *testing.T) {
+	l := newUidList()
+	if !l.update([]string{"2.b", "1.a"}) {
+		t.Error("expected list changed by new keys")
+	}
+	expected := map[string]uint32{"1.a": 1, "2.b": 2}
+	if !reflect.DeepEqual(l.Uids, expected) {
+		t.Errorf("expected uids given in keys order %v, got %v", expected, l.Uids)
+	}
+	if l.update([]string{"1.a", "2.b"}) {
+		t.Error("expected list unchanged")
+	}
+	// uids of removed keys are not reused
+	if !l.update([]string{"3.c", "2.b"}) {
+		t.Error("expected list changed by removed key")
+	}
+	expected = map[string]uint32{"2.b": 2, "3.c": 3}
+	if !reflect.DeepEqual(l.Uids, expected) || l.NextUid != 4 {
+		t.Errorf("expected uids %v and next uid 4, got %v and %d", expected, l.Uids, l.NextUid)
+	}
+}
+
+func TestUidListSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "INBOX.json")
+	l, err := loadUidList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.update([]string{"1.a"})
+	if err = l.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadUidList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(l, loaded) {
+		t.Errorf("expected %+v, loaded %+v", l, loaded)
+	}
+}
@@ -0,0 +1,112 @@
+package maildir
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+func (a *Account) events() <-chan fsnotify.Event {
+	if a.watcher == nil {
+		return nil
+	}
+	return a.watcher.Events
+}
+
+func (a *Account) watchErrors() <-chan error {
+	if a.watcher == nil {
+		return nil
+	}
+	return a.watcher.Errors
+}
+
+// remember flags of messages, as known by app, to find out what changed
+// later
+func (a *Account) remember(messages map[uint32]*msgFile) {
+	a.known = make(map[uint32]string)
+	for uid, m := range messages {
+		if uid <= a.lastSeenUid {
+			a.known[uid] = strings.Join(m.flags, " ")
+		}
+	}
+}
+
+// watch notifies changes of mailbox (inotify), whose messages with uid up to
+// lastseenuid are known by app, instead of previously watched one
+func (a *Account) watch(mailbox string, lastseenuid uint32, messages map[uint32]*msgFile) {
+	a.lastSeenUid = lastseenuid
+	a.remember(messages)
+	if a.watched == mailbox {
+		return
+	}
+	if a.watcher == nil {
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			a.logger.Warnf("cannot watch maildir, changes will not be noticed %v", err)
+			return
+		}
+		a.watcher = w
+	}
+	for _, subdir := range []string{"new", "cur"} {
+		if a.watched != "" {
+			a.watcher.Remove(filepath.Join(a.dir(a.watched), subdir))
+		}
+		if err := a.watcher.Add(filepath.Join(a.dir(mailbox), subdir)); err != nil {
+			a.logger.Warnf("cannot watch `%s` %v", mailbox, err)
+		}
+	}
+	a.watched = mailbox
+}
+
+// handleChanges notifies app of new messages in watched mailbox, and of
+// known messages whose flags changed or which are gone
+func (a *Account) handleChanges() {
+	if a.watched == "" {
+		return
+	}
+	mailbox := a.watched
+	messages, _, err := a.scan(mailbox)
+	if err != nil {
+		a.logger.Warnf("error reading `%s` after change %v", mailbox, err)
+		return
+	}
+	lastuid := a.lastSeenUid
+	newMails := make([]*models.Mail, 0)
+	for _, uid := range sortedUids(messages) {
+		if uid <= lastuid {
+			continue
+		}
+		m := messages[uid]
+		mail, err := a.readMail(mailbox, m)
+		if err != nil {
+			a.logger.Warnf("error reading `%s` %v", m.name, err)
+			continue
+		}
+		newMails = append(newMails, mail)
+		if uid > a.lastSeenUid {
+			a.lastSeenUid = uid
+		}
+	}
+	if len(newMails) > 0 {
+		a.notify(&workers.NewMessagesNotif{Mailbox: mailbox, Mails: newMails})
+	}
+	changed := false
+	for uid, flags := range a.known {
+		if m, ok := messages[uid]; !ok || strings.Join(m.flags, " ") != flags {
+			changed = true
+			break
+		}
+	}
+	a.remember(messages)
+	if changed {
+		a.notify(&workers.MessageUpdatesNotif{
+			Mailbox:      mailbox,
+			LastSeenUid:  lastuid,
+			MailsChanges: workers.MailsChanges{Mails: knownFlags(messages, lastuid)},
+		})
+	}
+}
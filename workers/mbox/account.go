@@ -0,0 +1,303 @@
+package mbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/config"
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/models"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// Account serves requests of an account whose mails are read from a single
+// mbox file (e.g. an archive or a mailing-list download), shown as one
+// mailbox. The file is never written, flags are only kept in db
+type Account struct {
+	cfg      *config.Account
+	requests chan workers.Message
+	path     string
+	mailbox  string
+	logger   *lib.Logger
+
+	// index of mbox file, reused until file changes. Uid of a message is its
+	// position in file
+	messages []*msgRange
+	size     int64
+	modTime  time.Time
+}
+
+func NewAccount(l *lib.Logger, c *config.Account) *Account {
+	return &Account{
+		cfg:      c,
+		requests: make(chan workers.Message, 10),
+		logger:   l,
+	}
+}
+
+func (a *Account) PostMessage(msg workers.Message) {
+	a.requests <- msg
+}
+
+func (a *Account) Close() {
+	close(a.requests)
+}
+
+func (a *Account) Run(responses chan<- workers.Message) {
+	defer lib.Recover(a.logger, nil)
+	for msg := range a.requests {
+		r := a.processRequest(msg)
+		r.SetId(msg.GetId())
+		responses <- r
+	}
+}
+
+func (a *Account) processRequest(msg workers.Message) workers.Message {
+	var r workers.Message
+	switch msg := msg.(type) {
+	case *workers.ConnectImap:
+		if err := a.open(); err != nil {
+			a.logger.Warnf("cannot open mbox %v", err)
+			r = &workers.Error{Error: errors.Wrapf(err, "cannot open mbox `%s`", a.cfg.Mbox.Path)}
+		} else {
+			r = &workers.Done{}
+		}
+	case *workers.FetchMailboxes:
+		if a.mailbox == "" {
+			r = &workers.Error{Error: fmt.Errorf("mbox `%s` is not opened", a.cfg.Mbox.Path)}
+			break
+		}
+		r = &workers.MsgToDb{Wrapped: &workers.FetchMailboxesImapRes{
+			Mailboxes: []*models.Mailbox{{Name: a.mailbox, ShortName: a.mailbox, ReadOnly: true}},
+		}}
+	case *workers.FetchNewMessages:
+		var err error
+		r, err = a.handleFetchNewMessages(msg)
+		if err != nil {
+			a.logger.Warnf("error reading new messages %v", err)
+			r = &workers.Error{Error: errors.New("error reading mbox")}
+		}
+	case *workers.FetchMessageUpdates:
+		var err error
+		r, err = a.handleFetchMessageUpdates(msg)
+		if err != nil {
+			a.logger.Warnf("error checking known messages %v", err)
+			r = &workers.Error{Error: errors.New("error reading mbox")}
+		}
+	case *workers.FetchFullMail:
+		var err error
+		r, err = a.handleFetchFullMail(msg)
+		if err != nil {
+			a.logger.Warnf("error reading full message %v", err)
+			r = &workers.Error{Error: errors.New("error reading mbox")}
+		}
+	case *workers.StoreFlags:
+		// flags are only kept in db
+		r = &workers.Done{}
+	default:
+		r = &workers.Error{Error: fmt.Errorf("%T is not supported by read-only mbox backend", msg)}
+	}
+	return r
+}
+
+// open checks mbox file exists, the mailbox being named after it
+func (a *Account) open() error {
+	var err error
+	a.path, err = lib.ExpandHome(a.cfg.Mbox.Path)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(a.path); err != nil {
+		return err
+	}
+	base := filepath.Base(a.path)
+	a.mailbox = strings.TrimSuffix(base, filepath.Ext(base))
+	if a.mailbox == "" {
+		a.mailbox = base
+	}
+	return nil
+}
+
+// index finds messages of mbox file, unless it did not change since
+// previous call
+func (a *Account) index() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if a.messages != nil && info.Size() == a.size && info.ModTime().Equal(a.modTime) {
+		return nil
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	a.logger.Debugf("indexing mbox `%s`", a.path)
+	if a.messages, err = scanMbox(f); err != nil {
+		return errors.Wrap(err, "while indexing mbox")
+	}
+	a.size = info.Size()
+	a.modTime = info.ModTime()
+	return nil
+}
+
+// uidValidity returns uidvalidity of first count messages of file. It is
+// computed from their content, so that it changes as soon as one of them is
+// removed or rewritten (i.e. their uids are no longer valid) but not when
+// messages are appended
+func (a *Account) uidValidity(count uint32) uint32 {
+	if count == 0 || int(count) > len(a.messages) {
+		// 0 means unknown uidvalidity
+		return 1
+	}
+	if sum := a.messages[count-1].prefixSum; sum != 0 {
+		return sum
+	}
+	return 1
+}
+
+// unchanged tells whether messages known in db (uids up to lastseenuid,
+// recorded with uidvalidity) are still the same in file
+func (a *Account) unchanged(lastseenuid, uidvalidity uint32) bool {
+	return uidvalidity == 0 || (int(lastseenuid) <= len(a.messages) && a.uidValidity(lastseenuid) == uidvalidity)
+}
+
+// read returns content of message with uid
+func (a *Account) read(f io.ReaderAt, uid uint32) ([]byte, error) {
+	if uid == 0 || int(uid) > len(a.messages) {
+		return nil, fmt.Errorf("no message with uid %d", uid)
+	}
+	m := a.messages[uid-1]
+	raw, err := ioutil.ReadAll(io.NewSectionReader(f, m.start, m.end-m.start))
+	if err != nil {
+		return nil, err
+	}
+	return lib.MboxUnescape(raw), nil
+}
+
+func (a *Account) handleFetchNewMessages(msg *workers.FetchNewMessages) (workers.Message, error) {
+	if err := a.index(); err != nil {
+		return nil, err
+	}
+	lastseenuid := msg.LastSeenUid
+	reset := !a.unchanged(msg.LastSeenUid, msg.UidValidity)
+	if reset {
+		a.logger.Warnf("mbox `%s` was rewritten, its messages are indexed again", a.path)
+		lastseenuid = 0
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := make([]*models.Mail, 0)
+	for uid := lastseenuid + 1; int(uid) <= len(a.messages); uid++ {
+		raw, err := a.read(f, uid)
+		if err != nil {
+			return nil, err
+		}
+		m, err := models.ParseMail(bytes.NewReader(raw))
+		if err != nil {
+			a.logger.Warnf("skipping malformed message %d of mbox %v", uid, err)
+			continue
+		}
+		m.Uid = uid
+		m.Flags = statusFlags(m.Header)
+		result = append(result, m)
+	}
+	// db records greatest uid of inserted mails as lastseenuid
+	known := lastseenuid
+	if len(result) > 0 {
+		known = result[len(result)-1].Uid
+	}
+	return &workers.FetchNewMessagesRes{
+		Mailbox:     msg.Mailbox,
+		Mails:       result,
+		UidValidity: a.uidValidity(known),
+		Reset:       reset,
+	}, nil
+}
+
+// handleFetchMessageUpdates reports known messages gone from file. Flags
+// are only kept in db so other messages never change
+func (a *Account) handleFetchMessageUpdates(msg *workers.FetchMessageUpdates) (workers.Message, error) {
+	if err := a.index(); err != nil {
+		return nil, err
+	}
+	changes := workers.MailsChanges{Incremental: true}
+	if !a.unchanged(msg.LastSeenUid, msg.UidValidity) {
+		// remaining messages are indexed again by FetchNewMessages, as file
+		// was rewritten, but uids beyond end of file are gone anyway
+		for uid := uint32(len(a.messages)) + 1; uid <= msg.LastSeenUid; uid++ {
+			changes.Vanished = append(changes.Vanished, uid)
+		}
+	}
+	return &workers.FetchMessageUpdatesRes{
+		Mailbox:      msg.Mailbox,
+		MailsChanges: changes,
+	}, nil
+}
+
+// cacheDir is where messages are stored once extracted from mbox file
+func (a *Account) cacheDir() string {
+	return path.Join("/tmp/nuntius/mbox", a.cfg.Name)
+}
+
+func (a *Account) handleFetchFullMail(msg *workers.FetchFullMail) (workers.Message, error) {
+	if err := a.index(); err != nil {
+		return nil, err
+	}
+	if msg.Uid == 0 || int(msg.Uid) > len(a.messages) {
+		return nil, fmt.Errorf("no message with uid %d", msg.Uid)
+	}
+	// named after content of file up to message, so that a rewritten
+	// message is not read from cache
+	r := &workers.FetchFullMailRes{
+		Filepath: path.Join(a.cacheDir(), fmt.Sprintf("%d-%d.mail", msg.Uid, a.messages[msg.Uid-1].prefixSum)),
+	}
+	if _, err := os.Stat(r.Filepath); err == nil {
+		return r, nil
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	raw, err := a.read(f, msg.Uid)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Peek {
+		// not cached, so that it is marked as read when fetched again
+		tmp, err := ioutil.TempFile("", "nuntius-*.mail")
+		if err != nil {
+			return nil, err
+		}
+		defer tmp.Close()
+		if _, err = tmp.Write(raw); err != nil {
+			return nil, err
+		}
+		r.Filepath = tmp.Name()
+		r.Temporary = true
+		return r, nil
+	}
+	if err = os.MkdirAll(a.cacheDir(), 0755); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(r.Filepath, raw, 0644); err != nil {
+		return nil, err
+	}
+	// first time message is read, as when it is fetched from imap server
+	r.FromImap = true
+	return r, nil
+}
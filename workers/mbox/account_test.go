@@ -0,0 +1,102 @@
+package mbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stregouet/nuntius/config"
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/workers"
+)
+
+func TestUidValidity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nuntius-mbox-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "archive.mbox")
+	l, err := lib.NewLogger("error", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAccount(l, &config.Account{Name: "test", Mbox: &config.MboxCfg{Path: path}})
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// make sure file is indexed again, whatever mtime resolution
+		a.messages = nil
+	}
+	// first message is longer than 4 KiB, so that changes happen after it
+	base := strings.Replace(testMbox, "first body\n", "first body\n"+strings.Repeat("padding line\n", 400), 1)
+	write(base)
+	if err = a.open(); err != nil {
+		t.Fatal(err)
+	}
+	// as done by ui on each sync, with what db records
+	var lastseenuid, uidvalidity uint32
+	sync := func() (*workers.FetchNewMessagesRes, *workers.FetchMessageUpdatesRes) {
+		r, err := a.handleFetchNewMessages(&workers.FetchNewMessages{LastSeenUid: lastseenuid, UidValidity: uidvalidity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := a.handleFetchMessageUpdates(&workers.FetchMessageUpdates{LastSeenUid: lastseenuid, UidValidity: uidvalidity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := r.(*workers.FetchNewMessagesRes)
+		if len(res.Mails) > 0 {
+			lastseenuid = res.Mails[len(res.Mails)-1].Uid
+		} else if res.Reset {
+			lastseenuid = 0
+		}
+		uidvalidity = res.UidValidity
+		return res, u.(*workers.FetchMessageUpdatesRes)
+	}
+	uids := func(r *workers.FetchNewMessagesRes) []uint32 {
+		result := make([]uint32, 0)
+		for _, m := range r.Mails {
+			result = append(result, m.Uid)
+		}
+		return result
+	}
+
+	r, _ := sync()
+	if r.Reset || !reflect.DeepEqual([]uint32{1, 2, 3}, uids(r)) {
+		t.Errorf("expected all messages on first sync, found %v (reset: %v)", uids(r), r.Reset)
+	}
+	r, u := sync()
+	if r.Reset || len(r.Mails) != 0 || len(u.Vanished) != 0 {
+		t.Errorf("expected nothing new, found %v (reset: %v, vanished: %v)", uids(r), r.Reset, u.Vanished)
+	}
+
+	appended := base + "\nFrom dave@example.com Wed Jul  7 09:00:00 2021\nSubject: four\n\nbody\n"
+	write(appended)
+	r, u = sync()
+	if r.Reset || !reflect.DeepEqual([]uint32{4}, uids(r)) || len(u.Vanished) != 0 {
+		t.Errorf("expected appended message only, found %v (reset: %v, vanished: %v)", uids(r), r.Reset, u.Vanished)
+	}
+
+	// second message is removed (e.g. mbox compaction), later ones shift
+	second := "From bob@example.com Tue Jul  6 11:30:00 2021 +0200\nSubject: two\n\n>From escaped line\n\n\n"
+	if !strings.Contains(appended, second) {
+		t.Fatal("second message not found")
+	}
+	write(strings.Replace(appended, second, "", 1))
+	r, u = sync()
+	if !r.Reset || !reflect.DeepEqual([]uint32{1, 2, 3}, uids(r)) {
+		t.Errorf("expected messages fetched again, found %v (reset: %v)", uids(r), r.Reset)
+	}
+	if !reflect.DeepEqual([]uint32{4}, u.Vanished) {
+		t.Errorf("expected uid 4 vanished, found %v", u.Vanished)
+	}
+	r, u = sync()
+	if r.Reset || len(r.Mails) != 0 || len(u.Vanished) != 0 {
+		t.Errorf("expected nothing new after rewrite, found %v (reset: %v, vanished: %v)", uids(r), r.Reset, u.Vanished)
+	}
+}
@@ -0,0 +1,63 @@
+package mbox
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/pkg/errors"
+
+	"github.com/stregouet/nuntius/lib"
+	"github.com/stregouet/nuntius/workers"
+)
+
+// archive is an mbox file whose messages are imported into an account
+type archive struct {
+	f        *os.File
+	messages []*msgRange
+}
+
+// OpenArchive indexes messages of mbox file at path, so that they can be
+// read one after the other
+func OpenArchive(path string) (workers.Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := scanMbox(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "while indexing mbox")
+	}
+	return &archive{f: f, messages: messages}, nil
+}
+
+func (a *archive) Len() int {
+	return len(a.messages)
+}
+
+func (a *archive) Read(i int) (*workers.ArchivedMail, error) {
+	m := a.messages[i]
+	raw, err := ioutil.ReadAll(io.NewSectionReader(a.f, m.start, m.end-m.start))
+	if err != nil {
+		return nil, err
+	}
+	raw = lib.MboxUnescape(raw)
+	e, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, errors.Wrap(err, "while reading header")
+	}
+	h := &mail.Header{Header: e.Header}
+	result := &workers.ArchivedMail{Raw: raw, Flags: statusFlags(h), Date: m.date}
+	if result.Date.IsZero() {
+		result.Date, _ = h.Date()
+	}
+	return result, nil
+}
+
+func (a *archive) Close() error {
+	return a.f.Close()
+}
@@ -0,0 +1,72 @@
+package mbox
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+const testArchive = `From alice@example.com Mon Jul  5 10:00:00 2021
+Subject: one
+Status: RO
+
+>From escaped line
+
+From bob@example.com unparsable date
+Subject: two
+Date: Tue, 06 Jul 2021 11:30:00 +0000
+X-Status: F
+
+second body
+`
+
+func TestArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.mbox")
+	if err := ioutil.WriteFile(path, []byte(testArchive), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := OpenArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	expected := []struct {
+		raw   string
+		flags []string
+		date  time.Time
+	}{
+		{
+			"Subject: one\nStatus: RO\n\nFrom escaped line\n",
+			[]string{imap.SeenFlag},
+			time.Date(2021, time.July, 5, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			// date taken from header when separator line has none
+			"Subject: two\nDate: Tue, 06 Jul 2021 11:30:00 +0000\nX-Status: F\n\nsecond body\n",
+			[]string{imap.FlaggedFlag},
+			time.Date(2021, time.July, 6, 11, 30, 0, 0, time.UTC),
+		},
+	}
+	if a.Len() != len(expected) {
+		t.Fatalf("expected %d mails, found %d", len(expected), a.Len())
+	}
+	for i, e := range expected {
+		m, err := a.Read(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Raw) != e.raw {
+			t.Errorf("(mail %d) expected raw %q, found %q", i+1, e.raw, m.Raw)
+		}
+		if !reflect.DeepEqual(e.flags, m.Flags) {
+			t.Errorf("(mail %d) expected flags %v, found %v", i+1, e.flags, m.Flags)
+		}
+		if !m.Date.Equal(e.date) {
+			t.Errorf("(mail %d) expected date %v, found %v", i+1, e.date, m.Date)
+		}
+	}
+}
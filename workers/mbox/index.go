@@ -0,0 +1,109 @@
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+)
+
+// msgRange is where a message lies in mbox file, its `From ` separator line
+// excluded. date is found in this separator line, prefixSum is crc32 of
+// file up to end of message
+type msgRange struct {
+	start     int64
+	end       int64
+	date      time.Time
+	prefixSum uint32
+}
+
+var fromLine = []byte("From ")
+
+// scanMbox returns where messages of mbox r are, in order. A message starts
+// with a `From ` line found at beginning of file or after a blank line, and
+// ends with its last non blank line
+func scanMbox(r io.Reader) ([]*msgRange, error) {
+	br := bufio.NewReader(r)
+	result := make([]*msgRange, 0)
+	var cur *msgRange
+	var offset, contentEnd int64
+	var sum, contentEndSum uint32
+	prevBlank := true
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			blank := len(bytes.TrimRight(line, "\r\n")) == 0
+			sum = crc32.Update(sum, crc32.IEEETable, line)
+			if prevBlank && bytes.HasPrefix(line, fromLine) {
+				if cur != nil {
+					cur.end = contentEnd
+					cur.prefixSum = contentEndSum
+					result = append(result, cur)
+				}
+				cur = &msgRange{start: offset + int64(len(line)), date: fromLineDate(line)}
+				contentEnd, contentEndSum = cur.start, sum
+			} else if !blank {
+				contentEnd, contentEndSum = offset+int64(len(line)), sum
+			}
+			prevBlank = blank
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if cur != nil {
+		cur.end = contentEnd
+		cur.prefixSum = contentEndSum
+		result = append(result, cur)
+	}
+	return result, nil
+}
+
+// fromLineDate parses date of a `From <sender> <asctime date>` line, some
+// writers append a timezone that is ignored. Zero time is returned when date
+// cannot be parsed
+func fromLineDate(line []byte) time.Time {
+	fields := strings.Fields(string(line))
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+	date, err := time.Parse("Mon Jan 2 15:04:05 2006", strings.Join(fields[2:7], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+var xStatusFlags = []struct {
+	char string
+	flag string
+}{
+	{"A", imap.AnsweredFlag},
+	{"F", imap.FlaggedFlag},
+	{"D", imap.DeletedFlag},
+	{"T", imap.DraftFlag},
+}
+
+// statusFlags returns imap flags stored in Status and X-Status header fields
+// by mail clients writing mbox files
+func statusFlags(h *mail.Header) []string {
+	flags := make([]string, 0)
+	if strings.Contains(h.Get("Status"), "R") {
+		flags = append(flags, imap.SeenFlag)
+	}
+	xstatus := h.Get("X-Status")
+	for _, s := range xStatusFlags {
+		if strings.Contains(xstatus, s.char) {
+			flags = append(flags, s.flag)
+		}
+	}
+	return flags
+}
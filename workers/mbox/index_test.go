@@ -0,0 +1,117 @@
+package mbox
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+)
+
+const testMbox = `From alice@example.com Mon Jul  5 10:00:00 2021
+Subject: one
+
+first body
+From inside a paragraph is not a separator
+
+From bob@example.com Tue Jul  6 11:30:00 2021 +0200
+Subject: two
+
+>From escaped line
+
+
+From carol@example.com unparsable date
+Subject: three
+
+last body
+`
+
+func TestScanMbox(t *testing.T) {
+	messages, err := scanMbox(strings.NewReader(testMbox))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		content string
+		date    time.Time
+	}{
+		{
+			"Subject: one\n\nfirst body\nFrom inside a paragraph is not a separator\n",
+			time.Date(2021, time.July, 5, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			"Subject: two\n\n>From escaped line\n",
+			time.Date(2021, time.July, 6, 11, 30, 0, 0, time.UTC),
+		},
+		{
+			"Subject: three\n\nlast body\n",
+			time.Time{},
+		},
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d messages, found %d", len(expected), len(messages))
+	}
+	for i, e := range expected {
+		m := messages[i]
+		if content := testMbox[m.start:m.end]; content != e.content {
+			t.Errorf("(message %d) expected content %q, found %q", i+1, e.content, content)
+		}
+		if !m.date.Equal(e.date) {
+			t.Errorf("(message %d) expected date %v, found %v", i+1, e.date, m.date)
+		}
+	}
+}
+
+func TestScanMboxPrefixSum(t *testing.T) {
+	sums := func(content string) []uint32 {
+		messages, err := scanMbox(strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := make([]uint32, 0, len(messages))
+		for _, m := range messages {
+			result = append(result, m.prefixSum)
+		}
+		return result
+	}
+	original := sums(testMbox)
+	appended := sums(testMbox + "\nFrom dave@example.com Wed Jul  7 09:00:00 2021\nSubject: four\n\nbody\n")
+	if !reflect.DeepEqual(original, appended[:len(original)]) {
+		t.Errorf("expected sums of first messages kept when appending, found %v then %v", original, appended)
+	}
+	rewritten := sums(strings.Replace(testMbox, "escaped line", "escaped_line", 1))
+	if rewritten[0] != original[0] || rewritten[1] == original[1] || rewritten[2] == original[2] {
+		t.Errorf("expected sums changed from rewritten message on, found %v then %v", original, rewritten)
+	}
+	if empty := sums(""); len(empty) != 0 {
+		t.Errorf("expected no message in empty file, found %v", empty)
+	}
+}
+
+func TestStatusFlags(t *testing.T) {
+	testCases := []struct {
+		status   string
+		xstatus  string
+		expected []string
+	}{
+		{"", "", []string{}},
+		{"O", "", []string{}},
+		{"RO", "", []string{imap.SeenFlag}},
+		{"R", "AF", []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag}},
+		{"", "DT", []string{imap.DeletedFlag, imap.DraftFlag}},
+	}
+	for _, tc := range testCases {
+		h := &mail.Header{}
+		if tc.status != "" {
+			h.Set("Status", tc.status)
+		}
+		if tc.xstatus != "" {
+			h.Set("X-Status", tc.xstatus)
+		}
+		if flags := statusFlags(h); !reflect.DeepEqual(tc.expected, flags) {
+			t.Errorf("(status: %q, x-status: %q) expected %v, found %v", tc.status, tc.xstatus, tc.expected, flags)
+		}
+	}
+}
@@ -71,20 +71,40 @@ type FetchThreadRes struct {
 
 type FetchMailboxRes struct {
 	BaseMessage
-	List        []*models.Thread
-	LastSeenUid uint32
+	List          []*models.Thread
+	LastSeenUid   uint32
+	UidValidity   uint32
+	HighestModSeq uint64
+	Sort          models.ThreadSort
+}
+
+// SortMailbox saves how threads of Mailbox are listed
+type SortMailbox struct {
+	BaseMessage
+	Mailbox string
+	Sort    models.ThreadSort
+}
+
+type SortMailboxRes struct {
+	BaseMessage
+	List []*models.Thread
 }
 
 type FetchFullMail struct {
 	BaseMessage
 	Mailbox string
 	Uid     uint32
+	// do not mark mail as read when fetching it
+	Peek bool
 }
 
 type FetchFullMailRes struct {
 	BaseMessage
 	Filepath string
 	FromImap bool
+	// peeked mails are not cached, so that they are marked as read when
+	// fetched again: Filepath is then a copy to be removed once read
+	Temporary bool
 }
 
 type SaveMailFlags struct {
@@ -93,22 +113,69 @@ type SaveMailFlags struct {
 	Flags  []string
 }
 
+// IndexMail (re)indexes mail with its full content, available at Filepath
+type IndexMail struct {
+	BaseMessage
+	MailId   int
+	Filepath string
+}
+
+type FetchSearch struct {
+	BaseMessage
+	Query string
+	// mails found by imap server for Query, by mailbox
+	Hits map[string][]uint32
+	Sort models.ThreadSort
+}
+
+type FetchSearchRes struct {
+	BaseMessage
+	List []*models.Thread
+}
+
+// SearchImap runs Query on imap server, in every mailbox when Mailboxes is
+// empty
+type SearchImap struct {
+	BaseMessage
+	Query     string
+	Mailboxes []string
+}
+
+type SearchImapRes struct {
+	BaseMessage
+	// found mails by mailbox
+	Mails map[string][]*models.Mail
+}
+
+// FetchNewMessages fetches messages with uid greater than LastSeenUid, or
+// every message when UidValidity (0 if unknown) is no longer valid
 type FetchNewMessages struct {
 	BaseMessage
 	Mailbox     string
 	LastSeenUid uint32
+	UidValidity uint32
 }
 
 type FetchNewMessagesRes struct {
 	BaseMessage
-	Mailbox string
-	Mails   []*models.Mail
+	Mailbox     string
+	Mails       []*models.Mail
+	UidValidity uint32
+	// true when uidvalidity changed, mails known so far must be dropped
+	Reset bool
 }
 
 type InsertNewMessages struct {
 	BaseMessage
 	Mailbox string
 	Mails   []*models.Mail
+	// Mails are not all new messages of mailbox (e.g. only the one we just
+	// appended), so lastseenuid must not be updated
+	Partial bool
+	// recorded unless 0
+	UidValidity uint32
+	// mails of mailbox are removed before inserting Mails
+	Reset bool
 }
 
 type InsertNewMessagesRes struct {
@@ -127,6 +194,17 @@ type FetchMailbox struct {
 	Mailbox string
 }
 
+// FetchMailboxMails lists all known mails of Mailbox, ordered by uid
+type FetchMailboxMails struct {
+	BaseMessage
+	Mailbox string
+}
+
+type FetchMailboxMailsRes struct {
+	BaseMessage
+	Mails []*models.Mail
+}
+
 type FetchMailboxesRes struct {
 	BaseMessage
 	Mailboxes []*models.Mailbox
@@ -147,21 +225,39 @@ func (m *FetchMailboxes) Clone() Message {
 
 type FetchMessageUpdates struct {
 	BaseMessage
-	Mailbox     string
-	LastSeenUid uint32
+	Mailbox       string
+	LastSeenUid   uint32
+	UidValidity   uint32
+	HighestModSeq uint64
+}
+
+// MailsChanges describes how already known mails (i.e. uid up to
+// LastSeenUid) of a mailbox changed on imap server
+type MailsChanges struct {
+	Mails []*models.Mail
+	// when true Mails only holds mails changed since HighestModSeq of
+	// previous sync, and mails gone from server are listed in Vanished or
+	// missing from Uids. Otherwise every known mail missing from Mails is gone
+	Incremental bool
+	Vanished    []uint32
+	// uids still on server, nil if unknown
+	Uids []uint32
+	// greatest modseq (rfc7162) of mailbox once changes are applied, 0 if
+	// unknown
+	HighestModSeq uint64
 }
 
 type FetchMessageUpdatesRes struct {
 	BaseMessage
 	Mailbox string
-	Mails   []*models.Mail
+	MailsChanges
 }
 
 type UpdateMessages struct {
 	BaseMessage
 	Mailbox     string
-	Mails       []*models.Mail
 	LastSeenUid uint32
+	MailsChanges
 }
 
 type UpdateMessagesRes struct {
@@ -173,7 +269,239 @@ type ConnectImap struct {
 	BaseMessage
 }
 
-type SendMail struct {
+// QueueMail inserts Mail in outbox, or updates it when it is already there
+type QueueMail struct {
+	BaseMessage
+	Mail *models.OutboxMail
+}
+
+type QueueMailRes struct {
+	BaseMessage
+	Mail *models.OutboxMail
+}
+
+type FetchOutbox struct {
+	BaseMessage
+}
+
+type FetchOutboxRes struct {
+	BaseMessage
+	Mails []*models.OutboxMail
+}
+
+type DeleteOutboxMail struct {
+	BaseMessage
+	Id int
+}
+
+// SendOutbox asks imap worker to send Mails in background, each one when
+// its next attempt is due
+type SendOutbox struct {
+	BaseMessage
+	Mails []*models.OutboxMail
+}
+
+// CancelOutboxMail stops sending outbox mail with Id
+type CancelOutboxMail struct {
+	BaseMessage
+	Id int
+}
+
+// MoveMails moves (or copies) mails from Mailbox to Dest
+type MoveMails struct {
+	BaseMessage
+	Mailbox string
+	Uids    []uint32
+	Dest    string
+	Copy    bool
+}
+
+// ArchiveMails moves mails from Mailbox to archive mailbox
+type ArchiveMails struct {
+	BaseMessage
+	Mailbox string
+	Uids    []uint32
+}
+
+// DeleteMails moves mails of Mailbox to trash, or expunges them when they
+// are already there
+type DeleteMails struct {
+	BaseMessage
+	Mailbox string
+	Uids    []uint32
+	// expunge mails when account has no trash mailbox, as confirmed by user
+	Permanently bool
+}
+
+// RemoveMails removes from db mails which are no longer in Mailbox on imap
+// server
+type RemoveMails struct {
+	BaseMessage
+	Mailbox string
+	Uids    []uint32
+}
+
+// CopyMails records in db that mails with Uids of Mailbox were copied, or
+// moved, to Dest where they got DestUids (0 when server did not tell)
+type CopyMails struct {
+	BaseMessage
+	Mailbox  string
+	Uids     []uint32
+	Dest     string
+	DestUids []uint32
+	Move     bool
+}
+
+type RemoveMailsRes struct {
+	BaseMessage
+	Mailbox string
+	Threads []*models.Thread
+}
+
+// StoreFlags adds (or removes when Remove is true) flags to mails of mailbox
+type StoreFlags struct {
+	BaseMessage
+	Mailbox string
+	Uids    []uint32
+	Flags   []string
+	Remove  bool
+}
+
+// ImportMail appends an archived mail to Mailbox, keeping its flags and
+// date as internal date
+type ImportMail struct {
+	BaseMessage
+	Mailbox string
+	Mail    *ArchivedMail
+}
+
+// HasMessageId checks whether a mail with MessageId is already in Mailbox
+type HasMessageId struct {
+	BaseMessage
+	Mailbox   string
+	MessageId string
+}
+
+type HasMessageIdRes struct {
+	BaseMessage
+	Found bool
+}
+
+type PostponeMail struct {
+	BaseMessage
+	Body        io.Reader
+	Attachments []string
+}
+
+// NewMessagesNotif is pushed by imap worker, without prior request, when new
+// messages arrive in the mailbox it is idling on
+type NewMessagesNotif struct {
+	BaseMessage
+	Mailbox string
+	Mails   []*models.Mail
+}
+
+// MessageUpdatesNotif is pushed by imap worker, without prior request, when
+// messages are expunged or their flags change in the mailbox it is idling on
+type MessageUpdatesNotif struct {
+	BaseMessage
+	Mailbox     string
+	LastSeenUid uint32
+	MailsChanges
+}
+
+type ConnState string
+
+const (
+	CONN_DISCONNECTED ConnState = "disconnected"
+	CONN_CONNECTING   ConnState = "connecting"
+	CONN_CONNECTED    ConnState = "connected"
+)
+
+// OutboxNotif is pushed by imap worker after each attempt to send an outbox
+// mail. Once Sent, ToDb (if any) saves the copy appended to sent mailbox,
+// Pending (if any) appends it once connected again and Error tells why it
+// could not be appended, otherwise Error tells why sending failed and Mail
+// holds the updated attempts count
+type OutboxNotif struct {
+	BaseMessage
+	Mail    *models.OutboxMail
+	Sent    bool
+	ToDb    Message
+	Pending *models.PendingAction
+	Error   error
+}
+
+// AppendSentMail appends a copy of a sent mail in sent mailbox
+type AppendSentMail struct {
+	BaseMessage
+	Body []byte
+}
+
+// MailboxResetNotif is pushed by imap worker when uidvalidity of the mailbox
+// it is idling on changed upon reconnection
+type MailboxResetNotif struct {
+	BaseMessage
+	Mailbox string
+}
+
+// ConnectionStateNotif is pushed by imap worker each time the connection to
+// imap server changes its state
+type ConnectionStateNotif struct {
+	BaseMessage
+	State ConnState
+	// reconnection attempt, 0 when not reconnecting
+	Attempt int
+	Error   error
+}
+
+// Queued is returned by imap worker instead of the actual response when
+// request cannot reach server and was recorded to be replayed later. Result
+// is the response to use meanwhile, nil when there is none
+type Queued struct {
+	BaseMessage
+	Action *models.PendingAction
+	Result Message
+}
+
+// QueueAction records Action in db
+type QueueAction struct {
+	BaseMessage
+	Action *models.PendingAction
+}
+
+type FetchPendingActions struct {
+	BaseMessage
+}
+
+type FetchPendingActionsRes struct {
+	BaseMessage
+	Actions []*models.PendingAction
+}
+
+// ReplayPendingActions asks imap worker to replay Actions in order
+type ReplayPendingActions struct {
+	BaseMessage
+	Actions []*models.PendingAction
+}
+
+type ReplayPendingActionsRes struct {
+	BaseMessage
+	// ids of actions replayed or dropped, other ones are still pending
+	Done []int
+	// number of actions dropped because they conflict with server state
+	Dropped int
+	// messages to post to db following replayed actions
+	ToDb []Message
+}
+
+type RemovePendingActions struct {
+	BaseMessage
+	Ids []int
+}
+
+// PendingCountRes gives number of actions still pending once db is updated
+type PendingCountRes struct {
 	BaseMessage
-	Body io.Reader
+	Count int
 }
@@ -0,0 +1,114 @@
+package workers
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/stregouet/nuntius/models"
+)
+
+// kinds of pending actions
+const (
+	PENDING_STORE_FLAGS = "store-flags"
+	PENDING_MOVE        = "move"
+	PENDING_ARCHIVE     = "archive"
+	PENDING_DELETE      = "delete"
+	PENDING_APPEND_SENT = "append-sent"
+)
+
+// IsQueueable returns true for requests which can be recorded while offline
+// and replayed later
+func IsQueueable(msg Message) bool {
+	switch msg.(type) {
+	case *StoreFlags, *MoveMails, *ArchiveMails, *DeleteMails, *AppendSentMail:
+		return true
+	}
+	return false
+}
+
+// NewPendingAction records msg so that it can be replayed later
+func NewPendingAction(msg Message) (*models.PendingAction, error) {
+	var kind string
+	switch msg.(type) {
+	case *StoreFlags:
+		kind = PENDING_STORE_FLAGS
+	case *MoveMails:
+		kind = PENDING_MOVE
+	case *ArchiveMails:
+		kind = PENDING_ARCHIVE
+	case *DeleteMails:
+		kind = PENDING_DELETE
+	case *AppendSentMail:
+		kind = PENDING_APPEND_SENT
+	default:
+		return nil, fmt.Errorf("cannot queue message %T", msg)
+	}
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &models.PendingAction{Kind: kind, Payload: string(raw)}, nil
+}
+
+// PendingMailbox returns mailbox whose mails queueable msg acts on
+func PendingMailbox(msg Message) string {
+	switch msg := msg.(type) {
+	case *StoreFlags:
+		return msg.Mailbox
+	case *MoveMails:
+		return msg.Mailbox
+	case *ArchiveMails:
+		return msg.Mailbox
+	case *DeleteMails:
+		return msg.Mailbox
+	}
+	return ""
+}
+
+// SetPendingUidValidity records in p uidvalidity of the mailbox its uids
+// belong to, as they only designate the same mails while it is unchanged
+func SetPendingUidValidity(p *models.PendingAction, uidvalidity uint32) error {
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(p.Payload), &payload); err != nil {
+		return err
+	}
+	payload["UidValidity"] = uidvalidity
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	p.Payload = string(raw)
+	return nil
+}
+
+// PendingUidValidity returns uidvalidity recorded in p, 0 when unknown
+func PendingUidValidity(p *models.PendingAction) (uint32, error) {
+	var payload struct {
+		UidValidity uint32
+	}
+	err := json.Unmarshal([]byte(p.Payload), &payload)
+	return payload.UidValidity, err
+}
+
+// ReplayMessage rebuilds message recorded in p
+func ReplayMessage(p *models.PendingAction) (Message, error) {
+	var msg Message
+	switch p.Kind {
+	case PENDING_STORE_FLAGS:
+		msg = &StoreFlags{}
+	case PENDING_MOVE:
+		msg = &MoveMails{}
+	case PENDING_ARCHIVE:
+		msg = &ArchiveMails{}
+	case PENDING_DELETE:
+		msg = &DeleteMails{}
+	case PENDING_APPEND_SENT:
+		msg = &AppendSentMail{}
+	default:
+		return nil, fmt.Errorf("unknown pending action `%s`", p.Kind)
+	}
+	if err := json.Unmarshal([]byte(p.Payload), msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}